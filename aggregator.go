@@ -0,0 +1,117 @@
+package msgqueue
+
+import (
+	"sync"
+	"time"
+)
+
+type AggregatorOptions struct {
+	// Function called with messages that share the same key.
+	Handler func(key string, msgs []*Message) error
+
+	// Function that returns correlation key of the message.
+	// The default is to use message name.
+	Key func(msg *Message) string
+
+	// Max number of messages in one aggregate. Since every message
+	// occupies a worker until the aggregate is handled, it should not
+	// exceed processor WorkerNumber.
+	MaxMessages int
+
+	// Time during which messages are collected. The default is 1 second.
+	Window time.Duration
+}
+
+func (opt *AggregatorOptions) init() {
+	if opt.Key == nil {
+		opt.Key = func(msg *Message) string {
+			return msg.Name
+		}
+	}
+	if opt.Window == 0 {
+		opt.Window = time.Second
+	}
+}
+
+type aggregate struct {
+	msgs  []*Message
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+// Aggregator is a Handler that collects messages with the same key
+// during a window and passes them to the handler as one aggregate.
+// HandleMessage blocks until the aggregate is handled and returns
+// the handler error, so failed aggregates are retried as usual.
+type Aggregator struct {
+	opt *AggregatorOptions
+
+	mu   sync.Mutex
+	aggs map[string]*aggregate
+}
+
+var _ Handler = (*Aggregator)(nil)
+
+func NewAggregator(opt *AggregatorOptions) *Aggregator {
+	opt.init()
+	return &Aggregator{
+		opt:  opt,
+		aggs: make(map[string]*aggregate),
+	}
+}
+
+func (a *Aggregator) HandleMessage(msg *Message) error {
+	key := a.opt.Key(msg)
+
+	a.mu.Lock()
+	agg, ok := a.aggs[key]
+	if !ok {
+		agg = &aggregate{
+			done: make(chan struct{}),
+		}
+		agg.timer = time.AfterFunc(a.opt.Window, func() {
+			a.flush(key, agg)
+		})
+		a.aggs[key] = agg
+	}
+	agg.msgs = append(agg.msgs, msg)
+	full := a.opt.MaxMessages > 0 && len(agg.msgs) >= a.opt.MaxMessages
+	a.mu.Unlock()
+
+	if full {
+		a.flush(key, agg)
+	}
+
+	<-agg.done
+	return agg.err
+}
+
+// Flush handles all collected aggregates without waiting for the window.
+func (a *Aggregator) Flush() {
+	a.mu.Lock()
+	aggs := make(map[string]*aggregate, len(a.aggs))
+	for key, agg := range a.aggs {
+		aggs[key] = agg
+	}
+	a.mu.Unlock()
+
+	for key, agg := range aggs {
+		a.flush(key, agg)
+	}
+}
+
+func (a *Aggregator) flush(key string, agg *aggregate) {
+	a.mu.Lock()
+	if a.aggs[key] != agg {
+		// Already flushed.
+		a.mu.Unlock()
+		return
+	}
+	delete(a.aggs, key)
+	agg.timer.Stop()
+	a.mu.Unlock()
+
+	agg.err = a.opt.Handler(key, agg.msgs)
+	close(agg.done)
+}
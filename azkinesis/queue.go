@@ -0,0 +1,893 @@
+package azkinesis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/go-redis/redis"
+)
+
+// Maximum size of Kinesis record data.
+const maxMessageSize = 1024 * 1024
+
+// Maximum number of records in PutRecords request.
+const putBatchSize = 500
+
+// Maximum number of records returned by GetRecords.
+const maxGetRecords = 10000
+
+// Kinesis allows 5 GetRecords calls per second per shard.
+const minGetInterval = 200 * time.Millisecond
+
+// Time during which ReserveN waits when there are no records.
+const pollInterval = time.Second
+
+// Time after which shard lease of the crashed process expires.
+// Leases are renewed and new shards are leased every leaseTTL/3.
+const leaseTTL = time.Minute
+
+// Checkpoint of the closed shard which records are all processed.
+const shardEnd = "SHARD_END"
+
+var errNoRedis = errors.New(
+	"queue: Kinesis consumer requires Options.Redis that implements RedisCmdable")
+
+var ownerId = newOwnerId()
+
+func newOwnerId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+type record struct {
+	seq  string
+	done bool
+}
+
+type releasedMessage struct {
+	msg msgqueue.Message
+	at  time.Time
+}
+
+// shard is a shard leased by this process.
+type shard struct {
+	id       string
+	iterator string
+	// Sequence number of the last record read from the shard.
+	lastRead string
+	lastGet  time.Time
+	busy     bool
+	// Shard is closed after resharding and all its records are read.
+	closed bool
+	ended  bool
+
+	// Records that are read, but not yet deleted, in shard order.
+	// Checkpoint is advanced over the deleted prefix.
+	pending []*record
+	// Released records that are reserved again after the delay.
+	released []releasedMessage
+}
+
+type Queue struct {
+	kinesis *kinesis.Kinesis
+	stream  string
+
+	opt      *msgqueue.Options
+	producer *producer.Producer
+
+	mu          sync.Mutex
+	shards      map[string]*shard
+	order       []string
+	next        int
+	refreshedAt time.Time
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Reconnecter = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that puts records to the Kinesis stream and
+// consumes them using the processor. Consumers with the same opt.Name
+// share the stream: each shard is leased by one process and its
+// checkpoint, i.e. the sequence number of the last processed record,
+// is stored in opt.Redis.
+func NewQueue(kinesis *kinesis.Kinesis, stream string, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		kinesis: kinesis,
+		stream:  stream,
+		opt:     opt,
+		shards:  make(map[string]*shard),
+	}
+
+	q.producer = producer.New(opt, q.add, checkRecordSize)
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(kinesis *kinesis.Kinesis, stream string, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(kinesis, stream, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "kinesis",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// Ping checks that the stream is reachable.
+func (q *Queue) Ping() error {
+	_, err := q.kinesis.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(q.stream),
+	})
+	return err
+}
+
+// Reconnect drops shard iterators so they are requested again
+// from the last read records on next request.
+func (q *Queue) Reconnect() error {
+	q.mu.Lock()
+	for _, s := range q.shards {
+		s.iterator = ""
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+
+	data, err := encodeData(msg)
+	if err != nil {
+		return err
+	}
+
+	out, err := q.kinesis.PutRecord(&kinesis.PutRecordInput{
+		StreamName:   aws.String(q.stream),
+		PartitionKey: aws.String(partitionKey(msg)),
+		Data:         data,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Id = messageId(aws.StringValue(out.ShardId), aws.StringValue(out.SequenceNumber))
+	return nil
+}
+
+// addBatch puts records in batches of 500. Records that Kinesis
+// failed to put are retried once.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > putBatchSize {
+			n = putBatchSize
+		}
+
+		batch := msgs[:n]
+		for i := 0; i < 2 && len(batch) > 0; i++ {
+			var err error
+			batch, err = q.putRecords(batch)
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch) > 0 {
+			return fmt.Errorf("queue: Kinesis failed to put %d records", len(batch))
+		}
+
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// putRecords puts the messages and returns messages that failed.
+func (q *Queue) putRecords(msgs []*msgqueue.Message) ([]*msgqueue.Message, error) {
+	entries := make([]*kinesis.PutRecordsRequestEntry, len(msgs))
+	for i, msg := range msgs {
+		data, err := encodeData(msg)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(partitionKey(msg)),
+			Data:         data,
+		}
+	}
+
+	out, err := q.kinesis.PutRecords(&kinesis.PutRecordsInput{
+		StreamName: aws.String(q.stream),
+		Records:    entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []*msgqueue.Message
+	for i, entry := range out.Records {
+		if i >= len(msgs) {
+			break
+		}
+		if entry.ErrorCode != nil {
+			failed = append(failed, msgs[i])
+			continue
+		}
+		msgs[i].Id = messageId(aws.StringValue(entry.ShardId), aws.StringValue(entry.SequenceNumber))
+	}
+	return failed, nil
+}
+
+// partitionKey returns partition key of the message. Messages with
+// the same GroupKey are put to the same shard, so they keep their order.
+func partitionKey(msg *msgqueue.Message) string {
+	if msg.GroupKey != "" {
+		return msg.GroupKey
+	}
+	if msg.Name != "" {
+		return msg.Name
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// checkRecordSize returns msgqueue.ErrTooLarge if record data with
+// the envelope and partition key exceeds Kinesis record size limit.
+func checkRecordSize(msg *msgqueue.Message) error {
+	data, err := encodeData(msg)
+	if err != nil {
+		return err
+	}
+	size := len(data)
+	switch {
+	case msg.GroupKey != "":
+		size += len(msg.GroupKey)
+	case msg.Name != "":
+		size += len(msg.Name)
+	default:
+		size += 32 // random hex key
+	}
+	if size > maxMessageSize {
+		return msgqueue.ErrTooLarge
+	}
+	return nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds Kinesis record size limit.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN returns released messages which delay has passed or reads
+// up to n records from the next leased shard.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	if q.redisClient() == nil {
+		return nil, errNoRedis
+	}
+	if n > maxGetRecords {
+		n = maxGetRecords
+	}
+
+	if err := q.refreshShards(); err != nil {
+		return nil, err
+	}
+
+	if msgs := q.takeReleased(n); len(msgs) > 0 {
+		return msgs, nil
+	}
+
+	for {
+		s := q.nextShard()
+		if s == nil {
+			break
+		}
+		msgs, err := q.getRecords(s, n)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+	}
+
+	time.Sleep(pollInterval)
+	return nil, nil
+}
+
+func (q *Queue) takeReleased(n int) []msgqueue.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var msgs []msgqueue.Message
+	now := time.Now()
+	for _, s := range q.shards {
+		released := s.released[:0]
+		for _, rm := range s.released {
+			if len(msgs) < n && !rm.at.After(now) {
+				msgs = append(msgs, rm.msg)
+			} else {
+				released = append(released, rm)
+			}
+		}
+		s.released = released
+	}
+	return msgs
+}
+
+// nextShard returns the next shard that can be read
+// marking it busy or nil if all shards were tried.
+func (q *Queue) nextShard() *shard {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := 0; i < len(q.order); i++ {
+		q.next = (q.next + 1) % len(q.order)
+		s, ok := q.shards[q.order[q.next]]
+		if !ok || s.busy || s.closed || time.Since(s.lastGet) < minGetInterval {
+			continue
+		}
+		s.busy = true
+		s.lastGet = time.Now()
+		return s
+	}
+	return nil
+}
+
+func (q *Queue) getRecords(s *shard, n int) ([]msgqueue.Message, error) {
+	defer func() {
+		q.mu.Lock()
+		s.busy = false
+		q.mu.Unlock()
+	}()
+
+	q.mu.Lock()
+	iterator, lastRead := s.iterator, s.lastRead
+	q.mu.Unlock()
+
+	if iterator == "" {
+		var err error
+		iterator, err = q.shardIterator(s.id, lastRead)
+		if err != nil {
+			return nil, err
+		}
+		if iterator == "" {
+			q.mu.Lock()
+			s.closed = true
+			q.mu.Unlock()
+			return nil, nil
+		}
+	}
+
+	out, err := q.kinesis.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: aws.String(iterator),
+		Limit:         aws.Int64(int64(n)),
+	})
+	if err != nil {
+		if isCode(err, kinesis.ErrCodeExpiredIteratorException) {
+			q.mu.Lock()
+			s.iterator = ""
+			q.mu.Unlock()
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s.iterator = aws.StringValue(out.NextShardIterator)
+	s.closed = out.NextShardIterator == nil
+
+	msgs := make([]msgqueue.Message, 0, len(out.Records))
+	for _, r := range out.Records {
+		seq := aws.StringValue(r.SequenceNumber)
+		msg, err := newMessage(s.id, r)
+		if err != nil {
+			q.opt.Logf(msgqueue.LogWarn, "%s can't decode record %s: %s", q, seq, err)
+			s.pending = append(s.pending, &record{seq: seq, done: true})
+		} else {
+			s.pending = append(s.pending, &record{seq: seq})
+			msgs = append(msgs, *msg)
+		}
+		s.lastRead = seq
+	}
+
+	if s.closed {
+		// Checkpoint of the closed shard without pending records is ended.
+		if err := q.advance(s); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// shardIterator returns iterator that starts after the last read record
+// or after the checkpoint. It returns empty iterator if all records of
+// the shard are processed.
+func (q *Queue) shardIterator(shardId, lastRead string) (string, error) {
+	seq := lastRead
+	if seq == "" {
+		var err error
+		seq, err = q.checkpoint(shardId)
+		if err != nil {
+			return "", err
+		}
+	}
+	if seq == shardEnd {
+		return "", nil
+	}
+
+	in := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(q.stream),
+		ShardId:           aws.String(shardId),
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	}
+	if seq != "" {
+		in.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		in.StartingSequenceNumber = aws.String(seq)
+	}
+
+	out, err := q.kinesis.GetShardIterator(in)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ShardIterator), nil
+}
+
+func (q *Queue) checkpointKey(shardId string) string {
+	return fmt.Sprintf("kinesis:%s:%s:%s:checkpoint", q.stream, q.Name(), shardId)
+}
+
+// redisClient returns Options.Redis that is used for leases and
+// checkpoints or nil if it does not implement RedisCmdable.
+func (q *Queue) redisClient() msgqueue.RedisCmdable {
+	client, _ := q.opt.Redis.(msgqueue.RedisCmdable)
+	return client
+}
+
+func (q *Queue) leaseKey(shardId string) string {
+	return fmt.Sprintf("kinesis:%s:%s:%s:lease", q.stream, q.Name(), shardId)
+}
+
+func (q *Queue) checkpoint(shardId string) (string, error) {
+	seq, err := q.redisClient().Get(q.checkpointKey(shardId)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return seq, err
+}
+
+// refreshShards lists shards of the stream, renews leases of owned
+// shards, and leases shards that are not owned by other processes.
+// Child shards are leased after their parents are processed, so
+// records with the same partition key keep their order.
+func (q *Queue) refreshShards() error {
+	q.mu.Lock()
+	if time.Since(q.refreshedAt) < leaseTTL/3 {
+		q.mu.Unlock()
+		return nil
+	}
+	q.refreshedAt = time.Now()
+	q.mu.Unlock()
+
+	shards, err := q.listShards()
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		ids[aws.StringValue(s.ShardId)] = true
+	}
+
+	var order []string
+	for _, ks := range shards {
+		id := aws.StringValue(ks.ShardId)
+
+		checkpoint, err := q.checkpoint(id)
+		if err != nil {
+			return err
+		}
+		if checkpoint == shardEnd || !q.parentsEnded(ks, ids) {
+			q.dropShard(id)
+			continue
+		}
+
+		ok, err := q.lease(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			q.dropShard(id)
+			continue
+		}
+		order = append(order, id)
+	}
+
+	q.mu.Lock()
+	for _, id := range order {
+		if _, ok := q.shards[id]; !ok {
+			q.shards[id] = &shard{id: id}
+		}
+	}
+	q.order = order
+	q.mu.Unlock()
+
+	return nil
+}
+
+func (q *Queue) listShards() ([]*kinesis.Shard, error) {
+	var shards []*kinesis.Shard
+	in := &kinesis.ListShardsInput{
+		StreamName: aws.String(q.stream),
+	}
+	for {
+		out, err := q.kinesis.ListShards(in)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		in = &kinesis.ListShardsInput{
+			NextToken: out.NextToken,
+		}
+	}
+}
+
+func (q *Queue) parentsEnded(s *kinesis.Shard, ids map[string]bool) bool {
+	for _, parent := range []*string{s.ParentShardId, s.AdjacentParentShardId} {
+		id := aws.StringValue(parent)
+		if id == "" || !ids[id] {
+			// Parent is expired and its records are deleted.
+			continue
+		}
+		checkpoint, err := q.checkpoint(id)
+		if err != nil || checkpoint != shardEnd {
+			return false
+		}
+	}
+	return true
+}
+
+// lease acquires or renews the shard lease.
+func (q *Queue) lease(shardId string) (bool, error) {
+	key := q.leaseKey(shardId)
+	ok, err := q.redisClient().SetNX(key, ownerId, leaseTTL).Result()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		return true, nil
+	}
+
+	// Lease is renewed only if it is owned by this process. It is not
+	// atomic, but the lease is renewed long before it expires.
+	owner, err := q.redisClient().Get(key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if owner != ownerId {
+		return false, nil
+	}
+	return true, q.redisClient().Set(key, ownerId, leaseTTL).Err()
+}
+
+// dropShard stops reading the shard. Records that are not processed
+// yet are read again by the process that leases the shard.
+func (q *Queue) dropShard(shardId string) {
+	q.mu.Lock()
+	delete(q.shards, shardId)
+	q.mu.Unlock()
+}
+
+func newMessage(shardId string, r *kinesis.Record) (*msgqueue.Message, error) {
+	env, err := decodeData(r.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	id := messageId(shardId, aws.StringValue(r.SequenceNumber))
+	createdAt := aws.TimeValue(r.ApproximateArrivalTimestamp)
+	msg := &msgqueue.Message{
+		Id:         id,
+		Body:       env.Body,
+		Header:     env.Header,
+		Priority:   env.Priority,
+		RetryLimit: env.RetryLimit,
+		GroupKey:   env.GroupKey,
+		Barrier:    env.Barrier,
+		CreatedAt:  createdAt,
+
+		ReservationId: id,
+		ReservedCount: 1,
+	}
+	if env.Delay > 0 {
+		delay := time.Duration(env.Delay) * time.Millisecond
+		if remaining := time.Until(createdAt.Add(delay)); remaining > 0 {
+			msg.Delay = remaining
+		}
+	}
+	return msg, nil
+}
+
+func messageId(shardId, seq string) string {
+	return shardId + "/" + seq
+}
+
+func splitMessageId(id string) (shardId, seq string) {
+	i := strings.LastIndexByte(id, '/')
+	if i == -1 {
+		return "", id
+	}
+	return id[:i], id[i+1:]
+}
+
+// Release reserves the message again after the delay. Kinesis can't
+// redeliver records, so released messages are kept in memory and the
+// shard checkpoint is not advanced past them until they are deleted.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	shardId, _ := splitMessageId(msg.Id)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s, ok := q.shards[shardId]
+	if !ok {
+		// Lease is lost and the record is read again by the new owner.
+		return nil
+	}
+
+	released := *msg
+	if released.Delay > 0 {
+		// Release that delays the message is not a retry.
+		released.Delay = 0
+	} else {
+		released.ReservedCount++
+	}
+	s.released = append(s.released, releasedMessage{
+		msg: released,
+		at:  time.Now().Add(delay),
+	})
+	return nil
+}
+
+// Touch is not supported, because records are not reserved in Kinesis.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	return msgqueue.ErrNotSupported
+}
+
+// Delete marks the record as processed and advances the shard checkpoint.
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	return q.DeleteBatch([]*msgqueue.Message{msg})
+}
+
+// DeleteBatch marks the records as processed and advances checkpoints
+// of their shards over the processed records.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	touched := make(map[*shard]bool)
+	for _, msg := range msgs {
+		shardId, seq := splitMessageId(msg.Id)
+		s, ok := q.shards[shardId]
+		if !ok {
+			continue
+		}
+		for _, r := range s.pending {
+			if r.seq == seq {
+				r.done = true
+				touched[s] = true
+				break
+			}
+		}
+	}
+
+	var firstErr error
+	for s := range touched {
+		if err := q.advance(s); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// advance removes processed records from the start of pending records
+// and saves the checkpoint. It is called with q.mu held, so checkpoints
+// are saved in order.
+func (q *Queue) advance(s *shard) error {
+	var checkpoint string
+	for len(s.pending) > 0 && s.pending[0].done {
+		checkpoint = s.pending[0].seq
+		s.pending = s.pending[1:]
+	}
+	if s.closed && !s.ended && len(s.pending) == 0 {
+		s.ended = true
+		checkpoint = shardEnd
+	}
+	if checkpoint == "" {
+		return nil
+	}
+	return q.redisClient().Set(q.checkpointKey(s.id), checkpoint, 0).Err()
+}
+
+// Purge is not supported, because Kinesis records can't be deleted.
+func (q *Queue) Purge() error {
+	return msgqueue.ErrNotSupported
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+// Shard leases are released, so other processes can take over shards.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	q.mu.Lock()
+	shards := q.shards
+	q.shards = make(map[string]*shard)
+	q.order = nil
+	q.refreshedAt = time.Time{}
+	q.mu.Unlock()
+
+	for id := range shards {
+		key := q.leaseKey(id)
+		if q.redisClient().Get(key).Val() == ownerId {
+			q.redisClient().Del(key)
+		}
+	}
+
+	return firstErr
+}
+
+func isCode(err error, code string) bool {
+	v, ok := err.(awserr.Error)
+	return ok && v.Code() == code
+}
+
+// Kinesis records don't have attributes so message with headers,
+// priority, retry limit, group key, barrier flag, or delay is prefixed
+// with JSON envelope on a separate line.
+type envelope struct {
+	Header     map[string]string `json:"header"`
+	Priority   int               `json:"priority,omitempty"`
+	RetryLimit int               `json:"retry_limit,omitempty"`
+	GroupKey   string            `json:"group_key,omitempty"`
+	Barrier    bool              `json:"barrier,omitempty"`
+	Delay      int64             `json:"delay,omitempty"` // milliseconds
+	Body       string            `json:"-"`
+}
+
+const envelopePrefix = `{"header":`
+
+func encodeData(msg *msgqueue.Message) ([]byte, error) {
+	delay := msg.ScheduledDelay()
+	if len(msg.Header) == 0 && msg.Priority == 0 && msg.RetryLimit == 0 &&
+		msg.GroupKey == "" && !msg.Barrier && delay <= 0 &&
+		!strings.HasPrefix(msg.Body, envelopePrefix) {
+		return []byte(msg.Body), nil
+	}
+	b, err := json.Marshal(envelope{
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+		Delay:      int64(delay / time.Millisecond),
+	})
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	b = append(b, msg.Body...)
+	return b, nil
+}
+
+func decodeData(b []byte) (*envelope, error) {
+	s := string(b)
+	if !strings.HasPrefix(s, envelopePrefix) {
+		return &envelope{Body: s}, nil
+	}
+
+	i := strings.IndexByte(s, '\n')
+	if i == -1 {
+		return &envelope{Body: s}, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(b[:i], &env); err != nil {
+		return nil, err
+	}
+	env.Body = s[i+1:]
+	return &env, nil
+}
@@ -0,0 +1,44 @@
+package azsqs
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// ClientOptions configures SQS client created by NewClient.
+type ClientOptions struct {
+	// Optional region that overrides the session region,
+	// e.g. region of queues owned by another account.
+	Region string
+
+	// Optional ARN of IAM role that is assumed using STS to access
+	// queues, e.g. role in the account that owns the queues.
+	RoleARN string
+	// Optional external id required by the role trust policy.
+	ExternalId string
+}
+
+// NewClient creates SQS client that uses the session with the region
+// and assumed role credentials. Queues that use different credentials
+// should use different clients.
+func NewClient(sess *session.Session, opt *ClientOptions) *sqs.SQS {
+	if opt == nil {
+		opt = new(ClientOptions)
+	}
+
+	cfg := aws.NewConfig()
+	if opt.Region != "" {
+		cfg = cfg.WithRegion(opt.Region)
+	}
+	if opt.RoleARN != "" {
+		creds := stscreds.NewCredentials(sess, opt.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if opt.ExternalId != "" {
+				p.ExternalID = aws.String(opt.ExternalId)
+			}
+		})
+		cfg = cfg.WithCredentials(creds)
+	}
+	return sqs.New(sess, cfg)
+}
@@ -0,0 +1,44 @@
+package azsqs
+
+import (
+	"github.com/go-msgqueue/msgqueue"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Factory creates queues that share one SQS client, Redis client,
+// and SQS API rate budget. Apps with many queues should use one
+// factory instead of creating SQS client per queue.
+type Factory struct {
+	sqs       *sqs.SQS
+	accountId string
+	opt       *msgqueue.FactoryOptions
+}
+
+func NewFactory(sqs *sqs.SQS, accountId string, opt *msgqueue.FactoryOptions) *Factory {
+	if opt == nil {
+		opt = new(msgqueue.FactoryOptions)
+	}
+	opt.Init()
+	return &Factory{
+		sqs:       sqs,
+		accountId: accountId,
+		opt:       opt,
+	}
+}
+
+// NewQueue creates new Queue that uses factory resources.
+func (f *Factory) NewQueue(opt *msgqueue.Options) *Queue {
+	f.opt.InitQueue(opt)
+	return newQueue(f.sqs, f.accountId, opt, f.opt)
+}
+
+// NewQueueURL creates new Queue that uses existing SQS queue
+// with the URL and factory resources. See NewQueueURL.
+func (f *Factory) NewQueueURL(queueURL string, opt *msgqueue.Options) *Queue {
+	if opt.Name == "" {
+		opt.Name = queueURLName(queueURL)
+	}
+	f.opt.InitQueue(opt)
+	return newQueueURL(f.sqs, queueURL, opt, f.opt)
+}
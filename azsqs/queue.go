@@ -2,7 +2,9 @@ package azsqs
 
 import (
 	"fmt"
+	"hash/fnv"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,27 +17,110 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
+// Prefix of message attributes that store message options. Header keys
+// with the prefix are rejected, so headers can't change message options.
+const attrPrefix = "mq."
+
+// Message attribute that stores delay exceeding SQS max delay.
+const delayAttr = attrPrefix + "delay"
+
+// Message attribute that stores message priority.
+const priorityAttr = attrPrefix + "priority"
+
+// Message attribute that stores per-message retry limit.
+const retryLimitAttr = attrPrefix + "retry_limit"
+
+// Message attribute that stores message group key.
+const groupKeyAttr = attrPrefix + "group_key"
+
+// Message attribute that marks barrier messages.
+const barrierAttr = attrPrefix + "barrier"
+
+// Message attribute that stores the number of reserves of the message
+// before it was released by sending it again.
+const reservedCountAttr = attrPrefix + "reserved_count"
+
+// Message attribute that stores creation time in milliseconds of the
+// message that was released by sending it again, because SQS resets
+// SentTimestamp of the sent copy.
+const createdAtAttr = attrPrefix + "created_at"
+
+// SQS limit of the number of message attributes.
+const maxMessageAttributes = 10
+
+const maxMessageSize = 256 * 1024
+
+// SQS limit of the total size of messages sent using SendMessageBatch.
+const maxBatchSize = 256 * 1024
+
 type Queue struct {
 	sqs       *sqs.SQS
 	accountId string
 	opt       *msgqueue.Options
 	memqueue  *memqueue.Queue
+	fopt      *msgqueue.FactoryOptions
 
 	mu        sync.RWMutex
 	_queueURL string
+	// Queue URL is set by NewQueueURL and is not resolved.
+	fixedURL bool
+
+	s3opt *S3Options
+	ropt  *ReceiveOptions
+
+	idleMu        sync.Mutex
+	emptyReceives int
+
+	// Hashes of headers of reserved messages by receipt handle,
+	// so messages with changed headers are sent again on release.
+	headers sync.Map
 
 	p *processor.Processor
 }
 
 var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Reconnecter = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
 
 func NewQueue(sqs *sqs.SQS, accountId string, opt *msgqueue.Options) *Queue {
+	return newQueue(sqs, accountId, opt, nil)
+}
+
+// NewQueueURL creates new Queue that uses existing SQS queue with the
+// URL, e.g. queue owned by another AWS account. The queue is not created
+// and its URL is not resolved using the account id. Client region and
+// credentials must allow access to the queue, see NewClient. If opt.Name
+// is empty, the name is taken from the URL.
+func NewQueueURL(sqs *sqs.SQS, queueURL string, opt *msgqueue.Options) *Queue {
+	return newQueueURL(sqs, queueURL, opt, nil)
+}
+
+func newQueueURL(
+	sqs *sqs.SQS, queueURL string, opt *msgqueue.Options, fopt *msgqueue.FactoryOptions,
+) *Queue {
+	if opt.Name == "" {
+		opt.Name = queueURLName(queueURL)
+	}
+	q := newQueue(sqs, "", opt, fopt)
+	q._queueURL = queueURL
+	q.fixedURL = true
+	return q
+}
+
+func newQueue(
+	sqs *sqs.SQS, accountId string, opt *msgqueue.Options, fopt *msgqueue.FactoryOptions,
+) *Queue {
 	opt.Init()
 	q := Queue{
 		sqs:       sqs,
 		accountId: accountId,
 		opt:       opt,
+		fopt:      fopt,
+		ropt:      new(ReceiveOptions),
 	}
+	q.ropt.init()
 
 	memopt := msgqueue.Options{
 		Name: opt.Name,
@@ -44,10 +129,15 @@ func NewQueue(sqs *sqs.SQS, accountId string, opt *msgqueue.Options) *Queue {
 		MinBackoff: time.Second,
 		Handler:    msgqueue.HandlerFunc(q.add),
 
-		Redis: opt.Redis,
+		Redis:  opt.Redis,
+		Logger: opt.Logger,
 	}
 	if opt.Handler != nil {
-		memopt.FallbackHandler = internal.MessageUnwrapperHandler(opt.Handler)
+		memopt.FallbackHandler = internal.MessageUnwrapperHandler(opt.Handler, opt.Codec)
+	}
+	if opt.Sync {
+		// Messages are processed by the memqueue using queue options.
+		memopt = *opt
 	}
 	q.memqueue = memqueue.NewQueue(&memopt)
 
@@ -55,6 +145,21 @@ func NewQueue(sqs *sqs.SQS, accountId string, opt *msgqueue.Options) *Queue {
 	return &q
 }
 
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(sqs *sqs.SQS, accountId string, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(sqs, accountId, opt), nil
+}
+
+// queueURLName returns queue name, i.e. last segment of the URL.
+func queueURLName(queueURL string) string {
+	return queueURL[strings.LastIndexByte(queueURL, '/')+1:]
+}
+
 func (q *Queue) Name() string {
 	return q.opt.Name
 }
@@ -67,6 +172,23 @@ func (q *Queue) Options() *msgqueue.Options {
 	return q.opt
 }
 
+// Describe describes the queue. Delays longer than 15 minutes that
+// SQS supports are emulated by delaying the message again.
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "sqs",
+		Options:        q.opt,
+		MaxPayloadSize: q.maxMessageSize(),
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
 func (q *Queue) Processor() *processor.Processor {
 	if q.p == nil {
 		q.p = processor.New(q, q.opt)
@@ -94,6 +216,46 @@ func (q *Queue) queueURL() string {
 	return queueURL
 }
 
+// Reconnect drops cached queue URL so it is resolved again
+// on next request. URL of the queue created using NewQueueURL is kept.
+func (q *Queue) Reconnect() error {
+	q.mu.Lock()
+	if !q.fixedURL {
+		q._queueURL = ""
+	}
+	q.mu.Unlock()
+	return nil
+}
+
+// Len returns approximate number of messages available in the queue.
+func (q *Queue) Len() (int, error) {
+	in := &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(q.queueURL()),
+		AttributeNames: []*string{aws.String("ApproximateNumberOfMessages")},
+	}
+	q.fopt.WaitAPI()
+	out, err := q.sqs.GetQueueAttributes(in)
+	if err != nil {
+		return 0, err
+	}
+	v, ok := out.Attributes["ApproximateNumberOfMessages"]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(*v)
+}
+
+// Ping checks that the queue is reachable by requesting its attributes.
+func (q *Queue) Ping() error {
+	in := &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(q.queueURL()),
+		AttributeNames: []*string{aws.String("QueueArn")},
+	}
+	q.fopt.WaitAPI()
+	_, err := q.sqs.GetQueueAttributes(in)
+	return err
+}
+
 func (q *Queue) createQueue() (string, error) {
 	visTimeout := strconv.Itoa(int(q.opt.ReservationTimeout / time.Second))
 	in := &sqs.CreateQueueInput{
@@ -102,6 +264,7 @@ func (q *Queue) createQueue() (string, error) {
 			"VisibilityTimeout": &visTimeout,
 		},
 	}
+	q.fopt.WaitAPI()
 	out, err := q.sqs.CreateQueue(in)
 	if err != nil {
 		return "", err
@@ -114,6 +277,7 @@ func (q *Queue) getQueueURL() (string, error) {
 		QueueName:              aws.String(q.Name()),
 		QueueOwnerAWSAccountId: &q.accountId,
 	}
+	q.fopt.WaitAPI()
 	out, err := q.sqs.GetQueueUrl(in)
 	if err != nil {
 		return "", err
@@ -122,35 +286,24 @@ func (q *Queue) getQueueURL() (string, error) {
 }
 
 func (q *Queue) add(msg *msgqueue.Message) error {
-	const maxDelay = 15 * time.Minute
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
 
 	msg = msg.Args[0].(*msgqueue.Message)
 
-	body, err := msg.MarshalArgs()
+	body, attrs, delay, err := q.sqsMessage(msg)
 	if err != nil {
 		return err
 	}
-	if body == "" {
-		body = "_" // SQS requires body.
-	}
-
 	in := &sqs.SendMessageInput{
-		QueueUrl:    aws.String(q.queueURL()),
-		MessageBody: aws.String(body),
-	}
-
-	if msg.Delay <= maxDelay {
-		in.DelaySeconds = aws.Int64(int64(msg.Delay / time.Second))
-	} else {
-		in.DelaySeconds = aws.Int64(int64(maxDelay / time.Second))
-		in.MessageAttributes = map[string]*sqs.MessageAttributeValue{
-			"delay": &sqs.MessageAttributeValue{
-				DataType:    aws.String("String"),
-				StringValue: aws.String((msg.Delay - maxDelay).String()),
-			},
-		}
+		QueueUrl:          aws.String(q.queueURL()),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attrs,
+		DelaySeconds:      aws.Int64(delay),
 	}
 
+	q.fopt.WaitAPI()
 	out, err := q.sqs.SendMessage(in)
 	if err != nil {
 		return err
@@ -160,9 +313,281 @@ func (q *Queue) add(msg *msgqueue.Message) error {
 	return nil
 }
 
-// Add adds message to the queue.
+// addBatch sends messages using SendMessageBatch. Messages that were
+// already sent have Id set and are skipped when the batch is retried.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(msgs))
+	for i, msg := range msgs {
+		if msg.Id != "" {
+			continue
+		}
+		body, attrs, delay, err := q.sqsMessage(msg)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(body),
+			MessageAttributes: attrs,
+			DelaySeconds:      aws.Int64(delay),
+		})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	in := &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(q.queueURL()),
+		Entries:  entries,
+	}
+	q.fopt.WaitAPI()
+	out, err := q.sqs.SendMessageBatch(in)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range out.Successful {
+		i, err := strconv.Atoi(*entry.Id)
+		if err != nil {
+			return err
+		}
+		msgs[i].Id = *entry.MessageId
+	}
+
+	if len(out.Failed) > 0 {
+		entry := out.Failed[0]
+		return fmt.Errorf(
+			"azsqs: SendMessageBatch failed for %d messages: %s (%s)",
+			len(out.Failed), *entry.Message, *entry.Code,
+		)
+	}
+	return nil
+}
+
+// sqsMessage returns SQS message body, attributes, and delay.
+// Body is stored in S3 if it exceeds the S3 offloading threshold.
+func (q *Queue) sqsMessage(
+	msg *msgqueue.Message,
+) (string, map[string]*sqs.MessageAttributeValue, int64, error) {
+	attrs, delay := messageAttributes(msg)
+	if !q.shouldOffload(msg) {
+		return messageBody(msg), attrs, delay, nil
+	}
+
+	body, err := q.offload(msg)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if attrs == nil {
+		attrs = make(map[string]*sqs.MessageAttributeValue, 1)
+	}
+	attrs[payloadSizeAttr] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(len(msg.Body))),
+	}
+	return body, attrs, delay, nil
+}
+
+// sendSize returns the size SQS counts towards message and batch size
+// limits: message body and names, types, and values of attributes.
+// Offloaded body is replaced by the S3 pointer.
+func (q *Queue) sendSize(msg *msgqueue.Message) int {
+	if !q.shouldOffload(msg) {
+		return inlineSize(msg)
+	}
+	// Pointer JSON with a hex key of 32 chars and a payload size attribute.
+	size := len(payloadPointerClass) + len(q.s3opt.Bucket) + len(q.s3opt.Prefix) + 100
+	return size + attributesSize(msg)
+}
+
+// inlineSize returns the send size of the message which body
+// is not offloaded.
+func inlineSize(msg *msgqueue.Message) int {
+	return len(messageBody(msg)) + attributesSize(msg)
+}
+
+func attributesSize(msg *msgqueue.Message) int {
+	var size int
+	attrs, _ := messageAttributes(msg)
+	for name, attr := range attrs {
+		size += len(name) + len(*attr.DataType) + len(*attr.StringValue)
+	}
+	return size
+}
+
+func messageBody(msg *msgqueue.Message) string {
+	if msg.Body == "" {
+		return "_" // SQS requires body.
+	}
+	return msg.Body
+}
+
+func messageAttributes(msg *msgqueue.Message) (map[string]*sqs.MessageAttributeValue, int64) {
+	const maxDelay = 15 * time.Minute
+
+	var attrs map[string]*sqs.MessageAttributeValue
+	setAttr := func(name, typ, value string) {
+		if attrs == nil {
+			attrs = make(map[string]*sqs.MessageAttributeValue, len(msg.Header)+1)
+		}
+		attrs[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String(typ),
+			StringValue: aws.String(value),
+		}
+	}
+
+	for k, v := range msg.Header {
+		setAttr(k, "String", v)
+	}
+
+	if msg.Priority != 0 {
+		setAttr(priorityAttr, "Number", strconv.Itoa(msg.Priority))
+	}
+
+	if msg.RetryLimit != 0 {
+		setAttr(retryLimitAttr, "Number", strconv.Itoa(msg.RetryLimit))
+	}
+
+	if msg.GroupKey != "" {
+		setAttr(groupKeyAttr, "String", msg.GroupKey)
+	}
+
+	if msg.Barrier {
+		setAttr(barrierAttr, "String", "1")
+	}
+
+	delay := msg.ScheduledDelay()
+	if delay <= maxDelay {
+		return attrs, int64(delay / time.Second)
+	}
+	setAttr(delayAttr, "String", (delay - maxDelay).String())
+	return attrs, int64(maxDelay / time.Second)
+}
+
+func isReservedAttr(name string) bool {
+	return strings.HasPrefix(name, attrPrefix) || name == payloadSizeAttr
+}
+
+// validateAttributes returns an error if message header uses reserved
+// attribute names or if the message has more attributes than SQS allows.
+// extra is the number of attributes that are added on send.
+func (q *Queue) validateAttributes(msg *msgqueue.Message, extra int) error {
+	for k := range msg.Header {
+		if isReservedAttr(k) {
+			return fmt.Errorf("azsqs: header %q uses reserved attribute name", k)
+		}
+	}
+
+	attrs, _ := messageAttributes(msg)
+	n := len(attrs) + extra
+	if q.shouldOffload(msg) {
+		n++
+	}
+	if _, ok := msg.Header[msgqueue.NameHeader]; !ok && q.opt.Upsert && msg.Name != "" {
+		n++
+	}
+	if n > maxMessageAttributes {
+		return fmt.Errorf(
+			"azsqs: message has %d attributes (%d header keys), SQS allows at most %d",
+			n, len(msg.Header), maxMessageAttributes,
+		)
+	}
+	return nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message with attributes exceeds SQS message size limit
+// and the body is not offloaded to S3. Header keys must not start with
+// "mq." and the message can have at most 10 attributes including the
+// header and attributes that store message options, e.g. Priority.
 func (q *Queue) Add(msg *msgqueue.Message) error {
-	return q.memqueue.Add(internal.WrapMessage(msg))
+	if q.opt.Sync {
+		return q.memqueue.Add(msg)
+	}
+	msg, err := internal.EncodeMessage(q.opt, msg)
+	if err != nil {
+		return err
+	}
+	if len(msg.Body) > q.maxMessageSize() {
+		return msgqueue.ErrTooLarge
+	}
+	msgqueue.InjectTrace(q.opt, msg)
+	if err := q.validateAttributes(msg, 0); err != nil {
+		return err
+	}
+	if !q.shouldOffload(msg) && q.sendSize(msg) > maxMessageSize {
+		return msgqueue.ErrTooLarge
+	}
+	if q.opt.Upsert && msg.Name != "" {
+		pending, err := msgqueue.UpsertLatestArgs(q.opt, msg)
+		if err != nil || pending {
+			return err
+		}
+	}
+	return q.memqueue.Add(internal.WrapMessage(q.opt, msg))
+}
+
+// AddBatch adds messages to the queue using SendMessageBatch. Messages
+// are split into batches of at most 10 messages and 256KB including
+// message attributes.
+// Named messages are added using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	if q.opt.Sync {
+		return q.memqueue.AddBatch(msgs)
+	}
+
+	const batchLen = 10
+
+	batch := make([]*msgqueue.Message, 0, batchLen)
+	var batchSize int
+	for _, msg := range msgs {
+		if msg.Name != "" {
+			err := q.Add(msg)
+			if err != nil && err != msgqueue.ErrDuplicate {
+				return err
+			}
+			continue
+		}
+
+		msg, err := internal.EncodeMessage(q.opt, msg)
+		if err != nil {
+			return err
+		}
+		if len(msg.Body) > q.maxMessageSize() {
+			return msgqueue.ErrTooLarge
+		}
+		msgqueue.InjectTrace(q.opt, msg)
+		if err := q.validateAttributes(msg, 0); err != nil {
+			return err
+		}
+
+		size := q.sendSize(msg)
+		if !q.shouldOffload(msg) && size > maxMessageSize {
+			return msgqueue.ErrTooLarge
+		}
+		if len(batch) > 0 && batchSize+size > maxBatchSize {
+			if err := q.memqueue.Add(internal.WrapMessages(batch)); err != nil {
+				return err
+			}
+			batch = make([]*msgqueue.Message, 0, batchLen)
+			batchSize = 0
+		}
+
+		batch = append(batch, msg)
+		batchSize += size
+		if len(batch) == batchLen {
+			if err := q.memqueue.Add(internal.WrapMessages(batch)); err != nil {
+				return err
+			}
+			batch = make([]*msgqueue.Message, 0, batchLen)
+			batchSize = 0
+		}
+	}
+
+	if len(batch) > 0 {
+		return q.memqueue.Add(internal.WrapMessages(batch))
+	}
+	return nil
 }
 
 // Call creates a message using the args and adds it to the queue.
@@ -179,31 +604,43 @@ func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
 	return q.Add(msg)
 }
 
+// ReserveN receives up to n messages using long polling. With idle
+// backoff configured, it waits before returning no messages. Messages
+// which body can't be fetched from S3 are skipped and received again
+// after the visibility timeout.
 func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
-	if n > 10 {
-		n = 10
+	if n > q.ropt.MaxNumberOfMessages {
+		n = q.ropt.MaxNumberOfMessages
 	}
 	in := &sqs.ReceiveMessageInput{
-		QueueUrl:              aws.String(q.queueURL()),
-		MaxNumberOfMessages:   aws.Int64(int64(n)),
-		WaitTimeSeconds:       aws.Int64(1),
-		AttributeNames:        []*string{aws.String("ApproximateReceiveCount")},
-		MessageAttributeNames: []*string{aws.String("delay")},
+		QueueUrl:            aws.String(q.queueURL()),
+		MaxNumberOfMessages: aws.Int64(int64(n)),
+		WaitTimeSeconds:     aws.Int64(int64(q.ropt.WaitTime / time.Second)),
+		AttributeNames: []*string{
+			aws.String("ApproximateReceiveCount"),
+			aws.String("SentTimestamp"),
+		},
+		MessageAttributeNames: []*string{aws.String("All")},
 	}
+	q.fopt.WaitAPI()
 	out, err := q.sqs.ReceiveMessage(in)
 	if err != nil {
 		return nil, err
 	}
 
-	msgs := make([]msgqueue.Message, len(out.Messages))
-	for i, sqsMsg := range out.Messages {
+	if backoff := q.idleBackoff(len(out.Messages)); backoff > 0 {
+		time.Sleep(backoff)
+	}
+
+	msgs := make([]msgqueue.Message, 0, len(out.Messages))
+	for _, sqsMsg := range out.Messages {
 		var reservedCount int
 		if v, ok := sqsMsg.Attributes["ApproximateReceiveCount"]; ok {
 			reservedCount, _ = strconv.Atoi(*v)
 		}
 
 		var delay time.Duration
-		if v, ok := sqsMsg.MessageAttributes["delay"]; ok {
+		if v, ok := sqsMsg.MessageAttributes[delayAttr]; ok {
 			dur, err := time.ParseDuration(*v.StringValue)
 			if err != nil {
 				return nil, err
@@ -215,42 +652,219 @@ func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
 			}
 		}
 
-		msgs[i] = msgqueue.Message{
+		var createdAt time.Time
+		if v, ok := sqsMsg.Attributes["SentTimestamp"]; ok {
+			if ms, err := strconv.ParseInt(*v, 10, 64); err == nil {
+				createdAt = time.Unix(0, ms*int64(time.Millisecond))
+			}
+		}
+
+		var priority int
+		if v, ok := sqsMsg.MessageAttributes[priorityAttr]; ok && v.StringValue != nil {
+			priority, _ = strconv.Atoi(*v.StringValue)
+		}
+
+		var retryLimit int
+		if v, ok := sqsMsg.MessageAttributes[retryLimitAttr]; ok && v.StringValue != nil {
+			retryLimit, _ = strconv.Atoi(*v.StringValue)
+		}
+
+		var groupKey string
+		if v, ok := sqsMsg.MessageAttributes[groupKeyAttr]; ok && v.StringValue != nil {
+			groupKey = *v.StringValue
+		}
+
+		if v, ok := sqsMsg.MessageAttributes[reservedCountAttr]; ok && v.StringValue != nil {
+			n, _ := strconv.Atoi(*v.StringValue)
+			reservedCount += n
+		}
+
+		if v, ok := sqsMsg.MessageAttributes[createdAtAttr]; ok && v.StringValue != nil {
+			if ms, err := strconv.ParseInt(*v.StringValue, 10, 64); err == nil {
+				createdAt = time.Unix(0, ms*int64(time.Millisecond))
+			}
+		}
+
+		_, barrier := sqsMsg.MessageAttributes[barrierAttr]
+
+		header := messageHeader(sqsMsg.MessageAttributes)
+		q.headers.Store(*sqsMsg.ReceiptHandle, headerHash(header))
+
+		msg := msgqueue.Message{
 			Body:          *sqsMsg.Body,
+			Header:        header,
+			Priority:      priority,
+			RetryLimit:    retryLimit,
+			GroupKey:      groupKey,
+			Barrier:       barrier,
 			Delay:         delay,
+			CreatedAt:     createdAt,
 			ReservationId: *sqsMsg.ReceiptHandle,
 			ReservedCount: reservedCount,
 		}
+
+		if _, ok := sqsMsg.MessageAttributes[payloadSizeAttr]; ok {
+			if err := q.fetch(&msg); err != nil {
+				// Message becomes visible again after the visibility
+				// timeout, so other messages are processed meanwhile.
+				q.headers.Delete(*sqsMsg.ReceiptHandle)
+				q.opt.Logf(msgqueue.LogWarn,
+					"%s fetching S3 payload of %s failed: %s", q, *sqsMsg.MessageId, err)
+				continue
+			}
+		}
+
+		msgs = append(msgs, msg)
 	}
 
 	return msgs, nil
 }
 
+func messageHeader(attrs map[string]*sqs.MessageAttributeValue) map[string]string {
+	var header map[string]string
+	for k, v := range attrs {
+		if isReservedAttr(k) || v.StringValue == nil {
+			continue
+		}
+		if header == nil {
+			header = make(map[string]string, len(attrs))
+		}
+		header[k] = *v.StringValue
+	}
+	return header
+}
+
+// headerHash returns hash of the header that does not depend
+// on the order of keys.
+func headerHash(header map[string]string) uint64 {
+	var sum uint64
+	for k, v := range header {
+		h := fnv.New64a()
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+		sum += h.Sum64()
+	}
+	return sum
+}
+
+// headerChanged reports whether message header was changed after the
+// message was reserved. It forgets the reserved message.
+func (q *Queue) headerChanged(msg *msgqueue.Message) bool {
+	v, ok := q.headers.Load(*receiptHandle(msg))
+	if !ok {
+		return false
+	}
+	q.headers.Delete(*receiptHandle(msg))
+	return v.(uint64) != headerHash(msg.Header)
+}
+
+// Release makes the message visible after the delay. SQS can't change
+// attributes of the message, so message which header was changed, e.g.
+// by the handler, is sent again with new attributes and deleted.
 func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	if q.headerChanged(msg) {
+		return q.resend(msg, delay)
+	}
+
 	in := &sqs.ChangeMessageVisibilityInput{
 		QueueUrl:          aws.String(q.queueURL()),
-		ReceiptHandle:     &msg.ReservationId,
+		ReceiptHandle:     receiptHandle(msg),
 		VisibilityTimeout: aws.Int64(int64(delay / time.Second)),
 	}
+	q.fopt.WaitAPI()
+	_, err := q.sqs.ChangeMessageVisibility(in)
+	return err
+}
+
+// resend sends copy of the message with the delay and deletes
+// the message. Number of reserves and creation time are kept
+// in the attributes.
+func (q *Queue) resend(msg *msgqueue.Message, delay time.Duration) error {
+	msg2 := &msgqueue.Message{
+		Body:       msg.Body,
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+		Delay:      delay,
+		CreatedAt:  msg.CreatedAt,
+	}
+	extra := 1
+	if !msg.CreatedAt.IsZero() {
+		extra++
+	}
+	if err := q.validateAttributes(msg2, extra); err != nil {
+		return err
+	}
+	body, attrs, delaySeconds, err := q.sqsMessage(msg2)
+	if err != nil {
+		return err
+	}
+	if attrs == nil {
+		attrs = make(map[string]*sqs.MessageAttributeValue, 1)
+	}
+	attrs[reservedCountAttr] = &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(strconv.Itoa(msg.ReservedCount)),
+	}
+	if !msg.CreatedAt.IsZero() {
+		ms := msg.CreatedAt.UnixNano() / int64(time.Millisecond)
+		attrs[createdAtAttr] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.FormatInt(ms, 10)),
+		}
+	}
+
+	in := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(q.queueURL()),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attrs,
+		DelaySeconds:      aws.Int64(delaySeconds),
+	}
+	q.fopt.WaitAPI()
+	if _, err := q.sqs.SendMessage(in); err != nil {
+		return err
+	}
+	return q.Delete(msg)
+}
+
+// Touch changes message visibility timeout to the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	in := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.queueURL()),
+		ReceiptHandle:     receiptHandle(msg),
+		VisibilityTimeout: aws.Int64(int64(dur / time.Second)),
+	}
+	q.fopt.WaitAPI()
 	_, err := q.sqs.ChangeMessageVisibility(in)
 	return err
 }
 
+// Delete deletes the message and its S3 object, if any.
 func (q *Queue) Delete(msg *msgqueue.Message) error {
+	q.headers.Delete(*receiptHandle(msg))
+
 	in := &sqs.DeleteMessageInput{
 		QueueUrl:      aws.String(q.queueURL()),
-		ReceiptHandle: &msg.ReservationId,
+		ReceiptHandle: receiptHandle(msg),
 	}
+	q.fopt.WaitAPI()
 	_, err := q.sqs.DeleteMessage(in)
-	return err
+	if err != nil {
+		return err
+	}
+	return q.deleteObject(msg)
 }
 
 func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
 	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(msgs))
 	for i, msg := range msgs {
+		q.headers.Delete(*receiptHandle(msg))
 		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
 			Id:            aws.String(strconv.Itoa(i)),
-			ReceiptHandle: &msg.ReservationId,
+			ReceiptHandle: receiptHandle(msg),
 		}
 	}
 
@@ -258,14 +872,32 @@ func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
 		QueueUrl: aws.String(q.queueURL()),
 		Entries:  entries,
 	}
-	_, err := q.sqs.DeleteMessageBatch(in)
-	return err
+	q.fopt.WaitAPI()
+	out, err := q.sqs.DeleteMessageBatch(in)
+	if err != nil || q.s3opt == nil {
+		return err
+	}
+
+	// S3 objects of messages that are not deleted are kept,
+	// because the messages are delivered again.
+	var firstErr error
+	for _, entry := range out.Successful {
+		i, err := strconv.Atoi(*entry.Id)
+		if err != nil {
+			return err
+		}
+		if err := q.deleteObject(msgs[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func (q *Queue) Purge() error {
 	in := &sqs.PurgeQueueInput{
 		QueueUrl: aws.String(q.queueURL()),
 	}
+	q.fopt.WaitAPI()
 	_, err := q.sqs.PurgeQueue(in)
 	return err
 }
@@ -0,0 +1,184 @@
+package azsqs
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+)
+
+func TestNewQueueURL(t *testing.T) {
+	const url = "https://sqs.eu-west-1.amazonaws.com/210987654321/partner-orders"
+
+	q := NewQueueURL(nil, url, &msgqueue.Options{})
+	defer q.Close()
+
+	if q.Name() != "partner-orders" {
+		t.Fatalf("got name %q", q.Name())
+	}
+	if got := q.queueURL(); got != url {
+		t.Fatalf("got URL %q", got)
+	}
+
+	if err := q.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.queueURL(); got != url {
+		t.Fatalf("got URL %q after reconnect", got)
+	}
+}
+
+func TestAddReservedHeader(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "reserved-header"})
+	defer q.Close()
+
+	msg := msgqueue.NewMessage()
+	msg.Header = map[string]string{"mq.priority": "9"}
+	err := q.Add(msg)
+	if err == nil || err.Error() != `azsqs: header "mq.priority" uses reserved attribute name` {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestAddTooManyAttributes(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "too-many-attributes"})
+	defer q.Close()
+
+	msg := msgqueue.NewMessage()
+	msg.Priority = 1
+	msg.Header = make(map[string]string)
+	for i := 0; i < maxMessageAttributes; i++ {
+		msg.Header[strconv.Itoa(i)] = "v"
+	}
+	err := q.Add(msg)
+	want := "azsqs: message has 11 attributes (10 header keys), SQS allows at most 10"
+	if err == nil || err.Error() != want {
+		t.Fatalf("got %v, wanted %q", err, want)
+	}
+}
+
+func TestMessageHeaderSkipsReservedAttributes(t *testing.T) {
+	msg := &msgqueue.Message{
+		Header:   map[string]string{"priority": "user value"},
+		Priority: 5,
+	}
+	attrs, _ := messageAttributes(msg)
+
+	header := messageHeader(attrs)
+	if len(header) != 1 || header["priority"] != "user value" {
+		t.Fatalf("got header %v", header)
+	}
+	if v := attrs[priorityAttr]; v == nil || *v.StringValue != "5" {
+		t.Fatalf("got priority attribute %v", v)
+	}
+}
+
+func TestAddBatchSplitsBySize(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "batch-size"})
+	defer q.Close()
+
+	var batches [][]*msgqueue.Message
+	q.memqueue.Close()
+	q.memqueue = memqueue.NewQueue(&msgqueue.Options{
+		Name: "batch-size-producer",
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			batches = append(batches, msg.Args[0].([]*msgqueue.Message))
+			return nil
+		}),
+		Sync: true,
+	})
+
+	msgs := make([]*msgqueue.Message, 5)
+	for i := range msgs {
+		msgs[i] = msgqueue.NewMessage()
+		msgs[i].Body = strings.Repeat("x", 100*1024)
+		msgs[i].Header = map[string]string{"tenant": "acme"}
+	}
+	if err := q.AddBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 3 {
+		t.Fatalf("got %d batches, wanted 3", len(batches))
+	}
+	for _, batch := range batches {
+		var size int
+		for _, msg := range batch {
+			size += q.sendSize(msg)
+		}
+		if size > maxBatchSize {
+			t.Fatalf("batch of %d messages has %d bytes", len(batch), size)
+		}
+	}
+}
+
+func TestAddTooLargeWithAttributes(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "too-large-attributes"})
+	defer q.Close()
+
+	msg := msgqueue.NewMessage()
+	msg.Body = strings.Repeat("x", maxMessageSize-10)
+	msg.Header = map[string]string{"tenant": strings.Repeat("a", 100)}
+	if err := q.Add(msg); err != msgqueue.ErrTooLarge {
+		t.Fatalf("got %v, wanted ErrTooLarge", err)
+	}
+}
+
+func TestOffloadAtThresholdWithAttributes(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "offload-attributes"})
+	defer q.Close()
+	q.SetS3Options(&S3Options{Bucket: "payloads"})
+
+	msg := msgqueue.NewMessage()
+	msg.Body = strings.Repeat("x", q.s3opt.Threshold)
+	msg.Header = map[string]string{"tenant": "acme"}
+	if !q.shouldOffload(msg) {
+		t.Fatalf("message with %d bytes is not offloaded", inlineSize(msg))
+	}
+	if size := q.sendSize(msg); size > maxMessageSize {
+		t.Fatalf("got send size %d, wanted at most %d", size, maxMessageSize)
+	}
+
+	msg.Header = nil
+	if q.shouldOffload(msg) {
+		t.Fatalf("message without attributes at threshold is offloaded")
+	}
+}
+
+func TestAddDoesNotModifyMessage(t *testing.T) {
+	q := NewQueue(nil, "", &msgqueue.Options{Name: "add-copy"})
+	defer q.Close()
+
+	var added *msgqueue.Message
+	q.memqueue.Close()
+	q.memqueue = memqueue.NewQueue(&msgqueue.Options{
+		Name: "add-copy-producer",
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			added = msg.Args[0].(*msgqueue.Message)
+			return nil
+		}),
+		Sync: true,
+	})
+
+	msg := msgqueue.NewMessage("hello")
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body != "" {
+		t.Fatalf("got Body %q, wanted caller's message unchanged", msg.Body)
+	}
+	if added == nil || added.Body == "" {
+		t.Fatalf("added message has no encoded Body")
+	}
+
+	// Changed args are encoded again.
+	msg.Args = []interface{}{"world"}
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body != "" {
+		t.Fatalf("got Body %q, wanted caller's message unchanged", msg.Body)
+	}
+}
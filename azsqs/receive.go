@@ -0,0 +1,82 @@
+package azsqs
+
+import (
+	"time"
+)
+
+// SQS limits of ReceiveMessage.
+const (
+	maxWaitTime            = 20 * time.Second
+	maxNumberOfMessagesMax = 10
+)
+
+// ReceiveOptions configures how messages are received from SQS.
+// See Queue.SetReceiveOptions.
+type ReceiveOptions struct {
+	// Long polling duration of ReceiveMessage. Longer duration
+	// reduces the number of empty receives. Default is 1 second.
+	// Max is 20 seconds.
+	WaitTime time.Duration
+	// Max number of messages received by ReceiveMessage.
+	// It is also limited by Options.BufferSize. Default and max is 10.
+	MaxNumberOfMessages int
+
+	// Optional max duration ReserveN waits after empty receives before
+	// next ReceiveMessage, so idle queues make fewer requests. Wait
+	// starts with MinIdleBackoff and doubles after every empty receive.
+	// It is reset when messages are received.
+	MaxIdleBackoff time.Duration
+	// Default is 1 second.
+	MinIdleBackoff time.Duration
+}
+
+func (opt *ReceiveOptions) init() {
+	if opt.WaitTime <= 0 {
+		opt.WaitTime = time.Second
+	}
+	if opt.WaitTime > maxWaitTime {
+		opt.WaitTime = maxWaitTime
+	}
+	if opt.MaxNumberOfMessages <= 0 || opt.MaxNumberOfMessages > maxNumberOfMessagesMax {
+		opt.MaxNumberOfMessages = maxNumberOfMessagesMax
+	}
+	if opt.MaxIdleBackoff > 0 && opt.MinIdleBackoff <= 0 {
+		opt.MinIdleBackoff = time.Second
+	}
+	if opt.MinIdleBackoff > opt.MaxIdleBackoff {
+		opt.MinIdleBackoff = opt.MaxIdleBackoff
+	}
+}
+
+// SetReceiveOptions configures ReceiveMessage requests used by ReserveN.
+// It must be called before the queue is processed.
+func (q *Queue) SetReceiveOptions(opt *ReceiveOptions) {
+	opt.init()
+	q.ropt = opt
+}
+
+// idleBackoff returns duration to wait after the receive. It is called
+// with the number of received messages.
+func (q *Queue) idleBackoff(received int) time.Duration {
+	if q.ropt.MaxIdleBackoff <= 0 {
+		return 0
+	}
+
+	q.idleMu.Lock()
+	defer q.idleMu.Unlock()
+
+	if received > 0 {
+		q.emptyReceives = 0
+		return 0
+	}
+
+	backoff := q.ropt.MinIdleBackoff
+	for i := 0; i < q.emptyReceives && backoff < q.ropt.MaxIdleBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.ropt.MaxIdleBackoff {
+		backoff = q.ropt.MaxIdleBackoff
+	}
+	q.emptyReceives++
+	return backoff
+}
@@ -0,0 +1,42 @@
+package azsqs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleBackoff(t *testing.T) {
+	ropt := &ReceiveOptions{
+		MaxIdleBackoff: 5 * time.Second,
+	}
+	ropt.init()
+	q := &Queue{ropt: ropt}
+
+	for i, wanted := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		if got := q.idleBackoff(0); got != wanted {
+			t.Fatalf("empty receive #%d: got %s, wanted %s", i+1, got, wanted)
+		}
+	}
+
+	if got := q.idleBackoff(3); got != 0 {
+		t.Fatalf("got %s after messages are received, wanted 0", got)
+	}
+	if got := q.idleBackoff(0); got != time.Second {
+		t.Fatalf("got %s after reset, wanted 1s", got)
+	}
+}
+
+func TestIdleBackoffDisabled(t *testing.T) {
+	ropt := new(ReceiveOptions)
+	ropt.init()
+	q := &Queue{ropt: ropt}
+
+	if got := q.idleBackoff(0); got != 0 {
+		t.Fatalf("got %s, wanted 0", got)
+	}
+	if ropt.WaitTime != time.Second || ropt.MaxNumberOfMessages != 10 {
+		t.Fatalf("got WaitTime=%s MaxNumberOfMessages=%d", ropt.WaitTime, ropt.MaxNumberOfMessages)
+	}
+}
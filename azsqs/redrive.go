@@ -0,0 +1,156 @@
+package azsqs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Long polling duration used by Redrive. Redrive stops
+// when no messages are received during the wait.
+const redriveWaitTime = time.Second
+
+// Redrive moves messages from the dead letter queue, e.g. the one
+// configured by SQS redrive policy of the target, back to the target
+// queue. Messages are moved as is with message attributes and S3
+// payload pointers using batched SQS requests, and are deleted from
+// dlq only after they are sent. Messages that were dead-lettered by
+// Processor with opt.Unwrap set are moved using processor.Redrive.
+// It returns the number of moved messages.
+func Redrive(dlq, target *Queue, opt *processor.RedriveOptions) (int, error) {
+	if opt == nil {
+		opt = new(processor.RedriveOptions)
+	}
+	if opt.Unwrap {
+		return processor.Redrive(dlq, target, opt)
+	}
+	opt.Init()
+	limiter := opt.Limiter()
+
+	batchSize := opt.BatchSize
+	if batchSize > maxNumberOfMessagesMax {
+		batchSize = maxNumberOfMessagesMax
+	}
+
+	var moved int
+	for opt.MaxMessages == 0 || moved < opt.MaxMessages {
+		n := batchSize
+		if opt.MaxMessages > 0 && opt.MaxMessages-moved < n {
+			n = opt.MaxMessages - moved
+		}
+
+		dlq.fopt.WaitAPI()
+		out, err := dlq.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(dlq.queueURL()),
+			MaxNumberOfMessages:   aws.Int64(int64(n)),
+			WaitTimeSeconds:       aws.Int64(int64(redriveWaitTime / time.Second)),
+			MessageAttributeNames: []*string{aws.String("All")},
+		})
+		if err != nil {
+			return moved, err
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+
+		if err := limiter.WaitN(context.Background(), len(out.Messages)); err != nil {
+			return moved, err
+		}
+
+		sent, err := target.sendVerbatim(out.Messages)
+		if len(sent) > 0 {
+			if err := dlq.deleteVerbatim(sent); err != nil {
+				return moved, err
+			}
+			moved += len(sent)
+		}
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// sendVerbatim sends received SQS messages to the queue and returns
+// messages that were sent. Attributes that are specific to the previous
+// processing of the message are not sent, so it is processed anew.
+func (q *Queue) sendVerbatim(msgs []*sqs.Message) ([]*sqs.Message, error) {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(msgs))
+	for i, msg := range msgs {
+		attrs := make(map[string]*sqs.MessageAttributeValue, len(msg.MessageAttributes))
+		for k, v := range msg.MessageAttributes {
+			if k == delayAttr || k == reservedCountAttr {
+				continue
+			}
+			attrs[k] = v
+		}
+		entries[i] = &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       msg.Body,
+			MessageAttributes: attrs,
+		}
+	}
+
+	q.fopt.WaitAPI()
+	out, err := q.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(q.queueURL()),
+		Entries:  entries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sent := make([]*sqs.Message, 0, len(out.Successful))
+	for _, entry := range out.Successful {
+		i, err := strconv.Atoi(*entry.Id)
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, msgs[i])
+	}
+
+	if len(out.Failed) > 0 {
+		entry := out.Failed[0]
+		return sent, fmt.Errorf(
+			"azsqs: SendMessageBatch failed for %d messages: %s (%s)",
+			len(out.Failed), *entry.Message, *entry.Code,
+		)
+	}
+	return sent, nil
+}
+
+// deleteVerbatim deletes received SQS messages. S3 objects are kept,
+// because the messages that point to them were sent to another queue.
+func (q *Queue) deleteVerbatim(msgs []*sqs.Message) error {
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: msg.ReceiptHandle,
+		}
+	}
+
+	q.fopt.WaitAPI()
+	out, err := q.sqs.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(q.queueURL()),
+		Entries:  entries,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(out.Failed) > 0 {
+		entry := out.Failed[0]
+		return fmt.Errorf(
+			"azsqs: DeleteMessageBatch failed for %d messages: %s (%s)",
+			len(out.Failed), *entry.Message, *entry.Code,
+		)
+	}
+	return nil
+}
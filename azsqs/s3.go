@@ -0,0 +1,201 @@
+package azsqs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-msgqueue/msgqueue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Message attribute that marks messages which body is stored in S3.
+// The attribute and the pointer format are the same as used by
+// Amazon SQS Extended Client Library, so messages can be exchanged
+// with apps that use it.
+const payloadSizeAttr = "ExtendedPayloadSize"
+
+const payloadPointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+// Maximum size of message body stored in S3.
+const maxS3MessageSize = 1<<31 - 1
+
+// Markers that embed S3 pointer into the reservation id, so the object
+// is deleted with the message.
+const (
+	bucketMarker = "-..s3BucketName..-"
+	keyMarker    = "-..s3Key..-"
+)
+
+// S3Options configures claim-check offloading of large message
+// bodies to S3. See Queue.SetS3Options.
+type S3Options struct {
+	S3     *s3.S3
+	Bucket string
+	// Optional prefix of object keys.
+	Prefix string
+
+	// Message bodies larger than the threshold are stored in S3.
+	// Default and max is SQS max message size, i.e. 256KB.
+	Threshold int
+	// Store all message bodies in S3 regardless of the threshold.
+	AlwaysOffload bool
+}
+
+func (opt *S3Options) init() {
+	if opt.Threshold <= 0 || opt.Threshold > maxMessageSize {
+		opt.Threshold = maxMessageSize
+	}
+}
+
+// SetS3Options enables storing message bodies that exceed the threshold
+// in S3 bucket. SQS message contains only pointer to the object, which
+// is fetched when the message is reserved and deleted when the message
+// is deleted. It must be called before the queue is used.
+func (q *Queue) SetS3Options(opt *S3Options) {
+	opt.init()
+	q.s3opt = opt
+}
+
+func (q *Queue) maxMessageSize() int {
+	if q.s3opt != nil {
+		return maxS3MessageSize
+	}
+	return maxMessageSize
+}
+
+// shouldOffload reports whether message body is stored in S3. Bodies
+// below the threshold are offloaded too when the body with attributes
+// exceeds SQS message size limit.
+func (q *Queue) shouldOffload(msg *msgqueue.Message) bool {
+	if q.s3opt == nil {
+		return false
+	}
+	return q.s3opt.AlwaysOffload ||
+		len(msg.Body) > q.s3opt.Threshold ||
+		inlineSize(msg) > maxMessageSize
+}
+
+type payloadPointer struct {
+	Bucket string `json:"s3BucketName"`
+	Key    string `json:"s3Key"`
+}
+
+// offload stores message body in S3 and returns SQS message body
+// with the pointer to the object.
+func (q *Queue) offload(msg *msgqueue.Message) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ptr := payloadPointer{
+		Bucket: q.s3opt.Bucket,
+		Key:    q.s3opt.Prefix + hex.EncodeToString(b),
+	}
+
+	_, err := q.s3opt.S3.PutObject(&s3.PutObjectInput{
+		Bucket:        aws.String(ptr.Bucket),
+		Key:           aws.String(ptr.Key),
+		Body:          bytes.NewReader([]byte(msg.Body)),
+		ContentLength: aws.Int64(int64(len(msg.Body))),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal([]interface{}{payloadPointerClass, ptr})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// fetch replaces pointer in the message body with the object contents
+// and embeds the pointer into the reservation id.
+func (q *Queue) fetch(msg *msgqueue.Message) error {
+	if q.s3opt == nil {
+		return fmt.Errorf("azsqs: %s received message stored in S3, but S3 is not configured", q)
+	}
+
+	ptr, err := parsePayloadPointer(msg.Body)
+	if err != nil {
+		return err
+	}
+
+	out, err := q.s3opt.S3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(ptr.Bucket),
+		Key:    aws.String(ptr.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	body, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return err
+	}
+
+	msg.Body = string(body)
+	msg.ReservationId = bucketMarker + ptr.Bucket + bucketMarker +
+		keyMarker + ptr.Key + keyMarker + msg.ReservationId
+	return nil
+}
+
+func parsePayloadPointer(body string) (*payloadPointer, error) {
+	var v []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return nil, err
+	}
+	if len(v) != 2 {
+		return nil, fmt.Errorf("azsqs: invalid S3 payload pointer: %.100q", body)
+	}
+	var ptr payloadPointer
+	if err := json.Unmarshal(v[1], &ptr); err != nil {
+		return nil, err
+	}
+	return &ptr, nil
+}
+
+// receiptHandle returns SQS receipt handle of the message
+// stripping S3 pointer from the reservation id.
+func receiptHandle(msg *msgqueue.Message) *string {
+	_, receipt := splitReservationId(msg.ReservationId)
+	return &receipt
+}
+
+func splitReservationId(id string) (*payloadPointer, string) {
+	if !strings.HasPrefix(id, bucketMarker) {
+		return nil, id
+	}
+	parts := strings.SplitN(id[len(bucketMarker):], bucketMarker, 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], keyMarker) {
+		return nil, id
+	}
+	bucket := parts[0]
+
+	parts = strings.SplitN(parts[1][len(keyMarker):], keyMarker, 2)
+	if len(parts) != 2 {
+		return nil, id
+	}
+	return &payloadPointer{Bucket: bucket, Key: parts[0]}, parts[1]
+}
+
+// deleteObject deletes S3 object of the message, if any.
+func (q *Queue) deleteObject(msg *msgqueue.Message) error {
+	ptr, _ := splitReservationId(msg.ReservationId)
+	if ptr == nil || q.s3opt == nil {
+		return nil
+	}
+	_, err := q.s3opt.S3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(ptr.Bucket),
+		Key:    aws.String(ptr.Key),
+	})
+	return err
+}
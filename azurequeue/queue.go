@@ -0,0 +1,436 @@
+package azurequeue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+)
+
+// Azure Storage Queue message size limit is 64KB and message
+// text is base64 encoded, so encoded message body can be up to 48KB.
+const (
+	maxTextSize    = 64 * 1024
+	maxMessageSize = maxTextSize / 4 * 3
+)
+
+// Maximum visibility timeout supported by Azure Storage Queues.
+const maxDelay = 7 * 24 * time.Hour
+
+// Maximum number of messages that can be dequeued at once.
+const maxDequeue = 32
+
+// Azure Storage Queues don't support long polling,
+// so ReserveN waits before returning no messages.
+const pollInterval = time.Second
+
+type Queue struct {
+	q        *azqueue.QueueClient
+	opt      *msgqueue.Options
+	producer *producer.Producer
+
+	// Text of reserved messages indexed by message id, because
+	// visibility timeout can only be updated together with the text.
+	reservedMu sync.Mutex
+	reserved   map[string]string
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that uses Azure Storage Queue with name
+// opt.Name. Queue names may contain only lowercase letters, numbers,
+// and hyphens. The queue is created when it does not exist.
+func NewQueue(client *azqueue.ServiceClient, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		q:        client.NewQueueClient(opt.Name),
+		opt:      opt,
+		reserved: make(map[string]string),
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(client *azqueue.ServiceClient, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(client, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "azurequeue",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxDelay,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// Len returns approximate number of messages in the queue.
+func (q *Queue) Len() (int, error) {
+	props, err := q.q.GetProperties(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if props.ApproximateMessagesCount == nil {
+		return 0, nil
+	}
+	return int(*props.ApproximateMessagesCount), nil
+}
+
+// Ping checks that the queue is reachable by requesting queue properties.
+func (q *Queue) Ping() error {
+	_, err := q.q.GetProperties(context.Background(), nil)
+	return err
+}
+
+func (q *Queue) createQueue() error {
+	_, err := q.q.Create(context.Background(), nil)
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.enqueue(msg)
+}
+
+// addBatch enqueues messages one by one, because
+// Azure Storage Queues don't support batched enqueue.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		if err := q.enqueue(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) enqueue(msg *msgqueue.Message) error {
+	text, err := encodeText(msg)
+	if err != nil {
+		return err
+	}
+	if len(text) > maxTextSize {
+		return msgqueue.ErrTooLarge
+	}
+
+	// Messages never expire, because they are deleted by the processor.
+	ttl := int32(-1)
+	visibility := int32(msg.ScheduledDelay() / time.Second)
+	if visibility > int32(maxDelay/time.Second) {
+		visibility = int32(maxDelay / time.Second)
+	}
+
+	resp, err := q.q.EnqueueMessage(context.Background(), text, &azqueue.EnqueueMessageOptions{
+		TimeToLive:        &ttl,
+		VisibilityTimeout: &visibility,
+	})
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			_ = q.createQueue()
+		}
+		return err
+	}
+
+	if len(resp.Messages) > 0 && resp.Messages[0].MessageID != nil {
+		msg.Id = *resp.Messages[0].MessageID
+	}
+	return nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds Azure Storage Queue message size limit.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN dequeues up to n messages making them invisible
+// for ReservationTimeout.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	if n > maxDequeue {
+		n = maxDequeue
+	}
+	num := int32(n)
+	visibility := int32(q.opt.ReservationTimeout / time.Second)
+
+	resp, err := q.q.DequeueMessages(context.Background(), &azqueue.DequeueMessagesOptions{
+		NumberOfMessages:  &num,
+		VisibilityTimeout: &visibility,
+	})
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			_ = q.createQueue()
+		}
+		return nil, err
+	}
+	if len(resp.Messages) == 0 {
+		time.Sleep(pollInterval)
+		return nil, nil
+	}
+
+	msgs := make([]msgqueue.Message, 0, len(resp.Messages))
+	for _, azMsg := range resp.Messages {
+		if azMsg.MessageID == nil || azMsg.PopReceipt == nil || azMsg.MessageText == nil {
+			continue
+		}
+
+		env, err := decodeText(*azMsg.MessageText)
+		if err != nil {
+			return nil, err
+		}
+
+		q.reservedMu.Lock()
+		q.reserved[*azMsg.MessageID] = *azMsg.MessageText
+		q.reservedMu.Unlock()
+
+		msg := msgqueue.Message{
+			Id:         *azMsg.MessageID,
+			Body:       env.Body,
+			Header:     env.Header,
+			Priority:   env.Priority,
+			RetryLimit: env.RetryLimit,
+			GroupKey:   env.GroupKey,
+			Barrier:    env.Barrier,
+
+			ReservationId: *azMsg.PopReceipt,
+		}
+		if azMsg.DequeueCount != nil {
+			msg.ReservedCount = int(*azMsg.DequeueCount)
+		}
+		if azMsg.InsertionTime != nil {
+			msg.CreatedAt = *azMsg.InsertionTime
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// updateVisibility makes the message visible after the duration.
+// Azure issues new pop receipt that is stored in the message.
+func (q *Queue) updateVisibility(msg *msgqueue.Message, dur time.Duration) error {
+	q.reservedMu.Lock()
+	text, ok := q.reserved[msg.Id]
+	q.reservedMu.Unlock()
+	if !ok {
+		return fmt.Errorf("queue: %s is not reserved", msg)
+	}
+
+	if dur > maxDelay {
+		dur = maxDelay
+	}
+	visibility := int32(dur / time.Second)
+
+	resp, err := q.q.UpdateMessage(
+		context.Background(), msg.Id, msg.ReservationId, text,
+		&azqueue.UpdateMessageOptions{
+			VisibilityTimeout: &visibility,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if resp.PopReceipt != nil {
+		msg.ReservationId = *resp.PopReceipt
+	}
+	return nil
+}
+
+// Release makes the message visible after the delay.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	err := q.updateVisibility(msg, delay)
+	q.unreserve(msg)
+	return err
+}
+
+// Touch makes the message invisible for the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	return q.updateVisibility(msg, dur)
+}
+
+func (q *Queue) unreserve(msg *msgqueue.Message) {
+	q.reservedMu.Lock()
+	delete(q.reserved, msg.Id)
+	q.reservedMu.Unlock()
+}
+
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	q.unreserve(msg)
+	_, err := q.q.DeleteMessage(context.Background(), msg.Id, msg.ReservationId, nil)
+	if err != nil && isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeleteBatch deletes the messages one by one, because
+// Azure Storage Queues don't support batched delete.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	var firstErr error
+	for _, msg := range msgs {
+		if err := q.Delete(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (q *Queue) Purge() error {
+	_, err := q.q.ClearMessages(context.Background(), nil)
+	return err
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func isStatus(err error, code int) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == code
+}
+
+// Azure Storage Queue messages don't have attributes so message with
+// headers, priority, retry limit, group key, or barrier flag is prefixed
+// with JSON envelope on a separate line. Message text must be valid XML,
+// so it is base64 encoded.
+type envelope struct {
+	Header     map[string]string `json:"header"`
+	Priority   int               `json:"priority,omitempty"`
+	RetryLimit int               `json:"retry_limit,omitempty"`
+	GroupKey   string            `json:"group_key,omitempty"`
+	Barrier    bool              `json:"barrier,omitempty"`
+	Body       string            `json:"-"`
+}
+
+const envelopePrefix = `{"header":`
+
+func encodeText(msg *msgqueue.Message) (string, error) {
+	if len(msg.Header) == 0 && msg.Priority == 0 && msg.RetryLimit == 0 &&
+		msg.GroupKey == "" && !msg.Barrier && !strings.HasPrefix(msg.Body, envelopePrefix) {
+		return base64.StdEncoding.EncodeToString([]byte(msg.Body)), nil
+	}
+	b, err := json.Marshal(envelope{
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+	})
+	if err != nil {
+		return "", err
+	}
+	b = append(b, '\n')
+	b = append(b, msg.Body...)
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decodeText(text string) (*envelope, error) {
+	b, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	if !strings.HasPrefix(s, envelopePrefix) {
+		return &envelope{Body: s}, nil
+	}
+
+	i := strings.IndexByte(s, '\n')
+	if i == -1 {
+		return &envelope{Body: s}, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(b[:i], &env); err != nil {
+		return nil, err
+	}
+	env.Body = s[i+1:]
+	return &env, nil
+}
@@ -0,0 +1,502 @@
+package beanstalkd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	"github.com/beanstalkd/go-beanstalk"
+)
+
+// Default max-job-size of beanstalkd.
+const maxMessageSize = 65535
+
+// Maximum job delay supported by beanstalkd.
+const maxDelay = math.MaxUint32 * time.Second
+
+// Beanstalkd priority of messages with zero priority. Jobs with lower
+// priority value are reserved first, so message priority is subtracted.
+const defaultPriority = 1 << 16
+
+// Jobs are reserved without waiting, so other commands are not blocked
+// behind reserve. ReserveN waits before returning no messages.
+const pollInterval = 100 * time.Millisecond
+
+type Queue struct {
+	addr string
+	opt  *msgqueue.Options
+
+	producer *producer.Producer
+
+	// Beanstalkd jobs can only be released, touched, and deleted using
+	// the connection that reserved them, so all commands share one
+	// connection.
+	mu    sync.Mutex
+	conn  *beanstalk.Conn
+	tube  *beanstalk.Tube
+	tubes *beanstalk.TubeSet
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Reconnecter = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that uses beanstalkd tube opt.Name
+// on the server with the address, e.g. "localhost:11300".
+func NewQueue(addr string, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		addr: addr,
+		opt:  opt,
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(addr string, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(addr, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "beanstalkd",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxDelay,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// connect dials the server if the queue is not connected.
+// It is called with q.mu held.
+func (q *Queue) connect() error {
+	if q.conn != nil {
+		return nil
+	}
+	conn, err := beanstalk.Dial("tcp", q.addr)
+	if err != nil {
+		return err
+	}
+	q.conn = conn
+	q.tube = beanstalk.NewTube(conn, q.Name())
+	q.tubes = beanstalk.NewTubeSet(conn, q.Name())
+	return nil
+}
+
+// do calls fn with the connection dialing it if needed.
+func (q *Queue) do(fn func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.connect(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// Reconnect closes the connection, so it is dialed again on next
+// command. Jobs reserved by the connection are released by the server.
+func (q *Queue) Reconnect() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.conn == nil {
+		return nil
+	}
+	err := q.conn.Close()
+	q.conn = nil
+	q.tube = nil
+	q.tubes = nil
+	return err
+}
+
+// Len returns the number of ready jobs in the tube.
+func (q *Queue) Len() (int, error) {
+	var stats map[string]string
+	err := q.do(func() error {
+		var err error
+		stats, err = q.tube.Stats()
+		return err
+	})
+	if err != nil {
+		if isErr(err, beanstalk.ErrNotFound) {
+			// Tube does not exist until a job is put.
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(stats["current-jobs-ready"])
+}
+
+// Ping checks that the server is reachable by requesting tube stats.
+func (q *Queue) Ping() error {
+	_, err := q.Len()
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.put(msg)
+}
+
+// addBatch puts jobs one by one, because
+// beanstalkd does not support batched puts.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		if err := q.put(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) put(msg *msgqueue.Message) error {
+	body, err := encodeBody(msg)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxMessageSize {
+		return msgqueue.ErrTooLarge
+	}
+
+	delay := msg.ScheduledDelay()
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	var id uint64
+	err = q.do(func() error {
+		var err error
+		id, err = q.tube.Put(body, jobPriority(msg.Priority), delay, q.ttr())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Id = strconv.FormatUint(id, 10)
+	return nil
+}
+
+// ttr returns job time-to-run, i.e. reservation timeout.
+func (q *Queue) ttr() time.Duration {
+	return q.opt.ReservationTimeout
+}
+
+func jobPriority(priority int) uint32 {
+	pri := defaultPriority - priority
+	if pri < 0 {
+		return 0
+	}
+	return uint32(pri)
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds beanstalkd max job size.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN reserves up to n ready jobs. Number of reserves of every
+// job is requested using job stats.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	var msgs []msgqueue.Message
+	err := q.do(func() error {
+		for len(msgs) < n {
+			id, body, err := q.tubes.Reserve(0)
+			if err != nil {
+				if isErr(err, beanstalk.ErrTimeout) {
+					return nil
+				}
+				return err
+			}
+
+			stats, err := q.conn.StatsJob(id)
+			if err != nil {
+				return err
+			}
+
+			msg, err := newMessage(id, body, stats)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, *msg)
+		}
+		return nil
+	})
+	if err != nil {
+		// Jobs that are already reserved are returned,
+		// so they are released after processing.
+		if len(msgs) > 0 {
+			return msgs, nil
+		}
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		time.Sleep(pollInterval)
+	}
+	return msgs, nil
+}
+
+func newMessage(id uint64, body []byte, stats map[string]string) (*msgqueue.Message, error) {
+	env, err := decodeBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	reserves, _ := strconv.Atoi(stats["reserves"])
+	age, _ := strconv.Atoi(stats["age"])
+
+	jobId := strconv.FormatUint(id, 10)
+	return &msgqueue.Message{
+		Id:         jobId,
+		Body:       env.Body,
+		Header:     env.Header,
+		Priority:   env.Priority,
+		RetryLimit: env.RetryLimit,
+		GroupKey:   env.GroupKey,
+		Barrier:    env.Barrier,
+		CreatedAt:  time.Now().Add(-time.Duration(age) * time.Second),
+
+		ReservationId: jobId,
+		ReservedCount: reserves,
+	}, nil
+}
+
+func parseJobId(msg *msgqueue.Message) (uint64, error) {
+	return strconv.ParseUint(msg.Id, 10, 64)
+}
+
+// Release releases the job with the delay keeping its priority.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	id, err := parseJobId(msg)
+	if err != nil {
+		return err
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return q.do(func() error {
+		return q.conn.Release(id, jobPriority(msg.Priority), delay)
+	})
+}
+
+// Touch resets the job time-to-run. Beanstalkd always extends
+// the reservation by ReservationTimeout regardless of the duration.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	id, err := parseJobId(msg)
+	if err != nil {
+		return err
+	}
+	return q.do(func() error {
+		return q.conn.Touch(id)
+	})
+}
+
+// Delete deletes the job. Jobs that are already deleted are ignored.
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	id, err := parseJobId(msg)
+	if err != nil {
+		return err
+	}
+	err = q.do(func() error {
+		return q.conn.Delete(id)
+	})
+	if err != nil && isErr(err, beanstalk.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// DeleteBatch deletes the jobs one by one, because
+// beanstalkd does not support batched deletes.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	var firstErr error
+	for _, msg := range msgs {
+		if err := q.Delete(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Purge deletes ready, delayed, and buried jobs of the tube.
+// Reserved jobs are not deleted.
+func (q *Queue) Purge() error {
+	return q.do(func() error {
+		for _, peek := range []func() (uint64, []byte, error){
+			q.tube.PeekReady, q.tube.PeekDelayed, q.tube.PeekBuried,
+		} {
+			for {
+				id, _, err := peek()
+				if err != nil {
+					if isErr(err, beanstalk.ErrNotFound) {
+						break
+					}
+					return err
+				}
+				err = q.conn.Delete(id)
+				if err != nil && !isErr(err, beanstalk.ErrNotFound) {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+// The connection is closed after the processor is stopped.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := q.Reconnect(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func isErr(err, target error) bool {
+	var connErr beanstalk.ConnError
+	if errors.As(err, &connErr) {
+		return connErr.Err == target
+	}
+	return err == target
+}
+
+// Beanstalkd jobs don't have attributes so message with headers,
+// priority, retry limit, group key, or barrier flag is prefixed
+// with JSON envelope on a separate line.
+type envelope struct {
+	Header     map[string]string `json:"header"`
+	Priority   int               `json:"priority,omitempty"`
+	RetryLimit int               `json:"retry_limit,omitempty"`
+	GroupKey   string            `json:"group_key,omitempty"`
+	Barrier    bool              `json:"barrier,omitempty"`
+	Body       string            `json:"-"`
+}
+
+const envelopePrefix = `{"header":`
+
+func encodeBody(msg *msgqueue.Message) ([]byte, error) {
+	if len(msg.Header) == 0 && msg.Priority == 0 && msg.RetryLimit == 0 &&
+		msg.GroupKey == "" && !msg.Barrier && !strings.HasPrefix(msg.Body, envelopePrefix) {
+		return []byte(msg.Body), nil
+	}
+	b, err := json.Marshal(envelope{
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	b = append(b, msg.Body...)
+	return b, nil
+}
+
+func decodeBody(b []byte) (*envelope, error) {
+	s := string(b)
+	if !strings.HasPrefix(s, envelopePrefix) {
+		return &envelope{Body: s}, nil
+	}
+
+	i := strings.IndexByte(s, '\n')
+	if i == -1 {
+		return &envelope{Body: s}, nil
+	}
+	var env envelope
+	if err := json.Unmarshal(b[:i], &env); err != nil {
+		return nil, err
+	}
+	env.Body = s[i+1:]
+	return &env, nil
+}
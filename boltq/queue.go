@@ -0,0 +1,576 @@
+package boltq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Every queue uses a top-level bucket with three sub-buckets:
+//   - messages maps message id to encoded message;
+//   - ready indexes messages that can be reserved by priority and id;
+//   - locked indexes delayed and reserved messages by locked until time and id.
+var (
+	messagesBucket = []byte("messages")
+	readyBucket    = []byte("ready")
+	lockedBucket   = []byte("locked")
+)
+
+// There is no way to wait for new messages, so
+// ReserveN waits before returning no messages.
+const pollInterval = 100 * time.Millisecond
+
+var errNotReserved = errors.New("boltq: message is not reserved")
+
+type Queue struct {
+	db  *bolt.DB
+	opt *msgqueue.Options
+
+	bucket []byte
+
+	producer *producer.Producer
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that stores messages in the bucket
+// "msgqueue:<opt.Name>" of the bbolt database. Several queues can
+// share the database.
+func NewQueue(db *bolt.DB, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		db:     db,
+		opt:    opt,
+		bucket: []byte("msgqueue:" + opt.Name),
+	}
+
+	q.producer = producer.New(opt, q.add, nil)
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(db *bolt.DB, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(db, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:    q.Name(),
+		Backend: "bolt",
+		Options: q.opt,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// buckets holds sub-buckets of the queue within a transaction.
+type buckets struct {
+	messages *bolt.Bucket
+	ready    *bolt.Bucket
+	locked   *bolt.Bucket
+}
+
+// update calls fn in a read-write transaction creating queue buckets
+// if needed. Concurrent calls are coalesced into one transaction,
+// so fn may be called several times and must be idempotent.
+func (q *Queue) update(fn func(*buckets) error) error {
+	return q.db.Batch(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(q.bucket)
+		if err != nil {
+			return err
+		}
+		var b buckets
+		for _, sub := range []struct {
+			name   []byte
+			bucket **bolt.Bucket
+		}{
+			{messagesBucket, &b.messages},
+			{readyBucket, &b.ready},
+			{lockedBucket, &b.locked},
+		} {
+			*sub.bucket, err = root.CreateBucketIfNotExists(sub.name)
+			if err != nil {
+				return err
+			}
+		}
+		return fn(&b)
+	})
+}
+
+// view calls fn in a read-only transaction. fn is not called
+// if the queue buckets don't exist yet.
+func (q *Queue) view(fn func(*buckets) error) error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(q.bucket)
+		if root == nil {
+			return nil
+		}
+		return fn(&buckets{
+			messages: root.Bucket(messagesBucket),
+			ready:    root.Bucket(readyBucket),
+			locked:   root.Bucket(lockedBucket),
+		})
+	})
+}
+
+// Len returns the number of messages that are ready to be reserved.
+func (q *Queue) Len() (int, error) {
+	var n int
+	err := q.view(func(b *buckets) error {
+		n = b.ready.Stats().KeyN
+
+		now := timeKey(time.Now())
+		c := b.locked.Cursor()
+		for k, _ := c.First(); k != nil && string(k[:8]) <= string(now); k, _ = c.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Ping checks that the database is open.
+func (q *Queue) Ping() error {
+	return q.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.addBatch([]*msgqueue.Message{msg})
+}
+
+// addBatch stores messages in a single transaction.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	ids := make([]uint64, len(msgs))
+	err := q.update(func(b *buckets) error {
+		now := time.Now()
+		for i, msg := range msgs {
+			id, err := b.messages.NextSequence()
+			if err != nil {
+				return err
+			}
+			ids[i] = id
+
+			rec := &record{
+				Body:        msg.Body,
+				Header:      msg.Header,
+				Priority:    msg.Priority,
+				RetryLimit:  msg.RetryLimit,
+				GroupKey:    msg.GroupKey,
+				Barrier:     msg.Barrier,
+				CreatedAt:   now.UnixNano(),
+				LockedUntil: now.Add(msg.ScheduledDelay()).UnixNano(),
+			}
+			if err := putRecord(b, id, rec, msg.ScheduledDelay() > 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range msgs {
+		msg.Id = strconv.FormatUint(ids[i], 10)
+	}
+	return nil
+}
+
+// Add adds message to the queue.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue using transactions.
+// Named messages are added using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN moves messages which lock expired to the ready index and
+// locks up to n ready messages with highest priority for
+// ReservationTimeout. Locked messages become ready again when the
+// lock expires, including after the process is restarted.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	var msgs []msgqueue.Message
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		// Update is used instead of Batch, because Batch
+		// can call the function more than once.
+		root := tx.Bucket(q.bucket)
+		if root == nil {
+			return nil
+		}
+		b := &buckets{
+			messages: root.Bucket(messagesBucket),
+			ready:    root.Bucket(readyBucket),
+			locked:   root.Bucket(lockedBucket),
+		}
+
+		now := time.Now()
+		if err := unlockExpired(b, now); err != nil {
+			return err
+		}
+
+		reservationId := newReservationId()
+		lockedUntil := now.Add(q.opt.ReservationTimeout).UnixNano()
+
+		var keys [][]byte
+		c := b.ready.Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < n; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			id := binary.BigEndian.Uint64(k[8:])
+			rec, err := getRecord(b, id)
+			if err != nil {
+				return err
+			}
+			if err := b.ready.Delete(k); err != nil {
+				return err
+			}
+
+			rec.LockedUntil = lockedUntil
+			rec.ReservedCount++
+			rec.ReservationId = reservationId
+			if err := putRecord(b, id, rec, true); err != nil {
+				return err
+			}
+
+			msgs = append(msgs, rec.message(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		time.Sleep(pollInterval)
+	}
+	return msgs, nil
+}
+
+// unlockExpired moves messages which lock expired to the ready index.
+func unlockExpired(b *buckets, now time.Time) error {
+	end := timeKey(now)
+
+	var keys [][]byte
+	c := b.locked.Cursor()
+	for k, _ := c.First(); k != nil && string(k[:8]) <= string(end); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for _, k := range keys {
+		id := binary.BigEndian.Uint64(k[8:])
+		rec, err := getRecord(b, id)
+		if err != nil {
+			return err
+		}
+		if err := b.locked.Delete(k); err != nil {
+			return err
+		}
+		if err := b.ready.Put(readyKey(rec.Priority, id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newReservationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func parseId(msg *msgqueue.Message) (uint64, error) {
+	return strconv.ParseUint(msg.Id, 10, 64)
+}
+
+// reserved returns the record of the reserved message. It returns
+// errNotReserved if the reservation expired and the message is
+// reserved again or deleted.
+func reserved(b *buckets, id uint64, msg *msgqueue.Message) (*record, error) {
+	if b.messages.Get(idKey(id)) == nil {
+		return nil, errNotReserved
+	}
+	rec, err := getRecord(b, id)
+	if err != nil {
+		return nil, err
+	}
+	if rec.ReservationId != msg.ReservationId {
+		return nil, errNotReserved
+	}
+	return rec, nil
+}
+
+// Release unlocks the message after the delay. The message is not
+// changed if its reservation expired and it is reserved again.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	return q.update(func(b *buckets) error {
+		rec, err := reserved(b, id, msg)
+		if err == errNotReserved {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := unindex(b, id, rec); err != nil {
+			return err
+		}
+
+		rec.LockedUntil = time.Now().Add(delay).UnixNano()
+		rec.ReservationId = ""
+		return putRecord(b, id, rec, delay > 0)
+	})
+}
+
+// Touch extends message lock to the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	return q.update(func(b *buckets) error {
+		rec, err := reserved(b, id, msg)
+		if err == errNotReserved {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := unindex(b, id, rec); err != nil {
+			return err
+		}
+
+		rec.LockedUntil = time.Now().Add(dur).UnixNano()
+		return putRecord(b, id, rec, true)
+	})
+}
+
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	return q.DeleteBatch([]*msgqueue.Message{msg})
+}
+
+// DeleteBatch deletes the messages in a single transaction. Messages which
+// reservation expired and that are reserved again are not deleted.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	return q.update(func(b *buckets) error {
+		for _, msg := range msgs {
+			id, err := parseId(msg)
+			if err != nil {
+				return err
+			}
+
+			rec, err := reserved(b, id, msg)
+			if err == errNotReserved {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := unindex(b, id, rec); err != nil {
+				return err
+			}
+			if err := b.messages.Delete(idKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Purge deletes all messages of the queue including reserved messages.
+func (q *Queue) Purge() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(q.bucket)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+// The database is not closed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// record is a message stored in the messages bucket.
+type record struct {
+	Body       string            `msgpack:"body"`
+	Header     map[string]string `msgpack:"header"`
+	Priority   int               `msgpack:"priority"`
+	RetryLimit int               `msgpack:"retry_limit"`
+	GroupKey   string            `msgpack:"group_key"`
+	Barrier    bool              `msgpack:"barrier"`
+	CreatedAt  int64             `msgpack:"created_at"`
+
+	LockedUntil   int64  `msgpack:"locked_until"`
+	ReservedCount int    `msgpack:"reserved_count"`
+	ReservationId string `msgpack:"reservation_id"`
+}
+
+func (rec *record) message(id uint64) msgqueue.Message {
+	return msgqueue.Message{
+		Id:         strconv.FormatUint(id, 10),
+		Body:       rec.Body,
+		Header:     rec.Header,
+		Priority:   rec.Priority,
+		RetryLimit: rec.RetryLimit,
+		GroupKey:   rec.GroupKey,
+		Barrier:    rec.Barrier,
+		CreatedAt:  time.Unix(0, rec.CreatedAt),
+
+		ReservationId: rec.ReservationId,
+		ReservedCount: rec.ReservedCount,
+	}
+}
+
+func getRecord(b *buckets, id uint64) (*record, error) {
+	var rec record
+	if err := msgpack.Unmarshal(b.messages.Get(idKey(id)), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// unindex removes the message from the locked and ready indexes.
+// Message which lock expired is in the ready index even if it was
+// not reserved again.
+func unindex(b *buckets, id uint64, rec *record) error {
+	if err := b.locked.Delete(lockedKey(rec.LockedUntil, id)); err != nil {
+		return err
+	}
+	return b.ready.Delete(readyKey(rec.Priority, id))
+}
+
+// putRecord stores the record and adds it to the locked or ready index.
+func putRecord(b *buckets, id uint64, rec *record, locked bool) error {
+	v, err := msgpack.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := b.messages.Put(idKey(id), v); err != nil {
+		return err
+	}
+	if locked {
+		return b.locked.Put(lockedKey(rec.LockedUntil, id), nil)
+	}
+	return b.ready.Put(readyKey(rec.Priority, id), nil)
+}
+
+func idKey(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+// readyKey sorts messages with higher priority first
+// and messages with same priority in insertion order.
+func readyKey(priority int, id uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(1<<63)-uint64(int64(priority)))
+	binary.BigEndian.PutUint64(b[8:], id)
+	return b
+}
+
+// lockedKey sorts messages by time when they become ready.
+func lockedKey(lockedUntil int64, id uint64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(lockedUntil))
+	binary.BigEndian.PutUint64(b[8:], id)
+	return b
+}
+
+func timeKey(tm time.Time) []byte {
+	return lockedKey(tm.UnixNano(), 0)[:8]
+}
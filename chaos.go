@@ -0,0 +1,83 @@
+package msgqueue
+
+import (
+	"fmt"
+	"time"
+)
+
+// ChaosOptions configure game day drills that inject controlled failures
+// into processing, so idempotency of handlers is validated continuously.
+// Drills must only be enabled in non-production environments.
+type ChaosOptions struct {
+	// Pause between drills. The first drill starts after
+	// Interval since the processor is started.
+	Interval time.Duration
+	// Duration of a drill.
+	Duration time.Duration
+
+	// Fraction of processed messages that are acknowledged after AckDelay.
+	// Messages are delivered again when AckDelay exceeds ReservationTimeout.
+	DelayAckRate float64
+	AckDelay     time.Duration
+	// Fraction of processed messages that are released instead of being
+	// deleted, so they are delivered again.
+	DuplicateRate float64
+	// Optional interval at which workers are restarted during a drill.
+	// Restarted workers finish processing current messages.
+	RestartInterval time.Duration
+
+	// Optional function called after every drill that checks processing
+	// invariants, e.g. that every order is charged once.
+	Check func() error
+	// Optional function called with the drill report. By default
+	// the report is logged.
+	OnReport func(*ChaosReport)
+}
+
+func (opt *ChaosOptions) validate() error {
+	if opt.Interval <= 0 {
+		return fmt.Errorf("queue: Chaos.Interval=%s is not positive", opt.Interval)
+	}
+	if opt.Duration <= 0 {
+		return fmt.Errorf("queue: Chaos.Duration=%s is not positive", opt.Duration)
+	}
+	if opt.DelayAckRate < 0 || opt.DelayAckRate > 1 {
+		return fmt.Errorf("queue: Chaos.DelayAckRate=%v is out of range", opt.DelayAckRate)
+	}
+	if opt.DuplicateRate < 0 || opt.DuplicateRate > 1 {
+		return fmt.Errorf("queue: Chaos.DuplicateRate=%v is out of range", opt.DuplicateRate)
+	}
+	if opt.AckDelay < 0 {
+		return fmt.Errorf("queue: Chaos.AckDelay=%s is negative", opt.AckDelay)
+	}
+	if opt.RestartInterval < 0 {
+		return fmt.Errorf("queue: Chaos.RestartInterval=%s is negative", opt.RestartInterval)
+	}
+	return nil
+}
+
+// ChaosReport describes failures injected during a drill
+// and whether processing invariants held.
+type ChaosReport struct {
+	Queue string
+	Start time.Time
+	End   time.Time
+
+	DelayedAcks int
+	Duplicates  int
+	Restarts    int
+
+	// Error returned by ChaosOptions.Check.
+	Err error
+}
+
+func (r *ChaosReport) String() string {
+	s := fmt.Sprintf(
+		"%s chaos drill: delayed_acks=%d duplicates=%d restarts=%d",
+		r.Queue, r.DelayedAcks, r.Duplicates, r.Restarts,
+	)
+	if r.Err != nil {
+		s += fmt.Sprintf(" check failed: %s", r.Err)
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package msgqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Checkpoints outlive retries of the message.
+const checkpointTTL = 7 * 24 * time.Hour
+
+var errNoCheckpoint = errors.New(
+	"queue: checkpoint requires Options.Redis that implements RedisCmdable and message with Id or Name")
+
+type checkpointKey struct{}
+
+type checkpoint struct {
+	redis RedisCmdable
+	key   string
+	saved uint32
+}
+
+// ContextWithCheckpoint returns a copy of ctx that stores checkpoints
+// of the message in Redis. Messages are identified by Id or by Name
+// when Id is not set, e.g. for memqueue. It is used by the processor.
+func ContextWithCheckpoint(ctx context.Context, opt *Options, msg *Message) context.Context {
+	cp := newCheckpoint(opt, msg)
+	if cp == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, checkpointKey{}, cp)
+}
+
+func newCheckpoint(opt *Options, msg *Message) *checkpoint {
+	id := msg.Id
+	if id == "" {
+		id = msg.Name
+	}
+	redis, ok := opt.Redis.(RedisCmdable)
+	if !ok || id == "" {
+		return nil
+	}
+	return &checkpoint{
+		redis: redis,
+		key:   fmt.Sprintf("checkpoint:%s:%s", opt.Name, id),
+	}
+}
+
+// SaveCheckpoint records progress of the long-running handler,
+// e.g. offset or cursor of the processed batch, so the handler
+// can resume from it using LoadCheckpoint when the message is
+// redelivered. The checkpoint is deleted when the message is
+// processed, fails without retries, or expires.
+func SaveCheckpoint(ctx context.Context, value string) error {
+	cp, ok := ctx.Value(checkpointKey{}).(*checkpoint)
+	if !ok {
+		return errNoCheckpoint
+	}
+	if err := cp.redis.Set(cp.key, value, checkpointTTL).Err(); err != nil {
+		return err
+	}
+	atomic.StoreUint32(&cp.saved, 1)
+	return nil
+}
+
+// LoadCheckpoint returns the checkpoint saved by SaveCheckpoint during
+// previous deliveries of the message or empty string if there is none.
+func LoadCheckpoint(ctx context.Context) (string, error) {
+	cp, ok := ctx.Value(checkpointKey{}).(*checkpoint)
+	if !ok {
+		return "", errNoCheckpoint
+	}
+	value, err := cp.redis.Get(cp.key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	atomic.StoreUint32(&cp.saved, 1)
+	return value, nil
+}
+
+// DeleteCheckpoint deletes the checkpoint of the message if it was
+// saved or loaded using ctx. It is used by the processor.
+func DeleteCheckpoint(ctx context.Context) error {
+	cp, ok := ctx.Value(checkpointKey{}).(*checkpoint)
+	if !ok || atomic.LoadUint32(&cp.saved) == 0 {
+		return nil
+	}
+	return cp.redis.Del(cp.key).Err()
+}
+
+// DeleteMessageCheckpoint deletes the checkpoint of the message saved
+// during any of its deliveries, e.g. when the message expires without
+// being processed. It is used by the processor.
+func DeleteMessageCheckpoint(opt *Options, msg *Message) error {
+	cp := newCheckpoint(opt, msg)
+	if cp == nil {
+		return nil
+	}
+	return cp.redis.Del(cp.key).Err()
+}
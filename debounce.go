@@ -0,0 +1,132 @@
+package msgqueue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Header that stores Redis key with the latest message args.
+const debounceKeyHeader = "debounce-key"
+
+// Latest args are kept long enough to survive queue backlogs.
+const debounceArgsTTL = 24 * time.Hour
+
+var errDebounceRedis = errors.New(
+	"queue: Debouncer requires Options.Redis that implements RedisCmdable")
+
+// Debouncer collapses messages with the same key added within the window
+// into a single message that is processed with the latest args.
+// State is kept in Redis so messages are collapsed across processes.
+//
+// Producers add messages using Debouncer.Add and consumers must wrap
+// queue handler using NewDebounceHandler.
+type Debouncer struct {
+	q      Queue
+	opt    *Options
+	window time.Duration
+}
+
+// NewDebouncer returns Debouncer that adds messages to the queue.
+// Redis and Codec are taken from the queue options.
+func NewDebouncer(q Queue, window time.Duration) *Debouncer {
+	opt := q.Options()
+	opt.Init()
+	return &Debouncer{
+		q:      q,
+		opt:    opt,
+		window: window,
+	}
+}
+
+func (d *Debouncer) lockKey(key string) string {
+	return fmt.Sprintf("debounce:%s:%s", d.q.Name(), key)
+}
+
+func (d *Debouncer) argsKey(key string) string {
+	return fmt.Sprintf("debounce:%s:%s:args", d.q.Name(), key)
+}
+
+// Add stores message args as the latest args for the key and adds
+// message to the queue if it is the first message in the window.
+func (d *Debouncer) Add(key string, msg *Message) error {
+	body := msg.Body
+	if body == "" {
+		var err error
+		body, err = msg.EncodeArgs(d.opt.Codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	redis, ok := d.opt.Redis.(RedisCmdable)
+	if !ok {
+		return errDebounceRedis
+	}
+
+	err := redis.Set(d.argsKey(key), body, debounceArgsTTL).Err()
+	if err != nil {
+		return err
+	}
+
+	first, err := redis.SetNX(d.lockKey(key), "", d.window).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		return nil
+	}
+
+	trigger := &Message{
+		Delay:    msg.Delay + d.window,
+		Priority: msg.Priority,
+		Header:   make(map[string]string, len(msg.Header)+1),
+	}
+	for k, v := range msg.Header {
+		trigger.Header[k] = v
+	}
+	trigger.Header[debounceKeyHeader] = d.argsKey(key)
+	return d.q.Add(trigger)
+}
+
+// NewDebounceHandler returns a Handler that calls fn with the latest
+// args of the message added using Debouncer.
+func NewDebounceHandler(redis RedisCmdable, fn interface{}) Handler {
+	return &debounceHandler{
+		redis: redis,
+		fn:    fn,
+		h:     NewHandler(fn),
+	}
+}
+
+type debounceHandler struct {
+	redis RedisCmdable
+	fn    interface{}
+	h     Handler
+}
+
+var _ codecHandler = (*debounceHandler)(nil)
+
+func (h *debounceHandler) withCodec(codec Codec) Handler {
+	return &debounceHandler{
+		redis: h.redis,
+		fn:    h.fn,
+		h:     NewCodecHandler(h.fn, codec),
+	}
+}
+
+func (h *debounceHandler) HandleMessage(msg *Message) error {
+	key, ok := msg.Header[debounceKeyHeader]
+	if !ok {
+		return h.h.HandleMessage(msg)
+	}
+
+	body, err := h.redis.Get(key).Result()
+	if err != nil {
+		return err
+	}
+
+	msg.Args = nil
+	msg.Body = body
+	return h.h.HandleMessage(msg)
+}
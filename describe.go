@@ -0,0 +1,40 @@
+package msgqueue
+
+import "time"
+
+// Describer is implemented by queues that describe their backend,
+// e.g. azsqs.Queue, ironmq.Queue, and memqueue.Queue.
+type Describer interface {
+	Describe() *Description
+}
+
+// Description describes the queue and its backend, so generic tooling
+// can adapt to the backend.
+type Description struct {
+	Name string
+	// Backend type, e.g. "sqs", "ironmq", or "memqueue".
+	Backend string
+	// Effective options of the queue, i.e. with defaults applied.
+	Options *Options
+
+	// Maximum encoded message body size in bytes or 0 if unlimited.
+	MaxPayloadSize int
+	// Maximum message delay or 0 if unlimited.
+	MaxDelay time.Duration
+
+	Capabilities Capabilities
+}
+
+// Capabilities describe operations supported by the queue backend.
+type Capabilities struct {
+	// Messages can be delayed.
+	Delay bool
+	// Queue can be purged.
+	Purge bool
+	// Messages can be read without reserving them.
+	Peek bool
+	// Reservations can be renewed, see Options.ReservationTimeout.
+	Renew bool
+	// Queue reports approximate number of messages.
+	Len bool
+}
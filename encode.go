@@ -3,44 +3,111 @@ package msgqueue
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"reflect"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
-func encodeArgs(args []interface{}) (string, error) {
+// Codec encodes message args into message body and decodes them back.
+type Codec interface {
+	// Marshal encodes args into message body.
+	Marshal(args []interface{}) ([]byte, error)
+	// Unmarshal decodes message body into args, which are pointers
+	// to handler arguments.
+	Unmarshal(b []byte, args []interface{}) error
+}
+
+var (
+	// MsgpackCodec encodes args using msgpack and base64.
+	// It is the default codec.
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// JSONCodec encodes args as JSON array.
+	JSONCodec Codec = jsonCodec{}
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(args []interface{}) ([]byte, error) {
 	b, err := msgpack.Marshal(args...)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	s := base64.StdEncoding.EncodeToString(b)
-	return s, nil
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(buf, b)
+	return buf, nil
 }
 
-func decodeArgs(s string, fnType reflect.Type) ([]reflect.Value, error) {
-	if fnType.NumIn() == 0 {
-		return nil, nil
+func (msgpackCodec) Unmarshal(b []byte, args []interface{}) error {
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(buf, b)
+	if err != nil {
+		return err
 	}
 
-	b, err := base64.StdEncoding.DecodeString(s)
-	if err != nil {
-		return nil, err
+	dec := msgpack.NewDecoder(bytes.NewBuffer(buf[:n]))
+	for i, arg := range args {
+		if err := dec.Decode(arg); err != nil {
+			return fmt.Errorf("queue: arg=%d decoding failed: %s", i, err)
+		}
 	}
+	return nil
+}
+
+type jsonCodec struct{}
 
-	buf := bytes.NewBuffer(b)
-	dec := msgpack.NewDecoder(buf)
+func (jsonCodec) Marshal(args []interface{}) ([]byte, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	return json.Marshal(args)
+}
 
-	in := make([]reflect.Value, fnType.NumIn())
-	for i := 0; i < fnType.NumIn(); i++ {
-		arg := reflect.New(fnType.In(i)).Elem()
-		if err := dec.DecodeValue(arg); err != nil {
-			err = fmt.Errorf("queue: arg=%d decoding failed: %s", i, err)
-			return nil, err
+func (jsonCodec) Unmarshal(b []byte, args []interface{}) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if len(raw) != len(args) {
+		return fmt.Errorf("got %d args, handler expects %d args", len(raw), len(args))
+	}
+	for i, arg := range args {
+		if err := json.Unmarshal(raw[i], arg); err != nil {
+			return fmt.Errorf("queue: arg=%d decoding failed: %s", i, err)
 		}
-		in[i] = arg
 	}
+	return nil
+}
 
+func encodeArgs(codec Codec, args []interface{}) (string, error) {
+	b, err := codec.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeArgs(codec Codec, s string, fnType reflect.Type, firstArg int) ([]reflect.Value, error) {
+	n := fnType.NumIn() - firstArg
+	if n == 0 {
+		return nil, nil
+	}
+
+	ptrs := make([]interface{}, n)
+	for i := range ptrs {
+		ptrs[i] = reflect.New(fnType.In(firstArg + i)).Interface()
+	}
+
+	if err := codec.Unmarshal([]byte(s), ptrs); err != nil {
+		return nil, err
+	}
+
+	in := make([]reflect.Value, n)
+	for i, ptr := range ptrs {
+		in[i] = reflect.ValueOf(ptr).Elem()
+	}
 	return in, nil
 }
@@ -0,0 +1,128 @@
+package msgqueue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrDuplicate is returned when message with the same name
+	// was already added to the queue.
+	ErrDuplicate = errors.New("queue: message with such name already exists")
+
+	// ErrQueueEmpty is returned when there are no messages to process.
+	ErrQueueEmpty = errors.New("queue: queue is empty")
+
+	// ErrQueueFull is returned when message is added to the queue
+	// that reached its capacity.
+	ErrQueueFull = errors.New("queue: queue is full")
+
+	// ErrNotSupported is returned when the operation is not supported
+	// by the queue backend.
+	ErrNotSupported = errors.New("queue: not supported")
+
+	// ErrTooLarge is returned when encoded message exceeds the
+	// backend message size limit.
+	ErrTooLarge = errors.New("queue: message is too large")
+
+	// ErrShutdown is returned when message is added to the closed queue.
+	ErrShutdown = errors.New("queue: queue is closed")
+
+	// ErrRateLimited is returned when message can't be processed
+	// because of the rate limit.
+	ErrRateLimited = errors.New("queue: rate limit exceeded")
+
+	// ErrDiscarded is returned by Discard. Message that fails with it
+	// is deleted without being passed to DeadLetterQueue or
+	// FallbackHandler.
+	ErrDiscarded = errors.New("queue: message is discarded")
+
+	// ErrHandlerTimeout is returned when handler does not return
+	// within Options.HandlerTimeout. Message is retried as usual.
+	ErrHandlerTimeout = errors.New("queue: handler timed out")
+
+	// ErrExpired is returned when message is older than Options.MaxAge
+	// and is deleted or moved to DeadLetterQueue without processing.
+	ErrExpired = errors.New("queue: message is expired")
+)
+
+// ErrRequeue is returned by handlers to release the message back to
+// the queue after MinBackoff without counting it as a failure.
+var ErrRequeue error = requeueError{}
+
+// Requeue is like ErrRequeue, but message is released after the delay.
+// Unlike Nack, requeued message is not counted as retry or failure.
+// memqueue does not count requeues towards RetryLimit, but SQS and
+// IronMQ count every delivery.
+func Requeue(delay time.Duration) error {
+	return requeueError{delay: delay}
+}
+
+type requeueError struct {
+	delay time.Duration
+}
+
+func (e requeueError) Error() string {
+	if e.delay == 0 {
+		return "queue: message is requeued"
+	}
+	return fmt.Sprintf("queue: message is requeued for %s", e.delay)
+}
+
+func (e requeueError) Delay() time.Duration {
+	return e.delay
+}
+
+func (requeueError) Requeue() bool {
+	return true
+}
+
+// Nack returns an error that makes the processor retry the message
+// after exactly the delay instead of using exponential backoff.
+// Message is still subject to RetryLimit.
+func Nack(delay time.Duration) error {
+	return nackError{delay: delay}
+}
+
+type nackError struct {
+	delay time.Duration
+}
+
+func (e nackError) Error() string {
+	return fmt.Sprintf("queue: message is nacked for %s", e.delay)
+}
+
+func (e nackError) Delay() time.Duration {
+	return e.delay
+}
+
+// Discard returns ErrDiscarded. Handlers return it to drop
+// the message without retries and without fallback.
+func Discard() error {
+	return ErrDiscarded
+}
+
+// Unretryable wraps the error so the message that failed with it is
+// not retried and fails permanently, e.g. on validation errors.
+// The wrapped error is returned by Unwrap, and the processor recognizes
+// Unretryable, Requeue, and Discard errors wrapped using fmt.Errorf %w.
+// Unretryable(nil) returns nil.
+func Unretryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return unretryableError{err}
+}
+
+type unretryableError struct {
+	error
+}
+
+func (unretryableError) Unretryable() bool {
+	return true
+}
+
+func (e unretryableError) Unwrap() error {
+	return e.error
+}
@@ -0,0 +1,62 @@
+package msgqueue
+
+import (
+	"context"
+
+	timerate "golang.org/x/time/rate"
+)
+
+// FactoryOptions configure resources shared by queues created
+// using backend factories, e.g. azsqs.NewFactory.
+type FactoryOptions struct {
+	// Optional prefix added to names of all queues created by the
+	// factory, e.g. "staging-". Because queue name is used in Redis keys
+	// of named messages and rate limits, environments that use different
+	// prefixes can safely share one Redis and one backend account.
+	Prefix string
+
+	// Redis client used by queues that don't set Options.Redis.
+	Redis Redis
+
+	// Rate limit for backend API calls shared by all queues
+	// created by the factory. The default is no limit.
+	APIRateLimit timerate.Limit
+	// Maximum burst of backend API calls. The default is 1.
+	APIBurst int
+
+	limiter *timerate.Limiter
+}
+
+func (opt *FactoryOptions) Init() {
+	if opt.limiter != nil {
+		return
+	}
+	if opt.APIRateLimit == 0 {
+		opt.APIRateLimit = timerate.Inf
+	}
+	if opt.APIBurst == 0 {
+		opt.APIBurst = 1
+	}
+	opt.limiter = timerate.NewLimiter(opt.APIRateLimit, opt.APIBurst)
+}
+
+// InitQueue sets options of the queue created by the factory
+// that are shared with other queues. Prefix is added to the queue
+// name once even if options are used to create several queues.
+func (opt *FactoryOptions) InitQueue(qopt *Options) {
+	if opt.Prefix != "" && !qopt.prefixed {
+		qopt.Name = opt.Prefix + qopt.Name
+		qopt.prefixed = true
+	}
+	if qopt.Redis == nil {
+		qopt.Redis = opt.Redis
+	}
+}
+
+// WaitAPI blocks until backend API call is allowed by APIRateLimit.
+func (opt *FactoryOptions) WaitAPI() {
+	if opt == nil || opt.limiter == nil || opt.APIRateLimit == timerate.Inf {
+		return
+	}
+	_ = opt.limiter.Wait(context.Background())
+}
@@ -0,0 +1,33 @@
+package msgqueue
+
+import "time"
+
+// FlagAction is the action FeatureFlags takes on the message.
+type FlagAction int
+
+const (
+	// FlagProcess processes the message as usual.
+	FlagProcess FlagAction = iota
+	// FlagDelay releases the message back to the queue without
+	// processing and without counting it as a retry.
+	FlagDelay
+	// FlagDrop deletes the message without processing
+	// like handler that returns ErrDiscarded.
+	FlagDrop
+)
+
+// FeatureFlags is consulted before the message is processed, e.g. to roll
+// out new message names or tenants gradually without checking flags
+// in every handler.
+type FeatureFlags interface {
+	// Action returns the action for the message. Delay is used
+	// with FlagDelay; zero delay means Options.MinBackoff.
+	Action(msg *Message) (FlagAction, time.Duration)
+}
+
+// FeatureFlagsFunc is an adapter to use ordinary functions as FeatureFlags.
+type FeatureFlagsFunc func(msg *Message) (FlagAction, time.Duration)
+
+func (fn FeatureFlagsFunc) Action(msg *Message) (FlagAction, time.Duration) {
+	return fn(msg)
+}
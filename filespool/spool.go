@@ -0,0 +1,510 @@
+// Package filespool implements producer-side queue that appends messages
+// to segment files and forwards them to a downstream queue when it is
+// reachable, so producers that are frequently offline don't lose messages.
+package filespool
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal"
+)
+
+// Segment is closed and new segment is started
+// when segment size exceeds the limit.
+const maxSegmentSize = 16 << 20
+
+// Cursor is saved after forwarding the number of messages.
+const cursorBatchSize = 100
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+)
+
+type pinger interface {
+	Ping() error
+}
+
+// Queue appends messages to segment files in the directory and forwards
+// them in order to the downstream queue, e.g. azsqs.Queue. When the
+// downstream queue is not reachable, messages are kept on disk and are
+// replayed after reconnect or process restart. Messages are forwarded at
+// least once, so messages may be forwarded again after a crash.
+type Queue struct {
+	downstream msgqueue.Queue
+	dir        string
+
+	mu      sync.Mutex
+	file    *os.File
+	segment uint64
+	size    int64
+
+	wake    chan struct{}
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewQueue returns Queue that spools messages in the directory, which
+// is created if it does not exist, and starts forwarding spooled
+// messages to the downstream queue.
+func NewQueue(downstream msgqueue.Queue, dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		downstream: downstream,
+		dir:        dir,
+
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	segments, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	// Last segment may end with partially written message,
+	// so messages are always appended to a new segment.
+	var last uint64
+	if len(segments) > 0 {
+		last = segments[len(segments)-1]
+	}
+	if err := q.openSegment(last + 1); err != nil {
+		return nil, err
+	}
+
+	go q.forward()
+	return q, nil
+}
+
+func (q *Queue) Name() string {
+	return q.downstream.Name()
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Spool<%s>", q.Name())
+}
+
+// Options returns options of the downstream queue.
+func (q *Queue) Options() *msgqueue.Options {
+	return q.downstream.Options()
+}
+
+// Downstream returns the queue where messages are forwarded.
+func (q *Queue) Downstream() msgqueue.Queue {
+	return q.downstream
+}
+
+// Add appends message to the current segment. Message delay is
+// converted to ScheduledAt, so time spent in the spool is not added
+// to the delay.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	msg, err := internal.EncodeMessage(q.Options(), msg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rec := record{
+		Name:       msg.Name,
+		Body:       msg.Body,
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+		CreatedAt:  now,
+	}
+	if delay := msg.ScheduledDelay(); delay > 0 {
+		rec.ScheduledAt = now.Add(delay)
+	}
+
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if err := q.append(b); err != nil {
+		return err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period. Messages are deduplicated by the downstream
+// queue when they are forwarded.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// append writes and syncs the line, so message is not lost
+// when the process crashes after Add returns.
+func (q *Queue) append(b []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file == nil {
+		return fmt.Errorf("filespool: %s is closed", q)
+	}
+
+	if q.size > 0 && q.size+int64(len(b)) > maxSegmentSize {
+		if err := q.file.Close(); err != nil {
+			return err
+		}
+		if err := q.openSegment(q.segment + 1); err != nil {
+			q.file = nil
+			return err
+		}
+	}
+
+	n, err := q.file.Write(b)
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
+
+// openSegment creates the segment file. It is called with q.mu held.
+func (q *Queue) openSegment(segment uint64) error {
+	f, err := os.OpenFile(q.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.file = f
+	q.segment = segment
+	q.size = 0
+	return nil
+}
+
+func (q *Queue) currentSegment() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.segment
+}
+
+func (q *Queue) segmentPath(segment uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", segment, segmentExt))
+}
+
+// segments returns numbers of segment files in ascending order.
+func (q *Queue) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, name := range names {
+		s := strings.TrimSuffix(filepath.Base(name), segmentExt)
+		segment, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// CloseTimeout waits at most timeout for spooled messages to be
+// forwarded and closes the current segment. Messages that are not
+// forwarded are replayed when the queue is created again using the
+// same directory. The downstream queue is not closed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	q.mu.Lock()
+	if q.file == nil {
+		q.mu.Unlock()
+		return nil
+	}
+	err := q.file.Close()
+	q.file = nil
+	q.mu.Unlock()
+
+	close(q.closing)
+	select {
+	case <-q.done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("filespool: %s is not drained in %s", q, timeout)
+	}
+	return err
+}
+
+// forward reads segments starting from the saved cursor and adds
+// messages to the downstream queue.
+func (q *Queue) forward() {
+	defer close(q.done)
+
+	cur, err := q.readCursor()
+	if err != nil {
+		q.logf(msgqueue.LogError, "filespool: reading cursor of %s failed: %s", q, err)
+	}
+
+	backoff := minBackoff
+	for {
+		more, err := q.forwardSegment(&cur)
+		if err != nil {
+			q.logf(msgqueue.LogWarn, "filespool: forwarding %s failed: %s (retrying in %s)",
+				q, err, backoff)
+			if !q.sleep(backoff) {
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		if more {
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-q.closing:
+			// Forward messages that are added before Close.
+			if more, err := q.forwardSegment(&cur); err != nil || !more {
+				return
+			}
+		}
+	}
+}
+
+// sleep waits for the duration. It returns false if the queue is closed.
+func (q *Queue) sleep(dur time.Duration) bool {
+	select {
+	case <-time.After(dur):
+		return true
+	case <-q.closing:
+		return false
+	}
+}
+
+// forwardSegment forwards complete messages of the segment at the cursor.
+// It returns true if the segment is finished and there are more segments.
+func (q *Queue) forwardSegment(cur *cursor) (bool, error) {
+	if cur.Segment == 0 {
+		segments, err := q.segments()
+		if err != nil {
+			return false, err
+		}
+		if len(segments) == 0 {
+			return false, nil
+		}
+		cur.Segment = segments[0]
+	}
+
+	// Writer never appends to earlier segments, so the segment
+	// is finished if it is not current before reading.
+	current := cur.Segment == q.currentSegment()
+
+	f, err := os.Open(q.segmentPath(cur.Segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q.nextSegment(cur)
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(cur.Offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	rd := bufio.NewReader(f)
+	var forwarded int
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if forwarded == 0 {
+			if err := q.ping(); err != nil {
+				return false, err
+			}
+		}
+		if err := q.forwardLine(line); err != nil {
+			if forwarded > 0 {
+				q.saveCursor(cur)
+			}
+			return false, err
+		}
+		cur.Offset += int64(len(line))
+
+		forwarded++
+		if forwarded%cursorBatchSize == 0 {
+			q.saveCursor(cur)
+		}
+	}
+	if forwarded > 0 {
+		q.saveCursor(cur)
+	}
+
+	// Incomplete line at the end of the current segment is being
+	// written. Earlier segments can end with partially written message
+	// only after a crash, so such line is skipped.
+	if current {
+		return false, nil
+	}
+	if err := os.Remove(q.segmentPath(cur.Segment)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return q.nextSegment(cur)
+}
+
+// nextSegment moves the cursor to the segment after the current one.
+func (q *Queue) nextSegment(cur *cursor) (bool, error) {
+	segments, err := q.segments()
+	if err != nil {
+		return false, err
+	}
+	for _, segment := range segments {
+		if segment > cur.Segment {
+			*cur = cursor{Segment: segment}
+			q.saveCursor(cur)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ping checks that the downstream queue is reachable
+// if the queue supports it.
+func (q *Queue) ping() error {
+	if p, ok := q.downstream.(pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+func (q *Queue) forwardLine(line []byte) error {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		q.logf(msgqueue.LogError, "filespool: skipping corrupted message in %s: %s", q, err)
+		return nil
+	}
+
+	err := q.downstream.Add(rec.message())
+	switch err {
+	case nil, msgqueue.ErrDuplicate:
+		return nil
+	case msgqueue.ErrTooLarge:
+		q.logf(msgqueue.LogError, "filespool: dropping message in %s: %s", q, err)
+		return nil
+	}
+	return err
+}
+
+func (q *Queue) logf(level msgqueue.LogLevel, format string, args ...interface{}) {
+	q.Options().Logf(level, format, args...)
+}
+
+// cursor is the position of the first message that is not forwarded.
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+func (q *Queue) readCursor() (cursor, error) {
+	var cur cursor
+	b, err := ioutil.ReadFile(filepath.Join(q.dir, cursorFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cur, nil
+		}
+		return cur, err
+	}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return cursor{}, err
+	}
+	return cur, nil
+}
+
+// saveCursor atomically replaces the cursor file. Failures are logged,
+// because messages are only forwarded again after a restart.
+func (q *Queue) saveCursor(cur *cursor) {
+	b, err := json.Marshal(cur)
+	if err == nil {
+		path := filepath.Join(q.dir, cursorFile)
+		err = ioutil.WriteFile(path+".tmp", b, 0600)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		q.logf(msgqueue.LogWarn, "filespool: saving cursor of %s failed: %s", q, err)
+	}
+}
+
+// record is a message stored in a segment file.
+type record struct {
+	Name        string            `json:"name,omitempty"`
+	Body        string            `json:"body"`
+	Header      map[string]string `json:"header,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	RetryLimit  int               `json:"retry_limit,omitempty"`
+	GroupKey    string            `json:"group_key,omitempty"`
+	Barrier     bool              `json:"barrier,omitempty"`
+	ScheduledAt time.Time         `json:"scheduled_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+func (rec *record) message() *msgqueue.Message {
+	return &msgqueue.Message{
+		Name:        rec.Name,
+		Body:        rec.Body,
+		Header:      rec.Header,
+		Priority:    rec.Priority,
+		RetryLimit:  rec.RetryLimit,
+		GroupKey:    rec.GroupKey,
+		Barrier:     rec.Barrier,
+		ScheduledAt: rec.ScheduledAt,
+		CreatedAt:   rec.CreatedAt,
+	}
+}
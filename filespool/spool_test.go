@@ -0,0 +1,224 @@
+package filespool_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/filespool"
+)
+
+// downstream records added messages and fails while it is offline.
+type downstream struct {
+	opt *msgqueue.Options
+
+	mu      sync.Mutex
+	offline bool
+	msgs    []*msgqueue.Message
+}
+
+var errOffline = errors.New("offline")
+
+func newDownstream(offline bool) *downstream {
+	opt := &msgqueue.Options{Name: "spool-test"}
+	opt.Init()
+	return &downstream{opt: opt, offline: offline}
+}
+
+func (q *downstream) Name() string               { return q.opt.Name }
+func (q *downstream) Options() *msgqueue.Options { return q.opt }
+
+func (q *downstream) Add(msg *msgqueue.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.offline {
+		return errOffline
+	}
+	q.msgs = append(q.msgs, msg)
+	return nil
+}
+
+func (q *downstream) Ping() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.offline {
+		return errOffline
+	}
+	return nil
+}
+
+func (q *downstream) setOffline(offline bool) {
+	q.mu.Lock()
+	q.offline = offline
+	q.mu.Unlock()
+}
+
+func (q *downstream) bodies() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var bodies []string
+	for _, msg := range q.msgs {
+		bodies = append(bodies, msg.Body)
+	}
+	return bodies
+}
+
+func waitBodies(t *testing.T, q *downstream, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bodies := q.bodies()
+		if len(bodies) >= n || time.Now().After(deadline) {
+			return bodies
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func addBodies(t *testing.T, q *filespool.Queue, bodies ...string) {
+	for _, body := range bodies {
+		msg := msgqueue.NewMessage()
+		msg.Body = body
+		if err := q.Add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	down := newDownstream(false)
+	q, err := filespool.NewQueue(down, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addBodies(t, q, "a", "b", "c")
+	bodies := waitBodies(t, down, 3)
+	if len(bodies) != 3 || bodies[0] != "a" || bodies[2] != "c" {
+		t.Fatalf("got %q", bodies)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddDoesNotModifyMessage(t *testing.T) {
+	down := newDownstream(false)
+	q, err := filespool.NewQueue(down, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := msgqueue.NewMessage("hello")
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Body != "" {
+		t.Fatalf("got Body %q, wanted caller's message unchanged", msg.Body)
+	}
+	if bodies := waitBodies(t, down, 1); len(bodies) != 1 || bodies[0] == "" {
+		t.Fatalf("got %q", bodies)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	down := newDownstream(true)
+	q, err := filespool.NewQueue(down, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addBodies(t, q, "a", "b")
+	time.Sleep(100 * time.Millisecond)
+	if bodies := down.bodies(); len(bodies) != 0 {
+		t.Fatalf("got %q while offline", bodies)
+	}
+
+	down.setOffline(false)
+	addBodies(t, q, "c")
+	// Forwarding is retried after a second.
+	bodies := waitBodies(t, down, 3)
+	if len(bodies) != 3 || bodies[0] != "a" || bodies[2] != "c" {
+		t.Fatalf("got %q", bodies)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	offline := newDownstream(true)
+	q, err := filespool.NewQueue(offline, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBodies(t, q, "a", "b")
+	if err := q.CloseTimeout(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	down := newDownstream(false)
+	q, err = filespool.NewQueue(down, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBodies(t, q, "c")
+
+	bodies := waitBodies(t, down, 3)
+	if len(bodies) != 3 || bodies[0] != "a" || bodies[1] != "b" || bodies[2] != "c" {
+		t.Fatalf("got %q", bodies)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forwarded messages are not replayed again.
+	down = newDownstream(false)
+	q, err = filespool.NewQueue(down, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if bodies := down.bodies(); len(bodies) != 0 {
+		t.Fatalf("got %q replayed", bodies)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	down := newDownstream(false)
+	q, err := filespool.NewQueue(down, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := msgqueue.NewMessage()
+	msg.Body = "a"
+	msg.Delay = time.Hour
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	waitBodies(t, down, 1)
+	down.mu.Lock()
+	got := down.msgs[0]
+	down.mu.Unlock()
+	if got.Delay != 0 || time.Until(got.ScheduledAt) < 59*time.Minute {
+		t.Fatalf("got delay %s and scheduled at %s", got.Delay, got.ScheduledAt)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,19 @@
+package msgqueue
+
+// HeaderFilter returns Options.Filter that accepts messages with
+// the header key set to one of the values. Message body is not decoded,
+// so skipping messages is cheap.
+func HeaderFilter(key string, values ...string) func(msg *Message) bool {
+	return func(msg *Message) bool {
+		v, ok := msg.Header[key]
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,408 @@
+package gcpubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	pubsub "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Pub/Sub message attributes that store message fields.
+// Pub/Sub can't delay messages, so delay is stored in the attribute
+// and the message is redelivered after the delay using ack deadline.
+const (
+	delayAttr      = "msgqueue_delay"
+	priorityAttr   = "msgqueue_priority"
+	retryLimitAttr = "msgqueue_retry_limit"
+	groupKeyAttr   = "msgqueue_group_key"
+	barrierAttr    = "msgqueue_barrier"
+)
+
+// Maximum size of Pub/Sub publish request.
+const maxMessageSize = 10 * 1024 * 1024
+
+// Maximum ack deadline supported by Pub/Sub. Releases with
+// longer delays are redelivered after the max deadline.
+const maxAckDeadline = 600 * time.Second
+
+// Time during which ReserveN waits for messages.
+const pullWait = time.Second
+
+type Queue struct {
+	pub     *pubsub.PublisherClient
+	sub     *pubsub.SubscriberClient
+	project string
+
+	opt      *msgqueue.Options
+	producer *producer.Producer
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that publishes messages to the topic
+// opt.Name of the project and reserves them from the subscription
+// with the same name. The topic and subscription must exist.
+func NewQueue(
+	pub *pubsub.PublisherClient, sub *pubsub.SubscriberClient, project string, opt *msgqueue.Options,
+) *Queue {
+	opt.Init()
+
+	q := Queue{
+		pub:     pub,
+		sub:     sub,
+		project: project,
+		opt:     opt,
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(
+	pub *pubsub.PublisherClient, sub *pubsub.SubscriberClient, project string, opts ...msgqueue.Option,
+) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(pub, sub, project, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "pubsub",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxAckDeadline,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+func (q *Queue) topic() string {
+	return fmt.Sprintf("projects/%s/topics/%s", q.project, q.Name())
+}
+
+func (q *Queue) subscription() string {
+	return fmt.Sprintf("projects/%s/subscriptions/%s", q.project, q.Name())
+}
+
+// Ping checks that the subscription is reachable.
+func (q *Queue) Ping() error {
+	_, err := q.sub.GetSubscription(context.Background(), &pubsubpb.GetSubscriptionRequest{
+		Subscription: q.subscription(),
+	})
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.publish([]*msgqueue.Message{msg})
+}
+
+// addBatch publishes messages splitting them into
+// requests that don't exceed the max request size.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for len(msgs) > 0 {
+		size := len(msgs[0].Body)
+		n := 1
+		for n < len(msgs) && size+len(msgs[n].Body) <= maxMessageSize {
+			size += len(msgs[n].Body)
+			n++
+		}
+
+		if err := q.publish(msgs[:n]); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+func (q *Queue) publish(msgs []*msgqueue.Message) error {
+	req := &pubsubpb.PublishRequest{
+		Topic:    q.topic(),
+		Messages: make([]*pubsubpb.PubsubMessage, len(msgs)),
+	}
+	for i, msg := range msgs {
+		req.Messages[i] = pubsubMessage(msg)
+	}
+
+	resp, err := q.pub.Publish(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range resp.MessageIds {
+		msgs[i].Id = id
+	}
+	return nil
+}
+
+func pubsubMessage(msg *msgqueue.Message) *pubsubpb.PubsubMessage {
+	attrs := make(map[string]string, len(msg.Header))
+	for k, v := range msg.Header {
+		attrs[k] = v
+	}
+
+	if delay := msg.ScheduledDelay(); delay > 0 {
+		attrs[delayAttr] = delay.String()
+	}
+	if msg.Priority != 0 {
+		attrs[priorityAttr] = strconv.Itoa(msg.Priority)
+	}
+	if msg.RetryLimit != 0 {
+		attrs[retryLimitAttr] = strconv.Itoa(msg.RetryLimit)
+	}
+	if msg.GroupKey != "" {
+		attrs[groupKeyAttr] = msg.GroupKey
+	}
+	if msg.Barrier {
+		attrs[barrierAttr] = "1"
+	}
+
+	return &pubsubpb.PubsubMessage{
+		Data:       []byte(msg.Body),
+		Attributes: attrs,
+	}
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds Pub/Sub max message size.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN pulls up to n messages waiting for them up to a second and
+// sets their ack deadline to ReservationTimeout. Delivery attempts are
+// counted by Pub/Sub only when the subscription has a dead letter
+// policy, otherwise reserved count of the messages is always 1.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pullWait)
+	resp, err := q.sub.Pull(ctx, &pubsubpb.PullRequest{
+		Subscription: q.subscription(),
+		MaxMessages:  int32(n),
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = nil
+		}
+		cancel()
+		return nil, err
+	}
+	cancel()
+	if len(resp.ReceivedMessages) == 0 {
+		return nil, nil
+	}
+
+	ackIds := make([]string, len(resp.ReceivedMessages))
+	msgs := make([]msgqueue.Message, len(resp.ReceivedMessages))
+	for i, rm := range resp.ReceivedMessages {
+		ackIds[i] = rm.AckId
+		msg, err := q.newMessage(rm)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i] = *msg
+	}
+
+	err = q.modifyAckDeadline(ackIds, q.opt.ReservationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (q *Queue) newMessage(rm *pubsubpb.ReceivedMessage) (*msgqueue.Message, error) {
+	psMsg := rm.Message
+	attrs := psMsg.Attributes
+	createdAt := psMsg.PublishTime.AsTime()
+
+	reservedCount := int(rm.DeliveryAttempt)
+	if reservedCount == 0 {
+		reservedCount = 1
+	}
+
+	var delay time.Duration
+	if v := attrs[delayAttr]; v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if remaining := time.Until(createdAt.Add(dur)); remaining > 0 {
+			delay = remaining
+		} else if reservedCount > 1 {
+			// Delivery that delayed the message is not a retry.
+			reservedCount--
+		}
+	}
+
+	priority, _ := strconv.Atoi(attrs[priorityAttr])
+	retryLimit, _ := strconv.Atoi(attrs[retryLimitAttr])
+
+	return &msgqueue.Message{
+		Id:            psMsg.MessageId,
+		Body:          string(psMsg.Data),
+		Header:        messageHeader(attrs),
+		Priority:      priority,
+		RetryLimit:    retryLimit,
+		GroupKey:      attrs[groupKeyAttr],
+		Barrier:       attrs[barrierAttr] != "",
+		Delay:         delay,
+		CreatedAt:     createdAt,
+		ReservationId: rm.AckId,
+		ReservedCount: reservedCount,
+	}, nil
+}
+
+func messageHeader(attrs map[string]string) map[string]string {
+	var header map[string]string
+	for k, v := range attrs {
+		if k == delayAttr || k == priorityAttr || k == retryLimitAttr ||
+			k == groupKeyAttr || k == barrierAttr {
+			continue
+		}
+		if header == nil {
+			header = make(map[string]string, len(attrs))
+		}
+		header[k] = v
+	}
+	return header
+}
+
+func (q *Queue) modifyAckDeadline(ackIds []string, dur time.Duration) error {
+	if dur > maxAckDeadline {
+		dur = maxAckDeadline
+	}
+	return q.sub.ModifyAckDeadline(context.Background(), &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       q.subscription(),
+		AckIds:             ackIds,
+		AckDeadlineSeconds: int32(dur / time.Second),
+	})
+}
+
+// Release sets the message ack deadline to the delay, so it is
+// redelivered after the delay. Delays longer than 10 minutes are
+// capped by Pub/Sub max ack deadline.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	return q.modifyAckDeadline([]string{msg.ReservationId}, delay)
+}
+
+// Touch sets the message ack deadline to the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	return q.modifyAckDeadline([]string{msg.ReservationId}, dur)
+}
+
+// Delete acknowledges the message.
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	return q.DeleteBatch([]*msgqueue.Message{msg})
+}
+
+// DeleteBatch acknowledges the messages using single request.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ackIds := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ackIds[i] = msg.ReservationId
+	}
+	return q.sub.Acknowledge(context.Background(), &pubsubpb.AcknowledgeRequest{
+		Subscription: q.subscription(),
+		AckIds:       ackIds,
+	})
+}
+
+// Purge acknowledges all messages published before now
+// by seeking the subscription.
+func (q *Queue) Purge() error {
+	_, err := q.sub.Seek(context.Background(), &pubsubpb.SeekRequest{
+		Subscription: q.subscription(),
+		Target: &pubsubpb.SeekRequest_Time{
+			Time: timestamppb.Now(),
+		},
+	})
+	return err
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
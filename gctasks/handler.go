@@ -0,0 +1,125 @@
+package gctasks
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// HTTP headers set by Cloud Tasks.
+const (
+	taskNameHeader       = "X-CloudTasks-TaskName"
+	taskRetryCountHeader = "X-CloudTasks-TaskRetryCount"
+)
+
+type handler struct {
+	opt      *msgqueue.Options
+	handler  msgqueue.Handler
+	fallback msgqueue.Handler
+}
+
+// NewHandler returns http.Handler that processes tasks pushed by
+// Cloud Tasks using opt.Handler. It responds with 200 OK when the
+// message is processed and with 500 when the handler fails, so Cloud
+// Tasks retries the task. When the message exceeds the retry limit,
+// it is passed to opt.FallbackHandler, if any, and is not retried.
+func NewHandler(opt *msgqueue.Options) http.Handler {
+	opt.Init()
+
+	h := &handler{
+		opt:     opt,
+		handler: msgqueue.NewCodecHandler(opt.Handler, opt.Codec),
+	}
+	if opt.FallbackHandler != nil {
+		h.fallback = msgqueue.NewCodecHandler(opt.FallbackHandler, opt.Codec)
+	}
+	return h
+}
+
+// Handler returns http.Handler that processes tasks of the queue.
+// See NewHandler.
+func (q *Queue) Handler() http.Handler {
+	return NewHandler(q.opt)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxMessageSize {
+		http.Error(w, msgqueue.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg, err := newMessage(req, body)
+	if err != nil {
+		// Malformed task is not retried.
+		h.opt.Logf(msgqueue.LogError, "gctasks: dropping malformed task %s: %s", msg.Id, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	msg.SetContext(req.Context())
+
+	err = h.handler.HandleMessage(msg)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	retryLimit := h.opt.RetryLimit
+	if msg.RetryLimit > 0 {
+		retryLimit = msg.RetryLimit
+	}
+	if msg.ReservedCount < retryLimit {
+		h.opt.Logf(msgqueue.LogWarn, "gctasks: task %s failed (retrying): %s", msg.Id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if h.fallback == nil {
+		h.opt.Logf(msgqueue.LogError, "gctasks: task %s failed: %s", msg.Id, err)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := h.fallback.HandleMessage(msg); err != nil {
+		h.opt.Logf(msgqueue.LogError, "gctasks: fallback of task %s failed: %s", msg.Id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func newMessage(req *http.Request, body []byte) (*msgqueue.Message, error) {
+	msg := &msgqueue.Message{
+		Id:   req.Header.Get(taskNameHeader),
+		Body: string(body),
+	}
+
+	// Retry count is 0 on the first attempt.
+	retryCount, _ := strconv.Atoi(req.Header.Get(taskRetryCountHeader))
+	msg.ReservedCount = retryCount + 1
+
+	if s := req.Header.Get(attrsHeader); s != "" {
+		var a attrs
+		if err := json.Unmarshal([]byte(s), &a); err != nil {
+			return msg, err
+		}
+		msg.Header = a.Header
+		msg.Priority = a.Priority
+		msg.RetryLimit = a.RetryLimit
+		msg.GroupKey = a.GroupKey
+		msg.Barrier = a.Barrier
+	}
+	return msg, nil
+}
@@ -0,0 +1,89 @@
+package gctasks_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/gctasks"
+)
+
+func newTask(body, retryCount, attrs string) *http.Request {
+	req := httptest.NewRequest("POST", "/tasks", strings.NewReader(body))
+	req.Header.Set("X-CloudTasks-TaskName", "task-1")
+	req.Header.Set("X-CloudTasks-TaskRetryCount", retryCount)
+	if attrs != "" {
+		req.Header.Set("X-Msgqueue-Attributes", attrs)
+	}
+	return req
+}
+
+func serve(h http.Handler, req *http.Request) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestHandler(t *testing.T) {
+	var got *msgqueue.Message
+	h := gctasks.NewHandler(&msgqueue.Options{
+		Name: "tasks-test",
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			got = msg
+			return nil
+		}),
+	})
+
+	req := newTask("hello", "2", `{"header":{"tenant":"acme"},"priority":5}`)
+	if code := serve(h, req); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if got.Id != "task-1" || got.Body != "hello" || got.ReservedCount != 3 {
+		t.Fatalf("got %+v", got)
+	}
+	if got.Header["tenant"] != "acme" || got.Priority != 5 {
+		t.Fatalf("got header %v and priority %d", got.Header, got.Priority)
+	}
+
+	req = httptest.NewRequest("GET", "/tasks", nil)
+	if code := serve(h, req); code != http.StatusMethodNotAllowed {
+		t.Fatalf("got %d, wanted 405", code)
+	}
+}
+
+func TestHandlerRetryLimit(t *testing.T) {
+	var fallbacks int
+	h := gctasks.NewHandler(&msgqueue.Options{
+		Name: "tasks-retry-limit-test",
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			return errors.New("fake error")
+		}),
+		FallbackHandler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			fallbacks++
+			return nil
+		}),
+		RetryLimit: 3,
+	})
+
+	if code := serve(h, newTask("", "0", "")); code != http.StatusInternalServerError {
+		t.Fatalf("got %d, wanted 500", code)
+	}
+	if fallbacks != 0 {
+		t.Fatalf("got %d fallbacks, wanted 0", fallbacks)
+	}
+
+	if code := serve(h, newTask("", "2", "")); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if fallbacks != 1 {
+		t.Fatalf("got %d fallbacks, wanted 1", fallbacks)
+	}
+
+	// Message retry limit overrides the option.
+	if code := serve(h, newTask("", "2", `{"retry_limit":5}`)); code != http.StatusInternalServerError {
+		t.Fatalf("got %d, wanted 500", code)
+	}
+}
@@ -0,0 +1,263 @@
+package gctasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	"cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Maximum size of Cloud Tasks task.
+const maxMessageSize = 1024 * 1024
+
+// Cloud Tasks can't schedule tasks more than 30 days in the future.
+const maxDelay = 30 * 24 * time.Hour
+
+// HTTP header that stores message fields which are not part of the body.
+const attrsHeader = "X-Msgqueue-Attributes"
+
+// Target is the HTTP endpoint that receives tasks.
+type Target struct {
+	// URL of the endpoint, e.g. Cloud Run service or Cloud Function,
+	// that serves Handler.
+	URL string
+
+	// Optional service account which is used to generate OIDC token,
+	// so the endpoint can require authentication.
+	ServiceAccountEmail string
+}
+
+// Queue creates Cloud Tasks HTTP tasks with message payload. Tasks are
+// pushed by Cloud Tasks to the target, so the queue does not have a
+// processor and messages are processed by Handler served by the target.
+type Queue struct {
+	client   *cloudtasks.Client
+	location string
+	target   Target
+
+	opt      *msgqueue.Options
+	producer *producer.Producer
+}
+
+var _ msgqueue.Queue = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that adds tasks to the Cloud Tasks queue
+// opt.Name of the project and location, e.g. "us-central1". The queue
+// must exist. Retries of failed tasks are configured by the Cloud Tasks
+// queue retry config.
+func NewQueue(
+	client *cloudtasks.Client, project, location string, target Target, opt *msgqueue.Options,
+) *Queue {
+	opt.Init()
+
+	q := Queue{
+		client:   client,
+		location: fmt.Sprintf("projects/%s/locations/%s", project, location),
+		target:   target,
+		opt:      opt,
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(
+	client *cloudtasks.Client, project, location string, target Target, opts ...msgqueue.Option,
+) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(client, project, location, target, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "cloudtasks",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxDelay,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+		},
+	}
+}
+
+func (q *Queue) queuePath() string {
+	return q.location + "/queues/" + q.Name()
+}
+
+// Ping checks that the Cloud Tasks queue is reachable.
+func (q *Queue) Ping() error {
+	_, err := q.client.GetQueue(context.Background(), &cloudtaskspb.GetQueueRequest{
+		Name: q.queuePath(),
+	})
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.createTask(msg)
+}
+
+// addBatch creates tasks one by one, because
+// Cloud Tasks does not support batched creates.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		if err := q.createTask(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) createTask(msg *msgqueue.Message) error {
+	req := &cloudtaskspb.HttpRequest{
+		Url:        q.target.URL,
+		HttpMethod: cloudtaskspb.HttpMethod_POST,
+		Headers: map[string]string{
+			"Content-Type": "application/octet-stream",
+		},
+		Body: []byte(msg.Body),
+	}
+	if q.target.ServiceAccountEmail != "" {
+		req.AuthorizationHeader = &cloudtaskspb.HttpRequest_OidcToken{
+			OidcToken: &cloudtaskspb.OidcToken{
+				ServiceAccountEmail: q.target.ServiceAccountEmail,
+			},
+		}
+	}
+
+	attrs, err := encodeAttrs(msg)
+	if err != nil {
+		return err
+	}
+	if attrs != "" {
+		req.Headers[attrsHeader] = attrs
+	}
+
+	task := &cloudtaskspb.Task{
+		MessageType: &cloudtaskspb.Task_HttpRequest{
+			HttpRequest: req,
+		},
+	}
+	if delay := msg.ScheduledDelay(); delay > 0 {
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		task.ScheduleTime = timestamppb.New(time.Now().Add(delay))
+	}
+
+	task, err = q.client.CreateTask(context.Background(), &cloudtaskspb.CreateTaskRequest{
+		Parent: q.queuePath(),
+		Task:   task,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Id = task.Name
+	return nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if message body exceeds Cloud Tasks max task size.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// Purge deletes all tasks of the Cloud Tasks queue.
+func (q *Queue) Purge() error {
+	_, err := q.client.PurgeQueue(context.Background(), &cloudtaskspb.PurgeQueueRequest{
+		Name: q.queuePath(),
+	})
+	return err
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// CloseTimeout waits at most timeout for pending tasks to be created.
+// The client is not closed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	return q.producer.CloseTimeout(timeout)
+}
+
+// attrs stores message fields which are not part of the task body.
+type attrs struct {
+	Header     map[string]string `json:"header,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+	RetryLimit int               `json:"retry_limit,omitempty"`
+	GroupKey   string            `json:"group_key,omitempty"`
+	Barrier    bool              `json:"barrier,omitempty"`
+}
+
+func encodeAttrs(msg *msgqueue.Message) (string, error) {
+	if len(msg.Header) == 0 && msg.Priority == 0 && msg.RetryLimit == 0 &&
+		msg.GroupKey == "" && !msg.Barrier {
+		return "", nil
+	}
+	b, err := json.Marshal(attrs{
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
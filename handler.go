@@ -1,11 +1,13 @@
 package msgqueue
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 )
 
 var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 type Handler interface {
 	HandleMessage(msg *Message) error
@@ -17,25 +19,57 @@ func (fn HandlerFunc) HandleMessage(msg *Message) error {
 	return fn(msg)
 }
 
+// Chain wraps the handler with middleware. The first middleware
+// is the outermost one, i.e. it is called first.
+func Chain(h Handler, middleware ...func(Handler) Handler) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// codecHandler is implemented by handlers that decode message body
+// themselves and need to know the queue codec.
+type codecHandler interface {
+	withCodec(codec Codec) Handler
+}
+
 type reflectFunc struct {
-	fv reflect.Value // Kind() == reflect.Func
-	ft reflect.Type
+	fv    reflect.Value // Kind() == reflect.Func
+	ft    reflect.Type
+	codec Codec
+
+	acceptsContext bool
 }
 
 var _ Handler = (*reflectFunc)(nil)
 
+// NewHandler returns a Handler that calls fn with the message args.
+// If the first fn argument is context.Context then fn is called
+// with the message context.
 func NewHandler(fn interface{}) Handler {
+	return NewCodecHandler(fn, MsgpackCodec)
+}
+
+// NewCodecHandler is like NewHandler, but message body
+// is decoded using the codec.
+func NewCodecHandler(fn interface{}, codec Codec) Handler {
+	if h, ok := fn.(codecHandler); ok {
+		return h.withCodec(codec)
+	}
 	if h, ok := fn.(Handler); ok {
 		return h
 	}
 
 	h := reflectFunc{
-		fv: reflect.ValueOf(fn),
+		fv:    reflect.ValueOf(fn),
+		codec: codec,
 	}
 	h.ft = h.fv.Type()
 	if h.ft.Kind() != reflect.Func {
 		panic(fmt.Sprintf("got %s, wanted %s", h.ft.Kind(), reflect.Func))
 	}
+	h.acceptsContext = h.ft.NumIn() > 0 && h.ft.In(0) == contextType
 	return &h
 }
 
@@ -45,8 +79,12 @@ func (h *reflectFunc) HandleMessage(msg *Message) error {
 		return err
 	}
 
-	if len(args) != h.ft.NumIn() {
-		return fmt.Errorf("got %d args, handler expects %d args", len(args), h.ft.NumIn())
+	if n := h.numArgs(); len(args) != n {
+		return fmt.Errorf("got %d args, handler expects %d args", len(args), n)
+	}
+
+	if h.acceptsContext {
+		args = append([]reflect.Value{reflect.ValueOf(msg.Context())}, args...)
 	}
 
 	out := h.fv.Call(args)
@@ -61,12 +99,26 @@ func (h *reflectFunc) HandleMessage(msg *Message) error {
 
 func (h *reflectFunc) decodeArgs(msg *Message) ([]reflect.Value, error) {
 	if msg.Body != "" {
-		return decodeArgs(msg.Body, h.ft)
+		return decodeArgs(h.codec, msg.Body, h.ft, h.ft.NumIn()-h.numArgs())
 	}
 
+	// Args are passed by reference without encoding,
+	// e.g. when message is added to memqueue.
+	offset := h.ft.NumIn() - h.numArgs()
 	args := make([]reflect.Value, len(msg.Args))
 	for i, arg := range msg.Args {
+		if arg == nil && offset+i < h.ft.NumIn() {
+			args[i] = reflect.Zero(h.ft.In(offset + i))
+			continue
+		}
 		args[i] = reflect.ValueOf(arg)
 	}
 	return args, nil
 }
+
+func (h *reflectFunc) numArgs() int {
+	if h.acceptsContext {
+		return h.ft.NumIn() - 1
+	}
+	return h.ft.NumIn()
+}
@@ -0,0 +1,110 @@
+// Package hybrid implements queue that processes messages in-process
+// and spills excess messages to a remote queue under load.
+package hybrid
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// Queue processes messages in-process using memqueue while the number of
+// pending local messages is below the limit and adds excess messages
+// to the remote queue, e.g. azsqs.Queue, that is processed by dedicated
+// workers. Name of the local queue is the remote name with "-local"
+// suffix. Named messages are deduplicated by local and remote queues
+// separately.
+type Queue struct {
+	remote   msgqueue.Queue
+	local    *memqueue.Queue
+	maxLocal int
+}
+
+var _ processor.ManagedQueue = (*Queue)(nil)
+
+// NewQueue returns Queue that processes about maxLocal pending messages,
+// i.e. buffered, in-flight, and delayed, in-process using options of the
+// remote queue. The default limit is the number of workers plus the buffer
+// size. The remote queue is not processed by the hybrid queue.
+func NewQueue(remote msgqueue.Queue, maxLocal int) *Queue {
+	opt := *remote.Options()
+	opt.Name = remote.Name() + "-local"
+	if maxLocal <= 0 {
+		maxLocal = opt.WorkerNumber + opt.BufferSize
+	}
+	return &Queue{
+		remote:   remote,
+		local:    memqueue.NewQueue(&opt),
+		maxLocal: maxLocal,
+	}
+}
+
+func (q *Queue) Name() string {
+	return q.remote.Name()
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Hybrid<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.local.Options()
+}
+
+// Processor returns processor of the local queue.
+func (q *Queue) Processor() *processor.Processor {
+	return q.local.Processor()
+}
+
+// Local returns the in-process queue.
+func (q *Queue) Local() *memqueue.Queue {
+	return q.local
+}
+
+// Remote returns the queue where excess messages are added.
+func (q *Queue) Remote() msgqueue.Queue {
+	return q.remote
+}
+
+// Add adds message to the local queue or, if the local queue
+// is full, to the remote queue.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	if q.spill() {
+		return q.remote.Add(msg)
+	}
+	return q.local.Add(msg)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+func (q *Queue) spill() bool {
+	// InFlight includes buffered and delayed messages.
+	st := q.local.Processor().Stats()
+	return int(st.InFlight) >= q.maxLocal
+}
+
+// Close closes the local queue waiting for local messages
+// to be processed. The remote queue is not closed.
+func (q *Queue) Close() error {
+	return q.local.Close()
+}
+
+// CloseTimeout is like Close, but waits at most timeout.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	return q.local.CloseTimeout(timeout)
+}
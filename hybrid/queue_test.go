@@ -0,0 +1,56 @@
+package hybrid_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/hybrid"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+)
+
+func TestSpill(t *testing.T) {
+	var processed int32
+	unblock := make(chan struct{})
+	handler := func() {
+		<-unblock
+		atomic.AddInt32(&processed, 1)
+	}
+
+	// memqueue stands for the remote backend processed by other workers.
+	remote := memqueue.NewQueue(&msgqueue.Options{
+		Name:         "hybrid-test",
+		Handler:      handler,
+		WorkerNumber: 1,
+		BufferSize:   10,
+	})
+	q := hybrid.NewQueue(remote, 2)
+	if q.Local().Name() != "hybrid-test-local" {
+		t.Fatalf("got local queue %q", q.Local().Name())
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := q.Call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := q.Local().Processor().Stats().InFlight; n != 2 {
+		t.Fatalf("got %d local messages, wanted 2", n)
+	}
+	if n := remote.Processor().Stats().InFlight; n != 3 {
+		t.Fatalf("got %d remote messages, wanted 3", n)
+	}
+
+	close(unblock)
+	if err := q.CloseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.CloseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&processed); n != 5 {
+		t.Fatalf("got %d processed messages, wanted 5", n)
+	}
+}
@@ -7,18 +7,26 @@ import (
 	"github.com/go-msgqueue/msgqueue"
 )
 
+// Maximum number of messages in a batch, e.g. SQS DeleteMessageBatch limit.
+const batchSize = 10
+
 type Batcher struct {
-	fn    func([]*msgqueue.Message)
-	limit chan struct{}
-	ch    chan *msgqueue.Message
-	wg    sync.WaitGroup
+	fn     func([]*msgqueue.Message)
+	linger time.Duration
+	limit  chan struct{}
+	ch     chan *msgqueue.Message
+	wg     sync.WaitGroup
 }
 
-func NewBatcher(limit int, fn func([]*msgqueue.Message)) *Batcher {
+// NewBatcher returns Batcher that calls fn with batches of messages using
+// at most limit concurrent calls. Messages are held at most linger before
+// the batch is flushed regardless of its size.
+func NewBatcher(limit int, linger time.Duration, fn func([]*msgqueue.Message)) *Batcher {
 	b := Batcher{
-		fn:    fn,
-		limit: make(chan struct{}, limit),
-		ch:    make(chan *msgqueue.Message, limit),
+		fn:     fn,
+		linger: linger,
+		limit:  make(chan struct{}, limit),
+		ch:     make(chan *msgqueue.Message, limit),
 	}
 	go b.batcher()
 	return &b
@@ -41,28 +49,33 @@ func (b *Batcher) Add(msg *msgqueue.Message) {
 
 func (b *Batcher) batcher() {
 	var msgs []*msgqueue.Message
+
+	// Timer is started by the first message of the batch, so messages
+	// are not held longer than linger even when they keep arriving.
+	timer := time.NewTimer(b.linger)
+	timer.Stop()
+
 	for {
 		var stop, timeout bool
 		select {
 		case msg, ok := <-b.ch:
 			if ok {
+				if len(msgs) == 0 {
+					timer.Reset(b.linger)
+				}
 				msgs = append(msgs, msg)
 			} else {
 				stop = true
 			}
-		case <-time.After(time.Second):
+		case <-timer.C:
 			timeout = true
 		}
 
-		if (timeout && len(msgs) > 0) || len(msgs) >= 10 {
-			b.limit <- struct{}{}
-			go func(msgs []*msgqueue.Message) {
-				b.fn(msgs)
-				<-b.limit
-				for i := 0; i < len(msgs); i++ {
-					b.wg.Done()
-				}
-			}(msgs)
+		if len(msgs) > 0 && (timeout || stop || len(msgs) >= batchSize) {
+			if !timeout && !timer.Stop() {
+				<-timer.C
+			}
+			b.flush(msgs)
 			msgs = nil
 		}
 
@@ -71,3 +84,14 @@ func (b *Batcher) batcher() {
 		}
 	}
 }
+
+func (b *Batcher) flush(msgs []*msgqueue.Message) {
+	b.limit <- struct{}{}
+	go func() {
+		b.fn(msgs)
+		<-b.limit
+		for i := 0; i < len(msgs); i++ {
+			b.wg.Done()
+		}
+	}()
+}
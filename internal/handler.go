@@ -2,15 +2,64 @@ package internal
 
 import "github.com/go-msgqueue/msgqueue"
 
-func WrapMessage(msg *msgqueue.Message) *msgqueue.Message {
-	msg0 := msgqueue.NewMessage(msg)
-	msg0.Name = msg.Name
-	return msg0
+// EncodeMessage returns a copy of the message that is added using remote
+// queue with args encoded into Body, so the caller's message, including
+// its Header, is not modified.
+func EncodeMessage(opt *msgqueue.Options, msg *msgqueue.Message) (*msgqueue.Message, error) {
+	cp := *msg
+	if msg.Header != nil {
+		cp.Header = make(map[string]string, len(msg.Header))
+		for k, v := range msg.Header {
+			cp.Header[k] = v
+		}
+	}
+	if cp.Body == "" {
+		body, err := msg.EncodeArgs(opt.Codec)
+		if err != nil {
+			return nil, err
+		}
+		cp.Body = body
+	}
+	return &cp, nil
 }
 
-func MessageUnwrapperHandler(fn interface{}) msgqueue.HandlerFunc {
-	h := msgqueue.NewHandler(fn)
+// WrapMessage wraps the message that is added using the producer memqueue.
+// Upserted messages are deduplicated by msgqueue.UpsertLatestArgs and
+// carry their name in msgqueue.NameHeader instead.
+func WrapMessage(opt *msgqueue.Options, msg *msgqueue.Message) *msgqueue.Message {
+	if !opt.Upsert || msg.Name == "" {
+		msg0 := msgqueue.NewMessage(msg)
+		msg0.Name = msg.Name
+		return msg0
+	}
+
+	cp := *msg
+	cp.Header = make(map[string]string, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		cp.Header[k] = v
+	}
+	cp.Header[msgqueue.NameHeader] = msg.Name
+	return msgqueue.NewMessage(&cp)
+}
+
+// WrapMessages wraps a batch of messages into one message.
+func WrapMessages(msgs []*msgqueue.Message) *msgqueue.Message {
+	return msgqueue.NewMessage(msgs)
+}
+
+func MessageUnwrapperHandler(fn interface{}, codec msgqueue.Codec) msgqueue.HandlerFunc {
+	h := msgqueue.NewCodecHandler(fn, codec)
 	return msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+		if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+			var firstErr error
+			for _, msg := range msgs {
+				if err := h.HandleMessage(msg); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			return firstErr
+		}
+
 		msg = msg.Args[0].(*msgqueue.Message)
 		return h.HandleMessage(msg)
 	})
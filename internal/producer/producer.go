@@ -0,0 +1,145 @@
+// Package producer implements adding messages to remote queue backends
+// in the background, so backends share encoding, tracing, upserting,
+// and batching of added messages.
+package producer
+
+import (
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+)
+
+// Maximum number of messages that are sent to the backend at once.
+const batchSize = 100
+
+// Producer adds messages to the backend using memqueue, so Add does not
+// wait for the backend and failed sends are retried. In Sync mode
+// messages are processed by the memqueue using queue options instead.
+type Producer struct {
+	opt      *msgqueue.Options
+	memqueue *memqueue.Queue
+	check    func(*msgqueue.Message) error
+}
+
+// New creates new Producer for the queue. add sends to the backend
+// the message that wraps either *msgqueue.Message or a batch of
+// []*msgqueue.Message. check validates encoded messages before they are
+// added, e.g. returns msgqueue.ErrTooLarge; it can be nil.
+func New(
+	opt *msgqueue.Options,
+	add func(*msgqueue.Message) error,
+	check func(*msgqueue.Message) error,
+) *Producer {
+	memopt := msgqueue.Options{
+		Name: opt.Name,
+
+		RetryLimit: 3,
+		MinBackoff: time.Second,
+		Handler:    msgqueue.HandlerFunc(add),
+
+		Redis:  opt.Redis,
+		Logger: opt.Logger,
+	}
+	if opt.Handler != nil {
+		memopt.FallbackHandler = internal.MessageUnwrapperHandler(opt.Handler, opt.Codec)
+	}
+	if opt.Sync {
+		// Messages are processed by the memqueue using queue options.
+		memopt = *opt
+	}
+
+	return &Producer{
+		opt:      opt,
+		memqueue: memqueue.NewQueue(&memopt),
+		check:    check,
+	}
+}
+
+// MaxSize returns check that rejects messages which
+// body exceeds the size with msgqueue.ErrTooLarge.
+func MaxSize(size int) func(*msgqueue.Message) error {
+	return func(msg *msgqueue.Message) error {
+		if len(msg.Body) > size {
+			return msgqueue.ErrTooLarge
+		}
+		return nil
+	}
+}
+
+// Add encodes the message and adds it to the backend in the background.
+// The caller's message is not modified.
+func (p *Producer) Add(msg *msgqueue.Message) error {
+	if p.opt.Sync {
+		return p.memqueue.Add(msg)
+	}
+	msg, err := p.encode(msg)
+	if err != nil {
+		return err
+	}
+	if p.opt.Upsert && msg.Name != "" {
+		pending, err := msgqueue.UpsertLatestArgs(p.opt, msg)
+		if err != nil || pending {
+			return err
+		}
+	}
+	return p.memqueue.Add(internal.WrapMessage(p.opt, msg))
+}
+
+// AddBatch adds messages to the backend in batches. Named messages are
+// added using Add so they are deduplicated as usual.
+func (p *Producer) AddBatch(msgs []*msgqueue.Message) error {
+	if p.opt.Sync {
+		return p.memqueue.AddBatch(msgs)
+	}
+
+	batch := make([]*msgqueue.Message, 0, batchSize)
+	for _, msg := range msgs {
+		if msg.Name != "" {
+			err := p.Add(msg)
+			if err != nil && err != msgqueue.ErrDuplicate {
+				return err
+			}
+			continue
+		}
+
+		msg, err := p.encode(msg)
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, msg)
+		if len(batch) == batchSize {
+			if err := p.memqueue.Add(internal.WrapMessages(batch)); err != nil {
+				return err
+			}
+			batch = make([]*msgqueue.Message, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		return p.memqueue.Add(internal.WrapMessages(batch))
+	}
+	return nil
+}
+
+// encode returns encoded copy of the message with trace context.
+func (p *Producer) encode(msg *msgqueue.Message) (*msgqueue.Message, error) {
+	msg, err := internal.EncodeMessage(p.opt, msg)
+	if err != nil {
+		return nil, err
+	}
+	msgqueue.InjectTrace(p.opt, msg)
+	if p.check != nil {
+		if err := p.check(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// CloseTimeout waits for added messages to be sent to the backend.
+func (p *Producer) CloseTimeout(timeout time.Duration) error {
+	return p.memqueue.CloseTimeout(timeout)
+}
@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// Every level of the wheel has wheelSize slots and each next level is
+// wheelSize times coarser, so with 1ms tick 5 levels cover ~12 days.
+// Longer delays are kept in the top level until they are due.
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits
+	wheelMask   = wheelSize - 1
+	wheelLevels = 5
+)
+
+type timerEntry struct {
+	when uint64 // tick when fn is due
+	fn   func()
+}
+
+// TimerWheel is a hierarchical timer wheel that calls functions after
+// delay using one goroutine and one timer, so pending timers only cost
+// memory. Timers fire at most one tick late. The goroutine sleeps until
+// the next tick that has due timers or needs cascading, and exits when
+// there are no pending timers.
+type TimerWheel struct {
+	tick   time.Duration
+	start  time.Time
+	wakeup chan struct{}
+
+	mu      sync.Mutex
+	now     uint64 // last processed tick
+	next    uint64 // tick the goroutine sleeps until
+	slots   [wheelLevels][wheelSize][]timerEntry
+	len     int
+	running bool
+}
+
+func NewTimerWheel(tick time.Duration) *TimerWheel {
+	return &TimerWheel{
+		tick:   tick,
+		start:  time.Now(),
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// Len returns the number of pending timers.
+func (w *TimerWheel) Len() int {
+	w.mu.Lock()
+	n := w.len
+	w.mu.Unlock()
+	return n
+}
+
+// AfterFunc calls fn after the delay. Functions are called sequentially
+// by the wheel goroutine, so blocked fn delays other due functions.
+func (w *TimerWheel) AfterFunc(delay time.Duration, fn func()) {
+	elapsed := time.Since(w.start) + delay
+	when := uint64((elapsed + w.tick - 1) / w.tick)
+
+	w.mu.Lock()
+	if !w.running {
+		w.now = w.currentTick()
+	}
+	if when <= w.now {
+		when = w.now + 1
+	}
+	w.insert(timerEntry{when: when, fn: fn})
+	w.len++
+	if !w.running {
+		w.running = true
+		w.next = w.nextTick()
+		go w.run()
+	} else if when < w.next {
+		w.next = when
+		select {
+		case w.wakeup <- struct{}{}:
+		default:
+		}
+	}
+	w.mu.Unlock()
+}
+
+func (w *TimerWheel) currentTick() uint64 {
+	return uint64(time.Since(w.start) / w.tick)
+}
+
+func (w *TimerWheel) insert(e timerEntry) {
+	if e.when < w.now {
+		e.when = w.now
+	}
+	delta := e.when - w.now
+
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*uint(level+1)) {
+		level++
+	}
+
+	when := e.when
+	if max := uint64(1)<<(wheelBits*wheelLevels) - 1; delta > max {
+		// Entry is cascaded from the furthest slot of
+		// the top level and reinserted until it is due.
+		when = w.now + max
+	}
+
+	slot := (when >> (wheelBits * uint(level))) & wheelMask
+	w.slots[level][slot] = append(w.slots[level][slot], e)
+}
+
+// advance processes the next tick appending due functions to fns.
+func (w *TimerWheel) advance(fns []func()) []func() {
+	w.now++
+
+	// Entries of the coarser levels are moved to the finer ones when
+	// the finer level completes a rotation. Higher levels go first,
+	// because their entries can land in the slots cascaded next.
+	levels := 0
+	for levels < wheelLevels-1 && (w.now>>(wheelBits*uint(levels)))&wheelMask == 0 {
+		levels++
+	}
+	for level := levels; level > 0; level-- {
+		slot := (w.now >> (wheelBits * uint(level))) & wheelMask
+		entries := w.slots[level][slot]
+		w.slots[level][slot] = nil
+		for _, e := range entries {
+			w.insert(e)
+		}
+	}
+
+	slot := w.now & wheelMask
+	for _, e := range w.slots[0][slot] {
+		fns = append(fns, e.fn)
+	}
+	w.slots[0][slot] = nil
+	return fns
+}
+
+// nextTick returns the next tick that has due entries in the first
+// level or the next cascading tick, whichever is earlier.
+func (w *TimerWheel) nextTick() uint64 {
+	for i := uint64(1); ; i++ {
+		tick := w.now + i
+		if tick&wheelMask == 0 || len(w.slots[0][tick&wheelMask]) > 0 {
+			return tick
+		}
+	}
+}
+
+func (w *TimerWheel) run() {
+	w.mu.Lock()
+	timer := time.NewTimer(w.untilTick(w.next))
+	w.mu.Unlock()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-w.wakeup:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		var fns []func()
+
+		w.mu.Lock()
+		for now := w.currentTick(); w.now < now; {
+			fns = w.advance(fns)
+		}
+		w.len -= len(fns)
+		done := w.len == 0
+		if done {
+			w.running = false
+		} else {
+			w.next = w.nextTick()
+			timer.Reset(w.untilTick(w.next))
+		}
+		w.mu.Unlock()
+
+		for _, fn := range fns {
+			fn()
+		}
+		if done {
+			return
+		}
+	}
+}
+
+func (w *TimerWheel) untilTick(tick uint64) time.Duration {
+	return time.Until(w.start.Add(time.Duration(tick) * w.tick))
+}
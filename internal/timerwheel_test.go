@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond)
+
+	delays := []time.Duration{
+		0,
+		time.Millisecond,
+		30 * time.Millisecond,
+		70 * time.Millisecond, // level 1
+		150 * time.Millisecond,
+	}
+
+	type result struct {
+		delay time.Duration
+		got   time.Duration
+	}
+	ch := make(chan result, len(delays))
+	start := time.Now()
+	for _, delay := range delays {
+		delay := delay
+		w.AfterFunc(delay, func() {
+			ch <- result{delay, time.Since(start)}
+		})
+	}
+
+	for range delays {
+		select {
+		case res := <-ch:
+			if res.got < res.delay || res.got > res.delay+50*time.Millisecond {
+				t.Fatalf("timer with delay %s fired after %s", res.delay, res.got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timer did not fire")
+		}
+	}
+
+	if n := w.Len(); n != 0 {
+		t.Fatalf("got Len=%d, wanted 0", n)
+	}
+}
+
+func TestTimerWheelCascade(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond)
+
+	// Simulate ticks without waiting for them.
+	var fired []uint64
+	w.mu.Lock()
+	for _, when := range []uint64{1, 63, 64, 65, 4095, 4096, 4097, 300000, 1 << 25} {
+		w.insert(timerEntry{when: when, fn: func() {}})
+		w.len++
+	}
+	var fns []func()
+	for w.len > 0 {
+		n := len(fns)
+		fns = w.advance(fns)
+		for i := n; i < len(fns); i++ {
+			fired = append(fired, w.now)
+		}
+		w.len -= len(fns) - n
+	}
+	w.mu.Unlock()
+
+	wanted := []uint64{1, 63, 64, 65, 4095, 4096, 4097, 300000, 1 << 25}
+	if len(fired) != len(wanted) {
+		t.Fatalf("got %v, wanted %v", fired, wanted)
+	}
+	for i := range wanted {
+		if fired[i] != wanted[i] {
+			t.Fatalf("got %v, wanted %v", fired, wanted)
+		}
+	}
+}
+
+func TestTimerWheelRestart(t *testing.T) {
+	w := NewTimerWheel(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		w.AfterFunc(5*time.Millisecond, wg.Done)
+		wg.Wait()
+		// Wait for the goroutine to exit.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := w.Len(); n != 0 {
+		t.Fatalf("got Len=%d, wanted 0", n)
+	}
+}
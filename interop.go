@@ -0,0 +1,116 @@
+package msgqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Maximum number of nested payload encodings, e.g. SNS envelope
+// with base64-encoded gzip-ed JSON.
+const maxInteropDepth = 4
+
+// InteropCodec returns a codec that decodes message body using the codec
+// and, if that fails, falls back to formats commonly used by non-Go
+// producers: gzip-ed bodies, base64 payloads, SNS notification envelopes,
+// and plain JSON. Plain JSON that is not an array of args is decoded into
+// the only handler argument. Args are encoded using the codec.
+func InteropCodec(codec Codec) Codec {
+	return interopCodec{codec: codec}
+}
+
+type interopCodec struct {
+	codec Codec
+}
+
+func (c interopCodec) Marshal(args []interface{}) ([]byte, error) {
+	return c.codec.Marshal(args)
+}
+
+func (c interopCodec) Unmarshal(b []byte, args []interface{}) error {
+	return c.unmarshal(b, args, 0)
+}
+
+func (c interopCodec) unmarshal(b []byte, args []interface{}, depth int) error {
+	firstErr := c.codec.Unmarshal(b, args)
+	if firstErr == nil {
+		return nil
+	}
+
+	if depth < maxInteropDepth {
+		if payload, ok := unwrapPayload(b); ok {
+			if err := c.unmarshal(payload, args, depth+1); err == nil {
+				return nil
+			}
+		}
+	}
+
+	if err := unmarshalPlainJSON(b, args); err == nil {
+		return nil
+	}
+	return firstErr
+}
+
+// unwrapPayload removes one layer of gzip, SNS envelope, or base64 encoding.
+func unwrapPayload(b []byte) ([]byte, bool) {
+	if isGzip(b) {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, false
+		}
+		payload, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, false
+		}
+		return payload, true
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, false
+	}
+
+	if b[0] == '{' {
+		var env struct {
+			Type    string
+			Message string
+		}
+		err := json.Unmarshal(b, &env)
+		if err == nil && env.Type == "Notification" && env.Message != "" {
+			return []byte(env.Message), true
+		}
+		return nil, false
+	}
+
+	payload := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(payload, b)
+	if err != nil {
+		return nil, false
+	}
+	payload = payload[:n]
+	// Only accept payloads that look like something we can decode
+	// to avoid treating arbitrary text as base64.
+	if isGzip(payload) || isJSON(payload) {
+		return payload, true
+	}
+	return nil, false
+}
+
+func isJSON(b []byte) bool {
+	var raw json.RawMessage
+	return json.Unmarshal(b, &raw) == nil
+}
+
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+func unmarshalPlainJSON(b []byte, args []interface{}) error {
+	err := JSONCodec.Unmarshal(b, args)
+	if err == nil || len(args) != 1 {
+		return err
+	}
+	return json.Unmarshal(b, args[0])
+}
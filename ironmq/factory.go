@@ -0,0 +1,34 @@
+package ironmq
+
+import (
+	"github.com/go-msgqueue/msgqueue"
+
+	"github.com/iron-io/iron_go3/config"
+	"github.com/iron-io/iron_go3/mq"
+)
+
+// Factory creates queues that share IronMQ project settings,
+// Redis client, and IronMQ API rate budget.
+type Factory struct {
+	settings config.Settings
+	opt      *msgqueue.FactoryOptions
+}
+
+func NewFactory(settings config.Settings, opt *msgqueue.FactoryOptions) *Factory {
+	if opt == nil {
+		opt = new(msgqueue.FactoryOptions)
+	}
+	opt.Init()
+	return &Factory{
+		settings: settings,
+		opt:      opt,
+	}
+}
+
+// NewQueue creates new Queue with the name opt.Name that uses
+// factory resources.
+func (f *Factory) NewQueue(opt *msgqueue.Options) *Queue {
+	f.opt.InitQueue(opt)
+	mqueue := mq.ConfigNew(opt.Name, &f.settings)
+	return newQueue(mqueue, opt, f.opt)
+}
@@ -0,0 +1,148 @@
+package ironmq
+
+import (
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// HTTP header set by IronMQ push queues.
+const messageIdHeader = "Iron-Message-Id"
+
+// Delivery counters outlive push queue retries.
+const deliveriesTTL = maxDelay
+
+// deliveriesScript counts deliveries of the push message.
+const deliveriesScript = `
+local n = redis.call("incr", KEYS[1])
+redis.call("pexpire", KEYS[1], ARGV[1])
+return n
+`
+
+type pushHandler struct {
+	q     *Queue
+	p     *processor.Processor
+	token string
+}
+
+// PushHandler returns http.Handler that accepts deliveries of IronMQ
+// push queue and processes them using the queue Processor, so push and
+// pull queues share the same handler. Requests must be authenticated
+// with "Authorization: Bearer <token>" header, which is configured in
+// the push queue subscriber headers; all requests are rejected when
+// token is empty. It responds with 200 OK when the message is processed
+// and with 500 when the handler fails, so IronMQ retries the delivery
+// according to the push queue retries setting.
+//
+// IronMQ does not report delivery attempts, so they are counted in
+// Redis when Options.Redis is set and messages that exceed the retry
+// limit are moved to the dead letter queue or passed to the fallback
+// handler. Without Redis every delivery is counted as the first one,
+// so only messages that fail with unretryable error are moved to the
+// dead letter queue or passed to the fallback handler.
+func (q *Queue) PushHandler(token string) http.Handler {
+	return &pushHandler{
+		q:     q,
+		p:     q.Processor(),
+		token: token,
+	}
+}
+
+func (h *pushHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxMessageSize {
+		http.Error(w, msgqueue.ErrTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg := newPushMessage(req, body)
+	msg.ReservedCount = h.deliveries(msg.Id)
+	msg.SetContext(req.Context())
+
+	if err := h.p.Handle(msg); err != nil {
+		// Handler errors are logged by the processor and
+		// are not exposed to the caller.
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.resetDeliveries(msg.Id)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *pushHandler) authorized(req *http.Request) bool {
+	if h.token == "" {
+		return false
+	}
+	got := req.Header.Get("Authorization")
+	want := "Bearer " + h.token
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func (h *pushHandler) deliveriesKey(id string) string {
+	return "ironmq:push:" + h.q.Name() + ":" + id
+}
+
+// deliveries returns the number of times the message was delivered,
+// including the current delivery. It returns 1 when deliveries can't
+// be counted.
+func (h *pushHandler) deliveries(id string) int {
+	redis, ok := h.q.opt.Redis.(msgqueue.RedisCmdable)
+	if !ok || id == "" {
+		return 1
+	}
+	ttl := int64(deliveriesTTL / time.Millisecond)
+	v, err := redis.Eval(deliveriesScript, []string{h.deliveriesKey(id)}, ttl).Result()
+	if err != nil {
+		h.q.opt.Logf(msgqueue.LogWarn, "ironmq: counting deliveries of %s failed: %s", id, err)
+		return 1
+	}
+	n, _ := v.(int64)
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+func (h *pushHandler) resetDeliveries(id string) {
+	if h.q.opt.Redis == nil || id == "" {
+		return
+	}
+	if err := h.q.opt.Redis.Del(h.deliveriesKey(id)).Err(); err != nil {
+		h.q.opt.Logf(msgqueue.LogWarn, "ironmq: Del failed: %s", err)
+	}
+}
+
+func newPushMessage(req *http.Request, body []byte) *msgqueue.Message {
+	env := decodeBody(string(body))
+	msg := &msgqueue.Message{
+		Id:         req.Header.Get(messageIdHeader),
+		Body:       env.Body,
+		Header:     env.Header,
+		Priority:   env.Priority,
+		RetryLimit: env.RetryLimit,
+		GroupKey:   env.GroupKey,
+		Barrier:    env.Barrier,
+	}
+	if env.CreatedAt > 0 {
+		msg.CreatedAt = time.Unix(0, env.CreatedAt*int64(time.Millisecond))
+	}
+	return msg
+}
@@ -0,0 +1,223 @@
+package ironmq_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/ironmq"
+
+	"github.com/go-redis/redis"
+	"github.com/iron-io/iron_go3/mq"
+)
+
+const pushToken = "secret"
+
+func pushRequest(h http.Handler, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/push", strings.NewReader(body))
+	req.Header.Set("Iron-Message-Id", "msg-1")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func push(h http.Handler, body string) int {
+	return pushRequest(h, pushToken, body).Code
+}
+
+func TestPushHandler(t *testing.T) {
+	var got *msgqueue.Message
+	q := ironmq.NewQueue(mq.Queue{Name: "push-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			got = msg
+			return nil
+		}),
+	})
+	h := q.PushHandler(pushToken)
+
+	body := `{"header":{"tenant":"acme"},"priority":5,"body":"hello"}`
+	if code := push(h, body); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if got.Id != "msg-1" || got.Body != "hello" || got.ReservedCount != 1 {
+		t.Fatalf("got %+v", got)
+	}
+	if got.Header["tenant"] != "acme" || got.Priority != 5 {
+		t.Fatalf("got header %v and priority %d", got.Header, got.Priority)
+	}
+
+	if code := push(h, "plain"); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if got.Body != "plain" {
+		t.Fatalf("got body %q, wanted plain", got.Body)
+	}
+
+	if st := q.Processor().Stats(); st.Processed != 2 {
+		t.Fatalf("got Processed=%d, wanted 2", st.Processed)
+	}
+}
+
+func TestPushHandlerFailed(t *testing.T) {
+	var fallbacks int
+	q := ironmq.NewQueue(mq.Queue{Name: "push-failed-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			if msg.Body == "invalid" {
+				return msgqueue.Unretryable(errors.New("invalid message"))
+			}
+			return errors.New("fake error")
+		}),
+		FallbackHandler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			fallbacks++
+			return nil
+		}),
+	})
+	h := q.PushHandler(pushToken)
+
+	// IronMQ retries the delivery.
+	if code := push(h, "hello"); code != http.StatusInternalServerError {
+		t.Fatalf("got %d, wanted 500", code)
+	}
+	if fallbacks != 0 {
+		t.Fatalf("fallback handler is called %d times, wanted 0", fallbacks)
+	}
+
+	if code := push(h, "invalid"); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if fallbacks != 1 {
+		t.Fatalf("fallback handler is called %d times, wanted 1", fallbacks)
+	}
+
+	st := q.Processor().Stats()
+	if st.Retries != 1 || st.Fails != 1 {
+		t.Fatalf("got Retries=%d Fails=%d, wanted 1 and 1", st.Retries, st.Fails)
+	}
+}
+
+func TestPushHandlerUnauthorized(t *testing.T) {
+	var handled int
+	q := ironmq.NewQueue(mq.Queue{Name: "push-auth-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			handled++
+			return nil
+		}),
+	})
+
+	h := q.PushHandler(pushToken)
+	if w := pushRequest(h, "", "hello"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted 401", w.Code)
+	}
+	if w := pushRequest(h, "wrong", "hello"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted 401", w.Code)
+	}
+
+	// Empty token rejects all requests.
+	if w := pushRequest(q.PushHandler(""), "", "hello"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got %d, wanted 401", w.Code)
+	}
+
+	if handled != 0 {
+		t.Fatalf("handler is called %d times, wanted 0", handled)
+	}
+}
+
+func TestPushHandlerHidesError(t *testing.T) {
+	q := ironmq.NewQueue(mq.Queue{Name: "push-error-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			return errors.New("password=hunter2")
+		}),
+	})
+
+	w := pushRequest(q.PushHandler(pushToken), pushToken, "hello")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, wanted 500", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "hunter2") {
+		t.Fatalf("response exposes handler error: %q", w.Body.String())
+	}
+}
+
+func TestPushHandlerRetryLimit(t *testing.T) {
+	client := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{"0": ":6379"},
+	})
+	defer client.Close()
+	if err := client.Del("ironmq:push:push-retry-test:msg-1").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var counts []int
+	var fallbacks int
+	q := ironmq.NewQueue(mq.Queue{Name: "push-retry-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			counts = append(counts, msg.ReservedCount)
+			return errors.New("fake error")
+		}),
+		FallbackHandler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			fallbacks++
+			return nil
+		}),
+		RetryLimit: 2,
+		Redis:      client,
+	})
+	h := q.PushHandler(pushToken)
+
+	if code := push(h, "hello"); code != http.StatusInternalServerError {
+		t.Fatalf("got %d, wanted 500", code)
+	}
+	if code := push(h, "hello"); code != http.StatusOK {
+		t.Fatalf("got %d, wanted 200", code)
+	}
+	if len(counts) != 2 || counts[0] != 1 || counts[1] != 2 {
+		t.Fatalf("got ReservedCount %v, wanted [1 2]", counts)
+	}
+	if fallbacks != 1 {
+		t.Fatalf("fallback handler is called %d times, wanted 1", fallbacks)
+	}
+
+	// Counter is reset once the delivery is acknowledged.
+	if n := client.Exists("ironmq:push:push-retry-test:msg-1").Val(); n != 0 {
+		t.Fatalf("delivery counter is not deleted")
+	}
+}
+
+func TestPushHandlerMaxAgeAndFilter(t *testing.T) {
+	var handled []string
+	q := ironmq.NewQueue(mq.Queue{Name: "push-max-age-test"}, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			handled = append(handled, msg.Body)
+			return nil
+		}),
+		Filter: func(msg *msgqueue.Message) bool {
+			return msg.Body != "skip"
+		},
+		MaxAge:         time.Minute,
+		ExpiredHandler: func(*msgqueue.Message, time.Duration) {},
+	})
+	h := q.PushHandler(pushToken)
+
+	old := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	body := fmt.Sprintf(`{"header":{},"created_at":%d,"body":"old"}`, old)
+	for _, body := range []string{body, "skip", "fresh"} {
+		if code := push(h, body); code != http.StatusOK {
+			t.Fatalf("got %d, wanted 200", code)
+		}
+	}
+
+	if len(handled) != 1 || handled[0] != "fresh" {
+		t.Fatalf("got %q, wanted [fresh]", handled)
+	}
+	st := q.Processor().Stats()
+	if st.Expired != 1 || st.Filtered != 1 {
+		t.Fatalf("got %d expired and %d filtered, wanted 1 and 1", st.Expired, st.Filtered)
+	}
+}
@@ -1,6 +1,7 @@
 package ironmq
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -14,25 +15,39 @@ import (
 	"github.com/iron-io/iron_go3/mq"
 )
 
+const maxMessageSize = 64 * 1024
+
+// Maximum message delay supported by IronMQ.
+const maxDelay = 7 * 24 * time.Hour
+
 type Queue struct {
 	q        mq.Queue
 	opt      *msgqueue.Options
 	memqueue *memqueue.Queue
+	fopt     *msgqueue.FactoryOptions
 
 	p *processor.Processor
 }
 
 var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
 
 func NewQueue(mqueue mq.Queue, opt *msgqueue.Options) *Queue {
+	return newQueue(mqueue, opt, nil)
+}
+
+func newQueue(mqueue mq.Queue, opt *msgqueue.Options, fopt *msgqueue.FactoryOptions) *Queue {
 	if opt.Name == "" {
 		opt.Name = mqueue.Name
 	}
 	opt.Init()
 
 	q := Queue{
-		q:   mqueue,
-		opt: opt,
+		q:    mqueue,
+		opt:  opt,
+		fopt: fopt,
 	}
 
 	memopt := msgqueue.Options{
@@ -42,10 +57,15 @@ func NewQueue(mqueue mq.Queue, opt *msgqueue.Options) *Queue {
 		MinBackoff: time.Second,
 		Handler:    msgqueue.HandlerFunc(q.add),
 
-		Redis: opt.Redis,
+		Redis:  opt.Redis,
+		Logger: opt.Logger,
 	}
 	if opt.Handler != nil {
-		memopt.FallbackHandler = internal.MessageUnwrapperHandler(opt.Handler)
+		memopt.FallbackHandler = internal.MessageUnwrapperHandler(opt.Handler, opt.Codec)
+	}
+	if opt.Sync {
+		// Messages are processed by the memqueue using queue options.
+		memopt = *opt
 	}
 	q.memqueue = memqueue.NewQueue(&memopt)
 
@@ -53,6 +73,16 @@ func NewQueue(mqueue mq.Queue, opt *msgqueue.Options) *Queue {
 	return &q
 }
 
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(mqueue mq.Queue, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(mqueue, opt), nil
+}
+
 func (q *Queue) Name() string {
 	return q.q.Name
 }
@@ -65,6 +95,22 @@ func (q *Queue) Options() *msgqueue.Options {
 	return q.opt
 }
 
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "ironmq",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxDelay,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
 func (q *Queue) Processor() *processor.Processor {
 	if q.p == nil {
 		q.p = processor.New(q, q.opt)
@@ -72,22 +118,45 @@ func (q *Queue) Processor() *processor.Processor {
 	return q.p
 }
 
+// Len returns number of messages in the queue.
+func (q *Queue) Len() (int, error) {
+	q.fopt.WaitAPI()
+	info, err := q.q.Info()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// Ping checks that the queue is reachable by requesting queue info.
+func (q *Queue) Ping() error {
+	q.fopt.WaitAPI()
+	_, err := q.q.Info()
+	return err
+}
+
 func (q *Queue) createQueue() error {
+	q.fopt.WaitAPI()
 	_, err := mq.ConfigCreateQueue(mq.QueueInfo{Name: q.q.Name}, &q.q.Settings)
 	return err
 }
 
 func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
 	msg = msg.Args[0].(*msgqueue.Message)
 
-	body, err := msg.MarshalArgs()
+	body, err := encodeBody(msg, q.opt.MaxAge > 0)
 	if err != nil {
 		return err
 	}
 
+	q.fopt.WaitAPI()
 	id, err := q.q.PushMessage(mq.Message{
 		Body:  body,
-		Delay: int64(msg.Delay / time.Second),
+		Delay: int64(msg.ScheduledDelay() / time.Second),
 	})
 	if err != nil {
 		return err
@@ -97,9 +166,97 @@ func (q *Queue) add(msg *msgqueue.Message) error {
 	return nil
 }
 
-// Add adds message to the queue.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	mqMsgs := make([]mq.Message, len(msgs))
+	for i, msg := range msgs {
+		body, err := encodeBody(msg, q.opt.MaxAge > 0)
+		if err != nil {
+			return err
+		}
+		mqMsgs[i] = mq.Message{
+			Body:  body,
+			Delay: int64(msg.ScheduledDelay() / time.Second),
+		}
+	}
+
+	q.fopt.WaitAPI()
+	ids, err := q.q.PushMessages(mqMsgs...)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if i < len(msgs) {
+			msgs[i].Id = id
+		}
+	}
+	return nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds IronMQ message size limit.
 func (q *Queue) Add(msg *msgqueue.Message) error {
-	return q.memqueue.Add(internal.WrapMessage(msg))
+	if q.opt.Sync {
+		return q.memqueue.Add(msg)
+	}
+	msg, err := internal.EncodeMessage(q.opt, msg)
+	if err != nil {
+		return err
+	}
+	if len(msg.Body) > maxMessageSize {
+		return msgqueue.ErrTooLarge
+	}
+	if q.opt.Upsert && msg.Name != "" {
+		pending, err := msgqueue.UpsertLatestArgs(q.opt, msg)
+		if err != nil || pending {
+			return err
+		}
+	}
+	msgqueue.InjectTrace(q.opt, msg)
+	return q.memqueue.Add(internal.WrapMessage(q.opt, msg))
+}
+
+// AddBatch adds messages to the queue using batched puts.
+// Named messages are added using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	if q.opt.Sync {
+		return q.memqueue.AddBatch(msgs)
+	}
+
+	const batchSize = 100
+
+	batch := make([]*msgqueue.Message, 0, batchSize)
+	for _, msg := range msgs {
+		if msg.Name != "" {
+			err := q.Add(msg)
+			if err != nil && err != msgqueue.ErrDuplicate {
+				return err
+			}
+			continue
+		}
+
+		msg, err := internal.EncodeMessage(q.opt, msg)
+		if err != nil {
+			return err
+		}
+		if len(msg.Body) > maxMessageSize {
+			return msgqueue.ErrTooLarge
+		}
+		msgqueue.InjectTrace(q.opt, msg)
+
+		batch = append(batch, msg)
+		if len(batch) == batchSize {
+			if err := q.memqueue.Add(internal.WrapMessages(batch)); err != nil {
+				return err
+			}
+			batch = make([]*msgqueue.Message, 0, batchSize)
+		}
+	}
+
+	if len(batch) > 0 {
+		return q.memqueue.Add(internal.WrapMessages(batch))
+	}
+	return nil
 }
 
 // Call creates a message using the args and adds it to the queue.
@@ -120,6 +277,7 @@ func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
 	if n > 100 {
 		n = 100
 	}
+	q.fopt.WaitAPI()
 	mqMsgs, err := q.q.LongPoll(n, int(q.opt.ReservationTimeout/time.Second), 1, false)
 	if err != nil {
 		if v, ok := err.(api.HTTPResponseError); ok && v.StatusCode() == 404 {
@@ -135,25 +293,50 @@ func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
 
 	msgs := make([]msgqueue.Message, len(mqMsgs))
 	for i, mqMsg := range mqMsgs {
+		env := decodeBody(mqMsg.Body)
 		msgs[i] = msgqueue.Message{
-			Id:   mqMsg.Id,
-			Body: mqMsg.Body,
+			Id:         mqMsg.Id,
+			Body:       env.Body,
+			Header:     env.Header,
+			Priority:   env.Priority,
+			RetryLimit: env.RetryLimit,
+			GroupKey:   env.GroupKey,
+			Barrier:    env.Barrier,
 
 			ReservationId: mqMsg.ReservationId,
 			ReservedCount: mqMsg.ReservedCount,
 		}
+		if env.CreatedAt > 0 {
+			msgs[i].CreatedAt = time.Unix(0, env.CreatedAt*int64(time.Millisecond))
+		}
 	}
 	return msgs, nil
 }
 
 func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
 	return retry(func() error {
+		q.fopt.WaitAPI()
 		return q.q.ReleaseMessage(msg.Id, msg.ReservationId, int64(delay/time.Second))
 	})
 }
 
+// Touch extends message reservation to the duration from now.
+// IronMQ issues new reservation id that is stored in the message.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	q.fopt.WaitAPI()
+	id, err := q.q.TouchMessageFor(msg.Id, msg.ReservationId, int(dur/time.Second))
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		msg.ReservationId = id
+	}
+	return nil
+}
+
 func (q *Queue) Delete(msg *msgqueue.Message) error {
 	err := retry(func() error {
+		q.fopt.WaitAPI()
 		return q.q.DeleteMessage(msg.Id, msg.ReservationId)
 	})
 	if err == nil {
@@ -174,11 +357,13 @@ func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
 		}
 	}
 	return retry(func() error {
+		q.fopt.WaitAPI()
 		return q.q.DeleteReservedMessages(mqMsgs)
 	})
 }
 
 func (q *Queue) Purge() error {
+	q.fopt.WaitAPI()
 	return q.q.Clear()
 }
 
@@ -201,6 +386,61 @@ func (q *Queue) CloseTimeout(timeout time.Duration) error {
 	return firstErr
 }
 
+// IronMQ messages don't have attributes so message with headers,
+// priority, retry limit, group key, barrier flag, or creation time
+// is stored as JSON envelope.
+type envelope struct {
+	Header     map[string]string `json:"header"`
+	Priority   int               `json:"priority,omitempty"`
+	RetryLimit int               `json:"retry_limit,omitempty"`
+	GroupKey   string            `json:"group_key,omitempty"`
+	Barrier    bool              `json:"barrier,omitempty"`
+	CreatedAt  int64             `json:"created_at,omitempty"` // Unix time in milliseconds
+	Body       string            `json:"body"`
+}
+
+const envelopePrefix = `{"header":`
+
+// encodeBody encodes message body and attributes. Creation time is only
+// stored when createdAt is true, i.e. when the queue uses MaxAge.
+func encodeBody(msg *msgqueue.Message, createdAt bool) (string, error) {
+	if len(msg.Header) == 0 && msg.Priority == 0 && msg.RetryLimit == 0 &&
+		msg.GroupKey == "" && !msg.Barrier && !createdAt {
+		return msg.Body, nil
+	}
+	env := envelope{
+		Header:     msg.Header,
+		Priority:   msg.Priority,
+		RetryLimit: msg.RetryLimit,
+		GroupKey:   msg.GroupKey,
+		Barrier:    msg.Barrier,
+		Body:       msg.Body,
+	}
+	if createdAt {
+		tm := msg.CreatedAt
+		if tm.IsZero() {
+			tm = time.Now()
+		}
+		env.CreatedAt = tm.UnixNano() / int64(time.Millisecond)
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeBody(body string) envelope {
+	if !strings.HasPrefix(body, envelopePrefix) {
+		return envelope{Body: body}
+	}
+	var env envelope
+	if err := json.Unmarshal([]byte(body), &env); err != nil {
+		return envelope{Body: body}
+	}
+	return env
+}
+
 func retry(fn func() error) error {
 	var err error
 	for i := 0; i < 3; i++ {
@@ -0,0 +1,100 @@
+package msgqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Outcomes of message processing recorded in the Ledger.
+const (
+	OutcomeProcessed = "processed"
+	OutcomeDiscarded = "discarded"
+	OutcomeRetried   = "retried"
+	OutcomeRequeued  = "requeued"
+	OutcomeFailed    = "failed"
+	OutcomeExpired   = "expired"
+)
+
+// LedgerEntry describes one attempt to process a message.
+type LedgerEntry struct {
+	Queue     string        `json:"queue"`
+	MessageId string        `json:"message_id,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Attempt   int           `json:"attempt"`
+	Outcome   string        `json:"outcome"`
+	Error     string        `json:"error,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Worker    string        `json:"worker"`
+	Time      time.Time     `json:"time"`
+}
+
+// Ledger records processed messages, e.g. to satisfy audit requirements.
+// Record is called synchronously by the worker after each attempt,
+// so implementations should be fast. Record errors are logged
+// and do not affect message processing.
+type Ledger interface {
+	Record(entry *LedgerEntry) error
+}
+
+// RedisLedger stores ledger entries in Redis hashes, one hash
+// per queue per UTC day. Hashes expire after the retention period.
+type RedisLedger struct {
+	redis     RedisCmdable
+	retention time.Duration
+}
+
+var _ Ledger = (*RedisLedger)(nil)
+
+// NewRedisLedger returns RedisLedger that keeps entries
+// for at least the retention period.
+func NewRedisLedger(redis RedisCmdable, retention time.Duration) *RedisLedger {
+	return &RedisLedger{
+		redis:     redis,
+		retention: retention,
+	}
+}
+
+func (l *RedisLedger) key(queue string, day time.Time) string {
+	return fmt.Sprintf("msgqueue:ledger:%s:%s", queue, day.UTC().Format("2006-01-02"))
+}
+
+func (l *RedisLedger) Record(entry *LedgerEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := l.key(entry.Queue, entry.Time)
+	field := strconv.FormatInt(entry.Time.UnixNano(), 10) + ":" + entry.MessageId
+	_, err = l.redis.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.HSet(key, field, b)
+		// The hash is extended by a day, because it is written to
+		// until the end of the day.
+		pipe.Expire(key, l.retention+24*time.Hour)
+		return nil
+	})
+	return err
+}
+
+// Entries returns entries recorded for the queue on the UTC day.
+// Entries are not sorted.
+func (l *RedisLedger) Entries(queue string, day time.Time) ([]*LedgerEntry, error) {
+	m, err := l.redis.HGetAll(l.key(queue, day)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*LedgerEntry, 0, len(m))
+	for _, s := range m {
+		entry := new(LedgerEntry)
+		if err := json.Unmarshal([]byte(s), entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,122 @@
+package msgqueue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Time after which the lock of the crashed process expires.
+// Locks of running handlers are refreshed every lockTTL/2.
+const lockTTL = time.Minute
+
+// Delay after which the message that can't acquire the lock is retried.
+const lockRetryDelay = time.Second
+
+// Lock is refreshed and released only by its owner. Checking the owner
+// and changing the key must be atomic, because the lock can expire and
+// be acquired by another process between two commands.
+const refreshLockScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`
+
+const releaseLockScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`
+
+type lockEnvKey struct{}
+
+type lockEnv struct {
+	opt *Options
+}
+
+// ContextWithRedis returns a copy of ctx that carries queue options
+// with Redis client used by WithLock. It is used by the processor.
+func ContextWithRedis(ctx context.Context, opt *Options) context.Context {
+	return context.WithValue(ctx, lockEnvKey{}, &lockEnv{
+		opt: opt,
+	})
+}
+
+// WithLock calls fn while holding Redis lock with the key, e.g. to run
+// singleton jobs. Lock uses Options.Redis of the queue that processes
+// the message and the key is scoped to the queue name, so queues with
+// different factory prefixes don't share locks. When the lock is held
+// elsewhere, fn is not called and WithLock returns Requeue error, so
+// the message is released with a short delay without counting it as
+// a failure.
+func WithLock(ctx context.Context, key string, fn func() error) error {
+	env, ok := ctx.Value(lockEnvKey{}).(*lockEnv)
+	if !ok || env.opt.Redis == nil {
+		return errors.New("queue: WithLock requires Options.Redis")
+	}
+	opt := env.opt
+	redis, ok := opt.Redis.(RedisCmdable)
+	if !ok {
+		return errors.New("queue: WithLock requires Redis that implements RedisCmdable")
+	}
+
+	key = fmt.Sprintf("lock:%s:%s", opt.Name, key)
+	token, err := lockToken()
+	if err != nil {
+		return err
+	}
+	ok, err = redis.SetNX(key, token, lockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return Requeue(lockRetryDelay)
+	}
+
+	done := make(chan struct{})
+	go refreshLock(opt, redis, key, token, done)
+	defer func() {
+		close(done)
+		err := redis.Eval(releaseLockScript, []string{key}, token).Err()
+		if err != nil {
+			opt.Logf(LogWarn, "queue: releasing lock %q failed: %s", key, err)
+		}
+	}()
+
+	return fn()
+}
+
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func refreshLock(opt *Options, redis RedisCmdable, key, token string, done <-chan struct{}) {
+	ticker := time.NewTicker(lockTTL / 2)
+	defer ticker.Stop()
+
+	ttl := int64(lockTTL / time.Millisecond)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		v, err := redis.Eval(refreshLockScript, []string{key}, token, ttl).Result()
+		if err != nil {
+			opt.Logf(LogWarn, "queue: refreshing lock %q failed: %s", key, err)
+			continue
+		}
+		if n, _ := v.(int64); n == 0 {
+			opt.Logf(LogWarn, "queue: lock %q expired and is held by another owner", key)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package msgqueue
+
+import "log"
+
+// Logger is used by processors and queues to log errors and events.
+// *log.Logger implements it. See logging/zap and logging/logrus
+// packages for structured logging adapters.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LevelLogger is Logger that supports log levels. Messages are passed
+// to Printf of loggers that don't implement it.
+type LevelLogger interface {
+	Logger
+	Logf(level LogLevel, format string, v ...interface{})
+}
+
+// LogLevel is the log message severity.
+type LogLevel int
+
+const (
+	// LogDebug is used for details of fetching and processing messages.
+	LogDebug LogLevel = iota - 1
+	// LogInfo is used for processor lifecycle events.
+	LogInfo
+	// LogWarn is used for recoverable failures, e.g. retried messages.
+	LogWarn
+	// LogError is used for failures, e.g. messages that failed permanently.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Logf logs the message using Options.Logger if level
+// is not below Options.LogLevel.
+func (opt *Options) Logf(level LogLevel, format string, v ...interface{}) {
+	if level < opt.LogLevel {
+		return
+	}
+	if l, ok := opt.Logger.(LevelLogger); ok {
+		l.Logf(level, format, v...)
+		return
+	}
+	opt.Logger.Printf(format, v...)
+}
+
+// stdLogger logs using the standard logger of log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
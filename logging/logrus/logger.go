@@ -0,0 +1,40 @@
+// Package logrus adapts logrus logger to msgqueue.Logger.
+package logrus
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Logger is msgqueue.Logger that logs using logrus.
+type Logger struct {
+	logger logrus.FieldLogger
+}
+
+var _ msgqueue.LevelLogger = (*Logger)(nil)
+
+// New returns Logger that logs using the logger with component=msgqueue
+// field. Messages without level are logged at info level.
+func New(logger logrus.FieldLogger) *Logger {
+	return &Logger{
+		logger: logger.WithField("component", "msgqueue"),
+	}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.logger.Infof(format, v...)
+}
+
+func (l *Logger) Logf(level msgqueue.LogLevel, format string, v ...interface{}) {
+	switch level {
+	case msgqueue.LogDebug:
+		l.logger.Debugf(format, v...)
+	case msgqueue.LogWarn:
+		l.logger.Warnf(format, v...)
+	case msgqueue.LogError:
+		l.logger.Errorf(format, v...)
+	default:
+		l.logger.Infof(format, v...)
+	}
+}
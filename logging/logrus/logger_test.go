@@ -0,0 +1,37 @@
+package logrus_test
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"github.com/go-msgqueue/msgqueue"
+	msglogrus "github.com/go-msgqueue/msgqueue/logging/logrus"
+)
+
+func TestLogger(t *testing.T) {
+	base, hook := test.NewNullLogger()
+	logger := msglogrus.New(base)
+
+	logger.Printf("%s is connected", "emails")
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("got no entries")
+	}
+	if entry.Level != logrus.InfoLevel {
+		t.Fatalf("got level %s, wanted info", entry.Level)
+	}
+	if entry.Message != "emails is connected" {
+		t.Fatalf("got message %q", entry.Message)
+	}
+	if v := entry.Data["component"]; v != "msgqueue" {
+		t.Fatalf("got component %v, wanted msgqueue", v)
+	}
+
+	logger.Logf(msgqueue.LogWarn, "%s Touch failed", "emails")
+	if level := hook.LastEntry().Level; level != logrus.WarnLevel {
+		t.Fatalf("got level %s, wanted warning", level)
+	}
+}
@@ -0,0 +1,40 @@
+// Package zap adapts zap logger to msgqueue.Logger.
+package zap
+
+import (
+	"go.uber.org/zap"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Logger is msgqueue.Logger that logs using zap.
+type Logger struct {
+	logger *zap.SugaredLogger
+}
+
+var _ msgqueue.LevelLogger = (*Logger)(nil)
+
+// New returns Logger that logs using the logger with component=msgqueue
+// field. Messages without level are logged at info level.
+func New(logger *zap.Logger) *Logger {
+	return &Logger{
+		logger: logger.With(zap.String("component", "msgqueue")).Sugar(),
+	}
+}
+
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.logger.Infof(format, v...)
+}
+
+func (l *Logger) Logf(level msgqueue.LogLevel, format string, v ...interface{}) {
+	switch level {
+	case msgqueue.LogDebug:
+		l.logger.Debugf(format, v...)
+	case msgqueue.LogWarn:
+		l.logger.Warnf(format, v...)
+	case msgqueue.LogError:
+		l.logger.Errorf(format, v...)
+	default:
+		l.logger.Infof(format, v...)
+	}
+}
@@ -0,0 +1,40 @@
+package zap_test
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/go-msgqueue/msgqueue"
+	msgzap "github.com/go-msgqueue/msgqueue/logging/zap"
+)
+
+func TestLogger(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := msgzap.New(zap.New(core))
+
+	logger.Printf("%s is connected", "emails")
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, wanted 1", len(entries))
+	}
+	if msg := entries[0].Message; msg != "emails is connected" {
+		t.Fatalf("got message %q", msg)
+	}
+	if v := entries[0].ContextMap()["component"]; v != "msgqueue" {
+		t.Fatalf("got component %v, wanted msgqueue", v)
+	}
+
+	logger.Logf(msgqueue.LogDebug, "reserved %d messages", 10)
+	logger.Logf(msgqueue.LogError, "%s Release failed", "emails")
+
+	entries = logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, wanted 2", len(entries))
+	}
+	if level := entries[1].Level; level != zap.ErrorLevel {
+		t.Fatalf("got level %s, wanted error", level)
+	}
+}
@@ -0,0 +1,162 @@
+package memqueue
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// OverflowPolicy determines what Add does when the queue is full.
+type OverflowPolicy int
+
+const (
+	// Block blocks Add until a message is taken by the processor.
+	Block OverflowPolicy = iota
+	// Reject makes Add return msgqueue.ErrQueueFull.
+	Reject
+	// DropOldest deletes the oldest waiting message without
+	// processing it to make room for the new one.
+	DropOldest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case Reject:
+		return "reject"
+	case DropOldest:
+		return "drop-oldest"
+	default:
+		return "unknown"
+	}
+}
+
+type backlog struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // signaled when messages are pushed or taken
+	msgs     *list.List
+	capacity int
+	policy   OverflowPolicy
+}
+
+// SetCapacity limits the number of added messages that wait for the
+// processor, so a slow handler does not make the queue grow without
+// bound. Messages buffered by the processor, delayed, and retried
+// messages don't count towards capacity. The policy determines what Add
+// does when the queue is full. It must be called before messages are
+// added and has no effect in Sync mode.
+func (q *Queue) SetCapacity(capacity int, policy OverflowPolicy) {
+	if q.backlog != nil {
+		q.backlog.mu.Lock()
+		q.backlog.capacity = capacity
+		q.backlog.policy = policy
+		q.backlog.cond.Broadcast()
+		q.backlog.mu.Unlock()
+		return
+	}
+
+	b := &backlog{
+		msgs:     list.New(),
+		capacity: capacity,
+		policy:   policy,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	q.backlog = b
+	go q.feed()
+}
+
+// push adds the message to the backlog applying the overflow policy.
+// Messages are rejected once the queue is closed, because the backlog
+// is only drained after that.
+func (q *Queue) push(msg *msgqueue.Message) error {
+	var dropped []*msgqueue.Message
+
+	b := q.backlog
+	b.mu.Lock()
+	for {
+		if q.isClosed() {
+			b.mu.Unlock()
+			_ = q.Delete(msg)
+			return msgqueue.ErrShutdown
+		}
+		if b.capacity <= 0 || b.msgs.Len() < b.capacity {
+			break
+		}
+
+		switch b.policy {
+		case Reject:
+			b.mu.Unlock()
+			_ = q.Delete(msg)
+			return msgqueue.ErrQueueFull
+		case DropOldest:
+			el := b.msgs.Front()
+			dropped = append(dropped, b.msgs.Remove(el).(*msgqueue.Message))
+		default:
+			b.cond.Wait()
+		}
+	}
+	b.msgs.PushBack(msg)
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	for _, msg := range dropped {
+		q.opt.Logf(msgqueue.LogWarn, "%s is full, dropping %s", q, msg)
+		_ = q.Delete(msg)
+	}
+	return nil
+}
+
+// feed moves messages from the backlog to the processor
+// until the queue is closed and the backlog is drained.
+func (q *Queue) feed() {
+	b := q.backlog
+	for {
+		b.mu.Lock()
+		for b.msgs.Len() == 0 && !q.isClosed() {
+			b.cond.Wait()
+		}
+		if b.msgs.Len() == 0 {
+			b.mu.Unlock()
+			return
+		}
+		msg := b.msgs.Remove(b.msgs.Front()).(*msgqueue.Message)
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		_ = q.p.Add(msg)
+	}
+}
+
+// purgeBacklog deletes messages that wait in the backlog.
+func (q *Queue) purgeBacklog() {
+	b := q.backlog
+	b.mu.Lock()
+	msgs := make([]*msgqueue.Message, 0, b.msgs.Len())
+	for b.msgs.Len() > 0 {
+		msgs = append(msgs, b.msgs.Remove(b.msgs.Front()).(*msgqueue.Message))
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	for _, msg := range msgs {
+		_ = q.Delete(msg)
+	}
+}
+
+func (q *Queue) wakeBacklog() {
+	b := q.backlog
+	b.mu.Lock()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (q *Queue) isClosed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,26 @@
+package memqueue
+
+import (
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Factory creates queues that share Redis client and queue name prefix.
+type Factory struct {
+	opt *msgqueue.FactoryOptions
+}
+
+func NewFactory(opt *msgqueue.FactoryOptions) *Factory {
+	if opt == nil {
+		opt = new(msgqueue.FactoryOptions)
+	}
+	opt.Init()
+	return &Factory{
+		opt: opt,
+	}
+}
+
+// NewQueue creates new Queue that uses factory resources.
+func (f *Factory) NewQueue(opt *msgqueue.Options) *Queue {
+	f.opt.InitQueue(opt)
+	return NewQueue(opt)
+}
@@ -1,8 +1,15 @@
 package memqueue_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -10,6 +17,7 @@ import (
 
 	"github.com/go-msgqueue/msgqueue"
 	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/processor"
 
 	"github.com/go-redis/rate"
 	"github.com/go-redis/redis"
@@ -47,6 +55,31 @@ var _ = Describe("message with args", func() {
 	})
 })
 
+var _ = Describe("message with args passed by reference", func() {
+	type payload struct {
+		N int
+	}
+
+	It("passes original values without encoding", func() {
+		ch := make(chan *payload, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(p *payload, m map[string]int) {
+				ch <- p
+			},
+			Sync: true,
+		})
+		defer q.Close()
+
+		p := &payload{N: 42}
+		err := q.Call(p, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		var got *payload
+		Expect(ch).To(Receive(&got))
+		Expect(got).To(BeIdenticalTo(p))
+	})
+})
+
 var _ = Describe("message with invalid number of args", func() {
 	ch := make(chan bool, 10)
 	handler := func(s string) {
@@ -101,6 +134,336 @@ var _ = Describe("handler that expects Message", func() {
 	})
 })
 
+type workerKey struct{}
+
+var _ = Describe("handler middleware", func() {
+	ch := make(chan string, 10)
+	middleware := func(name string) func(msgqueue.Handler) msgqueue.Handler {
+		return func(h msgqueue.Handler) msgqueue.Handler {
+			return msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+				ch <- name + " before"
+				err := h.HandleMessage(msg)
+				ch <- name + " after"
+				return err
+			})
+		}
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				ch <- "handler"
+			},
+			Middleware: []func(msgqueue.Handler) msgqueue.Handler{
+				middleware("outer"),
+				middleware("inner"),
+			},
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("wraps handler in order", func() {
+		for _, s := range []string{
+			"outer before", "inner before", "handler", "inner after", "outer after",
+		} {
+			Expect(ch).To(Receive(Equal(s)))
+		}
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("expvar", func() {
+	It("publishes processor stats", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:    "expvar-queue",
+			Handler: func() {},
+			Expvar:  true,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		stats := expvar.Get("msgqueue").(*expvar.Map).Get("expvar-queue")
+		Expect(stats).NotTo(BeNil())
+		Expect(stats.String()).To(ContainSubstring(`"Processed":1`))
+	})
+})
+
+var _ = Describe("worker hooks", func() {
+	var inits, shutdowns int32
+	ch := make(chan int, 10)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&inits, 0)
+		atomic.StoreInt32(&shutdowns, 0)
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context) {
+				ch <- ctx.Value(workerKey{}).(int)
+			},
+			WorkerNumber: 2,
+			WorkerInit: func(ctx context.Context) (context.Context, error) {
+				n := atomic.AddInt32(&inits, 1)
+				if n == 1 {
+					return nil, errors.New("not ready")
+				}
+				return context.WithValue(ctx, workerKey{}, int(n)), nil
+			},
+			WorkerShutdown: func(ctx context.Context) {
+				Expect(ctx.Value(workerKey{})).NotTo(BeNil())
+				atomic.AddInt32(&shutdowns, 1)
+			},
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(ch, 3*time.Second).Should(Receive(BeNumerically(">", 1)))
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&inits)
+		}, 3*time.Second).Should(Equal(int32(3)))
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("retries failed init and shuts down initialized workers", func() {
+		Expect(atomic.LoadInt32(&shutdowns)).To(Equal(int32(2)))
+	})
+})
+
+var _ = Describe("message with JSON body", func() {
+	ch := make(chan bool, 10)
+	handler := func(s string, i int) {
+		Expect(s).To(Equal("string"))
+		Expect(i).To(Equal(42))
+		ch <- true
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: handler,
+			Codec:   msgqueue.JSONCodec,
+		})
+
+		msg := msgqueue.NewMessage("string", 42)
+		body, err := msg.EncodeArgs(msgqueue.JSONCodec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal(`["string",42]`))
+
+		err = q.Add(&msgqueue.Message{Body: body})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is decoded using codec", func() {
+		Expect(ch).To(Receive())
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("message from external producer", func() {
+	type payload struct {
+		UserId int `json:"user_id"`
+	}
+
+	ch := make(chan payload, 10)
+	handler := func(p payload) {
+		ch <- p
+	}
+
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write([]byte(s))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(zw.Close()).NotTo(HaveOccurred())
+		return buf.String()
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	const plain = `{"user_id": 42}`
+	bodies := []string{
+		plain,
+		b64(plain),
+		gzipped(plain),
+		b64(gzipped(plain)),
+		`{"Type": "Notification", "Message": "` + b64(gzipped(plain)) + `"}`,
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: handler,
+			Codec:   msgqueue.InteropCodec(msgqueue.MsgpackCodec),
+		})
+
+		for _, body := range bodies {
+			err := q.Add(&msgqueue.Message{Body: body})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Call(payload{UserId: 42})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is decoded", func() {
+		for i := 0; i < len(bodies)+1; i++ {
+			Expect(ch).To(Receive(Equal(payload{UserId: 42})))
+		}
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("payload size stats", func() {
+	It("tracks min, avg, and max body size", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:      func(s string) {},
+			Codec:        msgqueue.JSONCodec,
+			WorkerNumber: 1,
+		})
+
+		for _, body := range []string{`["a"]`, `["aaaaaaaaaaaaaaa"]`} {
+			err := q.Add(&msgqueue.Message{Body: body})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		err := q.Call("not encoded")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(3)))
+		Expect(st.MinPayloadSize).To(Equal(uint32(5)))
+		Expect(st.MaxPayloadSize).To(Equal(uint32(19)))
+		Expect(st.AvgPayloadSize).To(BeNumerically(">=", 5))
+		Expect(st.AvgPayloadSize).To(BeNumerically("<=", 19))
+	})
+})
+
+var _ = Describe("message with header", func() {
+	ch := make(chan map[string]string, 10)
+	handler := func(msg *msgqueue.Message) error {
+		ch <- msg.Header
+		if msg.ReservedCount < 2 {
+			return errors.New("fake error")
+		}
+		return nil
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:    msgqueue.HandlerFunc(handler),
+			MinBackoff: time.Millisecond,
+		})
+
+		msg := msgqueue.NewMessage()
+		msg.Header = map[string]string{"tenant": "acme"}
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("preserves header on retry", func() {
+		header := map[string]string{"tenant": "acme"}
+		Expect(ch).To(Receive(Equal(header)))
+		Expect(ch).To(Receive(Equal(header)))
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("handler that expects context", func() {
+	ch := make(chan bool, 10)
+	handler := func(ctx context.Context, s string) {
+		Expect(ctx).NotTo(BeNil())
+		Expect(s).To(Equal("string"))
+		ch <- true
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: handler,
+		})
+		q.Call("string")
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is called with context", func() {
+		Expect(ch).To(Receive())
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("context passed to handler", func() {
+	ch := make(chan error, 10)
+	handler := func(ctx context.Context) {
+		<-ctx.Done()
+		ch <- ctx.Err()
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: handler,
+		})
+		defer q.Close()
+
+		q.Call()
+		time.Sleep(100 * time.Millisecond)
+
+		err := q.Processor().StopTimeout(100 * time.Millisecond)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("is cancelled when stop timeout expires", func() {
+		Expect(ch).To(Receive(Equal(context.Canceled)))
+	})
+})
+
+var _ = Describe("context of drained messages", func() {
+	It("is not cancelled until buffered messages are processed", func() {
+		ch := make(chan error, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context) {
+				time.Sleep(10 * time.Millisecond)
+				ch <- ctx.Err()
+			},
+			WorkerNumber: 1,
+			BufferSize:   10,
+		})
+
+		for i := 0; i < 3; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 3; i++ {
+			Expect(ch).To(Receive(BeNil()))
+		}
+	})
+})
+
 var _ = Describe("message retry timing", func() {
 	var q *memqueue.Queue
 	backoff := 100 * time.Millisecond
@@ -164,35 +527,2382 @@ var _ = Describe("message retry timing", func() {
 		})
 	})
 
-	Context("with NoDelay=true", func() {
-		BeforeEach(func() {
-			err := q.Close()
-			Expect(err).NotTo(HaveOccurred())
+	Context("message with ScheduledAt", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now().Add(5 * backoff)
+			msg := msgqueue.NewMessage()
+			msg.ScheduledAt = now
+
+			q.Add(msg)
+
+			err := q.Close()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("is retried in time", func() {
+			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
+			Expect(ch).To(Receive(BeTemporally("~", now.Add(backoff), backoff/10)))
+			Expect(ch).To(Receive(BeTemporally("~", now.Add(3*backoff), backoff/10)))
+			Expect(ch).NotTo(Receive())
+		})
+	})
+
+	Context("with NoDelay=true", func() {
+		BeforeEach(func() {
+			err := q.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			q = memqueue.NewQueue(&msgqueue.Options{
+				Handler:    handler,
+				RetryLimit: 3,
+				MinBackoff: backoff,
+			})
+			q.SetNoDelay(true)
+		})
+
+		It("is processed immediately", func() {
+			now := time.Now()
+
+			msg := msgqueue.NewMessage()
+			msg.Delay = time.Hour
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = q.Close()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
+			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
+			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
+			Expect(ch).NotTo(Receive())
+		})
+	})
+})
+
+var _ = Describe("message with retry limit", func() {
+	var count int32
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&count, 0)
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				atomic.AddInt32(&count, 1)
+				return errors.New("fake error")
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		msg := msgqueue.NewMessage()
+		msg.RetryLimit = 1
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("overrides queue retry limit", func() {
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(1)))
+	})
+})
+
+var _ = Describe("unretryable error", func() {
+	var count int32
+	ch := make(chan error, 10)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&count, 0)
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				atomic.AddInt32(&count, 1)
+				return msgqueue.Unretryable(errors.New("invalid message"))
+			},
+			FallbackHandler: func() {
+				ch <- nil
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("fails message without retries", func() {
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(1)))
+		Expect(ch).To(Receive())
+	})
+})
+
+var _ = Describe("Nack", func() {
+	const delay = 100 * time.Millisecond
+	ch := make(chan time.Time, 10)
+	var start time.Time
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				ch <- time.Now()
+				if len(ch) == 1 {
+					return msgqueue.Nack(delay)
+				}
+				return nil
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Hour,
+		})
+
+		start = time.Now()
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("retries message after the delay", func() {
+		Expect(ch).To(Receive(BeTemporally("~", start, delay/2)))
+		Expect(ch).To(Receive(BeTemporally("~", start.Add(delay), delay/2)))
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("Requeue", func() {
+	It("releases message without counting retries", func() {
+		var calls uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				switch atomic.AddUint32(&calls, 1) {
+				case 1:
+					return msgqueue.ErrRequeue
+				case 2:
+					return msgqueue.Requeue(time.Millisecond)
+				default:
+					return nil
+				}
+			},
+			RetryLimit: 1,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(atomic.LoadUint32(&calls)).To(Equal(uint32(3)))
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Expect(st.Requeued).To(Equal(uint64(2)))
+		Expect(st.Retries).To(Equal(uint64(0)))
+		Expect(st.Fails).To(Equal(uint64(0)))
+	})
+})
+
+var _ = Describe("Discard", func() {
+	var count int32
+	ch := make(chan bool, 10)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&count, 0)
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				atomic.AddInt32(&count, 1)
+				return msgqueue.Discard()
+			},
+			FallbackHandler: func() {
+				ch <- true
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("drops message without fallback", func() {
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(1)))
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("wrapped errors", func() {
+	It("returns nil for nil unretryable error", func() {
+		Expect(msgqueue.Unretryable(nil)).To(BeNil())
+
+		var count int32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				atomic.AddInt32(&count, 1)
+				return msgqueue.Unretryable(nil)
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(1)))
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Expect(st.Fails).To(Equal(uint64(0)))
+	})
+
+	It("unwraps unretryable error", func() {
+		invalid := errors.New("invalid message")
+		wrapped := fmt.Errorf("validate: %w", msgqueue.Unretryable(invalid))
+		Expect(errors.Is(wrapped, invalid)).To(BeTrue())
+
+		var count int32
+		ch := make(chan bool, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				atomic.AddInt32(&count, 1)
+				return wrapped
+			},
+			FallbackHandler: func() {
+				ch <- true
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(1)))
+		Expect(ch).To(Receive())
+	})
+
+	It("requeues and discards message", func() {
+		var calls uint32
+		ch := make(chan bool, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				if atomic.AddUint32(&calls, 1) == 1 {
+					return fmt.Errorf("busy: %w", msgqueue.ErrRequeue)
+				}
+				return fmt.Errorf("stale: %w", msgqueue.Discard())
+			},
+			FallbackHandler: func() {
+				ch <- true
+			},
+			RetryLimit: 1,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(atomic.LoadUint32(&calls)).To(Equal(uint32(2)))
+		Expect(ch).NotTo(Receive())
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Expect(st.Requeued).To(Equal(uint64(1)))
+		Expect(st.Fails).To(Equal(uint64(0)))
+	})
+})
+
+var _ = Describe("panicking handler", func() {
+	var q *memqueue.Queue
+	var count int32
+	ch := make(chan interface{}, 10)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&count, 0)
+
+		q = memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				if atomic.AddInt32(&count, 1) == 1 {
+					panic("boom")
+				}
+			},
+			PanicHandler: func(msg *msgqueue.Message, recovered interface{}, stack []byte) {
+				Expect(stack).NotTo(BeEmpty())
+				ch <- recovered
+			},
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is recovered and retried", func() {
+		Expect(ch).To(Receive(Equal("boom")))
+		Expect(atomic.LoadInt32(&count)).To(Equal(int32(2)))
+
+		st := q.Processor().Stats()
+		Expect(st.Panics).To(Equal(uint64(1)))
+		Expect(st.Processed).To(Equal(uint64(1)))
+	})
+})
+
+var _ = Describe("Pause", func() {
+	It("stops processing until Resume", func() {
+		ch := make(chan bool, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				ch <- true
+			},
+			BufferSize: 10,
+		})
+
+		p := q.Processor()
+		p.Pause()
+		Expect(p.Paused()).To(BeTrue())
+		Expect(p.Stats().Paused).To(BeTrue())
+
+		for i := 0; i < 3; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Consistently(ch, 100*time.Millisecond).ShouldNot(Receive())
+
+		p.Resume()
+		Expect(p.Paused()).To(BeFalse())
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ch).To(HaveLen(3))
+	})
+})
+
+var _ = Describe("MaxAge", func() {
+	oldMessage := func(s string) *msgqueue.Message {
+		msg := msgqueue.NewMessage(s)
+		msg.CreatedAt = time.Now().Add(-time.Hour)
+		return msg
+	}
+
+	It("moves expired messages to DeadLetterQueue", func() {
+		dlqCh := make(chan string, 10)
+		dlq := memqueue.NewQueue(&msgqueue.Options{
+			Name: "max-age-dlq",
+			Handler: func(queue, reason string, attempts int, body string) {
+				dlqCh <- reason
+			},
+		})
+
+		processed := make(chan string, 10)
+		var expired []string
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "max-age",
+			Handler: func(s string) {
+				processed <- s
+			},
+			MaxAge:          time.Minute,
+			DeadLetterQueue: dlq,
+			ExpiredHandler: func(msg *msgqueue.Message, age time.Duration) {
+				expired = append(expired, msg.Args[0].(string))
+			},
+			WorkerNumber: 1,
+		})
+
+		err := q.Add(oldMessage("old"))
+		Expect(err).NotTo(HaveOccurred())
+		err = q.Call("fresh")
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		err = dlq.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(processed).To(Receive(Equal("fresh")))
+		Expect(processed).NotTo(Receive())
+		Expect(dlqCh).To(Receive(Equal(msgqueue.ErrExpired.Error())))
+		Expect(expired).To(Equal([]string{"old"}))
+
+		st := q.Processor().Stats()
+		Expect(st.Expired).To(Equal(uint64(1)))
+		Expect(st.DeadLettered).To(Equal(uint64(1)))
+		Expect(st.InFlight).To(Equal(uint32(0)))
+	})
+
+	It("drops expired messages at ExpireRateLimit", func() {
+		var processed uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(s string) {
+				atomic.AddUint32(&processed, 1)
+			},
+			MaxAge:          time.Minute,
+			ExpireRateLimit: timerate.Every(time.Hour),
+			ExpiredHandler:  func(*msgqueue.Message, time.Duration) {},
+		})
+
+		for i := 0; i < 3; i++ {
+			err := q.Add(oldMessage("old"))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(q.Processor().Stats().Expired).To(Equal(uint64(1)))
+		Expect(atomic.LoadUint32(&processed)).To(Equal(uint32(2)))
+	})
+
+	It("returns ErrExpired in Sync mode", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:        func(s string) {},
+			MaxAge:         time.Minute,
+			ExpiredHandler: func(*msgqueue.Message, time.Duration) {},
+			Sync:           true,
+		})
+		defer q.Close()
+
+		err := q.Add(oldMessage("old"))
+		Expect(err).To(Equal(msgqueue.ErrExpired))
+	})
+})
+
+var _ = Describe("CaptureOutput", func() {
+	It("attaches handler output to dead-lettered message", func() {
+		dlqCh := make(chan *msgqueue.Message, 10)
+		dlq := memqueue.NewQueue(&msgqueue.Options{
+			Name: "capture-output-dlq",
+			Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+				dlqCh <- msg
+				return nil
+			}),
+		})
+
+		fallbackCh := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "capture-output",
+			Handler: func(ctx context.Context) error {
+				fmt.Fprintln(msgqueue.Output(ctx), "connecting to db")
+				return errors.New("fake error")
+			},
+			FallbackHandler: func(ctx context.Context) {
+				fallbackCh <- msgqueue.CapturedOutput(ctx)
+			},
+			CaptureOutput:   true,
+			DeadLetterQueue: dlq,
+			RetryLimit:      1,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		err = dlq.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var msg *msgqueue.Message
+		Expect(dlqCh).To(Receive(&msg))
+		Expect(msg.Header).To(HaveKeyWithValue("output", "connecting to db\n"))
+		Expect(fallbackCh).NotTo(Receive())
+	})
+
+	It("captures output for fallback handler", func() {
+		fallbackCh := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context) error {
+				fmt.Fprint(msgqueue.Output(ctx), "step 1")
+				return errors.New("fake error")
+			},
+			FallbackHandler: func(ctx context.Context) {
+				fallbackCh <- msgqueue.CapturedOutput(ctx)
+			},
+			CaptureOutput: true,
+			RetryLimit:    1,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fallbackCh).To(Receive(Equal("step 1")))
+	})
+})
+
+var _ = Describe("HandlerTimeout", func() {
+	It("retries message when handler hangs", func() {
+		hang := make(chan struct{})
+		defer close(hang)
+
+		var calls uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				if atomic.AddUint32(&calls, 1) == 1 {
+					<-hang
+				}
+			},
+			HandlerTimeout: 50 * time.Millisecond,
+			RetryLimit:     2,
+			MinBackoff:     time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		st := q.Processor().Stats()
+		Expect(st.Timeouts).To(Equal(uint64(1)))
+		Expect(st.Retries).To(Equal(uint64(1)))
+		Expect(st.Processed).To(Equal(uint64(1)))
+	})
+
+	It("abandons at most WorkerNumber handlers", func() {
+		hang := make(chan struct{})
+
+		var calls uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				if atomic.AddUint32(&calls, 1) <= 2 {
+					<-hang
+				}
+			},
+			WorkerNumber:   1,
+			HandlerTimeout: 50 * time.Millisecond,
+			RetryLimit:     3,
+			MinBackoff:     time.Millisecond,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(func() uint64 {
+			return q.Processor().Stats().Timeouts
+		}).Should(Equal(uint64(2)))
+		Consistently(func() uint32 {
+			return atomic.LoadUint32(&calls)
+		}).Should(Equal(uint32(2)))
+		Expect(q.Processor().Stats().Abandoned).To(Equal(uint32(1)))
+
+		close(hang)
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Eventually(func() uint32 {
+			return q.Processor().Stats().Abandoned
+		}).Should(Equal(uint32(0)))
+	})
+
+	It("cancels handler context at the deadline", func() {
+		ctxErr := make(chan error, 1)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context) error {
+				<-ctx.Done()
+				ctxErr <- ctx.Err()
+				return ctx.Err()
+			},
+			HandlerTimeout: 50 * time.Millisecond,
+			Sync:           true,
+			RetryLimit:     1,
+		})
+		defer q.Close()
+
+		err := q.Call()
+		Expect(err).To(Equal(msgqueue.ErrHandlerTimeout))
+		Eventually(ctxErr).Should(Receive(Equal(context.DeadlineExceeded)))
+	})
+})
+
+var _ = Describe("ConcurrencyLimits", func() {
+	It("limits concurrency of messages with the same key", func() {
+		var mu sync.Mutex
+		running := make(map[string]int)
+		maxRunning := make(map[string]int)
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(task string) {
+				mu.Lock()
+				running[task]++
+				if running[task] > maxRunning[task] {
+					maxRunning[task] = running[task]
+				}
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				running[task]--
+				mu.Unlock()
+			},
+			WorkerNumber: 10,
+			BufferSize:   20,
+			ConcurrencyKey: func(msg *msgqueue.Message) string {
+				return msg.Header["task"]
+			},
+			ConcurrencyLimits: map[string]int{"report": 2},
+		})
+
+		for i := 0; i < 6; i++ {
+			for _, task := range []string{"report", "ping"} {
+				msg := msgqueue.NewMessage(task)
+				msg.Header = map[string]string{"task": task}
+				err := q.Add(msg)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(q.Processor().Stats().Processed).To(Equal(uint64(12)))
+		Expect(maxRunning["report"]).To(Equal(2))
+		Expect(maxRunning["ping"]).To(BeNumerically(">", 2))
+	})
+
+	It("rejects non-positive limits", func() {
+		_, err := memqueue.New(
+			msgqueue.WithHandler(func() {}),
+			msgqueue.WithConcurrencyLimits(func(msg *msgqueue.Message) string {
+				return msg.Name
+			}, map[string]int{"report": 0}),
+		)
+		Expect(err).To(MatchError(`queue: ConcurrencyLimits["report"]=0 is not positive`))
+	})
+})
+
+var _ = Describe("GroupKey", func() {
+	It("processes messages with the same group key sequentially", func() {
+		var mu sync.Mutex
+		running := make(map[string]int)
+		maxRunning := make(map[string]int)
+		var order []int
+		var total, maxTotal int
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(group string, n int) {
+				mu.Lock()
+				running[group]++
+				if running[group] > maxRunning[group] {
+					maxRunning[group] = running[group]
+				}
+				total++
+				if total > maxTotal {
+					maxTotal = total
+				}
+				if group == "foo" {
+					order = append(order, n)
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				running[group]--
+				total--
+				mu.Unlock()
+			},
+			WorkerNumber: 10,
+			BufferSize:   20,
+		})
+
+		for i := 0; i < 5; i++ {
+			for _, group := range []string{"foo", "bar", "baz"} {
+				msg := msgqueue.NewMessage(group, i)
+				msg.GroupKey = group
+				err := q.Add(msg)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(q.Processor().Stats().Processed).To(Equal(uint64(15)))
+		Expect(maxRunning).To(Equal(map[string]int{"foo": 1, "bar": 1, "baz": 1}))
+		Expect(maxTotal).To(BeNumerically(">", 1))
+		Expect(order).To(Equal([]int{0, 1, 2, 3, 4}))
+	})
+})
+
+var _ = Describe("WithLock", func() {
+	It("requeues message when lock is held", func() {
+		ring := redisRing()
+		started := make(chan string, 10)
+		unblock := make(chan struct{})
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context, s string) error {
+				return msgqueue.WithLock(ctx, "singleton", func() error {
+					started <- s
+					if s == "first" {
+						<-unblock
+					}
+					return nil
+				})
+			},
+			Redis: ring,
+		})
+
+		err := q.Call("first")
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(started).Should(Receive(Equal("first")))
+
+		err = q.Call("second")
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() uint64 {
+			return q.Processor().Stats().Requeued
+		}).Should(Equal(uint64(1)))
+		Expect(started).NotTo(Receive())
+
+		close(unblock)
+		Eventually(started, 3*time.Second).Should(Receive(Equal("second")))
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(2)))
+		Expect(st.Retries).To(BeZero())
+	})
+
+	It("does not release lock acquired by another owner", func() {
+		ring := redisRing()
+		done := make(chan struct{})
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "lock-owner",
+			Handler: func(ctx context.Context) error {
+				defer close(done)
+				return msgqueue.WithLock(ctx, "singleton", func() error {
+					// Lock expired and was acquired by another process.
+					return ring.Set("lock:lock-owner:singleton", "other", time.Minute).Err()
+				})
+			},
+			Redis: ring,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(done).Should(BeClosed())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ring.Get("lock:lock-owner:singleton").Val()).To(Equal("other"))
+	})
+
+	It("is scoped to the queue", func() {
+		ring := redisRing()
+		started := make(chan string, 10)
+		unblock := make(chan struct{})
+
+		newQueue := func(name string) *memqueue.Queue {
+			return memqueue.NewQueue(&msgqueue.Options{
+				Name: name,
+				Handler: func(ctx context.Context) error {
+					return msgqueue.WithLock(ctx, "singleton", func() error {
+						started <- name
+						<-unblock
+						return nil
+					})
+				},
+				Redis: ring,
+			})
+		}
+		q1 := newQueue("dev-lock")
+		q2 := newQueue("prod-lock")
+
+		Expect(q1.Call()).NotTo(HaveOccurred())
+		Expect(q2.Call()).NotTo(HaveOccurred())
+		Eventually(started).Should(Receive())
+		Eventually(started).Should(Receive())
+
+		close(unblock)
+		Expect(q1.Close()).NotTo(HaveOccurred())
+		Expect(q2.Close()).NotTo(HaveOccurred())
+		Expect(q1.Processor().Stats().Requeued).To(BeZero())
+		Expect(q2.Processor().Stats().Requeued).To(BeZero())
+	})
+
+	It("requires Redis", func() {
+		err := msgqueue.WithLock(context.Background(), "singleton", func() error {
+			return nil
+		})
+		Expect(err).To(MatchError("queue: WithLock requires Options.Redis"))
+	})
+})
+
+var _ = Describe("ResetStats", func() {
+	It("resets counters", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(fail bool) error {
+				if fail {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			RetryLimit: 1,
+		})
+		q.SetSync(true)
+
+		_ = q.Call(false)
+		_ = q.Call(true)
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Expect(st.Fails).To(Equal(uint64(1)))
+		Expect(st.P99Duration).To(BeNumerically(">", 0))
+
+		q.Processor().ResetStats()
+		st = q.Processor().Stats()
+		Expect(st.Processed).To(BeZero())
+		Expect(st.Fails).To(BeZero())
+		Expect(st.AvgDuration).To(BeZero())
+		Expect(st.P99Duration).To(BeZero())
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("StatsJSON", func() {
+	It("returns versioned stats document", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:       "stats-json-queue",
+			Handler:    func() {},
+			RetryLimit: 5,
+		})
+		q.SetSync(true)
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		b, err := q.Processor().StatsJSON()
+		Expect(err).NotTo(HaveOccurred())
+
+		var doc struct {
+			Version  int    `json:"version"`
+			Queue    string `json:"queue"`
+			Counters struct {
+				Processed uint64 `json:"processed"`
+			} `json:"counters"`
+			Durations struct {
+				Histogram struct {
+					Count   uint64 `json:"count"`
+					Buckets []struct {
+						LeMs  float64 `json:"le_ms"`
+						Count uint64  `json:"count"`
+					} `json:"buckets"`
+				} `json:"histogram"`
+			} `json:"durations"`
+			Config struct {
+				RetryLimit int      `json:"retry_limit"`
+				RateLimit  *float64 `json:"rate_limit"`
+			} `json:"config"`
+		}
+		err = json.Unmarshal(b, &doc)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(doc.Version).To(Equal(processor.StatsJSONVersion))
+		Expect(doc.Queue).To(Equal("stats-json-queue"))
+		Expect(doc.Counters.Processed).To(Equal(uint64(1)))
+		Expect(doc.Durations.Histogram.Count).To(Equal(uint64(1)))
+		Expect(doc.Durations.Histogram.Buckets).NotTo(BeEmpty())
+		Expect(doc.Config.RetryLimit).To(Equal(5))
+		Expect(doc.Config.RateLimit).To(BeNil())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("DeleteLinger", func() {
+	It("flushes deletions while messages keep arriving", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:         "delete-linger-queue",
+			Handler:      func() {},
+			DeleteLinger: 100 * time.Millisecond,
+		})
+
+		// Messages keep arriving, but too rarely to fill a batch
+		// within a second.
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(150 * time.Millisecond):
+				}
+				err := q.Call()
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}()
+
+		Eventually(func() uint64 {
+			st := q.Processor().Stats()
+			return st.Processed - uint64(st.Deleting)
+		}, time.Second).Should(BeNumerically(">", 0))
+
+		close(stop)
+		<-done
+
+		err := q.CloseTimeout(5 * time.Second)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("FeatureFlags", func() {
+	It("processes, delays, or drops messages", func() {
+		var rolledOut int32
+		var mu sync.Mutex
+		var tenants []string
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "feature-flags-queue",
+			Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+				mu.Lock()
+				tenants = append(tenants, msg.Header["tenant"])
+				mu.Unlock()
+				return nil
+			}),
+			MinBackoff: time.Millisecond,
+			FeatureFlags: msgqueue.FeatureFlagsFunc(func(msg *msgqueue.Message) (msgqueue.FlagAction, time.Duration) {
+				switch msg.Header["tenant"] {
+				case "blocked":
+					return msgqueue.FlagDrop, 0
+				case "beta":
+					if atomic.LoadInt32(&rolledOut) == 0 {
+						return msgqueue.FlagDelay, 10 * time.Millisecond
+					}
+				}
+				return msgqueue.FlagProcess, 0
+			}),
+		})
+
+		for _, tenant := range []string{"default", "blocked", "beta"} {
+			msg := msgqueue.NewMessage()
+			msg.Header = map[string]string{"tenant": tenant}
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		processed := func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), tenants...)
+		}
+
+		Eventually(func() uint64 {
+			return q.Processor().Stats().Requeued
+		}).Should(BeNumerically(">=", 2))
+		Eventually(processed).Should(Equal([]string{"default"}))
+
+		atomic.StoreInt32(&rolledOut, 1)
+		Eventually(processed).Should(Equal([]string{"default", "beta"}))
+
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(3)))
+		Expect(st.Retries).To(BeZero())
+
+		err := q.CloseTimeout(5 * time.Second)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("Queue.Describe", func() {
+	It("describes memqueue backend", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:    "describe-queue",
+			Handler: func() {},
+		})
+
+		d := q.Describe()
+		Expect(d.Name).To(Equal("describe-queue"))
+		Expect(d.Backend).To(Equal("memqueue"))
+		Expect(d.Options).To(Equal(q.Options()))
+		Expect(d.Options.RetryLimit).To(Equal(10))
+		Expect(d.MaxPayloadSize).To(BeZero())
+		Expect(d.MaxDelay).To(BeZero())
+		Expect(d.Capabilities).To(Equal(msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+		}))
+
+		q.SetNoDelay(true)
+		Expect(q.Describe().Capabilities.Delay).To(BeFalse())
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.logs = append(l.logs, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+type testLevelLogger struct {
+	testLogger
+}
+
+func (l *testLevelLogger) Logf(level msgqueue.LogLevel, format string, v ...interface{}) {
+	l.Printf(level.String()+": "+format, v...)
+}
+
+var _ = Describe("Logger", func() {
+	It("receives processor logs", func() {
+		logger := new(testLogger)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "logger-queue",
+			Handler: func() error {
+				return errors.New("fake error")
+			},
+			RetryLimit: 1,
+			Logger:     logger,
+		})
+		q.SetSync(true)
+
+		err := q.Call()
+		Expect(err).To(MatchError("fake error"))
+
+		logger.mu.Lock()
+		Expect(logger.logs).To(ContainElement(
+			"Memqueue<logger-queue> handler failed: fake error"))
+		logger.mu.Unlock()
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not log quiet retries below LogLevel", func() {
+		logger := new(testLevelLogger)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "quiet-retries-queue",
+			Handler: func() error {
+				return errors.New("fake error")
+			},
+			RetryLimit:   2,
+			MinBackoff:   time.Millisecond,
+			Logger:       logger,
+			LogLevel:     msgqueue.LogWarn,
+			QuietRetries: true,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.CloseTimeout(5 * time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		logger.mu.Lock()
+		Expect(logger.logs).To(Equal([]string{
+			"error: Memqueue<quiet-retries-queue> handler failed: fake error",
+		}))
+		logger.mu.Unlock()
+	})
+})
+
+var _ = Describe("Abort", func() {
+	It("cancels handlers and releases messages without counting retries", func() {
+		var fail uint32 = 1
+		started := make(chan struct{}, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(ctx context.Context) error {
+				if atomic.LoadUint32(&fail) == 0 {
+					return nil
+				}
+				started <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			WorkerNumber: 1,
+			BufferSize:   10,
+		})
+
+		for i := 0; i < 3; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Eventually(started).Should(Receive())
+
+		p := q.Processor()
+		err := p.Abort(errors.New("credentials are revoked"))
+		Expect(err).NotTo(HaveOccurred())
+
+		st := p.Stats()
+		Expect(st.Requeued).To(BeNumerically(">=", 3))
+		Expect(st.Retries).To(Equal(uint64(0)))
+		Expect(st.Fails).To(Equal(uint64(0)))
+		Expect(st.Processed).To(Equal(uint64(0)))
+		Expect(started).NotTo(Receive())
+
+		atomic.StoreUint32(&fail, 0)
+		err = p.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Stats().Processed).To(Equal(uint64(3)))
+	})
+})
+
+var _ = Describe("Events", func() {
+	It("emits processor and message events", func() {
+		var calls uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				if atomic.AddUint32(&calls, 1) == 1 {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			WorkerNumber: 1,
+			RetryLimit:   2,
+			MinBackoff:   time.Millisecond,
+		})
+		p := q.Processor()
+		events := p.Events()
+
+		p.Pause()
+		p.Pause()
+		p.Resume()
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var types []processor.EventType
+		for len(events) > 0 {
+			e := <-events
+			types = append(types, e.Type)
+			if e.Type == processor.EventRetried {
+				Expect(e.Err).To(MatchError("fake error"))
+				Expect(e.Message).NotTo(BeNil())
+			}
+		}
+		Expect(types).To(Equal([]processor.EventType{
+			processor.EventPaused,
+			processor.EventResumed,
+			processor.EventReserved,
+			processor.EventRetried,
+			processor.EventReserved,
+			processor.EventProcessed,
+		}))
+	})
+})
+
+var _ = Describe("Health", func() {
+	It("reflects processor state", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {},
+		})
+		defer q.Close()
+
+		Expect(q.Ping()).NotTo(HaveOccurred())
+
+		p := q.Processor()
+		Expect(p.Healthy()).To(BeTrue())
+		Expect(p.Health()).NotTo(HaveOccurred())
+
+		p.Pause()
+		Expect(p.Healthy()).To(BeFalse())
+		Expect(p.Health()).To(MatchError("queue: processor is paused"))
+		p.Resume()
+
+		err := p.Stop()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Health()).To(MatchError("queue: processor is stopped"))
+
+		err = p.Start()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Healthy()).To(BeTrue())
+	})
+})
+
+var _ = Describe("AllocSampleRate", func() {
+	It("samples allocations per message name", func() {
+		var sink [][]byte
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "alloc-sample-test",
+			Handler: func(n int) {
+				sink = append(sink, make([]byte, n))
+			},
+			WorkerNumber:    1,
+			AllocSampleRate: 2,
+			Redis:           redisRing(),
+		})
+
+		for i := 0; i < 4; i++ {
+			msg := msgqueue.NewMessage(1 << 20)
+			msg.Name = fmt.Sprintf("alloc-%d", i)
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink).To(HaveLen(4))
+
+		stats := q.Processor().AllocStats()
+		Expect(stats).To(HaveLen(2))
+		for _, name := range []string{"alloc-1", "alloc-3"} {
+			st := stats[name]
+			Expect(st.Samples).To(Equal(uint64(1)))
+			Expect(st.AvgBytes()).To(BeNumerically(">=", 1<<20))
+		}
+
+		q.Processor().ResetStats()
+		Expect(q.Processor().AllocStats()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Checkpoint", func() {
+	It("resumes redelivered message from the checkpoint", func() {
+		offsets := make(chan int, 10)
+		redis := redisRing()
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "checkpoint-test",
+			Handler: func(ctx context.Context) error {
+				s, err := msgqueue.LoadCheckpoint(ctx)
+				if err != nil {
+					return err
+				}
+				offset, _ := strconv.Atoi(s)
+				offsets <- offset
+				for ; offset < 10; offset++ {
+					if offset == 5 && s == "" {
+						return errors.New("fake error")
+					}
+					err := msgqueue.SaveCheckpoint(ctx, strconv.Itoa(offset))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			RetryLimit: 2,
+			MinBackoff: time.Millisecond,
+			Redis:      redis,
+		})
+
+		msg := msgqueue.NewMessage()
+		msg.Name = "checkpoint-batch"
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(offsets).To(Receive(Equal(0)))
+		Expect(offsets).To(Receive(Equal(4)))
+		Expect(redis.Exists("checkpoint:checkpoint-test:checkpoint-batch").Val()).To(BeZero())
+	})
+
+	It("deletes checkpoint of expired message", func() {
+		redis := redisRing()
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:           "checkpoint-expired-test",
+			Handler:        func() {},
+			MaxAge:         time.Minute,
+			ExpiredHandler: func(*msgqueue.Message, time.Duration) {},
+			Redis:          redis,
+		})
+
+		const key = "checkpoint:checkpoint-expired-test:checkpoint-expired"
+		err := redis.Set(key, "5", time.Hour).Err()
+		Expect(err).NotTo(HaveOccurred())
+
+		msg := msgqueue.NewMessage()
+		msg.Name = "checkpoint-expired"
+		msg.CreatedAt = time.Now().Add(-time.Hour)
+		err = q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(q.Processor().Stats().Expired).To(Equal(uint64(1)))
+		Expect(redis.Exists(key).Val()).To(BeZero())
+	})
+
+	It("requires Redis", func() {
+		err := msgqueue.SaveCheckpoint(context.Background(), "1")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Filter", func() {
+	It("deletes messages without calling the handler", func() {
+		ch := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(s string) {
+				ch <- s
+			},
+			Filter: msgqueue.HeaderFilter("type", "order.created", "order.paid"),
+		})
+
+		for _, typ := range []string{"order.created", "user.created", "order.paid", ""} {
+			msg := msgqueue.NewMessage(typ)
+			if typ != "" {
+				msg.Header = map[string]string{"type": typ}
+			}
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ch).To(HaveLen(2))
+		st := q.Processor().Stats()
+		Expect(st.Filtered).To(Equal(uint64(2)))
+		Expect(st.Processed).To(Equal(uint64(2)))
+	})
+})
+
+var _ = Describe("Chaos", func() {
+	It("duplicates messages and restarts workers during drills", func() {
+		var calls uint32
+		reports := make(chan *msgqueue.ChaosReport, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				atomic.AddUint32(&calls, 1)
+			},
+			Chaos: &msgqueue.ChaosOptions{
+				Interval:        100 * time.Millisecond,
+				Duration:        100 * time.Millisecond,
+				DuplicateRate:   0.5,
+				RestartInterval: 20 * time.Millisecond,
+				Check: func() error {
+					return errors.New("invariant is violated")
+				},
+				OnReport: func(r *msgqueue.ChaosReport) {
+					reports <- r
+				},
+			},
+		})
+
+		time.Sleep(120 * time.Millisecond)
+		for i := 0; i < 10; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		var report *msgqueue.ChaosReport
+		Eventually(reports).Should(Receive(&report))
+		Expect(report.Duplicates).To(BeNumerically(">", 0))
+		Expect(report.Restarts).To(BeNumerically(">", 0))
+		Expect(report.Err).To(MatchError("invariant is violated"))
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(atomic.LoadUint32(&calls)).To(BeNumerically(">", 10))
+		Expect(q.Processor().Stats().InFlight).To(BeZero())
+	})
+})
+
+var _ = Describe("PriorityInversion", func() {
+	It("reorders rate limited messages with lower priority", func() {
+		ch := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(s string) {
+				ch <- s
+			},
+			WorkerNumber: 1,
+			RateLimit:    timerate.Every(time.Second),
+			RateLimitKey: func(msg *msgqueue.Message) string {
+				return strconv.Itoa(msg.Priority)
+			},
+			PriorityInversion: msgqueue.InversionReorder,
+		})
+
+		for _, s := range []string{"low1", "low2"} {
+			err := q.Call(s)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Eventually(ch).Should(Receive(Equal("low1")))
+		time.Sleep(50 * time.Millisecond)
+
+		msg := msgqueue.NewMessage("high")
+		msg.Priority = 1
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(ch, 500*time.Millisecond).Should(Receive(Equal("high")))
+		Eventually(ch, 2*time.Second).Should(Receive(Equal("low2")))
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(q.Processor().Stats().Inversions).To(Equal(uint64(1)))
+	})
+})
+
+var _ = Describe("lifecycle hooks", func() {
+	It("are called by processor", func() {
+		var mu sync.Mutex
+		var events []string
+		event := func(s string) {
+			mu.Lock()
+			events = append(events, s)
+			mu.Unlock()
+		}
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(fail bool) error {
+				if fail {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			WorkerNumber: 1,
+			RetryLimit:   1,
+			OnStart: func() {
+				event("start")
+			},
+			OnStop: func() {
+				event("stop")
+			},
+			OnMessageProcessed: func(msg *msgqueue.Message, dur time.Duration) {
+				event("processed")
+			},
+			OnMessageFailed: func(msg *msgqueue.Message, err error) {
+				event("failed: " + err.Error())
+			},
+		})
+
+		for _, fail := range []bool{false, true} {
+			err := q.Call(fail)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(events).To(Equal([]string{"start", "processed", "failed: fake error", "stop"}))
+	})
+})
+
+var _ = Describe("PauseName", func() {
+	It("pauses processing of messages with the name", func() {
+		ch := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "pause-name-test",
+			Handler: func(s string) {
+				ch <- s
+			},
+			MinBackoff: 10 * time.Millisecond,
+			Redis:      redisRing(),
+		})
+		q.Processor().PauseName("buggy")
+		Expect(q.Processor().PausedNames()).To(Equal([]string{"buggy"}))
+
+		for _, name := range []string{"buggy", "healthy"} {
+			msg := msgqueue.NewMessage(name)
+			msg.Header = map[string]string{msgqueue.TaskHeader: name}
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Eventually(ch).Should(Receive(Equal("healthy")))
+		Consistently(ch, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(q.Processor().Stats().Requeued).To(BeNumerically(">", 1))
+
+		q.Processor().ResumeName("buggy")
+		Expect(q.Processor().PausedNames()).To(BeEmpty())
+		Eventually(ch).Should(Receive(Equal("buggy")))
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(q.Processor().Stats().Retries).To(BeZero())
+	})
+})
+
+var _ = Describe("Manager", func() {
+	It("manages lifecycle of queues", func() {
+		q1 := memqueue.NewQueue(&msgqueue.Options{
+			Name:    "manager-test-1",
+			Handler: func() {},
+		})
+		q2 := memqueue.NewQueue(&msgqueue.Options{
+			Name:    "manager-test-2",
+			Handler: func() {},
+		})
+		m := processor.NewManager(q1, q2)
+
+		err := m.Add(q1)
+		Expect(err).To(MatchError("queue: manager-test-1 is already managed"))
+
+		err = m.StopAll(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, q := range []*memqueue.Queue{q1, q1, q2} {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(m.TotalStats().Buffered).To(Equal(uint32(3)))
+
+		err = m.StartAll()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = m.CloseAll(5 * time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(m.TotalStats().Processed).To(Equal(uint64(3)))
+		stats := m.Stats()
+		Expect(stats["manager-test-1"].Processed).To(Equal(uint64(2)))
+		Expect(stats["manager-test-2"].Processed).To(Equal(uint64(1)))
+	})
+})
+
+var _ = Describe("Upsert", func() {
+	It("replaces args of pending named message", func() {
+		ch := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "upsert-test",
+			Handler: func(s string) {
+				ch <- s
+			},
+			Redis:  redisRing(),
+			Upsert: true,
+		})
+		q.Processor().Stop()
+
+		for _, s := range []string{"v1", "v2", "v3"} {
+			msg := msgqueue.NewMessage(s)
+			msg.Name = "config"
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(q.Processor().Stats().Buffered).To(Equal(uint32(1)))
+
+		err := q.Processor().ProcessAll()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ch).To(Receive(Equal("v3")))
+		Expect(ch).NotTo(Receive())
+	})
+
+	It("adds named message again once it is processed", func() {
+		ch := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "upsert-processed-test",
+			Handler: func(s string) {
+				ch <- s
+			},
+			Redis:  redisRing(),
+			Upsert: true,
+		})
+
+		for _, s := range []string{"v1", "v2"} {
+			msg := msgqueue.NewMessage(s)
+			msg.Name = "config"
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+
+			Eventually(ch).Should(Receive(Equal(s)))
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ch).NotTo(Receive())
+	})
+
+	It("unlocks name of expired message", func() {
+		ch := make(chan string, 10)
+		expired := make(chan string, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "upsert-expired-test",
+			Handler: func(s string) {
+				ch <- s
+			},
+			MaxAge: time.Minute,
+			ExpiredHandler: func(msg *msgqueue.Message, age time.Duration) {
+				expired <- msg.Args[0].(string)
+			},
+			Redis:  redisRing(),
+			Upsert: true,
+		})
+
+		name := fmt.Sprintf("config-%d", time.Now().UnixNano())
+		msg := msgqueue.NewMessage("old")
+		msg.Name = name
+		msg.CreatedAt = time.Now().Add(-time.Hour)
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(expired).Should(Receive(Equal("old")))
+
+		msg = msgqueue.NewMessage("fresh")
+		msg.Name = name
+		err = q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(ch).Should(Receive(Equal("fresh")))
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(q.Processor().Stats().Expired).To(Equal(uint64(1)))
+	})
+
+	It("requires Redis", func() {
+		_, err := memqueue.New(
+			msgqueue.WithHandler(func() {}),
+			msgqueue.WithUpsert(),
+		)
+		Expect(err).To(MatchError("queue: Upsert requires Redis"))
+	})
+})
+
+var _ = Describe("Barrier", func() {
+	It("waits for previous messages and blocks next ones", func() {
+		var mu sync.Mutex
+		var events []string
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(s string) {
+				mu.Lock()
+				events = append(events, s+" started")
+				mu.Unlock()
+
+				time.Sleep(30 * time.Millisecond)
+
+				mu.Lock()
+				events = append(events, s+" done")
+				mu.Unlock()
+			},
+			WorkerNumber: 5,
+			BufferSize:   10,
+		})
+
+		for _, s := range []string{"before", "before", "barrier", "after", "after"} {
+			msg := msgqueue.NewMessage(s)
+			msg.Barrier = s == "barrier"
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(events).To(HaveLen(10))
+		Expect(events[4]).To(Equal("barrier started"))
+		Expect(events[5]).To(Equal("barrier done"))
+		for _, event := range events[:4] {
+			Expect(event).To(HavePrefix("before"))
+		}
+		for _, event := range events[6:] {
+			Expect(event).To(HavePrefix("after"))
+		}
+	})
+
+	It("does not deadlock when released message fills the buffer", func() {
+		proceed := make(chan struct{})
+		started := make(chan string, 10)
+		var calls uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "barrier-full-buffer-test",
+			Handler: func(s string) error {
+				started <- s
+				if s == "slow" && atomic.AddUint32(&calls, 1) == 1 {
+					<-proceed
+					// Released without delay while the barrier waits
+					// and the buffer is full.
+					return msgqueue.Nack(0)
+				}
+				return nil
+			},
+			WorkerNumber:  2,
+			BufferSize:    1,
+			PriorityLanes: 1,
+			RetryLimit:    2,
+		})
+
+		add := func(s string, barrier bool) {
+			msg := msgqueue.NewMessage(s)
+			msg.Barrier = barrier
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		add("slow", false)
+		Eventually(started).Should(Receive(Equal("slow")))
+		add("barrier", true)
+		Eventually(func() uint32 {
+			return q.Processor().Stats().Buffered
+		}).Should(BeZero())
+		add("after", false)
+		close(proceed)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- q.Close()
+		}()
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+		Expect(q.Processor().Stats().Processed).To(Equal(uint64(3)))
+	})
+})
+
+var _ = Describe("Ledger", func() {
+	It("records processing attempts", func() {
+		ring := redisRing()
+		ledger := msgqueue.NewRedisLedger(ring, time.Hour)
+
+		var count uint32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "ledger-test",
+			Handler: func() error {
+				if atomic.AddUint32(&count, 1) == 1 {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			RetryLimit: 2,
+			MinBackoff: time.Millisecond,
+			Redis:      ring,
+			Ledger:     ledger,
+		})
+
+		msg := msgqueue.NewMessage()
+		msg.Name = "audited"
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := ledger.Entries("ledger-test", time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+
+		if entries[0].Attempt > entries[1].Attempt {
+			entries[0], entries[1] = entries[1], entries[0]
+		}
+		Expect(entries[0].Outcome).To(Equal(msgqueue.OutcomeRetried))
+		Expect(entries[0].Error).To(Equal("fake error"))
+		Expect(entries[1].Outcome).To(Equal(msgqueue.OutcomeProcessed))
+		Expect(entries[1].Attempt).To(Equal(2))
+		for _, entry := range entries {
+			Expect(entry.Queue).To(Equal("ledger-test"))
+			Expect(entry.Name).To(Equal("audited"))
+			Expect(entry.Worker).NotTo(BeEmpty())
+		}
+	})
+})
+
+var _ = Describe("InFlightMessages", func() {
+	It("returns messages that are being processed", func() {
+		ring := redisRing()
+		started := make(chan struct{})
+		unblock := make(chan struct{})
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "inflight-queue",
+			Handler: func() {
+				started <- struct{}{}
+				<-unblock
+			},
+			Redis:         ring,
+			TrackInFlight: true,
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(started).Should(Receive())
+
+		msgs := q.Processor().InFlightMessages()
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Queue).To(Equal("inflight-queue"))
+		Expect(msgs[0].ReservedCount).To(Equal(1))
+		Expect(msgs[0].Worker).To(ContainSubstring(":"))
+
+		remote, err := processor.GetInFlightMessages(ring, "inflight-queue")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remote).To(HaveLen(1))
+		Expect(remote[0].Worker).To(Equal(msgs[0].Worker))
+
+		close(unblock)
+		err = q.CloseTimeout(5 * time.Second)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(q.Processor().InFlightMessages()).To(BeEmpty())
+		remote, err = processor.GetInFlightMessages(ring, "inflight-queue")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(remote).To(BeEmpty())
+	})
+})
+
+var _ = Describe("GetFleetStats", func() {
+	It("aggregates stats reported by processes", func() {
+		ring := redisRing()
+
+		report := func(worker string, st *processor.ProcessStats) {
+			b, err := json.Marshal(st)
+			Expect(err).NotTo(HaveOccurred())
+			err = ring.HSet("msgqueue:stats:fleet-test", worker, b).Err()
+			Expect(err).NotTo(HaveOccurred())
+		}
+		report("other:1", &processor.ProcessStats{
+			Stats:         processor.Stats{Processed: 10, AvgDuration: time.Second},
+			Time:          time.Now(),
+			Interval:      time.Minute,
+			ProcessedRate: 2,
+		})
+		report("crashed:1", &processor.ProcessStats{
+			Stats:    processor.Stats{Processed: 100},
+			Time:     time.Now().Add(-time.Hour),
+			Interval: time.Minute,
+		})
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:                "fleet-test",
+			Handler:             func() {},
+			Redis:               ring,
+			StatsReportInterval: 10 * time.Millisecond,
+		})
+		for i := 0; i < 10; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Eventually(func() uint64 {
+			fleet, err := processor.GetFleetStats(ring, "fleet-test")
+			Expect(err).NotTo(HaveOccurred())
+			return fleet.Processed
+		}).Should(Equal(uint64(20)))
+
+		fleet, err := processor.GetFleetStats(ring, "fleet-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fleet.Processes).To(HaveLen(2))
+		Expect(fleet.ProcessedRate).To(BeNumerically(">=", 2))
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		fleet, err = processor.GetFleetStats(ring, "fleet-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fleet.Processes).To(HaveLen(1))
+		Expect(fleet.Processes[0].Worker).To(Equal("other:1"))
+		Expect(fleet.AvgDuration).To(Equal(time.Second))
+	})
+})
+
+var _ = Describe("CoalesceKey", func() {
+	keyMessage := func(key string) *msgqueue.Message {
+		msg := msgqueue.NewMessage(key)
+		msg.Header = map[string]string{"key": key}
+		return msg
+	}
+
+	newQueue := func(handler interface{}) *memqueue.Queue {
+		return memqueue.NewQueue(&msgqueue.Options{
+			Handler:      handler,
+			WorkerNumber: 3,
+			RetryLimit:   2,
+			MinBackoff:   time.Millisecond,
+			CoalesceKey: func(msg *msgqueue.Message) string {
+				return msg.Header["key"]
+			},
+		})
+	}
+
+	It("processes one of identical concurrent messages", func() {
+		started := make(chan struct{}, 10)
+		unblock := make(chan struct{})
+		var calls uint32
+		q := newQueue(func(key string) {
+			atomic.AddUint32(&calls, 1)
+			started <- struct{}{}
+			<-unblock
+		})
+
+		err := q.Add(keyMessage("foo"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(started).Should(Receive())
+
+		for i := 0; i < 2; i++ {
+			err := q.Add(keyMessage("foo"))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// Duplicates are attached to the message being processed.
+		Consistently(started, 100*time.Millisecond).ShouldNot(Receive())
+		close(unblock)
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(atomic.LoadUint32(&calls)).To(Equal(uint32(1)))
+		st := q.Processor().Stats()
+		Expect(st.Processed).To(Equal(uint64(1)))
+		Expect(st.Coalesced).To(Equal(uint64(2)))
+		Expect(st.InFlight).To(Equal(uint32(0)))
+	})
+
+	It("retries duplicates when message fails", func() {
+		started := make(chan struct{}, 10)
+		unblock := make(chan struct{})
+		var calls uint32
+		q := newQueue(func(key string) error {
+			if atomic.AddUint32(&calls, 1) == 1 {
+				started <- struct{}{}
+				<-unblock
+				return errors.New("fake error")
+			}
+			return nil
+		})
+
+		err := q.Add(keyMessage("foo"))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(started).Should(Receive())
+
+		err = q.Add(keyMessage("foo"))
+		Expect(err).NotTo(HaveOccurred())
+		// Duplicates are attached to the message being processed.
+		Consistently(started, 100*time.Millisecond).ShouldNot(Receive())
+		close(unblock)
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		st := q.Processor().Stats()
+		Expect(st.Coalesced).To(Equal(uint64(0)))
+		Expect(st.Processed).To(Equal(uint64(2)))
+	})
+})
+
+var _ = Describe("SetWorkerNumber", func() {
+	It("grows and shrinks worker pool while running", func() {
+		var workers int32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:      func() {},
+			WorkerNumber: 1,
+			WorkerInit: func(ctx context.Context) (context.Context, error) {
+				atomic.AddInt32(&workers, 1)
+				return ctx, nil
+			},
+			WorkerShutdown: func(ctx context.Context) {
+				atomic.AddInt32(&workers, -1)
+			},
+		})
+
+		p := q.Processor()
+		count := func() int32 {
+			return atomic.LoadInt32(&workers)
+		}
+		Eventually(count).Should(Equal(int32(1)))
+
+		err := p.SetWorkerNumber(3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.WorkerNumber()).To(Equal(3))
+		Eventually(count).Should(Equal(int32(3)))
+
+		err = p.SetWorkerNumber(2)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(count).Should(Equal(int32(2)))
+
+		for i := 0; i < 10; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count()).To(Equal(int32(0)))
+		Expect(p.Stats().Processed).To(Equal(uint64(10)))
+	})
+
+	It("rejects non-positive number", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {},
+		})
+		defer q.Close()
+
+		err := q.Processor().SetWorkerNumber(0)
+		Expect(err).To(MatchError("queue: WorkerNumber=0 is not positive"))
+	})
+})
+
+var _ = Describe("autoscaler", func() {
+	It("scales workers with the backlog", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				time.Sleep(100 * time.Millisecond)
+			},
+			MinWorkers:        1,
+			MaxWorkers:        4,
+			AutoscaleInterval: 50 * time.Millisecond,
+			BufferSize:        20,
+		})
+		defer q.Close()
+
+		p := q.Processor()
+		Expect(p.WorkerNumber()).To(Equal(1))
+
+		for i := 0; i < 20; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Eventually(p.WorkerNumber).Should(Equal(4))
+		Eventually(p.WorkerNumber, 3*time.Second).Should(Equal(1))
+		Expect(p.Stats().Processed).To(Equal(uint64(20)))
+	})
+
+	It("stops idle workers above MinWorkers", func() {
+		var workers int32
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:           func() {},
+			WorkerNumber:      4,
+			MinWorkers:        2,
+			MaxWorkers:        4,
+			AutoscaleInterval: time.Hour,
+			WorkerIdleTimeout: 50 * time.Millisecond,
+			WorkerInit: func(ctx context.Context) (context.Context, error) {
+				atomic.AddInt32(&workers, 1)
+				return ctx, nil
+			},
+			WorkerShutdown: func(ctx context.Context) {
+				atomic.AddInt32(&workers, -1)
+			},
+		})
+		defer q.Close()
+
+		p := q.Processor()
+		Expect(p.WorkerNumber()).To(Equal(4))
+
+		Eventually(p.WorkerNumber).Should(Equal(2))
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&workers)
+		}).Should(Equal(int32(2)))
+		Consistently(p.WorkerNumber, 200*time.Millisecond).Should(Equal(2))
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() uint64 {
+			return p.Stats().Processed
+		}).Should(Equal(uint64(1)))
+	})
+
+	It("rejects MinWorkers greater than MaxWorkers", func() {
+		_, err := memqueue.New(
+			msgqueue.WithHandler(func() {}),
+			msgqueue.WithAutoscale(5, 2),
+		)
+		Expect(err).To(MatchError("queue: got autoscale bounds 5..2, wanted 1 <= min <= max"))
+	})
+})
+
+var _ = Describe("Sync mode", func() {
+	It("processes message in caller goroutine", func() {
+		var processed bool
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(s string) error {
+				processed = true
+				if s == "fail" {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			Sync:       true,
+			RetryLimit: 1,
+		})
+		defer q.Close()
+
+		err := q.Call("hello")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processed).To(BeTrue())
+
+		err = q.Call("fail")
+		Expect(err).To(MatchError("fake error"))
+	})
+
+	It("retries message in caller goroutine", func() {
+		var calls int
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				calls++
+				if calls == 1 {
+					return errors.New("fake error")
+				}
+				return nil
+			},
+			Sync:       true,
+			MinBackoff: time.Millisecond,
+		})
+		defer q.Close()
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(calls).To(Equal(2))
+
+		st := q.Processor().Stats()
+		Expect(st.Retries).To(Equal(uint64(1)))
+		Expect(st.Processed).To(Equal(uint64(1)))
+	})
+
+	It("returns error of the last attempt", func() {
+		var calls int
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() error {
+				calls++
+				return fmt.Errorf("fake error #%d", calls)
+			},
+			Sync:       true,
+			RetryLimit: 3,
+			MinBackoff: time.Millisecond,
+		})
+		defer q.Close()
+
+		err := q.Call()
+		Expect(err).To(MatchError("fake error #3"))
+		Expect(calls).To(Equal(3))
+	})
+})
+
+var _ = Describe("message with priority", func() {
+	ch := make(chan string, 10)
+	handler := func(s string) {
+		ch <- s
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:      handler,
+			WorkerNumber: 1,
+			BufferSize:   10,
+		})
+		q.Processor().Stop()
+
+		for _, s := range []string{"low", "low"} {
+			err := q.Call(s)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		msg := msgqueue.NewMessage("high")
+		msg.Priority = 1
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Processor().ProcessAll()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("is processed first", func() {
+		Expect(ch).To(Receive(Equal("high")))
+		Expect(ch).To(Receive(Equal("low")))
+		Expect(ch).To(Receive(Equal("low")))
+	})
+})
+
+var _ = Describe("PriorityLanes", func() {
+	It("processes messages from higher lanes first", func() {
+		ch := make(chan int, 10)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func(priority int) {
+				ch <- priority
+			},
+			WorkerNumber:  1,
+			BufferSize:    10,
+			PriorityLanes: 3,
+		})
+		q.Processor().Stop()
+
+		for _, priority := range []int{0, 1, 5, 0, 2, 1} {
+			msg := msgqueue.NewMessage(priority)
+			msg.Priority = priority
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(q.Processor().Stats().Buffered).To(Equal(uint32(6)))
+
+		err := q.Processor().ProcessAll()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var got []int
+		for len(ch) > 0 {
+			got = append(got, <-ch)
+		}
+		Expect(got).To(Equal([]int{5, 2, 1, 1, 0, 0}))
+	})
+
+	It("does not block urgent messages when low lane is full", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:    func() {},
+			BufferSize: 1,
+		})
+		q.Processor().Stop()
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		msg := msgqueue.NewMessage()
+		msg.Priority = 1
+		done := make(chan error, 1)
+		go func() {
+			done <- q.Add(msg)
+		}()
+		Eventually(done).Should(Receive(BeNil()))
+
+		err = q.Processor().ProcessAll()
+		Expect(err).NotTo(HaveOccurred())
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("AddBatch", func() {
+	ch := make(chan string, 10)
+	handler := func(s string) {
+		ch <- s
+	}
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: handler,
+			Redis:   redisRing(),
+		})
+		q.Processor().Stop()
+
+		var msgs []*msgqueue.Message
+		for _, s := range []string{"a", "b", "b"} {
+			msg := msgqueue.NewMessage(s)
+			msg.Name = s
+			msgs = append(msgs, msg)
+		}
+		err := q.AddBatch(msgs)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Processor().ProcessAll()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("adds messages skipping duplicates", func() {
+		Expect(ch).To(Receive(Equal("a")))
+		Expect(ch).To(Receive(Equal("b")))
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("Aggregator", func() {
+	type digest struct {
+		key  string
+		args []interface{}
+	}
+
+	ch := make(chan digest, 10)
+
+	BeforeEach(func() {
+		agg := msgqueue.NewAggregator(&msgqueue.AggregatorOptions{
+			Handler: func(key string, msgs []*msgqueue.Message) error {
+				var args []interface{}
+				for _, msg := range msgs {
+					args = append(args, msg.Args...)
+				}
+				ch <- digest{key, args}
+				return nil
+			},
+			Key: func(msg *msgqueue.Message) string {
+				return msg.Args[0].(string)
+			},
+			MaxMessages: 3,
+			Window:      100 * time.Millisecond,
+		})
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:      agg,
+			WorkerNumber: 10,
+		})
+
+		for i := 0; i < 3; i++ {
+			q.Call("user1")
+		}
+		q.Call("user2")
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("handles messages with the same key as one aggregate", func() {
+		var d1, d2 digest
+		Expect(ch).To(Receive(&d1))
+		Expect(d1.key).To(Equal("user1"))
+		Expect(d1.args).To(HaveLen(3))
+
+		Expect(ch).To(Receive(&d2))
+		Expect(d2.key).To(Equal("user2"))
+		Expect(d2.args).To(HaveLen(1))
+
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+var _ = Describe("Debouncer", func() {
+	ch := make(chan int, 10)
+	handler := func(n int) {
+		ch <- n
+	}
 
-			q = memqueue.NewQueue(&msgqueue.Options{
-				Handler:    handler,
-				RetryLimit: 3,
-				MinBackoff: backoff,
-			})
-			q.SetNoDelay(true)
+	BeforeEach(func() {
+		ring := redisRing()
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:    "debounce",
+			Redis:   ring,
+			Handler: msgqueue.NewDebounceHandler(ring, handler),
 		})
 
-		It("is processed immediately", func() {
-			now := time.Now()
-
-			msg := msgqueue.NewMessage()
-			msg.Delay = time.Hour
-			err := q.Add(msg)
+		d := msgqueue.NewDebouncer(q, 100*time.Millisecond)
+		for i := 1; i <= 5; i++ {
+			err := d.Add("rebuild-cache", msgqueue.NewMessage(i))
 			Expect(err).NotTo(HaveOccurred())
+		}
 
-			err = q.Close()
-			Expect(err).NotTo(HaveOccurred())
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
 
-			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
-			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
-			Expect(ch).To(Receive(BeTemporally("~", now, backoff/10)))
-			Expect(ch).NotTo(Receive())
-		})
+	It("processes one message with the latest args", func() {
+		Expect(ch).To(Receive(Equal(5)))
+		Expect(ch).NotTo(Receive())
 	})
 })
 
@@ -226,6 +2936,58 @@ var _ = Describe("failing queue with error handler", func() {
 	})
 })
 
+var _ = Describe("failing queue with dead letter queue", func() {
+	type deadLetter struct {
+		queue    string
+		reason   string
+		attempts int
+		body     string
+	}
+
+	ch := make(chan deadLetter, 10)
+	fallbackCh := make(chan bool, 10)
+
+	BeforeEach(func() {
+		dlq := memqueue.NewQueue(&msgqueue.Options{
+			Name: "dlq",
+			Handler: func(queue, reason string, attempts int, body string) {
+				ch <- deadLetter{queue, reason, attempts, body}
+			},
+		})
+
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name: "failing",
+			Handler: func(s string) error {
+				return errors.New("fake error")
+			},
+			FallbackHandler: func() {
+				fallbackCh <- true
+			},
+			DeadLetterQueue: dlq,
+			RetryLimit:      2,
+			MinBackoff:      time.Millisecond,
+		})
+		q.Call("hello")
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = dlq.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("moves message to the dead letter queue", func() {
+		var dl deadLetter
+		Expect(ch).To(Receive(&dl))
+		Expect(dl.queue).To(Equal("failing"))
+		Expect(dl.reason).To(Equal("fake error"))
+		Expect(dl.attempts).To(Equal(2))
+		Expect(dl.body).NotTo(BeEmpty())
+		Expect(ch).NotTo(Receive())
+		Expect(fallbackCh).NotTo(Receive())
+	})
+})
+
 var _ = Describe("named message", func() {
 	var count int64
 	handler := func() {
@@ -261,6 +3023,74 @@ var _ = Describe("named message", func() {
 	})
 })
 
+var _ = Describe("named message with narrow Redis", func() {
+	// narrowRedis implements only msgqueue.Redis like custom
+	// clients written before RedisCmdable was added.
+	type narrowRedis struct {
+		msgqueue.Redis
+	}
+
+	It("is deduplicated without RedisCmdable", func() {
+		var count int64
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Redis:   narrowRedis{redisRing()},
+			Handler: func() { atomic.AddInt64(&count, 1) },
+		})
+
+		for i := 0; i < 3; i++ {
+			msg := msgqueue.NewMessage()
+			msg.Name = "myname"
+			_ = q.Add(msg)
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(atomic.LoadInt64(&count)).To(Equal(int64(1)))
+	})
+
+	It("is rejected by features that require RedisCmdable", func() {
+		_, err := memqueue.New(
+			msgqueue.WithHandler(func() {}),
+			msgqueue.WithRedis(narrowRedis{redisRing()}),
+			msgqueue.WithUpsert(),
+		)
+		Expect(err).To(MatchError("queue: Upsert requires Redis that implements RedisCmdable"))
+	})
+})
+
+var _ = Describe("named message with orphaned lock", func() {
+	var q *memqueue.Queue
+
+	BeforeEach(func() {
+		ring := redisRing()
+		key := "memqueue:reconcile:myname"
+		ring.SetNX(key, "", time.Hour)
+		ring.HSet("memqueue:reconcile:locks", key, "dead-owner")
+
+		q = memqueue.NewQueue(&msgqueue.Options{
+			Name:    "reconcile",
+			Redis:   ring,
+			Handler: func() {},
+		})
+	})
+
+	AfterEach(func() {
+		Expect(q.Close()).NotTo(HaveOccurred())
+	})
+
+	It("is added after lock is released", func() {
+		msg := msgqueue.NewMessage()
+		msg.Name = "myname"
+		err := q.Add(msg)
+		Expect(err).NotTo(HaveOccurred())
+
+		msg = msgqueue.NewMessage()
+		msg.Name = "myname"
+		err = q.Add(msg)
+		Expect(err).To(Equal(msgqueue.ErrDuplicate))
+	})
+})
+
 var _ = Describe("CallOnce", func() {
 	var now time.Time
 	delay := time.Second
@@ -364,6 +3194,314 @@ var _ = Describe("stress testing failing queue", func() {
 	})
 })
 
+var _ = Describe("New", func() {
+	It("creates queue using functional options", func() {
+		ch := make(chan bool, 10)
+		q, err := memqueue.New(
+			msgqueue.WithHandler(func() { ch <- true }),
+			msgqueue.WithWorkers(2),
+			msgqueue.WithRetryLimit(1),
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ch).To(Receive())
+	})
+
+	It("returns an error when handler is missing", func() {
+		_, err := memqueue.New(msgqueue.WithWorkers(2))
+		Expect(err).To(MatchError("memqueue: Handler is required"))
+	})
+
+	It("returns an error for invalid options", func() {
+		_, err := memqueue.New(msgqueue.WithHandler(func() {}), msgqueue.WithWorkers(0))
+		Expect(err).To(MatchError("queue: got 0 workers, wanted at least 1"))
+
+		_, err = memqueue.New(msgqueue.WithHandler("not a func"))
+		Expect(err).To(MatchError("queue: Handler is string, wanted func"))
+	})
+})
+
+type limitRecorder struct {
+	mu     sync.Mutex
+	keys   []string
+	limits []timerate.Limit
+}
+
+func (l *limitRecorder) AllowRate(name string, limit timerate.Limit) (time.Duration, bool) {
+	l.mu.Lock()
+	l.keys = append(l.keys, name)
+	l.limits = append(l.limits, limit)
+	l.mu.Unlock()
+	return 0, true
+}
+
+var _ = Describe("rate limit without Redis", func() {
+	const period = 100 * time.Millisecond
+	ch := make(chan time.Time, 10)
+	var start time.Time
+
+	BeforeEach(func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: func() {
+				ch <- time.Now()
+			},
+			RateLimit: timerate.Every(period),
+		})
+
+		start = time.Now()
+		for i := 0; i < 3; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("uses local rate limiter", func() {
+		Expect(ch).To(Receive(BeTemporally("~", start, period/2)))
+		Expect(ch).To(Receive(BeTemporally("~", start.Add(period), period/2)))
+		Expect(ch).To(Receive(BeTemporally("~", start.Add(2*period), period/2)))
+		Expect(ch).NotTo(Receive())
+	})
+})
+
+// denyOnce denies the second message and allows the rest.
+type denyOnce struct {
+	calls uint32
+}
+
+func (l *denyOnce) AllowRate(name string, limit timerate.Limit) (time.Duration, bool) {
+	if atomic.AddUint32(&l.calls, 1) == 2 {
+		return 100 * time.Millisecond, false
+	}
+	return 0, true
+}
+
+var _ = Describe("ProcessOne with rate limit", func() {
+	It("releases rate limited message without counting a retry", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:     func() {},
+			RateLimit:   timerate.Every(time.Second),
+			RateLimiter: new(denyOnce),
+		})
+		p := q.Processor()
+		p.Stop()
+
+		for i := 0; i < 2; i++ {
+			err := q.Call()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := p.ProcessOne()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = p.ProcessOne()
+		Expect(err).To(Equal(msgqueue.ErrRateLimited))
+
+		st := p.Stats()
+		Expect(st.Buffered).To(Equal(uint32(0)))
+		Expect(st.Delayed).To(Equal(uint32(1)))
+		Expect(st.Retries).To(Equal(uint64(0)))
+
+		err = p.Start()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(p.Stats().Processed).To(Equal(uint64(2)))
+	})
+})
+
+var _ = Describe("rate limit key", func() {
+	It("rate limits messages by key", func() {
+		limiter := new(limitRecorder)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Name:         "rate-limit-key",
+			Handler:      func() {},
+			WorkerNumber: 1,
+			RateLimit:    timerate.Every(time.Millisecond),
+			RateLimiter:  limiter,
+			RateLimitKey: func(msg *msgqueue.Message) string {
+				return msg.Header["tenant"]
+			},
+		})
+
+		for _, tenant := range []string{"foo", "bar", ""} {
+			msg := msgqueue.NewMessage()
+			if tenant != "" {
+				msg.Header = map[string]string{"tenant": tenant}
+			}
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		Expect(limiter.keys).To(ConsistOf(
+			"rate-limit-key:foo", "rate-limit-key:bar", "rate-limit-key",
+		))
+	})
+})
+
+type keyStorage struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+func (s *keyStorage) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]struct{})
+	}
+	_, ok := s.keys[key]
+	s.keys[key] = struct{}{}
+	return ok
+}
+
+var _ = Describe("factory prefix", func() {
+	It("namespaces queue name, named messages, and rate limits", func() {
+		storage := new(keyStorage)
+		limiter := new(limitRecorder)
+
+		var qs []*memqueue.Queue
+		for _, prefix := range []string{"staging-", "production-"} {
+			f := memqueue.NewFactory(&msgqueue.FactoryOptions{
+				Prefix: prefix,
+			})
+			q := f.NewQueue(&msgqueue.Options{
+				Name:        "factory-prefix",
+				Handler:     func() {},
+				RateLimit:   timerate.Every(time.Millisecond),
+				RateLimiter: limiter,
+				Storage:     storage,
+			})
+			qs = append(qs, q)
+
+			msg := msgqueue.NewMessage()
+			msg.Name = "hello"
+			err := q.Add(msg)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(qs[0].Name()).To(Equal("staging-factory-prefix"))
+		Expect(qs[1].Name()).To(Equal("production-factory-prefix"))
+
+		for _, q := range qs {
+			err := q.Close()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		Expect(storage.keys).To(HaveLen(2))
+		Expect(storage.keys).To(HaveKey("memqueue:staging-factory-prefix:hello"))
+		Expect(storage.keys).To(HaveKey("memqueue:production-factory-prefix:hello"))
+
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		Expect(limiter.keys).To(ConsistOf(
+			"staging-factory-prefix", "production-factory-prefix",
+		))
+	})
+
+	It("adds prefix to names that start with it", func() {
+		f := memqueue.NewFactory(&msgqueue.FactoryOptions{
+			Prefix: "staging-",
+		})
+		q := f.NewQueue(&msgqueue.Options{
+			Name:    "staging-factory-prefix-name",
+			Handler: func() {},
+		})
+		defer q.Close()
+
+		Expect(q.Name()).To(Equal("staging-staging-factory-prefix-name"))
+	})
+
+	It("does not add prefix twice", func() {
+		f := memqueue.NewFactory(&msgqueue.FactoryOptions{
+			Prefix: "staging-",
+		})
+		opt := &msgqueue.Options{
+			Name:    "factory-prefix-twice",
+			Handler: func() {},
+		}
+
+		q := f.NewQueue(opt)
+		Expect(q.Name()).To(Equal("staging-factory-prefix-twice"))
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		q = f.NewQueue(opt)
+		defer q.Close()
+		Expect(q.Name()).To(Equal("staging-factory-prefix-twice"))
+	})
+})
+
+var _ = Describe("rate limit schedule", func() {
+	window := func(start, end int, limit timerate.Limit) msgqueue.RateLimitWindow {
+		return msgqueue.RateLimitWindow{
+			Start: time.Duration(start) * time.Hour,
+			End:   time.Duration(end) * time.Hour,
+			Limit: limit,
+		}
+	}
+	at := func(hour int) time.Time {
+		return time.Date(2017, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	It("uses limit of the window containing the time", func() {
+		opt := &msgqueue.Options{
+			RateLimit: 100,
+			RateLimitSchedule: []msgqueue.RateLimitWindow{
+				window(9, 17, 10),
+				window(22, 6, 1000),
+			},
+		}
+		Expect(opt.RateLimitAt(at(12))).To(Equal(timerate.Limit(10)))
+		Expect(opt.RateLimitAt(at(23))).To(Equal(timerate.Limit(1000)))
+		Expect(opt.RateLimitAt(at(3))).To(Equal(timerate.Limit(1000)))
+		Expect(opt.RateLimitAt(at(18))).To(Equal(timerate.Limit(100)))
+	})
+
+	It("applies scheduled limit when processing messages", func() {
+		hour := time.Now().Hour()
+		limiter := new(limitRecorder)
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler:     func() {},
+			RateLimiter: limiter,
+			RateLimitSchedule: []msgqueue.RateLimitWindow{
+				window((hour+23)%24, (hour+2)%24, 5),
+			},
+		})
+
+		err := q.Call()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		Expect(limiter.limits).To(Equal([]timerate.Limit{5}))
+	})
+
+	It("rejects invalid windows", func() {
+		_, err := memqueue.New(
+			msgqueue.WithHandler(func() {}),
+			msgqueue.WithRateLimitSchedule(window(25, 1, 1)),
+		)
+		Expect(err).To(MatchError("queue: RateLimitWindow.Start=25h0m0s is out of range"))
+	})
+})
+
 var _ = Describe("Queue", func() {
 	var q *memqueue.Queue
 
@@ -384,6 +3522,14 @@ var _ = Describe("Queue", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	It("returns ErrShutdown when closed", func() {
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Call()
+		Expect(err).To(Equal(msgqueue.ErrShutdown))
+	})
+
 	It("stops processor", func() {
 		err := q.Processor().Stop()
 		Expect(err).NotTo(HaveOccurred())
@@ -397,7 +3543,7 @@ var _ = Describe("Queue", func() {
 
 		It("processes one message", func() {
 			err := q.Processor().ProcessOne()
-			Expect(err).To(MatchError("queue is empty"))
+			Expect(err).To(Equal(msgqueue.ErrQueueEmpty))
 
 			err = q.Processor().ProcessAll()
 			Expect(err).NotTo(HaveOccurred())
@@ -431,9 +3577,9 @@ var _ = Describe("Queue", func() {
 				st := p.Stats()
 				Expect(st.InFlight).To(Equal(uint32(0)))
 				Expect(st.Deleting).To(Equal(uint32(0)))
-				Expect(st.Processed).To(Equal(uint32(3)))
-				Expect(st.Retries).To(Equal(uint32(0)))
-				Expect(st.Fails).To(Equal(uint32(0)))
+				Expect(st.Processed).To(Equal(uint64(3)))
+				Expect(st.Retries).To(Equal(uint64(0)))
+				Expect(st.Fails).To(Equal(uint64(0)))
 			})
 
 			It("processes one message", func() {
@@ -445,9 +3591,9 @@ var _ = Describe("Queue", func() {
 				st := p.Stats()
 				Expect(st.InFlight).To(Equal(uint32(2)))
 				Expect(st.Deleting).To(Equal(uint32(0)))
-				Expect(st.Processed).To(Equal(uint32(1)))
-				Expect(st.Retries).To(Equal(uint32(0)))
-				Expect(st.Fails).To(Equal(uint32(0)))
+				Expect(st.Processed).To(Equal(uint64(1)))
+				Expect(st.Retries).To(Equal(uint64(0)))
+				Expect(st.Fails).To(Equal(uint64(0)))
 
 				err = p.ProcessAll()
 				Expect(err).NotTo(HaveOccurred())
@@ -455,14 +3601,124 @@ var _ = Describe("Queue", func() {
 				st = p.Stats()
 				Expect(st.InFlight).To(Equal(uint32(0)))
 				Expect(st.Deleting).To(Equal(uint32(0)))
-				Expect(st.Processed).To(Equal(uint32(3)))
-				Expect(st.Retries).To(Equal(uint32(0)))
-				Expect(st.Fails).To(Equal(uint32(0)))
+				Expect(st.Processed).To(Equal(uint64(3)))
+				Expect(st.Retries).To(Equal(uint64(0)))
+				Expect(st.Fails).To(Equal(uint64(0)))
 			})
 		})
 	})
 })
 
+var _ = Describe("SetCapacity", func() {
+	var q *memqueue.Queue
+	var release chan struct{}
+	var processed chan int
+
+	BeforeEach(func() {
+		release = make(chan struct{})
+		processed = make(chan int, 100)
+		q = memqueue.NewQueue(&msgqueue.Options{
+			Name: fmt.Sprintf("capacity-queue-%d", time.Now().UnixNano()),
+			Handler: func(i int) {
+				<-release
+				processed <- i
+			},
+			WorkerNumber: 1,
+			BufferSize:   1,
+		})
+	})
+
+	// fill adds messages until the worker, the processor buffer,
+	// and the feeder are busy and the backlog is full.
+	fill := func() {
+		for i := 0; i < 5; i++ {
+			err := q.Call(i)
+			Expect(err).NotTo(HaveOccurred())
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	It("rejects messages when full", func() {
+		q.SetCapacity(2, memqueue.Reject)
+		fill()
+
+		err := q.Call(5)
+		Expect(err).To(Equal(msgqueue.ErrQueueFull))
+
+		close(release)
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processed).To(HaveLen(5))
+	})
+
+	It("blocks producer until there is room", func() {
+		q.SetCapacity(2, memqueue.Block)
+		fill()
+
+		added := make(chan error, 1)
+		go func() {
+			added <- q.Call(5)
+		}()
+		Consistently(added, 200*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(added).Should(Receive(BeNil()))
+
+		err := q.Close()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(processed).To(HaveLen(6))
+	})
+
+	It("drops oldest waiting message", func() {
+		q.SetCapacity(2, memqueue.DropOldest)
+		fill()
+
+		err := q.Call(5)
+		Expect(err).NotTo(HaveOccurred())
+
+		close(release)
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		var got []int
+		for len(processed) > 0 {
+			got = append(got, <-processed)
+		}
+		Expect(got).To(Equal([]int{0, 1, 2, 4, 5}))
+	})
+
+	It("rejects messages added while closing", func() {
+		q.SetCapacity(2, memqueue.Block)
+		fill()
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- q.Close()
+		}()
+		Eventually(func() error {
+			return q.Call(5)
+		}).Should(Equal(msgqueue.ErrShutdown))
+
+		close(release)
+		Eventually(closed).Should(Receive(BeNil()))
+		Expect(processed).To(HaveLen(5))
+	})
+
+	It("deletes waiting messages on close timeout", func() {
+		q.SetCapacity(2, memqueue.Block)
+		fill()
+
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			close(release)
+		}()
+		err := q.CloseTimeout(100 * time.Millisecond)
+		Expect(err).To(HaveOccurred())
+
+		Consistently(processed, 200*time.Millisecond).ShouldNot(Receive(BeNumerically(">=", 3)))
+	})
+})
+
 // slot splits time into equal periods (called slots) and returns
 // slot number for provided time.
 func slot(period time.Duration) int64 {
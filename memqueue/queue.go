@@ -1,6 +1,7 @@
 package memqueue
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -19,21 +20,65 @@ type Queue struct {
 
 	p  *processor.Processor
 	wg sync.WaitGroup
+
+	namesMu sync.Mutex
+	names   map[string]struct{} // keys of pending named messages
+
+	backlog *backlog // set by SetCapacity
+
+	// Delays of messages released in Sync mode,
+	// which are processed again by the caller of Add.
+	releasedMu sync.Mutex
+	released   map[*msgqueue.Message]time.Duration
+
+	// closeMu makes checking closed and adding to wg atomic,
+	// so messages are not added while CloseTimeout waits.
+	closeMu   sync.RWMutex
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
 
 func NewQueue(opt *msgqueue.Options) *Queue {
 	opt.Init()
 	q := Queue{
 		opt: opt,
+
+		sync: opt.Sync,
+
+		names:    make(map[string]struct{}),
+		released: make(map[*msgqueue.Message]time.Duration),
+		closed:   make(chan struct{}),
+	}
+	q.p = processor.New(&q, opt)
+	if !opt.Sync {
+		q.p.Start()
 	}
-	q.p = processor.Start(&q, opt)
 
 	registerQueue(&q)
+	if _, ok := opt.Redis.(msgqueue.RedisCmdable); ok {
+		_ = q.Reconcile()
+		go q.reconciler()
+	}
 	return &q
 }
 
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Handler == nil {
+		return nil, errors.New("memqueue: Handler is required")
+	}
+	return NewQueue(opt), nil
+}
+
 func (q *Queue) Name() string {
 	return q.opt.Name
 }
@@ -46,6 +91,20 @@ func (q *Queue) Options() *msgqueue.Options {
 	return q.opt
 }
 
+// Describe describes the queue. Messages are not delayed
+// when SetNoDelay is used.
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:    q.Name(),
+		Backend: "memqueue",
+		Options: q.opt,
+		Capabilities: msgqueue.Capabilities{
+			Delay: !q.noDelay,
+			Purge: true,
+		},
+	}
+}
+
 func (q *Queue) Processor() *processor.Processor {
 	return q.p
 }
@@ -64,10 +123,22 @@ func (q *Queue) Close() error {
 }
 
 // Close closes the queue waiting for pending messages to be processed.
+// Messages added after Close is called are rejected with
+// msgqueue.ErrShutdown. On timeout messages that wait in the backlog
+// are deleted without processing.
 func (q *Queue) CloseTimeout(timeout time.Duration) error {
 	defer q.p.Stop()
 	defer unregisterQueue(q)
 
+	q.closeOnce.Do(func() {
+		q.closeMu.Lock()
+		close(q.closed)
+		q.closeMu.Unlock()
+		if q.backlog != nil {
+			q.wakeBacklog()
+		}
+	})
+
 	done := make(chan struct{})
 	go func() {
 		q.wg.Wait()
@@ -76,6 +147,9 @@ func (q *Queue) CloseTimeout(timeout time.Duration) error {
 
 	select {
 	case <-time.After(timeout):
+		if q.backlog != nil {
+			q.purgeBacklog()
+		}
 		return fmt.Errorf("workers did not stop after %s", timeout)
 	case <-done:
 		return nil
@@ -87,6 +161,18 @@ func (q *Queue) Add(msg *msgqueue.Message) error {
 	return q.addMessage(msg)
 }
 
+// AddBatch adds messages to the queue. Messages with
+// duplicate names are skipped.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		err := q.addMessage(msg)
+		if err != nil && err != msgqueue.ErrDuplicate {
+			return err
+		}
+	}
+	return nil
+}
+
 // Call creates a message using the args and adds it to the queue.
 func (q *Queue) Call(args ...interface{}) error {
 	msg := msgqueue.NewMessage(args...)
@@ -102,23 +188,60 @@ func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
 }
 
 func (q *Queue) addMessage(msg *msgqueue.Message) error {
-	if !q.isUniqueName(msg.Name) {
+	q.closeMu.RLock()
+	if q.isClosed() {
+		q.closeMu.RUnlock()
+		return msgqueue.ErrShutdown
+	}
+	if q.opt.Upsert && msg.Name != "" {
+		// Upserted names are locked by latest args until the message
+		// is deleted by the processor.
+		pending, err := msgqueue.UpsertLatestArgs(q.opt, msg)
+		if err != nil || pending {
+			q.closeMu.RUnlock()
+			return err
+		}
+	} else if !q.isUniqueName(msg.Name) {
+		q.closeMu.RUnlock()
 		return msgqueue.ErrDuplicate
+	} else if msg.Name != "" {
+		q.addName(q.nameKey(msg.Name))
 	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	msgqueue.InjectTrace(q.opt, msg)
 	q.wg.Add(1)
-	return q.enqueueMessage(msg)
+	q.closeMu.RUnlock()
+	if q.backlog != nil && !q.sync && (q.noDelay || msg.ScheduledDelay() == 0) {
+		msg.Delay = 0
+		msg.ReservedCount++
+		return q.push(msg)
+	}
+	return q.enqueueMessage(msg, false)
 }
 
-func (q *Queue) enqueueMessage(msg *msgqueue.Message) error {
+// enqueueMessage adds the message to the processor. Released messages
+// are added without blocking, because workers release them.
+func (q *Queue) enqueueMessage(msg *msgqueue.Message, released bool) error {
 	var delay time.Duration
-	delay, msg.Delay = msg.Delay, 0
+	delay, msg.Delay = msg.ScheduledDelay(), 0
 	msg.ReservedCount++
 
 	if q.sync {
-		return q.p.Process(msg)
+		if released {
+			q.releasedMu.Lock()
+			q.released[msg] = delay
+			q.releasedMu.Unlock()
+			return nil
+		}
+		return q.processSync(msg)
 	}
 
 	if q.noDelay || delay == 0 {
+		if released {
+			return q.p.AddReleased(msg)
+		}
 		return q.p.Add(msg)
 	}
 
@@ -126,25 +249,63 @@ func (q *Queue) enqueueMessage(msg *msgqueue.Message) error {
 	return nil
 }
 
+// processSync processes the message in the caller goroutine retrying it
+// after the backoff until it is deleted. It returns the error of the
+// last attempt, so nil is returned when a retry succeeds.
+func (q *Queue) processSync(msg *msgqueue.Message) error {
+	for {
+		err := q.p.Process(msg)
+
+		q.releasedMu.Lock()
+		delay, ok := q.released[msg]
+		delete(q.released, msg)
+		q.releasedMu.Unlock()
+		if !ok {
+			return err
+		}
+
+		if !q.noDelay && delay > 0 {
+			time.Sleep(delay)
+		}
+		msg.ReservedCount++
+	}
+}
+
 func (q *Queue) isUniqueName(name string) bool {
 	if name == "" {
 		return true
 	}
-	key := fmt.Sprintf("%s:%s:%s", redisPrefix, q.Name(), name)
-	exists := q.opt.Storage.Exists(key)
+	exists := q.opt.Storage.Exists(q.nameKey(name))
 	return !exists
 }
 
+func (q *Queue) nameKey(name string) string {
+	return fmt.Sprintf("%s:%s:%s", redisPrefix, q.Name(), name)
+}
+
 func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
-	return nil, processor.ErrNotSupported
+	return nil, msgqueue.ErrNotSupported
+}
+
+// Touch is a no-op, because memqueue messages are not reserved.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	return nil
+}
+
+// Ping always succeeds, because memqueue does not have a backend.
+func (q *Queue) Ping() error {
+	return nil
 }
 
 func (q *Queue) Release(msg *msgqueue.Message, dur time.Duration) error {
 	msg.Delay = dur
-	return q.enqueueMessage(msg)
+	return q.enqueueMessage(msg, true)
 }
 
 func (q *Queue) Delete(msg *msgqueue.Message) error {
+	if msg.Name != "" {
+		q.removeName(q.nameKey(msg.Name))
+	}
 	q.wg.Done()
 	return nil
 }
@@ -159,5 +320,8 @@ func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
 }
 
 func (q *Queue) Purge() error {
+	if q.backlog != nil {
+		q.purgeBacklog()
+	}
 	return q.p.Purge()
 }
@@ -0,0 +1,140 @@
+package memqueue
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+const reconcileInterval = time.Minute
+
+// Process is considered dead when it does not refresh its owner key
+// for several reconcile intervals.
+const ownerTTL = 3 * reconcileInterval
+
+var ownerId = newOwnerId()
+
+func newOwnerId() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+func ownerKey(id string) string {
+	return fmt.Sprintf("%s:owner:%s", redisPrefix, id)
+}
+
+func (q *Queue) locksKey() string {
+	return fmt.Sprintf("%s:%s:locks", redisPrefix, q.Name())
+}
+
+// addName records that the named message is pending in this process
+// so its lock can be released if the process dies before the message
+// is processed.
+func (q *Queue) addName(key string) {
+	q.namesMu.Lock()
+	q.names[key] = struct{}{}
+	q.namesMu.Unlock()
+
+	if redis, ok := q.opt.Redis.(msgqueue.RedisCmdable); ok {
+		redis.HSet(q.locksKey(), key, ownerId)
+	}
+}
+
+func (q *Queue) removeName(key string) {
+	q.namesMu.Lock()
+	delete(q.names, key)
+	q.namesMu.Unlock()
+
+	if redis, ok := q.opt.Redis.(msgqueue.RedisCmdable); ok {
+		redis.HDel(q.locksKey(), key)
+	}
+}
+
+func (q *Queue) hasName(key string) bool {
+	q.namesMu.Lock()
+	_, ok := q.names[key]
+	q.namesMu.Unlock()
+	return ok
+}
+
+func (q *Queue) pendingNames() []string {
+	q.namesMu.Lock()
+	keys := make([]string, 0, len(q.names))
+	for key := range q.names {
+		keys = append(keys, key)
+	}
+	q.namesMu.Unlock()
+	return keys
+}
+
+func (q *Queue) reconciler() {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.Reconcile(); err != nil {
+				q.opt.Logf(msgqueue.LogWarn, "%s Reconcile failed: %s", q, err)
+			}
+		case <-q.closed:
+			return
+		}
+	}
+}
+
+// Reconcile repairs locks of named messages. It releases locks
+// of pending messages owned by processes that are no longer alive
+// and restores expired locks of messages pending in this process.
+// It is a no-op unless Options.Redis implements RedisCmdable.
+func (q *Queue) Reconcile() error {
+	redis, ok := q.opt.Redis.(msgqueue.RedisCmdable)
+	if !ok {
+		return nil
+	}
+
+	if err := redis.Set(ownerKey(ownerId), "", ownerTTL).Err(); err != nil {
+		return err
+	}
+
+	locks, err := redis.HGetAll(q.locksKey()).Result()
+	if err != nil {
+		return err
+	}
+
+	alive := make(map[string]bool)
+	for key, owner := range locks {
+		if owner == ownerId {
+			if !q.hasName(key) {
+				redis.HDel(q.locksKey(), key)
+			}
+			continue
+		}
+
+		ok, seen := alive[owner]
+		if !seen {
+			ok = redis.Exists(ownerKey(owner)).Val() > 0
+			alive[owner] = ok
+		}
+		if ok {
+			continue
+		}
+
+		if d, ok := q.opt.Storage.(msgqueue.Deleter); ok {
+			if err := d.Delete(key); err != nil {
+				return err
+			}
+		}
+		redis.HDel(q.locksKey(), key)
+	}
+
+	for _, key := range q.pendingNames() {
+		// Exists sets the lock if it is missing.
+		_ = q.opt.Storage.Exists(key)
+		redis.HSet(q.locksKey(), key, ownerId)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+//go:build go1.18
+// +build go1.18
+
+package memqueue_test
+
+import (
+	"context"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+var _ = Describe("TypedQueue", func() {
+	ch := make(chan user, 10)
+	handler := func(ctx context.Context, u user) error {
+		ch <- u
+		return nil
+	}
+
+	It("passes typed value to the handler", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: msgqueue.TypedHandler(handler),
+		})
+		tq := msgqueue.NewTypedQueue[user](q)
+
+		err := tq.Add(user{Name: "bob", Age: 42})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ch).To(Receive(Equal(user{Name: "bob", Age: 42})))
+	})
+
+	It("decodes typed value using queue codec", func() {
+		q := memqueue.NewQueue(&msgqueue.Options{
+			Handler: msgqueue.TypedHandler(handler),
+			Codec:   msgqueue.JSONCodec,
+		})
+
+		err := q.Add(&msgqueue.Message{Body: `[{"Name":"alice","Age":7}]`})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = q.Close()
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ch).To(Receive(Equal(user{Name: "alice", Age: 7})))
+	})
+})
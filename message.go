@@ -1,7 +1,7 @@
 package msgqueue
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"math/rand"
 	"time"
@@ -9,7 +9,9 @@ import (
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
-var ErrDuplicate = errors.New("queue: message with such name already exists")
+// TaskHeader is the message header that names the task of the message,
+// e.g. "generate-invoice". Processor.PauseName matches it by default.
+const TaskHeader = "task"
 
 // Message is used to create and retrieve messages from a queue.
 type Message struct {
@@ -24,17 +26,51 @@ type Message struct {
 	// before executing the message.
 	Delay time.Duration
 
+	// ScheduledAt specifies the time when the message must be executed.
+	// If both Delay and ScheduledAt are set, the later one is used.
+	ScheduledAt time.Time
+
 	// Function args passed to the handler.
 	Args []interface{}
 
 	// Text representation of the Args.
 	Body string
 
+	// Messages with higher priority are processed before other
+	// messages buffered by the processor.
+	Priority int
+
+	// Optional key of the message group. Processor workers handle
+	// messages with the same group key sequentially in the order they
+	// are received, while different groups are processed in parallel.
+	// Failed message is retried after messages received after it.
+	GroupKey string
+
+	// Barrier message is processed after messages that workers of the
+	// processor received before it, and messages received after it wait
+	// until it is processed. Barrier with GroupKey is ordered only
+	// within the group. Barriers don't coordinate other processes.
+	Barrier bool
+
+	// Optional number of tries/releases after which the message fails
+	// permanently. It overrides Options.RetryLimit when positive.
+	RetryLimit int
+
+	// Optional message headers, e.g. tenant or trace id.
+	// Headers are preserved when message is released back to the queue.
+	Header map[string]string
+
+	// Time when the message was added to the queue. It is set by
+	// the queue and is used to expire messages older than Options.MaxAge.
+	CreatedAt time.Time
+
 	// SQS/IronMQ reservation id that is used to release/delete the message..
 	ReservationId string
 
 	// The number of times the message has been reserved or released.
 	ReservedCount int
+
+	ctx context.Context
 }
 
 func NewMessage(args ...interface{}) *Message {
@@ -43,6 +79,33 @@ func NewMessage(args ...interface{}) *Message {
 	}
 }
 
+// ScheduledDelay returns the duration the queue must wait before
+// executing the message taking into account both Delay and ScheduledAt.
+func (m *Message) ScheduledDelay() time.Duration {
+	delay := m.Delay
+	if !m.ScheduledAt.IsZero() {
+		if d := m.ScheduledAt.Sub(time.Now()); d > delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// Context returns the message context. It is cancelled when
+// the processor that handles the message is stopped.
+func (m *Message) Context() context.Context {
+	if m.ctx != nil {
+		return m.ctx
+	}
+	return context.Background()
+}
+
+// SetContext sets the message context that is passed to handlers
+// that accept context.Context as the first argument.
+func (m *Message) SetContext(ctx context.Context) {
+	m.ctx = ctx
+}
+
 func (m *Message) String() string {
 	return fmt.Sprintf("Message<Id=%q Name=%q>", m.Id, m.Name)
 }
@@ -55,8 +118,14 @@ func (m *Message) SetDelayName(delay time.Duration, args ...interface{}) {
 	m.Delay += time.Duration(rand.Intn(5)+1) * time.Second
 }
 
+// MarshalArgs encodes message args using MsgpackCodec.
 func (m *Message) MarshalArgs() (string, error) {
-	return encodeArgs(m.Args)
+	return m.EncodeArgs(MsgpackCodec)
+}
+
+// EncodeArgs encodes message args using the codec.
+func (m *Message) EncodeArgs(codec Codec) (string, error) {
+	return encodeArgs(codec, m.Args)
 }
 
 func timeSlot(resolution time.Duration) int64 {
@@ -0,0 +1,15 @@
+package msgqueue
+
+import "time"
+
+// Metrics receives processor metrics, e.g. to push them to statsd.
+// See metrics/statsd package. Methods must be safe for concurrent use.
+type Metrics interface {
+	// Count adds n to the counter, e.g. "processed", "retried",
+	// "requeued", or "failed".
+	Count(queue, name string, n int64)
+	// Gauge sets the gauge, e.g. "buffered", "in_flight", or "delayed".
+	Gauge(queue, name string, value float64)
+	// Timing records the duration, e.g. "duration" of the handler.
+	Timing(queue, name string, dur time.Duration)
+}
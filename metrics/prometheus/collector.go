@@ -0,0 +1,147 @@
+// Package prometheus exports processor stats as Prometheus metrics.
+package prometheus
+
+import (
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// Queue is a queue with processor, e.g. azsqs.Queue,
+// ironmq.Queue, or memqueue.Queue.
+type Queue interface {
+	Name() string
+	Options() *msgqueue.Options
+	Processor() *processor.Processor
+}
+
+// DurationBuckets are upper bounds of the handler duration
+// histogram buckets.
+var DurationBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+var queueLabels = []string{"queue"}
+
+type counter struct {
+	desc  *prom.Desc
+	value func(st *processor.Stats) float64
+}
+
+// Collector is prom.Collector that exposes stats of the queues
+// labeled by queue name.
+type Collector struct {
+	queues []Queue
+
+	gauges   []counter
+	counters []counter
+	depth    *prom.Desc
+	duration *prom.Desc
+}
+
+var _ prom.Collector = (*Collector)(nil)
+
+// NewCollector returns Collector for the queues. Queue depth is
+// reported for queues that implement processor.Lener, e.g. SQS
+// and IronMQ queues. It requires an API call on every scrape.
+func NewCollector(queues ...Queue) *Collector {
+	desc := func(name, help string) *prom.Desc {
+		return prom.NewDesc("msgqueue_"+name, help, queueLabels, nil)
+	}
+	return &Collector{
+		queues: queues,
+
+		gauges: []counter{
+			{desc("buffered", "Number of messages buffered by the processor."),
+				func(st *processor.Stats) float64 { return float64(st.Buffered) }},
+			{desc("in_flight", "Number of messages being processed."),
+				func(st *processor.Stats) float64 { return float64(st.InFlight) }},
+			{desc("delayed", "Number of messages delayed by the processor."),
+				func(st *processor.Stats) float64 { return float64(st.Delayed) }},
+		},
+		counters: []counter{
+			{desc("processed_total", "Number of processed messages."),
+				func(st *processor.Stats) float64 { return float64(st.Processed) }},
+			{desc("retries_total", "Number of retried messages."),
+				func(st *processor.Stats) float64 { return float64(st.Retries) }},
+			{desc("requeued_total", "Number of requeued messages."),
+				func(st *processor.Stats) float64 { return float64(st.Requeued) }},
+			{desc("fails_total", "Number of messages that failed permanently."),
+				func(st *processor.Stats) float64 { return float64(st.Fails) }},
+			{desc("panics_total", "Number of handler panics."),
+				func(st *processor.Stats) float64 { return float64(st.Panics) }},
+			{desc("timeouts_total", "Number of handler timeouts."),
+				func(st *processor.Stats) float64 { return float64(st.Timeouts) }},
+			{desc("dead_lettered_total", "Number of messages moved to the dead letter queue."),
+				func(st *processor.Stats) float64 { return float64(st.DeadLettered) }},
+			{desc("expired_total", "Number of expired messages."),
+				func(st *processor.Stats) float64 { return float64(st.Expired) }},
+			{desc("coalesced_total", "Number of deleted duplicate messages."),
+				func(st *processor.Stats) float64 { return float64(st.Coalesced) }},
+			{desc("filtered_total", "Number of messages skipped by the filter."),
+				func(st *processor.Stats) float64 { return float64(st.Filtered) }},
+			{desc("priority_inversions_total", "Number of rate limited messages that delayed higher priority messages."),
+				func(st *processor.Stats) float64 { return float64(st.Inversions) }},
+		},
+		depth:    desc("depth", "Approximate number of messages in the queue backend."),
+		duration: desc("handler_duration_seconds", "Message processing duration."),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	for _, g := range c.gauges {
+		ch <- g.desc
+	}
+	for _, cnt := range c.counters {
+		ch <- cnt.desc
+	}
+	ch <- c.depth
+	ch <- c.duration
+}
+
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	for _, q := range c.queues {
+		name := q.Name()
+		p := q.Processor()
+		st := p.Stats()
+
+		for _, g := range c.gauges {
+			ch <- prom.MustNewConstMetric(g.desc, prom.GaugeValue, g.value(st), name)
+		}
+		for _, cnt := range c.counters {
+			ch <- prom.MustNewConstMetric(cnt.desc, prom.CounterValue, cnt.value(st), name)
+		}
+
+		if lener, ok := q.(processor.Lener); ok {
+			n, err := lener.Len()
+			if err != nil {
+				q.Options().Logf(msgqueue.LogWarn, "%s Len failed: %s", name, err)
+			} else {
+				ch <- prom.MustNewConstMetric(c.depth, prom.GaugeValue, float64(n), name)
+			}
+		}
+
+		counts, count, sum := p.DurationBuckets(DurationBuckets)
+		buckets := make(map[float64]uint64, len(counts))
+		for i, n := range counts {
+			buckets[DurationBuckets[i].Seconds()] = n
+		}
+		ch <- prom.MustNewConstHistogram(c.duration, count, sum.Seconds(), buckets, name)
+	}
+}
@@ -0,0 +1,60 @@
+package prometheus_test
+
+import (
+	"testing"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/metrics/prometheus"
+)
+
+func TestCollector(t *testing.T) {
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name:    "prometheus-test",
+		Handler: func() {},
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := q.Call(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prom.NewRegistry()
+	reg.MustRegister(prometheus.NewCollector(q))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(map[string]float64)
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		if label := m.GetLabel()[0]; label.GetValue() != "prometheus-test" {
+			t.Fatalf("got queue label %q, wanted prometheus-test", label.GetValue())
+		}
+		switch {
+		case m.Counter != nil:
+			metrics[f.GetName()] = m.GetCounter().GetValue()
+		case m.Gauge != nil:
+			metrics[f.GetName()] = m.GetGauge().GetValue()
+		case m.Histogram != nil:
+			metrics[f.GetName()] = float64(m.GetHistogram().GetSampleCount())
+		}
+	}
+
+	if got := metrics["msgqueue_processed_total"]; got != 3 {
+		t.Errorf("got msgqueue_processed_total=%v, wanted 3", got)
+	}
+	if got := metrics["msgqueue_handler_duration_seconds"]; got != 3 {
+		t.Errorf("got msgqueue_handler_duration_seconds count %v, wanted 3", got)
+	}
+	if _, ok := metrics["msgqueue_depth"]; ok {
+		t.Error("got msgqueue_depth for memqueue, wanted none")
+	}
+}
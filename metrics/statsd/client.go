@@ -0,0 +1,77 @@
+// Package statsd sends processor metrics to statsd or DogStatsD.
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Client is msgqueue.Metrics that sends metrics to statsd over UDP.
+// Metrics are named <prefix>.<queue>.<name>, e.g. msgqueue.emails.processed.
+type Client struct {
+	// Use DogStatsD tags, i.e. <prefix>.<name> metrics tagged
+	// with queue:<queue>.
+	Tags bool
+
+	conn   net.Conn
+	prefix string
+}
+
+var _ msgqueue.Metrics = (*Client)(nil)
+
+// NewClient returns Client that sends metrics to the statsd address,
+// e.g. "localhost:8125", using the metric name prefix.
+func NewClient(addr, prefix string) (*Client, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn:   conn,
+		prefix: prefix,
+	}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) Count(queue, name string, n int64) {
+	c.send(queue, name, strconv.FormatInt(n, 10), "c")
+}
+
+func (c *Client) Gauge(queue, name string, value float64) {
+	c.send(queue, name, strconv.FormatFloat(value, 'f', -1, 64), "g")
+}
+
+func (c *Client) Timing(queue, name string, dur time.Duration) {
+	ms := float64(dur) / float64(time.Millisecond)
+	c.send(queue, name, strconv.FormatFloat(ms, 'f', -1, 64), "ms")
+}
+
+func (c *Client) send(queue, name, value, typ string) {
+	b := make([]byte, 0, 64)
+	if c.prefix != "" {
+		b = append(b, c.prefix...)
+		b = append(b, '.')
+	}
+	if !c.Tags {
+		b = append(b, queue...)
+		b = append(b, '.')
+	}
+	b = append(b, name...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, '|')
+	b = append(b, typ...)
+	if c.Tags {
+		b = append(b, "|#queue:"...)
+		b = append(b, queue...)
+	}
+	// Metrics are best effort and are not retried.
+	_, _ = c.conn.Write(b)
+}
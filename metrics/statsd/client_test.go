@@ -0,0 +1,102 @@
+package statsd_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/metrics/statsd"
+)
+
+func listen(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readPackets(t *testing.T, conn *net.UDPConn, n int) []string {
+	var packets []string
+	buf := make([]byte, 1024)
+	for i := 0; i < n; i++ {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		m, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, string(buf[:m]))
+	}
+	return packets
+}
+
+func TestClient(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	c, err := statsd.NewClient(conn.LocalAddr().String(), "msgqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Count("emails", "processed", 1)
+	c.Gauge("emails", "buffered", 2.5)
+	c.Timing("emails", "duration", 1500*time.Microsecond)
+	c.Tags = true
+	c.Count("emails", "failed", 3)
+
+	wanted := []string{
+		"msgqueue.emails.processed:1|c",
+		"msgqueue.emails.buffered:2.5|g",
+		"msgqueue.emails.duration:1.5|ms",
+		"msgqueue.failed:3|c|#queue:emails",
+	}
+	got := readPackets(t, conn, len(wanted))
+	for i := range wanted {
+		if got[i] != wanted[i] {
+			t.Fatalf("got %q, wanted %q", got[i], wanted[i])
+		}
+	}
+}
+
+func TestProcessorMetrics(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	c, err := statsd.NewClient(conn.LocalAddr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name:    "statsd-test",
+		Handler: func() {},
+		Metrics: c,
+	})
+	q.SetSync(true)
+
+	if err := q.Call(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range readPackets(t, conn, 5) {
+		seen[strings.SplitN(p, ":", 2)[0]] = true
+	}
+	for _, name := range []string{"statsd-test.duration", "statsd-test.processed"} {
+		if !seen[name] {
+			t.Fatalf("metric %s is not sent (got %v)", name, seen)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+// Package msgqueuetest provides helpers for tests of code that uses queues.
+package msgqueuetest
+
+import (
+	"testing"
+
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// CheckNoPending fails the test if any of the queues still has buffered,
+// in-flight, delayed, or dead-lettered messages. If no queues are given,
+// all memqueue queues that are not closed yet are checked. Call it at the
+// end of the test to catch leaked async work.
+func CheckNoPending(t testing.TB, queues ...processor.Queuer) {
+	if len(queues) == 0 {
+		for _, q := range memqueue.Queues() {
+			queues = append(queues, q)
+		}
+	}
+
+	for _, q := range queues {
+		st := q.Processor().Stats()
+		if st.InFlight == 0 && st.DeadLettered == 0 {
+			continue
+		}
+		t.Errorf(
+			"%s has pending messages: buffered=%d in_flight=%d delayed=%d dead_lettered=%d",
+			q, st.Buffered, st.InFlight, st.Delayed, st.DeadLettered,
+		)
+	}
+}
@@ -0,0 +1,94 @@
+package msgqueuetest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/msgqueuetest"
+)
+
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCheckNoPendingPasses(t *testing.T) {
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name:    "msgqueuetest-passes",
+		Handler: func() {},
+	})
+	defer q.Close()
+
+	if err := q.Call(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Processor().ProcessAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := new(fakeT)
+	msgqueuetest.CheckNoPending(ft, q)
+	if len(ft.errors) != 0 {
+		t.Fatalf("got %q, wanted no errors", ft.errors)
+	}
+}
+
+func TestCheckNoPendingFailsOnDelayedMessage(t *testing.T) {
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name:    "msgqueuetest-delayed",
+		Handler: func() {},
+	})
+	defer q.CloseTimeout(time.Millisecond)
+
+	msg := msgqueue.NewMessage()
+	msg.Delay = time.Hour
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := new(fakeT)
+	msgqueuetest.CheckNoPending(ft)
+	if len(ft.errors) != 1 {
+		t.Fatalf("got %q, wanted 1 error", ft.errors)
+	}
+	const wanted = "Memqueue<msgqueuetest-delayed> has pending messages: " +
+		"buffered=0 in_flight=1 delayed=1 dead_lettered=0"
+	if ft.errors[0] != wanted {
+		t.Fatalf("got %q, wanted %q", ft.errors[0], wanted)
+	}
+}
+
+func TestCheckNoPendingFailsOnDeadLetteredMessage(t *testing.T) {
+	dlq := memqueue.NewQueue(&msgqueue.Options{
+		Name:    "msgqueuetest-dlq",
+		Handler: func(queue, reason string, attempts int, body string) {},
+	})
+	defer dlq.Close()
+
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name: "msgqueuetest-dead-lettered",
+		Handler: func() error {
+			return msgqueue.Unretryable(fmt.Errorf("fake error"))
+		},
+		DeadLetterQueue: dlq,
+	})
+	if err := q.Call(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := new(fakeT)
+	msgqueuetest.CheckNoPending(ft, q)
+	if len(ft.errors) != 1 {
+		t.Fatalf("got %q, wanted 1 error", ft.errors)
+	}
+}
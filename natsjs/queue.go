@@ -0,0 +1,410 @@
+package natsjs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Message headers that store message attributes.
+// JetStream can't delay messages, so delay is stored in the header
+// and the message is redelivered after the delay using NAK.
+const (
+	delayHeader      = "Msgqueue-Delay"
+	priorityHeader   = "Msgqueue-Priority"
+	retryLimitHeader = "Msgqueue-Retry-Limit"
+	groupKeyHeader   = "Msgqueue-Group-Key"
+	barrierHeader    = "Msgqueue-Barrier"
+)
+
+// Default max_payload of NATS server.
+const maxMessageSize = 1024 * 1024
+
+// Time during which ReserveN waits for messages.
+const fetchWait = time.Second
+
+type Queue struct {
+	js       nats.JetStreamContext
+	stream   string
+	opt      *msgqueue.Options
+	producer *producer.Producer
+
+	subMu sync.Mutex
+	sub   *nats.Subscription
+
+	// Reserved messages indexed by stream sequence,
+	// so they can be acked and nacked.
+	reservedMu sync.Mutex
+	reserved   map[string]*nats.Msg
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that publishes messages to the subject
+// opt.Name of the existing JetStream stream and reserves them using
+// durable pull consumer with the same name.
+func NewQueue(js nats.JetStreamContext, stream string, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		js:       js,
+		stream:   stream,
+		opt:      opt,
+		reserved: make(map[string]*nats.Msg),
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(js nats.JetStreamContext, stream string, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(js, stream, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "nats",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// durable returns name of the pull consumer. Consumer
+// names can't contain subject tokens and wildcards.
+func (q *Queue) durable() string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(q.Name())
+}
+
+func (q *Queue) subscription() (*nats.Subscription, error) {
+	q.subMu.Lock()
+	defer q.subMu.Unlock()
+
+	if q.sub != nil {
+		return q.sub, nil
+	}
+	sub, err := q.js.PullSubscribe(
+		q.Name(), q.durable(),
+		nats.BindStream(q.stream),
+		nats.AckExplicit(),
+		nats.AckWait(q.opt.ReservationTimeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	q.sub = sub
+	return sub, nil
+}
+
+// Len returns the number of messages that are not yet
+// delivered to the consumer.
+func (q *Queue) Len() (int, error) {
+	info, err := q.js.ConsumerInfo(q.stream, q.durable())
+	if err != nil {
+		return 0, err
+	}
+	return int(info.NumPending), nil
+}
+
+// Ping checks that the stream is reachable by requesting stream info.
+func (q *Queue) Ping() error {
+	_, err := q.js.StreamInfo(q.stream)
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+
+	ack, err := q.js.PublishMsg(q.natsMessage(msg))
+	if err != nil {
+		return err
+	}
+
+	msg.Id = strconv.FormatUint(ack.Sequence, 10)
+	return nil
+}
+
+// addBatch publishes messages one by one, because
+// JetStream does not support batched publishing.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		ack, err := q.js.PublishMsg(q.natsMessage(msg))
+		if err != nil {
+			return err
+		}
+		msg.Id = strconv.FormatUint(ack.Sequence, 10)
+	}
+	return nil
+}
+
+func (q *Queue) natsMessage(msg *msgqueue.Message) *nats.Msg {
+	header := make(nats.Header, len(msg.Header))
+	for k, v := range msg.Header {
+		header.Set(k, v)
+	}
+
+	if delay := msg.ScheduledDelay(); delay > 0 {
+		header.Set(delayHeader, delay.String())
+	}
+	if msg.Priority != 0 {
+		header.Set(priorityHeader, strconv.Itoa(msg.Priority))
+	}
+	if msg.RetryLimit != 0 {
+		header.Set(retryLimitHeader, strconv.Itoa(msg.RetryLimit))
+	}
+	if msg.GroupKey != "" {
+		header.Set(groupKeyHeader, msg.GroupKey)
+	}
+	if msg.Barrier {
+		header.Set(barrierHeader, "1")
+	}
+
+	return &nats.Msg{
+		Subject: q.Name(),
+		Header:  header,
+		Data:    []byte(msg.Body),
+	}
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds NATS max payload.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	sub, err := q.subscription()
+	if err != nil {
+		return nil, err
+	}
+
+	natsMsgs, err := sub.Fetch(n, nats.MaxWait(fetchWait))
+	if err == nats.ErrTimeout {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]msgqueue.Message, 0, len(natsMsgs))
+	for _, natsMsg := range natsMsgs {
+		meta, err := natsMsg.Metadata()
+		if err != nil {
+			q.terminate(natsMsg, err)
+			continue
+		}
+		reservedCount := int(meta.NumDelivered)
+
+		var delay time.Duration
+		if v := natsMsg.Header.Get(delayHeader); v != "" {
+			dur, err := time.ParseDuration(v)
+			if err != nil {
+				q.terminate(natsMsg, err)
+				continue
+			}
+			if reservedCount == 1 {
+				delay = dur
+			} else {
+				reservedCount--
+			}
+		}
+
+		priority, _ := strconv.Atoi(natsMsg.Header.Get(priorityHeader))
+		retryLimit, _ := strconv.Atoi(natsMsg.Header.Get(retryLimitHeader))
+
+		id := strconv.FormatUint(meta.Sequence.Stream, 10)
+		q.reservedMu.Lock()
+		q.reserved[id] = natsMsg
+		q.reservedMu.Unlock()
+
+		msgs = append(msgs, msgqueue.Message{
+			Id:            id,
+			Body:          string(natsMsg.Data),
+			Header:        messageHeader(natsMsg.Header),
+			Priority:      priority,
+			RetryLimit:    retryLimit,
+			GroupKey:      natsMsg.Header.Get(groupKeyHeader),
+			Barrier:       natsMsg.Header.Get(barrierHeader) != "",
+			Delay:         delay,
+			CreatedAt:     meta.Timestamp,
+			ReservationId: id,
+			ReservedCount: reservedCount,
+		})
+	}
+	return msgs, nil
+}
+
+// terminate stops redelivery of the message that can't be reserved,
+// so other fetched messages are processed as usual.
+func (q *Queue) terminate(natsMsg *nats.Msg, reason error) {
+	q.opt.Logf(msgqueue.LogWarn, "%s can't reserve message: %s", q, reason)
+	if err := natsMsg.Term(); err != nil {
+		q.opt.Logf(msgqueue.LogWarn, "%s Term failed: %s", q, err)
+	}
+}
+
+func messageHeader(h nats.Header) map[string]string {
+	var header map[string]string
+	for k, v := range h {
+		if k == delayHeader || k == priorityHeader || k == retryLimitHeader ||
+			k == groupKeyHeader || k == barrierHeader || len(v) == 0 {
+			continue
+		}
+		if header == nil {
+			header = make(map[string]string, len(h))
+		}
+		header[k] = v[0]
+	}
+	return header
+}
+
+func (q *Queue) reservedMessage(msg *msgqueue.Message, remove bool) (*nats.Msg, error) {
+	q.reservedMu.Lock()
+	natsMsg, ok := q.reserved[msg.ReservationId]
+	if ok && remove {
+		delete(q.reserved, msg.ReservationId)
+	}
+	q.reservedMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("queue: %s is not reserved", msg)
+	}
+	return natsMsg, nil
+}
+
+// Release negatively acknowledges the message, so it is
+// redelivered after the delay.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	natsMsg, err := q.reservedMessage(msg, true)
+	if err != nil {
+		return err
+	}
+	return natsMsg.NakWithDelay(delay)
+}
+
+// Touch resets the message ack wait. JetStream always extends
+// the reservation by ReservationTimeout regardless of the duration.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	natsMsg, err := q.reservedMessage(msg, false)
+	if err != nil {
+		return err
+	}
+	return natsMsg.InProgress()
+}
+
+// Delete acknowledges the message.
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	natsMsg, err := q.reservedMessage(msg, true)
+	if err != nil {
+		return err
+	}
+	return natsMsg.Ack()
+}
+
+// DeleteBatch acknowledges the messages one by one,
+// because JetStream does not support batched acks.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	var firstErr error
+	for _, msg := range msgs {
+		if err := q.Delete(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Purge deletes messages of the queue subject from the stream.
+func (q *Queue) Purge() error {
+	return q.js.PurgeStream(q.stream, &nats.StreamPurgeRequest{
+		Subject: q.Name(),
+	})
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,424 @@
+package msgqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	timerate "golang.org/x/time/rate"
+)
+
+// Option configures queue Options.
+type Option func(opt *Options) error
+
+// NewOptions creates Options using functional options and validates them.
+func NewOptions(opts ...Option) (*Options, error) {
+	opt := new(Options)
+	for _, fn := range opts {
+		if err := fn(opt); err != nil {
+			return nil, err
+		}
+	}
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+func WithName(name string) Option {
+	return func(opt *Options) error {
+		opt.Name = name
+		return nil
+	}
+}
+
+func WithHandler(handler interface{}) Option {
+	return func(opt *Options) error {
+		if handler == nil {
+			return fmt.Errorf("queue: Handler is nil")
+		}
+		opt.Handler = handler
+		return nil
+	}
+}
+
+func WithFallbackHandler(handler interface{}) Option {
+	return func(opt *Options) error {
+		if handler == nil {
+			return fmt.Errorf("queue: FallbackHandler is nil")
+		}
+		opt.FallbackHandler = handler
+		return nil
+	}
+}
+
+func WithPanicHandler(fn func(msg *Message, recovered interface{}, stack []byte)) Option {
+	return func(opt *Options) error {
+		opt.PanicHandler = fn
+		return nil
+	}
+}
+
+func WithHandlerTimeout(timeout time.Duration) Option {
+	return func(opt *Options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("queue: got handler timeout %s, wanted positive duration", timeout)
+		}
+		opt.HandlerTimeout = timeout
+		return nil
+	}
+}
+
+func WithCaptureOutput() Option {
+	return func(opt *Options) error {
+		opt.CaptureOutput = true
+		return nil
+	}
+}
+
+func WithMiddleware(middleware ...func(Handler) Handler) Option {
+	return func(opt *Options) error {
+		opt.Middleware = append(opt.Middleware, middleware...)
+		return nil
+	}
+}
+
+func WithDeadLetterQueue(q Queue) Option {
+	return func(opt *Options) error {
+		opt.DeadLetterQueue = q
+		return nil
+	}
+}
+
+func WithSync() Option {
+	return func(opt *Options) error {
+		opt.Sync = true
+		return nil
+	}
+}
+
+func WithWorkers(n int) Option {
+	return func(opt *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("queue: got %d workers, wanted at least 1", n)
+		}
+		opt.WorkerNumber = n
+		return nil
+	}
+}
+
+// WithAutoscale enables the autoscaler that adjusts the number
+// of workers between min and max.
+func WithAutoscale(min, max int) Option {
+	return func(opt *Options) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("queue: got autoscale bounds %d..%d, wanted 1 <= min <= max", min, max)
+		}
+		opt.MinWorkers = min
+		opt.MaxWorkers = max
+		return nil
+	}
+}
+
+func WithWorkerIdleTimeout(timeout time.Duration) Option {
+	return func(opt *Options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("queue: got worker idle timeout %s, wanted positive duration", timeout)
+		}
+		opt.WorkerIdleTimeout = timeout
+		return nil
+	}
+}
+
+func WithWorkerHooks(
+	init func(ctx context.Context) (context.Context, error),
+	shutdown func(ctx context.Context),
+) Option {
+	return func(opt *Options) error {
+		opt.WorkerInit = init
+		opt.WorkerShutdown = shutdown
+		return nil
+	}
+}
+
+func WithScavengers(n int) Option {
+	return func(opt *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("queue: got %d scavengers, wanted at least 1", n)
+		}
+		opt.ScavengerNumber = n
+		return nil
+	}
+}
+
+func WithBufferSize(n int) Option {
+	return func(opt *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("queue: got buffer size %d, wanted at least 1", n)
+		}
+		opt.BufferSize = n
+		return nil
+	}
+}
+
+func WithDeleteLinger(linger time.Duration) Option {
+	return func(opt *Options) error {
+		if linger <= 0 {
+			return fmt.Errorf("queue: got delete linger %s, wanted positive", linger)
+		}
+		opt.DeleteLinger = linger
+		return nil
+	}
+}
+
+func WithPriorityLanes(n int) Option {
+	return func(opt *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("queue: got %d priority lanes, wanted at least 1", n)
+		}
+		opt.PriorityLanes = n
+		return nil
+	}
+}
+
+func WithReservationTimeout(timeout time.Duration) Option {
+	return func(opt *Options) error {
+		if timeout < time.Second {
+			return fmt.Errorf("queue: got reservation timeout %s, wanted at least 1s", timeout)
+		}
+		opt.ReservationTimeout = timeout
+		return nil
+	}
+}
+
+func WithRetryLimit(n int) Option {
+	return func(opt *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("queue: got retry limit %d, wanted at least 1", n)
+		}
+		opt.RetryLimit = n
+		return nil
+	}
+}
+
+func WithMinBackoff(backoff time.Duration) Option {
+	return func(opt *Options) error {
+		if backoff <= 0 {
+			return fmt.Errorf("queue: got min backoff %s, wanted positive duration", backoff)
+		}
+		opt.MinBackoff = backoff
+		return nil
+	}
+}
+
+// WithMaxAge expires messages older than maxAge dropping them at most
+// at the limit rate. Use timerate.Inf to drop all expired messages.
+func WithMaxAge(maxAge time.Duration, limit timerate.Limit) Option {
+	return func(opt *Options) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("queue: got max age %s, wanted positive duration", maxAge)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("queue: got expire rate limit %v, wanted positive limit", limit)
+		}
+		opt.MaxAge = maxAge
+		opt.ExpireRateLimit = limit
+		return nil
+	}
+}
+
+func WithRateLimit(limit timerate.Limit) Option {
+	return func(opt *Options) error {
+		if limit <= 0 {
+			return fmt.Errorf("queue: got rate limit %v, wanted positive limit", limit)
+		}
+		opt.RateLimit = limit
+		return nil
+	}
+}
+
+func WithRateLimitKey(fn func(msg *Message) string) Option {
+	return func(opt *Options) error {
+		opt.RateLimitKey = fn
+		return nil
+	}
+}
+
+func WithConcurrencyLimits(fn func(msg *Message) string, limits map[string]int) Option {
+	return func(opt *Options) error {
+		opt.ConcurrencyKey = fn
+		opt.ConcurrencyLimits = limits
+		return nil
+	}
+}
+
+func WithCoalesceKey(fn func(msg *Message) string) Option {
+	return func(opt *Options) error {
+		opt.CoalesceKey = fn
+		return nil
+	}
+}
+
+func WithPauseKey(fn func(msg *Message) string) Option {
+	return func(opt *Options) error {
+		opt.PauseKey = fn
+		return nil
+	}
+}
+
+func WithFilter(fn func(msg *Message) bool) Option {
+	return func(opt *Options) error {
+		opt.Filter = fn
+		return nil
+	}
+}
+
+func WithPriorityInversion(inversion PriorityInversion) Option {
+	return func(opt *Options) error {
+		if inversion < InversionIgnore || inversion > InversionReorder {
+			return fmt.Errorf("queue: got priority inversion %d, wanted InversionIgnore..InversionReorder", inversion)
+		}
+		opt.PriorityInversion = inversion
+		return nil
+	}
+}
+
+func WithRateLimitSchedule(windows ...RateLimitWindow) Option {
+	return func(opt *Options) error {
+		for i := range windows {
+			if err := windows[i].validate(); err != nil {
+				return err
+			}
+		}
+		opt.RateLimitSchedule = windows
+		return nil
+	}
+}
+
+func WithUpsert() Option {
+	return func(opt *Options) error {
+		opt.Upsert = true
+		return nil
+	}
+}
+
+func WithRedis(redis Redis) Option {
+	return func(opt *Options) error {
+		opt.Redis = redis
+		return nil
+	}
+}
+
+func WithStorage(storage Storage) Option {
+	return func(opt *Options) error {
+		opt.Storage = storage
+		return nil
+	}
+}
+
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(opt *Options) error {
+		opt.RateLimiter = limiter
+		return nil
+	}
+}
+
+func WithLedger(ledger Ledger) Option {
+	return func(opt *Options) error {
+		opt.Ledger = ledger
+		return nil
+	}
+}
+
+func WithFeatureFlags(flags FeatureFlags) Option {
+	return func(opt *Options) error {
+		opt.FeatureFlags = flags
+		return nil
+	}
+}
+
+func WithTracerProvider(provider TracerProvider) Option {
+	return func(opt *Options) error {
+		opt.TracerProvider = provider
+		return nil
+	}
+}
+
+func WithMetrics(metrics Metrics) Option {
+	return func(opt *Options) error {
+		opt.Metrics = metrics
+		return nil
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(opt *Options) error {
+		opt.Logger = logger
+		return nil
+	}
+}
+
+func WithLogLevel(level LogLevel) Option {
+	return func(opt *Options) error {
+		if level < LogDebug || level > LogError {
+			return fmt.Errorf("queue: got log level %d, wanted LogDebug..LogError", level)
+		}
+		opt.LogLevel = level
+		return nil
+	}
+}
+
+func WithQuietRetries() Option {
+	return func(opt *Options) error {
+		opt.QuietRetries = true
+		return nil
+	}
+}
+
+func WithTrackInFlight() Option {
+	return func(opt *Options) error {
+		opt.TrackInFlight = true
+		return nil
+	}
+}
+
+func WithAllocSampleRate(rate int) Option {
+	return func(opt *Options) error {
+		if rate <= 0 {
+			return fmt.Errorf("queue: got alloc sample rate %d, wanted positive", rate)
+		}
+		opt.AllocSampleRate = rate
+		return nil
+	}
+}
+
+func WithChaos(chaos *ChaosOptions) Option {
+	return func(opt *Options) error {
+		if err := chaos.validate(); err != nil {
+			return err
+		}
+		opt.Chaos = chaos
+		return nil
+	}
+}
+
+func WithStatsReportInterval(interval time.Duration) Option {
+	return func(opt *Options) error {
+		opt.StatsReportInterval = interval
+		return nil
+	}
+}
+
+func WithExpvar() Option {
+	return func(opt *Options) error {
+		opt.Expvar = true
+		return nil
+	}
+}
+
+func WithCodec(codec Codec) Option {
+	return func(opt *Options) error {
+		opt.Codec = codec
+		return nil
+	}
+}
@@ -1,6 +1,9 @@
 package msgqueue
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"runtime"
 	"time"
 
@@ -9,6 +12,8 @@ import (
 	timerate "golang.org/x/time/rate"
 )
 
+// Redis is the part of the Redis client API that is required to
+// deduplicate named messages and to limit rate across processes.
 type Redis interface {
 	Del(...string) *redis.IntCmd
 	SetNX(string, interface{}, time.Duration) *redis.BoolCmd
@@ -18,20 +23,56 @@ type Redis interface {
 	Publish(channel, message string) *redis.IntCmd
 }
 
+// RedisCmdable is an optional interface implemented by Redis clients,
+// e.g. *redis.Client and *redis.Ring, that is checked at runtime by
+// features that keep state in Redis: Upsert, WithLock, checkpoints,
+// debouncing, ledger, in-flight tracking, fleet stats, Kinesis leases,
+// and memqueue lock reconciliation. Custom Redis implementations that
+// only implement Redis keep working without these features.
+type RedisCmdable interface {
+	Redis
+	Exists(...string) *redis.IntCmd
+	Get(string) *redis.StringCmd
+	Set(string, interface{}, time.Duration) *redis.StatusCmd
+	HSet(key, field string, value interface{}) *redis.BoolCmd
+	HDel(key string, fields ...string) *redis.IntCmd
+	HGetAll(key string) *redis.StringStringMapCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+}
+
 type Storage interface {
 	Exists(key string) bool
 }
 
+// Deleter is an optional interface implemented by Storage
+// that can delete keys.
+type Deleter interface {
+	Delete(key string) error
+}
+
 type storage struct {
 	Redis
 }
 
 var _ Storage = (*storage)(nil)
+var _ Deleter = (*storage)(nil)
 
 func (s storage) Exists(key string) bool {
 	return !s.SetNX(key, "", 24*time.Hour).Val()
 }
 
+func (s storage) Delete(key string) error {
+	return s.Del(key).Err()
+}
+
+// Queue is the part of the queue API that is needed
+// to move messages between queues.
+type Queue interface {
+	Name() string
+	Options() *Options
+	Add(msg *Message) error
+}
+
 type RateLimiter interface {
 	AllowRate(name string, limit timerate.Limit) (delay time.Duration, allow bool)
 }
@@ -45,14 +86,90 @@ type Options struct {
 	// Function called to process failed message.
 	FallbackHandler interface{}
 
+	// Optional time after which Handler call is abandoned and message
+	// is retried. Context passed to the handler is cancelled at the
+	// deadline. Handler that ignores the context may still run when
+	// the message is retried, so the message can be processed twice
+	// at the same time. At most WorkerNumber handlers are abandoned.
+	// The default is no limit.
+	HandlerTimeout time.Duration
+
+	// Capture output that handler writes to msgqueue.Output(ctx).
+	// Output of failed messages is logged and attached to dead-lettered
+	// messages as "output" header.
+	CaptureOutput bool
+
+	// Optional function called when Handler or FallbackHandler panics.
+	// Panicking message is retried like a message that returned an error.
+	// The default is to log the panic with the stack trace.
+	PanicHandler func(msg *Message, recovered interface{}, stack []byte)
+
+	// Optional middleware applied around Handler, e.g. for logging,
+	// metrics, or tracing. The first middleware is the outermost one.
+	Middleware []func(Handler) Handler
+
+	// Optional queue where messages are moved when RetryLimit is exceeded.
+	// Dead-lettered message is created with following args: original
+	// queue name, error string, number of attempts, and original message body.
+	DeadLetterQueue Queue
+
+	// Process messages synchronously in the goroutine that adds them,
+	// without workers and buffering. Failed messages are retried inline
+	// after the backoff and Add returns the error of the last attempt,
+	// i.e. nil when a retry succeeds.
+	// Remote queues in Sync mode don't send messages to the backend.
+	// It is useful for local development and tests.
+	Sync bool
+
 	// Number of goroutines processing messages.
 	WorkerNumber int
 
+	// Optional bounds of the worker pool. When MaxWorkers is set,
+	// the autoscaler periodically samples queue length and processing
+	// latency and adjusts the number of workers within the bounds.
+	// WorkerNumber is used as the initial number of workers and
+	// defaults to MinWorkers. MinWorkers defaults to 1.
+	MinWorkers int
+	MaxWorkers int
+	// Interval between autoscaler samples. The default is 10 seconds.
+	AutoscaleInterval time.Duration
+	// Optional time after which idle workers above MinWorkers exit
+	// without waiting for the autoscaler. Requires MaxWorkers.
+	WorkerIdleTimeout time.Duration
+
+	// Optional function called when worker starts. Worker does not
+	// process messages until WorkerInit succeeds. Returned context is
+	// passed to handlers run by the worker, so it can carry per-worker
+	// resources such as database connections.
+	WorkerInit func(ctx context.Context) (context.Context, error)
+	// Optional function called with worker context when worker stops.
+	WorkerShutdown func(ctx context.Context)
+
+	// Optional functions called when processor is started and after
+	// it is stopped, e.g. to warm connections or flush caches.
+	OnStart func()
+	OnStop  func()
+	// Optional function called after message is processed successfully.
+	OnMessageProcessed func(msg *Message, dur time.Duration)
+	// Optional function called after every failed attempt to process
+	// the message, including attempts that are retried.
+	OnMessageFailed func(msg *Message, err error)
+
 	// Number of scavengers deleting messages.
 	ScavengerNumber int
+	// Maximum time processed messages are held to be deleted in batch.
+	// Lower values shorten the window in which processed messages can be
+	// redelivered on low traffic queues. The default is 1 second.
+	DeleteLinger time.Duration
 
 	// Size of the buffer where reserved messages are stored.
 	BufferSize int
+	// Number of buffer lanes. Each lane buffers up to BufferSize messages
+	// with Priority equal to the lane index, and messages from the higher
+	// lanes are processed first. Messages with higher priorities share
+	// the top lane. The default is 2, i.e. messages with Priority > 0
+	// are processed before other messages.
+	PriorityLanes int
 
 	// Time after which the reserved message is returned to the queue.
 	ReservationTimeout time.Duration
@@ -64,8 +181,64 @@ type Options struct {
 	// Minimum time between retries.
 	MinBackoff time.Duration
 
+	// Optional age after which messages are expired, i.e. moved to
+	// DeadLetterQueue or deleted without processing. It allows recovering
+	// from long outages by processing fresh messages instead of draining
+	// stale backlog. The default is no limit.
+	MaxAge time.Duration
+	// Rate at which expired messages are dropped. Expired messages
+	// exceeding the rate are processed as usual. The default is no limit.
+	ExpireRateLimit timerate.Limit
+	// Optional function called when message is expired, e.g. to alert.
+	// The default is to log the expired message.
+	ExpiredHandler func(msg *Message, age time.Duration)
+
 	// Processing rate limit.
 	RateLimit timerate.Limit
+	// Optional function that returns rate limit key for the message,
+	// e.g. message name or tenant id. Messages with different keys are
+	// rate limited separately. The default is to limit the whole queue.
+	RateLimitKey func(msg *Message) string
+	// Optional time of day windows that override RateLimit.
+	RateLimitSchedule []RateLimitWindow
+	// How priority inversion caused by rate limits is handled.
+	// The default is InversionIgnore.
+	PriorityInversion PriorityInversion
+
+	// Optional function that returns concurrency key for the message,
+	// e.g. job type. Workers process at most ConcurrencyLimits[key]
+	// messages with the same key at the same time. Keys without
+	// a limit are not limited.
+	ConcurrencyKey    func(msg *Message) string
+	ConcurrencyLimits map[string]int
+
+	// Optional function that returns idempotency key for the message,
+	// e.g. message name. When messages with the same key are processed
+	// at the same time, only the first one is passed to the handler.
+	// Others are deleted when it succeeds or released when it fails.
+	CoalesceKey func(msg *Message) string
+
+	// Optional function that returns the task of the message, which is
+	// matched against tasks paused by Processor.PauseName. The default
+	// is the value of TaskHeader.
+	PauseKey func(msg *Message) string
+
+	// Optional function called before message body is decoded, e.g. to
+	// skip irrelevant messages of a shared queue using message Header.
+	// Messages for which it returns false are deleted without calling
+	// Handler. See HeaderFilter.
+	Filter func(msg *Message) bool
+
+	// Optional feature flags that decide whether the message is
+	// processed, delayed, or dropped before it is passed to the handler.
+	FeatureFlags FeatureFlags
+
+	// Upsert named messages: adding message with the name of pending
+	// message replaces args of the pending message instead of returning
+	// ErrDuplicate. Latest args are stored in Redis and are used when
+	// the pending message is processed. The name is unlocked when the
+	// message is deleted. Requires Redis.
+	Upsert bool
 
 	// Redis client that is used for storing metadata.
 	Redis Redis
@@ -73,10 +246,67 @@ type Options struct {
 	// Optional storage interface. The default is to use Redis.
 	Storage Storage
 
-	// Optional rate limiter interface. The default is to use Redis.
+	// Optional rate limiter interface. The default is to use Redis
+	// or LocalRateLimiter when Redis is not set.
 	RateLimiter RateLimiter
 
-	inited bool
+	// Codec used to encode message args. The default is MsgpackCodec.
+	Codec Codec
+
+	// Optional ledger where the outcome of every processing attempt
+	// is recorded, e.g. for audit. See RedisLedger.
+	Ledger Ledger
+
+	// Optional provider of the tracer that creates spans of Reserve,
+	// Process, Release, and DeleteBatch operations. Trace context is
+	// propagated from producers to consumers using message headers.
+	TracerProvider TracerProvider
+
+	// Optional sink of processor metrics, e.g. statsd. Counters and
+	// timings are sent as messages are processed and gauges are sent
+	// every 10 seconds while the processor is running.
+	Metrics Metrics
+
+	// Publish processor Stats under expvar map "msgqueue"
+	// using the queue name as a key.
+	Expvar bool
+
+	// Optional interval at which processor Stats are reported to Redis,
+	// so they can be aggregated across processes using
+	// processor.GetFleetStats. Requires Redis.
+	StatsReportInterval time.Duration
+
+	// Register messages that are being processed in Redis, so they can
+	// be inspected across processes using processor.GetInFlightMessages.
+	// Requires Redis.
+	TrackInFlight bool
+
+	// Optional rate at which allocations of handler calls are sampled:
+	// 1 in AllocSampleRate calls is measured and reported by
+	// Processor.AllocStats per message name. Sampling briefly stops
+	// the world, so the rate should be at least 100 in production.
+	AllocSampleRate int
+
+	// Optional game day drills that inject failures into processing.
+	// Must not be used in production.
+	Chaos *ChaosOptions
+
+	// Optional function called when processor loses or restores
+	// connection to the queue backend.
+	ConnStateHandler func(queue string, connected bool)
+
+	// Logger used by the processor and the queue. The default is
+	// the standard logger of log package.
+	Logger Logger
+	// Minimum level of logged messages. The default is LogInfo.
+	LogLevel LogLevel
+	// Log failures of messages that will be retried at LogDebug
+	// level instead of LogWarn, so expected retries don't flood logs.
+	QuietRetries bool
+
+	inited   bool
+	prefixed bool // Name includes FactoryOptions.Prefix
+	tracer   Tracer
 }
 
 func (opt *Options) Init() {
@@ -85,21 +315,46 @@ func (opt *Options) Init() {
 	}
 	opt.inited = true
 
+	if opt.MaxWorkers > 0 {
+		if opt.MinWorkers == 0 {
+			opt.MinWorkers = 1
+		}
+		if opt.WorkerNumber == 0 {
+			opt.WorkerNumber = opt.MinWorkers
+		}
+		if opt.AutoscaleInterval == 0 {
+			opt.AutoscaleInterval = 10 * time.Second
+		}
+	}
 	if opt.WorkerNumber == 0 {
 		opt.WorkerNumber = 10 * runtime.NumCPU()
 	}
 	if opt.ScavengerNumber == 0 {
 		opt.ScavengerNumber = runtime.NumCPU() + 1
 	}
+	if opt.DeleteLinger == 0 {
+		opt.DeleteLinger = time.Second
+	}
 	if opt.BufferSize == 0 {
 		opt.BufferSize = opt.WorkerNumber
 		if opt.BufferSize > 10 {
 			opt.BufferSize = 10
 		}
 	}
+	if opt.PriorityLanes == 0 {
+		opt.PriorityLanes = 2
+	}
 	if opt.RateLimit == 0 {
 		opt.RateLimit = timerate.Inf
 	}
+	if opt.ExpireRateLimit == 0 {
+		opt.ExpireRateLimit = timerate.Inf
+	}
+	for i := range opt.RateLimitSchedule {
+		if opt.RateLimitSchedule[i].Limit == 0 {
+			opt.RateLimitSchedule[i].Limit = timerate.Inf
+		}
+	}
 	if opt.ReservationTimeout == 0 {
 		opt.ReservationTimeout = 300 * time.Second
 	}
@@ -110,12 +365,156 @@ func (opt *Options) Init() {
 		opt.MinBackoff = 3 * time.Second
 	}
 
+	if opt.Codec == nil {
+		opt.Codec = MsgpackCodec
+	}
+
+	if opt.Logger == nil {
+		opt.Logger = stdLogger{}
+	}
+
 	if opt.Storage == nil {
 		opt.Storage = storage{opt.Redis}
 	}
 
-	if opt.RateLimit != timerate.Inf && opt.RateLimiter == nil && opt.Redis != nil {
-		fallbackLimiter := timerate.NewLimiter(opt.RateLimit, 1)
-		opt.RateLimiter = rate.NewLimiter(opt.Redis, fallbackLimiter)
+	if opt.TracerProvider != nil {
+		opt.tracer = opt.TracerProvider.Tracer(opt.Name)
+	}
+
+	if opt.hasRateLimit() && opt.RateLimiter == nil {
+		if opt.Redis != nil {
+			fallbackLimiter := timerate.NewLimiter(opt.minRateLimit(), 1)
+			opt.RateLimiter = rate.NewLimiter(opt.Redis, fallbackLimiter)
+		} else {
+			opt.RateLimiter = NewLocalRateLimiter()
+		}
+	}
+}
+
+// Validate returns an error describing the first invalid option.
+func (opt *Options) Validate() error {
+	if err := validateHandler("Handler", opt.Handler); err != nil {
+		return err
+	}
+	if err := validateHandler("FallbackHandler", opt.FallbackHandler); err != nil {
+		return err
+	}
+
+	if opt.WorkerNumber < 0 {
+		return fmt.Errorf("queue: WorkerNumber=%d is negative", opt.WorkerNumber)
+	}
+	if opt.MinWorkers < 0 {
+		return fmt.Errorf("queue: MinWorkers=%d is negative", opt.MinWorkers)
+	}
+	if opt.MaxWorkers < 0 {
+		return fmt.Errorf("queue: MaxWorkers=%d is negative", opt.MaxWorkers)
+	}
+	for key, limit := range opt.ConcurrencyLimits {
+		if limit <= 0 {
+			return fmt.Errorf("queue: ConcurrencyLimits[%q]=%d is not positive", key, limit)
+		}
+	}
+	if opt.WorkerIdleTimeout < 0 {
+		return fmt.Errorf("queue: WorkerIdleTimeout=%s is negative", opt.WorkerIdleTimeout)
+	}
+	if opt.MaxWorkers > 0 && opt.MinWorkers > opt.MaxWorkers {
+		return fmt.Errorf(
+			"queue: MinWorkers=%d is greater than MaxWorkers=%d",
+			opt.MinWorkers, opt.MaxWorkers,
+		)
+	}
+	if opt.ScavengerNumber < 0 {
+		return fmt.Errorf("queue: ScavengerNumber=%d is negative", opt.ScavengerNumber)
+	}
+	if opt.BufferSize < 0 {
+		return fmt.Errorf("queue: BufferSize=%d is negative", opt.BufferSize)
+	}
+	if opt.DeleteLinger < 0 {
+		return fmt.Errorf("queue: DeleteLinger=%s is negative", opt.DeleteLinger)
+	}
+	if opt.PriorityLanes < 0 {
+		return fmt.Errorf("queue: PriorityLanes=%d is negative", opt.PriorityLanes)
+	}
+	if opt.ReservationTimeout < 0 {
+		return fmt.Errorf("queue: ReservationTimeout=%s is negative", opt.ReservationTimeout)
+	}
+	if opt.RetryLimit < 0 {
+		return fmt.Errorf("queue: RetryLimit=%d is negative", opt.RetryLimit)
+	}
+	if opt.MinBackoff < 0 {
+		return fmt.Errorf("queue: MinBackoff=%s is negative", opt.MinBackoff)
+	}
+	if opt.RateLimit < 0 {
+		return fmt.Errorf("queue: RateLimit=%v is negative", opt.RateLimit)
+	}
+	if opt.HandlerTimeout < 0 {
+		return fmt.Errorf("queue: HandlerTimeout=%s is negative", opt.HandlerTimeout)
+	}
+	if opt.MaxAge < 0 {
+		return fmt.Errorf("queue: MaxAge=%s is negative", opt.MaxAge)
+	}
+	if opt.StatsReportInterval < 0 {
+		return fmt.Errorf("queue: StatsReportInterval=%s is negative", opt.StatsReportInterval)
+	}
+	if opt.Upsert {
+		if err := opt.requireRedisCmdable("Upsert"); err != nil {
+			return err
+		}
+	}
+	if opt.StatsReportInterval > 0 {
+		if err := opt.requireRedisCmdable("StatsReportInterval"); err != nil {
+			return err
+		}
+	}
+	if opt.TrackInFlight {
+		if err := opt.requireRedisCmdable("TrackInFlight"); err != nil {
+			return err
+		}
+	}
+	if opt.AllocSampleRate < 0 {
+		return fmt.Errorf("queue: AllocSampleRate=%d is negative", opt.AllocSampleRate)
+	}
+	if opt.PriorityInversion < InversionIgnore || opt.PriorityInversion > InversionReorder {
+		return fmt.Errorf("queue: PriorityInversion=%d is unknown", opt.PriorityInversion)
+	}
+	if opt.ExpireRateLimit < 0 {
+		return fmt.Errorf("queue: ExpireRateLimit=%v is negative", opt.ExpireRateLimit)
+	}
+
+	for i := range opt.RateLimitSchedule {
+		if err := opt.RateLimitSchedule[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	if opt.Chaos != nil {
+		if err := opt.Chaos.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (opt *Options) requireRedisCmdable(name string) error {
+	if opt.Redis == nil {
+		return fmt.Errorf("queue: %s requires Redis", name)
+	}
+	if _, ok := opt.Redis.(RedisCmdable); !ok {
+		return fmt.Errorf("queue: %s requires Redis that implements RedisCmdable", name)
+	}
+	return nil
+}
+
+func validateHandler(name string, fn interface{}) error {
+	if fn == nil {
+		return nil
+	}
+	if _, ok := fn.(Handler); ok {
+		return nil
+	}
+	if kind := reflect.TypeOf(fn).Kind(); kind != reflect.Func {
+		return fmt.Errorf("queue: %s is %s, wanted %s", name, kind, reflect.Func)
 	}
+	return nil
 }
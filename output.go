@@ -0,0 +1,70 @@
+package msgqueue
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// Maximum size of the captured handler output. Output
+// exceeding the limit is truncated.
+const maxOutputSize = 16 * 1024
+
+type outputKey struct{}
+
+// Output returns the writer for handler output, e.g. to create a logger
+// with log.New(msgqueue.Output(ctx), "", log.LstdFlags). When
+// Options.CaptureOutput is set, the output is captured per message and
+// attached to failure records. Otherwise it is written to os.Stderr.
+func Output(ctx context.Context) io.Writer {
+	if buf, ok := ctx.Value(outputKey{}).(*outputBuffer); ok {
+		return buf
+	}
+	return os.Stderr
+}
+
+// CapturedOutput returns output written by the handler so far
+// or empty string if output is not captured.
+func CapturedOutput(ctx context.Context) string {
+	if buf, ok := ctx.Value(outputKey{}).(*outputBuffer); ok {
+		return buf.String()
+	}
+	return ""
+}
+
+// WithOutputCapture returns a copy of ctx where Output captures
+// handler output. It is used by the processor.
+func WithOutputCapture(ctx context.Context) context.Context {
+	return context.WithValue(ctx, outputKey{}, new(outputBuffer))
+}
+
+type outputBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(p)
+	if room := maxOutputSize - b.buf.Len(); len(p) > room {
+		p = p[:room]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *outputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.truncated {
+		return b.buf.String() + "... (truncated)"
+	}
+	return b.buf.String()
+}
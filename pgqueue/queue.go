@@ -0,0 +1,419 @@
+package pgqueue
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// Table that stores messages of all queues.
+const tableName = "msgqueue_messages"
+
+const createTableQuery = `
+CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+	id bigserial PRIMARY KEY,
+	queue text NOT NULL,
+	body bytea NOT NULL,
+	header text,
+	priority integer NOT NULL DEFAULT 0,
+	retry_limit integer NOT NULL DEFAULT 0,
+	group_key text NOT NULL DEFAULT '',
+	barrier boolean NOT NULL DEFAULT false,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	locked_until timestamptz NOT NULL DEFAULT now(),
+	reserved_count integer NOT NULL DEFAULT 0,
+	reservation_id text
+);
+CREATE INDEX IF NOT EXISTS ` + tableName + `_queue_locked_until_idx
+	ON ` + tableName + ` (queue, locked_until);
+`
+
+// reserveQuery locks ready messages skipping messages locked by other
+// consumers and makes them invisible until locked_until.
+const reserveQuery = `
+WITH next AS (
+	SELECT id FROM ` + tableName + `
+	WHERE queue = $1 AND locked_until <= now()
+	ORDER BY priority DESC, id
+	LIMIT $2
+	FOR UPDATE SKIP LOCKED
+)
+UPDATE ` + tableName + ` AS m
+SET locked_until = now() + $3 * interval '1 millisecond',
+	reserved_count = m.reserved_count + 1,
+	reservation_id = $4
+FROM next
+WHERE m.id = next.id
+RETURNING m.id, m.body, m.header, m.priority, m.retry_limit,
+	m.group_key, m.barrier, m.created_at, m.reserved_count
+`
+
+// Number of columns of inserted message.
+const insertColumns = 8
+
+// Postgres does not notify consumers about new messages,
+// so ReserveN waits before returning no messages.
+const pollInterval = time.Second
+
+type Queue struct {
+	db  *sql.DB
+	opt *msgqueue.Options
+
+	producer *producer.Producer
+
+	createMu sync.Mutex
+	created  bool
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that stores messages in the
+// msgqueue_messages table of the PostgreSQL database. The table is
+// created on first use. Postgres driver, e.g. github.com/lib/pq or
+// github.com/jackc/pgx/v5/stdlib, must be registered by the app.
+func NewQueue(db *sql.DB, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		db:  db,
+		opt: opt,
+	}
+
+	q.producer = producer.New(opt, q.add, nil)
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(db *sql.DB, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(db, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:    q.Name(),
+		Backend: "postgres",
+		Options: q.opt,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// createTable creates the messages table once. Failed attempts
+// are retried on next call.
+func (q *Queue) createTable() error {
+	q.createMu.Lock()
+	defer q.createMu.Unlock()
+
+	if q.created {
+		return nil
+	}
+	if _, err := q.db.Exec(createTableQuery); err != nil {
+		return err
+	}
+	q.created = true
+	return nil
+}
+
+// Len returns the number of messages that are ready to be reserved.
+func (q *Queue) Len() (int, error) {
+	if err := q.createTable(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := q.db.QueryRow(
+		`SELECT count(*) FROM `+tableName+` WHERE queue = $1 AND locked_until <= now()`,
+		q.Name(),
+	).Scan(&n)
+	return n, err
+}
+
+// Ping checks that the database is reachable.
+func (q *Queue) Ping() error {
+	return q.db.Ping()
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.addBatch([]*msgqueue.Message{msg})
+}
+
+// addBatch inserts messages using single multi-row insert.
+// Postgres returns ids of inserted rows in the insert order.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	if err := q.createTable(); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString(`INSERT INTO ` + tableName + ` (queue, body, header, priority, ` +
+		`retry_limit, group_key, barrier, locked_until) VALUES `)
+
+	args := make([]interface{}, 0, len(msgs)*insertColumns)
+	for i, msg := range msgs {
+		var header interface{}
+		if len(msg.Header) > 0 {
+			h, err := json.Marshal(msg.Header)
+			if err != nil {
+				return err
+			}
+			header = string(h)
+		}
+
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		n := len(args)
+		fmt.Fprintf(&b, "($%d, $%d, $%d, $%d, $%d, $%d, $%d, now() + $%d * interval '1 millisecond')",
+			n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8)
+		args = append(args,
+			q.Name(), []byte(msg.Body), header, msg.Priority,
+			msg.RetryLimit, msg.GroupKey, msg.Barrier,
+			int64(msg.ScheduledDelay()/time.Millisecond),
+		)
+	}
+	b.WriteString(" RETURNING id")
+
+	rows, err := q.db.Query(b.String(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if i < len(msgs) {
+			msgs[i].Id = strconv.FormatInt(id, 10)
+		}
+	}
+	return rows.Err()
+}
+
+// Add adds message to the queue.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue using multi-row inserts.
+// Named messages are added using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN locks up to n ready messages with highest priority for
+// ReservationTimeout using SELECT ... FOR UPDATE SKIP LOCKED, so
+// concurrent consumers don't wait for each other.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	if err := q.createTable(); err != nil {
+		return nil, err
+	}
+
+	reservationId := newReservationId()
+	rows, err := q.db.Query(
+		reserveQuery, q.Name(), n,
+		int64(q.opt.ReservationTimeout/time.Millisecond), reservationId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []msgqueue.Message
+	for rows.Next() {
+		var (
+			id     int64
+			body   []byte
+			header sql.NullString
+		)
+		msg := msgqueue.Message{
+			ReservationId: reservationId,
+		}
+		err := rows.Scan(
+			&id, &body, &header, &msg.Priority, &msg.RetryLimit,
+			&msg.GroupKey, &msg.Barrier, &msg.CreatedAt, &msg.ReservedCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Id = strconv.FormatInt(id, 10)
+		msg.Body = string(body)
+		if header.Valid {
+			if err := json.Unmarshal([]byte(header.String), &msg.Header); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		time.Sleep(pollInterval)
+	}
+	return msgs, nil
+}
+
+func newReservationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func parseId(msg *msgqueue.Message) (int64, error) {
+	return strconv.ParseInt(msg.Id, 10, 64)
+}
+
+// Release unlocks the message after the delay. The message is not
+// changed if its reservation expired and it is reserved again.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(
+		`UPDATE `+tableName+` SET locked_until = now() + $1 * interval '1 millisecond', `+
+			`reservation_id = NULL WHERE id = $2 AND reservation_id = $3`,
+		int64(delay/time.Millisecond), id, msg.ReservationId,
+	)
+	return err
+}
+
+// Touch extends message lock to the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.Exec(
+		`UPDATE `+tableName+` SET locked_until = now() + $1 * interval '1 millisecond' `+
+			`WHERE id = $2 AND reservation_id = $3`,
+		int64(dur/time.Millisecond), id, msg.ReservationId,
+	)
+	return err
+}
+
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	return q.DeleteBatch([]*msgqueue.Message{msg})
+}
+
+// DeleteBatch deletes the messages using single query. Messages which
+// reservation expired and that are reserved again are not deleted.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString(`DELETE FROM ` + tableName + ` WHERE (id, reservation_id) IN (`)
+	args := make([]interface{}, 0, 2*len(msgs))
+	for i, msg := range msgs {
+		id, err := parseId(msg)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "($%d::bigint, $%d)", len(args)+1, len(args)+2)
+		args = append(args, id, msg.ReservationId)
+	}
+	b.WriteString(")")
+
+	_, err := q.db.Exec(b.String(), args...)
+	return err
+}
+
+// Purge deletes all messages of the queue including reserved messages.
+func (q *Queue) Purge() error {
+	if err := q.createTable(); err != nil {
+		return err
+	}
+	_, err := q.db.Exec(`DELETE FROM `+tableName+` WHERE queue = $1`, q.Name())
+	return err
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,17 @@
+package msgqueue
+
+// PriorityInversion defines how the processor handles priority inversion,
+// i.e. messages waiting in higher priority lanes while workers wait for
+// the rate limit with lower priority messages.
+type PriorityInversion int
+
+const (
+	// InversionIgnore does not detect priority inversion.
+	InversionIgnore PriorityInversion = iota
+	// InversionAlert counts and logs priority inversions.
+	InversionAlert
+	// InversionReorder returns rate limited lower priority messages
+	// to the buffer, so workers take higher priority messages first.
+	// Messages with GroupKey and barriers are not returned.
+	InversionReorder
+)
@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"sync/atomic"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Abort stops the processor after a fatal error, e.g. revoked credentials
+// or lost connection to a dependency. Unlike Stop, it does not process
+// buffered messages: contexts of running handlers are cancelled and
+// messages that were not processed are released back to the queue without
+// delay and without counting them as retries. Messages processed
+// successfully before handlers observe cancellation are deleted as usual.
+func (p *Processor) Abort(reason error) error {
+	p.abortMu.Lock()
+	p.abortErr = reason
+	p.abortMu.Unlock()
+
+	p.errorf("%s aborted: %s", p.q, reason)
+
+	err := p.stopWorkersTimeout(stopTimeout, true)
+
+	// Released memqueue messages are buffered again, so only
+	// messages that were buffered before are released.
+	for n := len(p.ready); n > 0; n-- {
+		select {
+		case <-p.ready:
+			p.releaseAborted(p.takeMessage())
+		default:
+			n = 0
+		}
+	}
+
+	return err
+}
+
+// aborted returns the reason passed to Abort or nil if the processor
+// is not aborted.
+func (p *Processor) aborted() error {
+	p.abortMu.Lock()
+	err := p.abortErr
+	p.abortMu.Unlock()
+	return err
+}
+
+func (p *Processor) resetAbort() {
+	p.abortMu.Lock()
+	p.abortErr = nil
+	p.abortMu.Unlock()
+}
+
+// releaseAborted releases the message without delay
+// and without counting it as a retry.
+func (p *Processor) releaseAborted(msg *msgqueue.Message) {
+	atomic.AddUint64(&p.requeued, 1)
+	p.count("requeued")
+
+	// Release increments ReservedCount of memqueue messages.
+	msg.ReservedCount--
+	if err := p.releaseMessage(msg, 0); err != nil {
+		p.errorf("%s Release failed: %s", p.q, err)
+	}
+
+	atomic.AddUint32(&p.inFlight, ^uint32(0))
+}
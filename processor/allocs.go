@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// maxAllocNames limits the number of message names
+// tracked separately by AllocStats.
+const maxAllocNames = 1000
+
+// AllocStats are allocations sampled around handler calls
+// for messages with the same name.
+type AllocStats struct {
+	// Number of sampled handler calls.
+	Samples uint64
+	// Number of heap allocations and allocated bytes
+	// during sampled calls.
+	Mallocs uint64
+	Bytes   uint64
+	// Number of completed GC cycles during sampled calls.
+	NumGC uint64
+}
+
+// AvgBytes returns the average number of bytes allocated by a call.
+func (st *AllocStats) AvgBytes() uint64 {
+	if st.Samples == 0 {
+		return 0
+	}
+	return st.Bytes / st.Samples
+}
+
+// AllocStats returns allocation stats sampled with Options.AllocSampleRate
+// indexed by message name. Messages without name and names beyond
+// the first 1000 are reported under the empty name.
+func (p *Processor) AllocStats() map[string]AllocStats {
+	p.allocsMu.Lock()
+	m := make(map[string]AllocStats, len(p.allocs))
+	for name, st := range p.allocs {
+		m[name] = *st
+	}
+	p.allocsMu.Unlock()
+	return m
+}
+
+func (p *Processor) resetAllocStats() {
+	p.allocsMu.Lock()
+	p.allocs = make(map[string]*AllocStats)
+	p.allocsMu.Unlock()
+}
+
+func sampleNoop() {}
+
+// sampleAllocs samples 1 in Options.AllocSampleRate handler calls and
+// returns the function that records allocations since the call started.
+// Memory stats are process-wide, so allocations of concurrently running
+// handlers are included.
+func (p *Processor) sampleAllocs(msg *msgqueue.Message) func() {
+	rate := uint64(p.opt.AllocSampleRate)
+	if rate == 0 || atomic.AddUint64(&p.allocSeq, 1)%rate != 0 {
+		return sampleNoop
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	return func() {
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+
+		name := msg.Name
+		p.allocsMu.Lock()
+		st, ok := p.allocs[name]
+		if !ok && len(p.allocs) >= maxAllocNames {
+			name = ""
+			st, ok = p.allocs[name]
+		}
+		if !ok {
+			st = new(AllocStats)
+			p.allocs[name] = st
+		}
+		st.Samples++
+		st.Mallocs += after.Mallocs - before.Mallocs
+		st.Bytes += after.TotalAlloc - before.TotalAlloc
+		st.NumGC += uint64(after.NumGC - before.NumGC)
+		p.allocsMu.Unlock()
+	}
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// autoscaler periodically adjusts the number of workers between
+// MinWorkers and MaxWorkers.
+func (p *Processor) autoscaler() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opt.AutoscaleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n, err := p.desiredWorkers()
+		if err != nil {
+			p.warnf("%s Len failed: %s", p.q, err)
+			continue
+		}
+		if n != p.WorkerNumber() {
+			_ = p.SetWorkerNumber(n)
+		}
+	}
+}
+
+// desiredWorkers returns the number of workers that are needed to keep
+// processing current messages and to drain the backlog within one
+// autoscale interval.
+func (p *Processor) desiredWorkers() (int, error) {
+	buffered := len(p.ready)
+	backlog := buffered
+	if l, ok := p.q.(Lener); ok {
+		n, err := l.Len()
+		if err != nil {
+			return 0, err
+		}
+		backlog += n
+	}
+
+	busy := int(atomic.LoadUint32(&p.inFlight)) - buffered - int(atomic.LoadUint32(&p.delayed))
+	if busy < 0 {
+		busy = 0
+	}
+
+	n := busy
+	if backlog > 0 {
+		dur := time.Duration(atomic.LoadUint32(&p.avgDuration)) * time.Millisecond
+		if dur < time.Millisecond {
+			dur = time.Millisecond
+		}
+		interval := p.opt.AutoscaleInterval
+		n += int((time.Duration(backlog)*dur + interval - 1) / interval)
+	}
+
+	// Scale down gradually so bursty traffic does not cause flapping.
+	if cur := p.WorkerNumber(); n < cur/2 {
+		n = cur / 2
+	}
+
+	if n < p.opt.MinWorkers {
+		n = p.opt.MinWorkers
+	}
+	if n > p.opt.MaxWorkers {
+		n = p.opt.MaxWorkers
+	}
+	return n, nil
+}
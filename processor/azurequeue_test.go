@@ -0,0 +1,67 @@
+package processor_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/azurequeue"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azqueue"
+)
+
+// Connection string of Azurite storage emulator.
+const azuriteConnString = "DefaultEndpointsProtocol=http;" +
+	"AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"QueueEndpoint=http://127.0.0.1:10001/devstoreaccount1;"
+
+func azureQueue(t *testing.T, name string, opt *msgqueue.Options) *azurequeue.Queue {
+	client, err := azqueue.NewServiceClientFromConnectionString(azuriteConnString, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	q := azurequeue.NewQueue(client, opt)
+	_ = q.Purge()
+	return q
+}
+
+func TestAzureQueueProcessor(t *testing.T) {
+	testProcessor(t, azureQueue(t, "azure-processor", &msgqueue.Options{}))
+}
+
+func TestAzureQueueAddBatch(t *testing.T) {
+	testAddBatch(t, azureQueue(t, "azure-add-batch", &msgqueue.Options{}))
+}
+
+func TestAzureQueueDelay(t *testing.T) {
+	testDelay(t, azureQueue(t, "azure-delay", &msgqueue.Options{}))
+}
+
+func TestAzureQueueRetry(t *testing.T) {
+	testRetry(t, azureQueue(t, "azure-retry", &msgqueue.Options{}))
+}
+
+func TestAzureQueueNamedMessage(t *testing.T) {
+	testNamedMessage(t, azureQueue(t, "azure-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestAzureQueueCallOnce(t *testing.T) {
+	testCallOnce(t, azureQueue(t, "azure-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestAzureQueueDelayer(t *testing.T) {
+	testDelayer(t, azureQueue(t, "azure-delayer", &msgqueue.Options{}))
+}
+
+func TestAzureQueueTouch(t *testing.T) {
+	testTouch(t, azureQueue(t, "azure-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
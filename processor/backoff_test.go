@@ -0,0 +1,32 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		dur    time.Duration
+		retry  int
+		wanted time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 17, maxBackoff},
+		{time.Second, 34, maxBackoff},
+		{time.Second, 64, maxBackoff},
+		{time.Second, 1 << 30, maxBackoff},
+		{maxBackoff, 2, maxBackoff},
+		{0, 100, 0},
+	}
+	for _, test := range tests {
+		got := exponentialBackoff(test.dur, test.retry)
+		if got != test.wanted {
+			t.Fatalf("exponentialBackoff(%s, %d) = %s, wanted %s",
+				test.dur, test.retry, got, test.wanted)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package processor_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/beanstalkd"
+)
+
+func beanstalkdQueue(t *testing.T, name string, opt *msgqueue.Options) *beanstalkd.Queue {
+	opt.Name = queueName(name)
+	q := beanstalkd.NewQueue("localhost:11300", opt)
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestBeanstalkdProcessor(t *testing.T) {
+	testProcessor(t, beanstalkdQueue(t, "beanstalkd-processor", &msgqueue.Options{}))
+}
+
+func TestBeanstalkdAddBatch(t *testing.T) {
+	testAddBatch(t, beanstalkdQueue(t, "beanstalkd-add-batch", &msgqueue.Options{}))
+}
+
+func TestBeanstalkdDelay(t *testing.T) {
+	testDelay(t, beanstalkdQueue(t, "beanstalkd-delay", &msgqueue.Options{}))
+}
+
+func TestBeanstalkdRetry(t *testing.T) {
+	testRetry(t, beanstalkdQueue(t, "beanstalkd-retry", &msgqueue.Options{}))
+}
+
+func TestBeanstalkdNamedMessage(t *testing.T) {
+	testNamedMessage(t, beanstalkdQueue(t, "beanstalkd-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestBeanstalkdCallOnce(t *testing.T) {
+	testCallOnce(t, beanstalkdQueue(t, "beanstalkd-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestBeanstalkdDelayer(t *testing.T) {
+	testDelayer(t, beanstalkdQueue(t, "beanstalkd-delayer", &msgqueue.Options{}))
+}
+
+func TestBeanstalkdTouch(t *testing.T) {
+	testTouch(t, beanstalkdQueue(t, "beanstalkd-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
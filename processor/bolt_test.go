@@ -0,0 +1,82 @@
+package processor_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/boltq"
+)
+
+func boltQueue(t *testing.T, name string, opt *msgqueue.Options) *boltq.Queue {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "queue.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	q := boltq.NewQueue(db, opt)
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestBoltProcessor(t *testing.T) {
+	testProcessor(t, boltQueue(t, "bolt-processor", &msgqueue.Options{}))
+}
+
+func TestBoltAddBatch(t *testing.T) {
+	testAddBatch(t, boltQueue(t, "bolt-add-batch", &msgqueue.Options{}))
+}
+
+func TestBoltDelay(t *testing.T) {
+	testDelay(t, boltQueue(t, "bolt-delay", &msgqueue.Options{}))
+}
+
+func TestBoltRetry(t *testing.T) {
+	testRetry(t, boltQueue(t, "bolt-retry", &msgqueue.Options{}))
+}
+
+func TestBoltNamedMessage(t *testing.T) {
+	testNamedMessage(t, boltQueue(t, "bolt-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestBoltCallOnce(t *testing.T) {
+	testCallOnce(t, boltQueue(t, "bolt-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestBoltUpsert(t *testing.T) {
+	redis := redisRing()
+	testUpsert(t, boltQueue(t, "bolt-upsert", &msgqueue.Options{
+		Redis:  redis,
+		Upsert: true,
+	}), redis)
+}
+
+func TestBoltTouchParked(t *testing.T) {
+	testTouchParked(t, boltQueue(t, "bolt-touch-parked", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
+
+func TestBoltPauseName(t *testing.T) {
+	testPauseName(t, boltQueue(t, "bolt-pause-name", &msgqueue.Options{}))
+}
+
+func TestBoltDelayer(t *testing.T) {
+	testDelayer(t, boltQueue(t, "bolt-delayer", &msgqueue.Options{}))
+}
+
+func TestBoltTouch(t *testing.T) {
+	testTouch(t, boltQueue(t, "bolt-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
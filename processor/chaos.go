@@ -0,0 +1,146 @@
+package processor
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+type chaosStats struct {
+	active      uint32
+	delayedAcks uint32
+	duplicates  uint32
+	restarts    uint32
+}
+
+// chaosRunner runs drills configured by Options.Chaos
+// until processor is stopped.
+func (p *Processor) chaosRunner() {
+	defer p.wg.Done()
+
+	opt := p.opt.Chaos
+	for {
+		if !p.sleep(opt.Interval) {
+			return
+		}
+
+		report := &msgqueue.ChaosReport{
+			Queue: p.q.Name(),
+			Start: time.Now(),
+		}
+		for _, n := range []*uint32{
+			&p.chaos.delayedAcks, &p.chaos.duplicates, &p.chaos.restarts,
+		} {
+			atomic.StoreUint32(n, 0)
+		}
+		atomic.StoreUint32(&p.chaos.active, 1)
+		p.warnf("%s chaos drill started", p.q)
+
+		ok := p.chaosDrill(opt)
+
+		atomic.StoreUint32(&p.chaos.active, 0)
+		report.End = time.Now()
+		report.DelayedAcks = int(atomic.LoadUint32(&p.chaos.delayedAcks))
+		report.Duplicates = int(atomic.LoadUint32(&p.chaos.duplicates))
+		report.Restarts = int(atomic.LoadUint32(&p.chaos.restarts))
+		if opt.Check != nil {
+			report.Err = opt.Check()
+		}
+
+		if opt.OnReport != nil {
+			opt.OnReport(report)
+		} else if report.Err != nil {
+			p.errorf("%s", report)
+		} else {
+			p.infof("%s", report)
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// chaosDrill restarts workers during the drill. It reports
+// false if processor is stopped before the drill ends.
+func (p *Processor) chaosDrill(opt *msgqueue.ChaosOptions) bool {
+	end := time.NewTimer(opt.Duration)
+	defer end.Stop()
+
+	var restart <-chan time.Time
+	if opt.RestartInterval > 0 {
+		ticker := time.NewTicker(opt.RestartInterval)
+		defer ticker.Stop()
+		restart = ticker.C
+	}
+
+	for {
+		select {
+		case <-end.C:
+			return true
+		case <-restart:
+			if p.restartWorkers() {
+				atomic.AddUint32(&p.chaos.restarts, 1)
+			}
+		case <-p.stop:
+			return false
+		}
+	}
+}
+
+// sleep waits for the duration. It reports false
+// if processor is stopped before that.
+func (p *Processor) sleep(dur time.Duration) bool {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// restartWorkers replaces running workers with new ones.
+func (p *Processor) restartWorkers() bool {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	if p.stopped() {
+		return false
+	}
+	for _, quit := range p.workers {
+		close(quit)
+	}
+	p.workers = nil
+	p.addWorkers(p.workerNumber)
+	return true
+}
+
+// injectChaos delays or duplicates processed message during a drill.
+// It reports whether the message is released instead of being deleted.
+func (p *Processor) injectChaos(msg *msgqueue.Message) bool {
+	opt := p.opt.Chaos
+	if opt == nil || atomic.LoadUint32(&p.chaos.active) == 0 {
+		return false
+	}
+
+	if opt.DuplicateRate > 0 && rand.Float64() < opt.DuplicateRate {
+		atomic.AddUint32(&p.chaos.duplicates, 1)
+		// Release increments ReservedCount of memqueue messages.
+		msg.ReservedCount--
+		if err := p.releaseMessage(msg, 0); err != nil {
+			p.errorf("%s Release failed: %s", p.q, err)
+		}
+		return true
+	}
+
+	if opt.DelayAckRate > 0 && rand.Float64() < opt.DelayAckRate {
+		atomic.AddUint32(&p.chaos.delayedAcks, 1)
+		p.sleep(opt.AckDelay)
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// eventsBufferSize is the number of events that are kept
+// until they are received from the Events channel.
+const eventsBufferSize = 1000
+
+// EventType is the type of the processor event.
+type EventType int
+
+const (
+	// EventReserved is emitted when message is reserved
+	// and added to the processor buffer.
+	EventReserved EventType = iota
+	// EventProcessed is emitted when message is processed successfully
+	// or discarded. Event.Err is msgqueue.ErrDiscarded in the latter case.
+	EventProcessed
+	// EventRetried is emitted when processing failed
+	// and message is released to be retried.
+	EventRetried
+	// EventFailed is emitted when processing failed
+	// and message will not be retried.
+	EventFailed
+	// EventPaused is emitted when processor is paused by Pause.
+	EventPaused
+	// EventResumed is emitted when processor is resumed by Resume.
+	EventResumed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventReserved:
+		return "reserved"
+	case EventProcessed:
+		return "processed"
+	case EventRetried:
+		return "retried"
+	case EventFailed:
+		return "failed"
+	case EventPaused:
+		return "paused"
+	case EventResumed:
+		return "resumed"
+	}
+	return "unknown"
+}
+
+// Event describes a change in the processor or in the state of a message.
+type Event struct {
+	Type  EventType
+	Queue string
+	Time  time.Time
+
+	// Message is nil for EventPaused and EventResumed.
+	// It must not be modified.
+	Message *msgqueue.Message
+	// Processing error of retried, failed and discarded messages.
+	Err error
+	// Processing duration of processed, retried and failed messages.
+	Duration time.Duration
+}
+
+// Events returns the channel of processor events that can be used
+// to build dashboards and alerts without polling Stats. Events are
+// emitted only after Events is called. Processing is never blocked
+// by a slow receiver: events are dropped when the channel is full.
+func (p *Processor) Events() <-chan Event {
+	p.eventsMu.Lock()
+	if p.events == nil {
+		p.events = make(chan Event, eventsBufferSize)
+	}
+	ch := p.events
+	p.eventsMu.Unlock()
+	return ch
+}
+
+func (p *Processor) emit(typ EventType, msg *msgqueue.Message, err error, dur time.Duration) {
+	p.eventsMu.Lock()
+	ch := p.events
+	p.eventsMu.Unlock()
+	if ch == nil {
+		return
+	}
+
+	select {
+	case ch <- Event{
+		Type:     typ,
+		Queue:    p.q.Name(),
+		Time:     time.Now(),
+		Message:  msg,
+		Err:      err,
+		Duration: dur,
+	}:
+	default:
+	}
+}
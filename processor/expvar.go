@@ -0,0 +1,22 @@
+package processor
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	expvarOnce  sync.Once
+	expvarStats *expvar.Map
+)
+
+// publishExpvar publishes processor stats under expvar map "msgqueue"
+// using the queue name as a key.
+func (p *Processor) publishExpvar() {
+	expvarOnce.Do(func() {
+		expvarStats = expvar.NewMap("msgqueue")
+	})
+	expvarStats.Set(p.q.Name(), expvar.Func(func() interface{} {
+		return p.Stats()
+	}))
+}
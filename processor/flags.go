@@ -0,0 +1,26 @@
+package processor
+
+import (
+	"sync/atomic"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// applyFlags consults Options.FeatureFlags and delays or drops the message
+// like handler that returns Requeue or ErrDiscarded. It reports whether
+// the message was handled and its outcome.
+func (p *Processor) applyFlags(msg *msgqueue.Message) (result, bool, error) {
+	action, delay := p.opt.FeatureFlags.Action(msg)
+	switch action {
+	case msgqueue.FlagDelay:
+		p.record(msg, msgqueue.OutcomeRequeued, nil, 0)
+		return resultRequeued, true, msgqueue.Requeue(delay)
+	case msgqueue.FlagDrop:
+		p.record(msg, msgqueue.OutcomeDiscarded, nil, 0)
+		atomic.AddUint64(&p.processed, 1)
+		p.count("processed")
+		p.emit(EventProcessed, msg, msgqueue.ErrDiscarded, 0)
+		return resultProcessed, true, msgqueue.ErrDiscarded
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,178 @@
+package processor
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Reports older than staleReports intervals belong to stopped
+// or crashed processes and are removed.
+const staleReports = 3
+
+func fleetStatsKey(queue string) string {
+	return "msgqueue:stats:" + queue
+}
+
+// ProcessStats is Stats reported by one process.
+type ProcessStats struct {
+	Stats
+
+	// Process that reported the stats, i.e. hostname:pid.
+	Worker string
+	// Time when the stats were reported.
+	Time time.Time
+	// Interval between reports.
+	Interval time.Duration
+	// Number of messages processed per second since the previous report.
+	ProcessedRate float64
+}
+
+// FleetStats is Stats aggregated across processes processing the queue.
+type FleetStats struct {
+	// Sum of the process stats. AvgDuration and AvgPayloadSize
+	// are weighted by the number of processed messages. Duration
+	// quantiles are the maximum across processes. ClockSkew
+	// is not summed. Paused is true only when all processes
+	// are paused.
+	Stats
+
+	// Sum of the process processing rates, i.e. messages per second.
+	ProcessedRate float64
+
+	Processes []*ProcessStats
+}
+
+// statsReporter periodically publishes processor stats to Redis,
+// so they can be aggregated across processes using GetFleetStats.
+func (p *Processor) statsReporter(redis msgqueue.RedisCmdable) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opt.StatsReportInterval)
+	defer ticker.Stop()
+
+	key := fleetStatsKey(p.q.Name())
+	var prevProcessed uint64
+	prevTime := time.Now()
+	for {
+		select {
+		case <-p.stop:
+			if err := redis.HDel(key, workerId).Err(); err != nil {
+				p.warnf("%s HDel failed: %s", p.q, err)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		st := ProcessStats{
+			Stats:    *p.Stats(),
+			Worker:   workerId,
+			Time:     now,
+			Interval: p.opt.StatsReportInterval,
+		}
+		if st.Processed < prevProcessed {
+			// Stats were reset.
+			prevProcessed = 0
+		}
+		st.ProcessedRate = float64(st.Processed-prevProcessed) / now.Sub(prevTime).Seconds()
+		prevProcessed, prevTime = st.Processed, now
+
+		b, err := json.Marshal(&st)
+		if err != nil {
+			p.warnf("%s json.Marshal failed: %s", p.q, err)
+			continue
+		}
+		if err := redis.HSet(key, workerId, b).Err(); err != nil {
+			p.warnf("%s HSet failed: %s", p.q, err)
+		}
+	}
+}
+
+// GetFleetStats returns stats of the queue aggregated across processes
+// that report stats to Redis using Options.StatsReportInterval.
+// Reports of stopped processes are ignored and removed.
+func GetFleetStats(redis msgqueue.RedisCmdable, queue string) (*FleetStats, error) {
+	key := fleetStatsKey(queue)
+	m, err := redis.HGetAll(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	fleet := new(FleetStats)
+	stats := make([]*Stats, 0, len(m))
+	now := time.Now()
+	for worker, s := range m {
+		st := new(ProcessStats)
+		if err := json.Unmarshal([]byte(s), st); err != nil {
+			return nil, err
+		}
+		st.Worker = worker
+		if now.Sub(st.Time) > staleReports*st.Interval {
+			_ = redis.HDel(key, worker).Err()
+			continue
+		}
+
+		fleet.Processes = append(fleet.Processes, st)
+		fleet.ProcessedRate += st.ProcessedRate
+		stats = append(stats, &st.Stats)
+	}
+	fleet.Stats = sumStats(stats)
+	return fleet, nil
+}
+
+// sumStats sums the stats. AvgDuration and AvgPayloadSize are weighted
+// by the number of processed messages. Duration quantiles are the maximum
+// quantiles, because quantiles can't be summed. ClockSkew is not summed.
+// Paused is true only when all stats are paused.
+func sumStats(stats []*Stats) Stats {
+	var sum Stats
+	var weighted int64
+	for i, st := range stats {
+		if sum.Processed+st.Processed > 0 {
+			sum.AvgPayloadSize = uint32(
+				(uint64(sum.AvgPayloadSize)*uint64(sum.Processed) +
+					uint64(st.AvgPayloadSize)*uint64(st.Processed)) /
+					uint64(sum.Processed+st.Processed),
+			)
+		}
+		if st.MinPayloadSize > 0 && (sum.MinPayloadSize == 0 || st.MinPayloadSize < sum.MinPayloadSize) {
+			sum.MinPayloadSize = st.MinPayloadSize
+		}
+		if st.MaxPayloadSize > sum.MaxPayloadSize {
+			sum.MaxPayloadSize = st.MaxPayloadSize
+		}
+		if st.P50Duration > sum.P50Duration {
+			sum.P50Duration = st.P50Duration
+		}
+		if st.P95Duration > sum.P95Duration {
+			sum.P95Duration = st.P95Duration
+		}
+		if st.P99Duration > sum.P99Duration {
+			sum.P99Duration = st.P99Duration
+		}
+		weighted += int64(st.Processed) * int64(st.AvgDuration)
+
+		sum.Buffered += st.Buffered
+		sum.InFlight += st.InFlight
+		sum.Delayed += st.Delayed
+		sum.Deleting += st.Deleting
+		sum.Processed += st.Processed
+		sum.Retries += st.Retries
+		sum.Requeued += st.Requeued
+		sum.Fails += st.Fails
+		sum.Panics += st.Panics
+		sum.Timeouts += st.Timeouts
+		sum.DeadLettered += st.DeadLettered
+		sum.Expired += st.Expired
+		sum.Coalesced += st.Coalesced
+		sum.Filtered += st.Filtered
+		sum.Inversions += st.Inversions
+		sum.Paused = st.Paused && (i == 0 || sum.Paused)
+	}
+	if sum.Processed > 0 {
+		sum.AvgDuration = time.Duration(weighted / int64(sum.Processed))
+	}
+	return sum
+}
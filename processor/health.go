@@ -0,0 +1,53 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errStopped = errors.New("queue: processor is stopped")
+	errPaused  = errors.New("queue: processor is paused")
+)
+
+// Healthy reports whether processor is started, is not paused, and
+// fetches messages without persistent errors. It does not access
+// the queue backend and is cheap enough for frequent readiness probes.
+func (p *Processor) Healthy() bool {
+	return p.state() == nil
+}
+
+// Health returns the reason why processor is not healthy or the error
+// of pinging the queue backend. It returns nil when processor is healthy.
+func (p *Processor) Health() error {
+	if err := p.state(); err != nil {
+		return err
+	}
+	if err := p.q.Ping(); err != nil {
+		return fmt.Errorf("queue: Ping failed: %s", err)
+	}
+	return nil
+}
+
+func (p *Processor) state() error {
+	if p.stopped() {
+		return errStopped
+	}
+	if p.Paused() {
+		return errPaused
+	}
+
+	p.fetchErrMu.Lock()
+	err := p.fetchErr
+	p.fetchErrMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("queue: fetching messages failed: %s", err)
+	}
+	return nil
+}
+
+func (p *Processor) setFetchErr(err error) {
+	p.fetchErrMu.Lock()
+	p.fetchErr = err
+	p.fetchErrMu.Unlock()
+}
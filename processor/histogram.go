@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Number of histogram buckets per power of two. Durations
+// are reported with about 1/histSubBuckets precision.
+const histSubBuckets = 8
+
+// Enough buckets to hold any duration in microseconds.
+const histBuckets = 64 * histSubBuckets
+
+// histogram counts durations in log-linear buckets like HDR histogram.
+// It is safe for concurrent use.
+type histogram struct {
+	sum    uint64 // nanoseconds
+	counts [histBuckets]uint64
+}
+
+func histBucket(us uint64) int {
+	if us < histSubBuckets {
+		return int(us)
+	}
+	var exp uint
+	for v := us; v >= 2*histSubBuckets; v >>= 1 {
+		exp++
+	}
+	return int(exp+1)*histSubBuckets + int(us>>exp) - histSubBuckets
+}
+
+// histUpperBound returns the exclusive upper bound of the bucket in microseconds.
+func histUpperBound(i int) uint64 {
+	if i < histSubBuckets {
+		return uint64(i + 1)
+	}
+	exp := uint(i/histSubBuckets - 1)
+	mant := uint64(i%histSubBuckets + histSubBuckets)
+	return (mant + 1) << exp
+}
+
+func (h *histogram) Observe(dur time.Duration) {
+	if dur < 0 {
+		dur = 0
+	}
+	atomic.AddUint64(&h.sum, uint64(dur))
+	atomic.AddUint64(&h.counts[histBucket(uint64(dur/time.Microsecond))], 1)
+}
+
+// Buckets returns cumulative counts of durations that are less than
+// or equal to the sorted bounds, total count, and sum of durations.
+// Counts are approximate, because durations are counted in buckets.
+func (h *histogram) Buckets(bounds []time.Duration) ([]uint64, uint64, time.Duration) {
+	counts := make([]uint64, len(bounds))
+	var total uint64
+	j := 0
+	for i := range h.counts {
+		upper := time.Duration(histUpperBound(i)) * time.Microsecond
+		for j < len(bounds) && bounds[j] < upper {
+			counts[j] = total
+			j++
+		}
+		total += atomic.LoadUint64(&h.counts[i])
+	}
+	for ; j < len(bounds); j++ {
+		counts[j] = total
+	}
+	return counts, total, time.Duration(atomic.LoadUint64(&h.sum))
+}
+
+// Quantiles returns upper bounds of the buckets that contain the quantiles.
+func (h *histogram) Quantiles(qs ...float64) []time.Duration {
+	var counts [histBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+
+	res := make([]time.Duration, len(qs))
+	if total == 0 {
+		return res
+	}
+	for j, q := range qs {
+		rank := uint64(q*float64(total) + 0.5)
+		if rank == 0 {
+			rank = 1
+		}
+		var n uint64
+		for i, c := range counts {
+			n += c
+			if n >= rank {
+				res[j] = time.Duration(histUpperBound(i)) * time.Microsecond
+				break
+			}
+		}
+	}
+	return res
+}
+
+func (h *histogram) Reset() {
+	atomic.StoreUint64(&h.sum, 0)
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+}
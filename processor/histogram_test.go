@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistBucket(t *testing.T) {
+	prev := -1
+	for us := uint64(0); us < 1e6; us++ {
+		i := histBucket(us)
+		if i < prev {
+			t.Fatalf("bucket of %d is %d, previous bucket is %d", us, i, prev)
+		}
+		if upper := histUpperBound(i); us >= upper {
+			t.Fatalf("%d is not less than upper bound %d of bucket %d", us, upper, i)
+		}
+		if i > 0 && us < histUpperBound(i-1) {
+			t.Fatalf("%d is less than upper bound of bucket %d", us, i-1)
+		}
+		prev = i
+	}
+	if i := histBucket(1<<63 - 1); i >= histBuckets {
+		t.Fatalf("bucket of max duration is %d, wanted < %d", i, histBuckets)
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	got := h.Quantiles(0.5, 0.99)
+	for i, want := range []time.Duration{50 * time.Millisecond, 99 * time.Millisecond} {
+		if got[i] < want || got[i] > want+want/histSubBuckets {
+			t.Errorf("quantile %d is %s, wanted about %s", i, got[i], want)
+		}
+	}
+
+	h.Reset()
+	if got := h.Quantiles(0.5); got[0] != 0 {
+		t.Errorf("quantile after reset is %s, wanted 0", got[0])
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	counts, total, sum := h.Buckets([]time.Duration{
+		time.Millisecond / 2, 10 * time.Millisecond, time.Second,
+	})
+	if total != 100 {
+		t.Errorf("got total %d, wanted 100", total)
+	}
+	if sum != 5050*time.Millisecond {
+		t.Errorf("got sum %s, wanted 5.05s", sum)
+	}
+	if counts[0] != 0 || counts[1] < 9 || counts[1] > 10 || counts[2] != 100 {
+		t.Errorf("got counts %v, wanted [0 ~10 100]", counts)
+	}
+}
@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+func inFlightKey(queue string) string {
+	return "msgqueue:inflight:" + queue
+}
+
+// InFlightMessage describes the message that is being processed.
+type InFlightMessage struct {
+	Queue         string
+	Id            string
+	Name          string
+	ReservedCount int
+	// Process that processes the message, i.e. hostname:pid.
+	Worker string
+	// Time when processing of the message started.
+	StartedAt time.Time
+	// Time after which the reservation expires unless it is renewed.
+	ReservationTimeout time.Duration
+}
+
+// InFlightMessages returns messages that are being processed
+// by the processor in the order they were started.
+func (p *Processor) InFlightMessages() []*InFlightMessage {
+	p.inFlightMu.Lock()
+	msgs := make([]*InFlightMessage, 0, len(p.inFlightMsgs))
+	for _, m := range p.inFlightMsgs {
+		msgs = append(msgs, m)
+	}
+	p.inFlightMu.Unlock()
+
+	sortInFlight(msgs)
+	return msgs
+}
+
+// trackInFlight registers the message as being processed and returns
+// the function that unregisters it. With Options.TrackInFlight the message
+// is also registered in Redis, so it can be inspected using
+// GetInFlightMessages.
+func (p *Processor) trackInFlight(msg *msgqueue.Message) func() {
+	m := &InFlightMessage{
+		Queue:              p.q.Name(),
+		Id:                 msg.Id,
+		Name:               msg.Name,
+		ReservedCount:      msg.ReservedCount,
+		Worker:             workerId,
+		StartedAt:          time.Now(),
+		ReservationTimeout: p.opt.ReservationTimeout,
+	}
+
+	p.inFlightMu.Lock()
+	p.inFlightMsgs[msg] = m
+	p.inFlightMu.Unlock()
+
+	var field string
+	redis, ok := p.opt.Redis.(msgqueue.RedisCmdable)
+	if p.opt.TrackInFlight && ok {
+		seq := atomic.AddUint64(&p.inFlightSeq, 1)
+		field = workerId + "/" + strconv.FormatUint(seq, 10)
+		if b, err := json.Marshal(m); err != nil {
+			p.warnf("%s json.Marshal failed: %s", p.q, err)
+			field = ""
+		} else if err := redis.HSet(inFlightKey(m.Queue), field, b).Err(); err != nil {
+			p.warnf("%s HSet failed: %s", p.q, err)
+			field = ""
+		}
+	}
+
+	return func() {
+		p.inFlightMu.Lock()
+		delete(p.inFlightMsgs, msg)
+		p.inFlightMu.Unlock()
+
+		if field != "" {
+			if err := redis.HDel(inFlightKey(m.Queue), field).Err(); err != nil {
+				p.warnf("%s HDel failed: %s", p.q, err)
+			}
+		}
+	}
+}
+
+// GetInFlightMessages returns messages of the queue that are being processed
+// by processes that use Options.TrackInFlight, e.g. to find out which process
+// holds a stuck message. Messages of crashed processes are ignored and
+// removed after their reservation expires.
+func GetInFlightMessages(redis msgqueue.RedisCmdable, queue string) ([]*InFlightMessage, error) {
+	key := inFlightKey(queue)
+	m, err := redis.HGetAll(key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*InFlightMessage, 0, len(m))
+	now := time.Now()
+	for field, s := range m {
+		msg := new(InFlightMessage)
+		if err := json.Unmarshal([]byte(s), msg); err != nil {
+			return nil, err
+		}
+		if msg.ReservationTimeout > 0 && now.Sub(msg.StartedAt) > msg.ReservationTimeout {
+			_ = redis.HDel(key, field).Err()
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	sortInFlight(msgs)
+	return msgs, nil
+}
+
+func sortInFlight(msgs []*InFlightMessage) {
+	for i := 1; i < len(msgs); i++ {
+		for j := i; j > 0 && msgs[j].StartedAt.Before(msgs[j-1].StartedAt); j-- {
+			msgs[j], msgs[j-1] = msgs[j-1], msgs[j]
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/go-msgqueue/msgqueue"
 	"github.com/go-msgqueue/msgqueue/ironmq"
 
+	"github.com/iron-io/iron_go3/config"
 	"github.com/iron-io/iron_go3/mq"
 )
 
@@ -14,11 +15,30 @@ func TestIronmqProcessor(t *testing.T) {
 	testProcessor(t, q)
 }
 
+func TestIronmqAddBatch(t *testing.T) {
+	q := ironmq.NewQueue(mq.New(queueName("ironmq-add-batch")), &msgqueue.Options{})
+	testAddBatch(t, q)
+}
+
+func TestIronmqFactory(t *testing.T) {
+	f := ironmq.NewFactory(config.Config("iron_mq"), &msgqueue.FactoryOptions{
+		APIRateLimit: 10,
+	})
+	testProcessor(t, f.NewQueue(&msgqueue.Options{
+		Name: queueName("ironmq-factory"),
+	}))
+}
+
 func TestIronmqDelay(t *testing.T) {
 	q := ironmq.NewQueue(mq.New(queueName("ironmq-delay")), &msgqueue.Options{})
 	testDelay(t, q)
 }
 
+func TestIronmqScheduledAt(t *testing.T) {
+	q := ironmq.NewQueue(mq.New(queueName("ironmq-scheduled-at")), &msgqueue.Options{})
+	testScheduledAt(t, q)
+}
+
 func TestIronmqRetry(t *testing.T) {
 	q := ironmq.NewQueue(mq.New(queueName("ironmq-retry")), &msgqueue.Options{})
 	testRetry(t, q)
@@ -0,0 +1,62 @@
+package processor_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/azkinesis"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func kinesisQueue(t *testing.T, name string, opt *msgqueue.Options) *azkinesis.Queue {
+	client := kinesis.New(session.New())
+
+	// Records can't be deleted, so every run uses new stream.
+	stream := fmt.Sprintf("%s-%d", queueName(name), time.Now().Unix())
+	_, err := client.CreateStream(&kinesis.CreateStreamInput{
+		StreamName: aws.String(stream),
+		ShardCount: aws.Int64(2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.WaitUntilStreamExists(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(stream),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	opt.Redis = redisRing()
+	return azkinesis.NewQueue(client, stream, opt)
+}
+
+func TestKinesisProcessor(t *testing.T) {
+	testProcessor(t, kinesisQueue(t, "kinesis-processor", &msgqueue.Options{}))
+}
+
+func TestKinesisAddBatch(t *testing.T) {
+	testAddBatch(t, kinesisQueue(t, "kinesis-add-batch", &msgqueue.Options{}))
+}
+
+func TestKinesisDelay(t *testing.T) {
+	testDelay(t, kinesisQueue(t, "kinesis-delay", &msgqueue.Options{}))
+}
+
+func TestKinesisRetry(t *testing.T) {
+	testRetry(t, kinesisQueue(t, "kinesis-retry", &msgqueue.Options{}))
+}
+
+func TestKinesisNamedMessage(t *testing.T) {
+	testNamedMessage(t, kinesisQueue(t, "kinesis-named-message", &msgqueue.Options{}))
+}
+
+func TestKinesisCallOnce(t *testing.T) {
+	testCallOnce(t, kinesisQueue(t, "kinesis-call-once", &msgqueue.Options{}))
+}
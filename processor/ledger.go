@@ -0,0 +1,31 @@
+package processor
+
+import (
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// record adds the processing attempt to the ledger if it is configured.
+func (p *Processor) record(msg *msgqueue.Message, outcome string, err error, dur time.Duration) {
+	if p.opt.Ledger == nil {
+		return
+	}
+
+	entry := &msgqueue.LedgerEntry{
+		Queue:     p.q.Name(),
+		MessageId: msg.Id,
+		Name:      msg.Name,
+		Attempt:   msg.ReservedCount,
+		Outcome:   outcome,
+		Duration:  dur,
+		Worker:    workerId,
+		Time:      time.Now(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := p.opt.Ledger.Record(entry); err != nil {
+		p.warnf("%s Ledger.Record failed: %s", p.q, err)
+	}
+}
@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ManagedQueue is a queue with processor that can be managed
+// by Manager, e.g. azsqs.Queue, ironmq.Queue, or memqueue.Queue.
+type ManagedQueue interface {
+	Name() string
+	Processor() *Processor
+	CloseTimeout(timeout time.Duration) error
+}
+
+// Manager manages lifecycle of multiple queues and their processors.
+type Manager struct {
+	mu     sync.RWMutex
+	queues []ManagedQueue
+}
+
+// NewManager returns Manager that manages the queues.
+// It panics if queue names are not unique.
+func NewManager(queues ...ManagedQueue) *Manager {
+	m := new(Manager)
+	for _, q := range queues {
+		if err := m.Add(q); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// Add adds the queue to the manager. Queues with the same name
+// are not allowed.
+func (m *Manager) Add(q ManagedQueue) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, q0 := range m.queues {
+		if q0.Name() == q.Name() {
+			return fmt.Errorf("queue: %s is already managed", q.Name())
+		}
+	}
+	m.queues = append(m.queues, q)
+	return nil
+}
+
+// Queues returns managed queues in the order they were added.
+func (m *Manager) Queues() []ManagedQueue {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]ManagedQueue(nil), m.queues...)
+}
+
+// StartAll starts processors of all queues.
+func (m *Manager) StartAll() error {
+	for _, q := range m.Queues() {
+		if err := q.Processor().Start(); err != nil {
+			return fmt.Errorf("%s: %s", q.Name(), err)
+		}
+	}
+	return nil
+}
+
+// StopAll stops processors of all queues in parallel waiting
+// at most timeout. It returns the first error.
+func (m *Manager) StopAll(timeout time.Duration) error {
+	return m.forEach(func(q ManagedQueue) error {
+		return q.Processor().StopTimeout(timeout)
+	})
+}
+
+// CloseAll closes all queues in parallel waiting at most timeout.
+// It returns the first error.
+func (m *Manager) CloseAll(timeout time.Duration) error {
+	return m.forEach(func(q ManagedQueue) error {
+		return q.CloseTimeout(timeout)
+	})
+}
+
+func (m *Manager) forEach(fn func(q ManagedQueue) error) error {
+	queues := m.Queues()
+	errs := make([]error, len(queues))
+
+	var wg sync.WaitGroup
+	for i, q := range queues {
+		wg.Add(1)
+		go func(i int, q ManagedQueue) {
+			defer wg.Done()
+			errs[i] = fn(q)
+		}(i, q)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %s", queues[i].Name(), err)
+		}
+	}
+	return nil
+}
+
+// Stats returns processor stats of managed queues by queue name.
+func (m *Manager) Stats() map[string]*Stats {
+	queues := m.Queues()
+	stats := make(map[string]*Stats, len(queues))
+	for _, q := range queues {
+		stats[q.Name()] = q.Processor().Stats()
+	}
+	return stats
+}
+
+// TotalStats returns processor stats summed across managed queues.
+// AvgDuration and AvgPayloadSize are weighted by the number of
+// processed messages. Duration quantiles are the maximum across queues.
+// Paused is true only when all queues are paused.
+func (m *Manager) TotalStats() *Stats {
+	queues := m.Queues()
+	stats := make([]*Stats, len(queues))
+	for i, q := range queues {
+		stats[i] = q.Processor().Stats()
+	}
+	total := sumStats(stats)
+	return &total
+}
@@ -0,0 +1,45 @@
+package processor
+
+import (
+	"time"
+)
+
+// Interval at which gauges are sent to Options.Metrics.
+const metricsInterval = 10 * time.Second
+
+func (p *Processor) count(name string) {
+	if p.opt.Metrics != nil {
+		p.opt.Metrics.Count(p.q.Name(), name, 1)
+	}
+}
+
+func (p *Processor) timing(name string, dur time.Duration) {
+	if p.opt.Metrics != nil {
+		p.opt.Metrics.Timing(p.q.Name(), name, dur)
+	}
+}
+
+// metricsReporter periodically sends processor gauges to Options.Metrics.
+func (p *Processor) metricsReporter() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		p.sendGauges()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Processor) sendGauges() {
+	st := p.Stats()
+	name := p.q.Name()
+	p.opt.Metrics.Gauge(name, "buffered", float64(st.Buffered))
+	p.opt.Metrics.Gauge(name, "in_flight", float64(st.InFlight))
+	p.opt.Metrics.Gauge(name, "delayed", float64(st.Delayed))
+}
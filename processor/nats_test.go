@@ -0,0 +1,72 @@
+package processor_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/natsjs"
+
+	"github.com/nats-io/nats.go"
+)
+
+const natsStream = "msgqueue-test"
+
+func natsQueue(t *testing.T, name string, opt *msgqueue.Options) *natsjs.Queue {
+	nc, err := nats.Connect(nats.DefaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     natsStream + "-" + opt.Name,
+		Subjects: []string{opt.Name},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return natsjs.NewQueue(js, natsStream+"-"+opt.Name, opt)
+}
+
+func TestNATSProcessor(t *testing.T) {
+	testProcessor(t, natsQueue(t, "nats-processor", &msgqueue.Options{}))
+}
+
+func TestNATSAddBatch(t *testing.T) {
+	testAddBatch(t, natsQueue(t, "nats-add-batch", &msgqueue.Options{}))
+}
+
+func TestNATSDelay(t *testing.T) {
+	testDelay(t, natsQueue(t, "nats-delay", &msgqueue.Options{}))
+}
+
+func TestNATSRetry(t *testing.T) {
+	testRetry(t, natsQueue(t, "nats-retry", &msgqueue.Options{}))
+}
+
+func TestNATSNamedMessage(t *testing.T) {
+	testNamedMessage(t, natsQueue(t, "nats-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestNATSCallOnce(t *testing.T) {
+	testCallOnce(t, natsQueue(t, "nats-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestNATSDelayer(t *testing.T) {
+	testDelayer(t, natsQueue(t, "nats-delayer", &msgqueue.Options{}))
+}
+
+func TestNATSTouch(t *testing.T) {
+	testTouch(t, natsQueue(t, "nats-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
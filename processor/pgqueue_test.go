@@ -0,0 +1,67 @@
+package processor_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/pgqueue"
+)
+
+func pgDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("postgres", "postgres://postgres@localhost/postgres?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func pgQueue(t *testing.T, name string, opt *msgqueue.Options) *pgqueue.Queue {
+	opt.Name = queueName(name)
+	q := pgqueue.NewQueue(pgDB(t), opt)
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestPostgresProcessor(t *testing.T) {
+	testProcessor(t, pgQueue(t, "postgres-processor", &msgqueue.Options{}))
+}
+
+func TestPostgresAddBatch(t *testing.T) {
+	testAddBatch(t, pgQueue(t, "postgres-add-batch", &msgqueue.Options{}))
+}
+
+func TestPostgresDelay(t *testing.T) {
+	testDelay(t, pgQueue(t, "postgres-delay", &msgqueue.Options{}))
+}
+
+func TestPostgresRetry(t *testing.T) {
+	testRetry(t, pgQueue(t, "postgres-retry", &msgqueue.Options{}))
+}
+
+func TestPostgresNamedMessage(t *testing.T) {
+	testNamedMessage(t, pgQueue(t, "postgres-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestPostgresCallOnce(t *testing.T) {
+	testCallOnce(t, pgQueue(t, "postgres-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestPostgresDelayer(t *testing.T) {
+	testDelayer(t, pgQueue(t, "postgres-delayer", &msgqueue.Options{}))
+}
+
+func TestPostgresTouch(t *testing.T) {
+	testTouch(t, pgQueue(t, "postgres-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
@@ -0,0 +1,53 @@
+package processor
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Interval at which rate limited workers check for buffered
+// messages with higher priority.
+const inversionCheckInterval = 100 * time.Millisecond
+
+// inverted reports whether messages with higher priority than the rate
+// limited message are buffered. Inversions are counted and logged
+// according to Options.PriorityInversion.
+func (p *Processor) inverted(msg *msgqueue.Message) bool {
+	var higher bool
+	for i := p.lane(msg) + 1; i < len(p.lanes); i++ {
+		if len(p.lanes[i]) > 0 {
+			higher = true
+			break
+		}
+	}
+	if !higher {
+		return false
+	}
+
+	atomic.AddUint64(&p.inversions, 1)
+	if p.opt.PriorityInversion == msgqueue.InversionAlert {
+		p.warnf("%s rate limited %s delays messages with higher priority", p.q, msg)
+	}
+	return true
+}
+
+// reorder returns the rate limited message to the buffer, so the worker
+// takes message with higher priority. It reports whether the message is
+// returned. Messages with GroupKey and barriers keep their order.
+func (p *Processor) reorder(msg *msgqueue.Message, t gateTicket) bool {
+	if p.opt.PriorityInversion != msgqueue.InversionReorder ||
+		msg.GroupKey != "" || msg.Barrier {
+		return false
+	}
+
+	select {
+	case p.lanes[p.lane(msg)] <- msg:
+	default:
+		return false
+	}
+	p.ungate(t)
+	p.ready <- struct{}{}
+	return true
+}
@@ -1,63 +1,219 @@
 package processor
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/go-msgqueue/msgqueue"
 	"github.com/go-msgqueue/msgqueue/internal"
+
+	timerate "golang.org/x/time/rate"
 )
 
 const consumerBackoff = time.Second
+const maxConsumerBackoff = time.Minute
+const reconnectThreshold = 3
 const maxBackoff = 12 * time.Hour
 const stopTimeout = 30 * time.Second
 
-var ErrNotSupported = errors.New("processor: not supported")
+// Precision of delayed messages.
+const delayTick = time.Millisecond
+
+// workerId identifies the process that handles messages,
+// e.g. in the Ledger and fleet stats.
+var workerId = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}()
+
+var errNamePaused = errors.New("message name is paused")
+
+// ErrNotSupported is an alias for msgqueue.ErrNotSupported.
+var ErrNotSupported = msgqueue.ErrNotSupported
 
 type Delayer interface {
 	Delay() time.Duration
 }
 
+// Unretryable is implemented by errors that fail message permanently
+// without retries, e.g. errors returned by msgqueue.Unretryable.
+type Unretryable interface {
+	Unretryable() bool
+}
+
+// Requeuer is implemented by errors that release message back to
+// the queue without counting it as failure, e.g. msgqueue.ErrRequeue.
+type Requeuer interface {
+	Requeue() bool
+}
+
+// Reconnecter is implemented by queues that cache connection details
+// (e.g. resolved queue URL) and can reset them when fetching fails
+// persistently.
+type Reconnecter interface {
+	Reconnect() error
+}
+
+// Lener is implemented by queues that can report approximate number
+// of messages waiting in the backend. It is used by the autoscaler.
+type Lener interface {
+	Len() (int, error)
+}
+
 type Stats struct {
+	Buffered    uint32
 	InFlight    uint32
+	Delayed     uint32
 	Deleting    uint32
-	Processed   uint32
-	Retries     uint32
-	Fails       uint32
+	Processed   uint64
+	Retries     uint64
+	Requeued    uint64
+	Fails       uint64
+	Panics      uint64
+	Timeouts    uint64
 	AvgDuration time.Duration
+
+	// Number of handlers that still run after HandlerTimeout.
+	Abandoned uint32
+
+	// Processing duration quantiles since the processor is created
+	// or stats are reset. They are precise to about 12%.
+	P50Duration time.Duration
+	P95Duration time.Duration
+	P99Duration time.Duration
+
+	// Approximate clock skew between this consumer and the host that
+	// timestamps messages, i.e. SQS or IronMQ producer. Positive skew
+	// means that consumer clock is ahead. It includes the minimum queue
+	// latency and is only meaningful when queue is not backlogged.
+	ClockSkew time.Duration
+
+	// Number of messages moved to DeadLetterQueue.
+	DeadLettered uint64
+	// Number of messages expired because of Options.MaxAge.
+	Expired uint64
+	// Number of messages deleted because message with the same
+	// Options.CoalesceKey was processed at the same time.
+	Coalesced uint64
+	// Number of messages deleted because of Options.Filter.
+	Filtered uint64
+	// Number of rate limited messages that delayed messages with higher
+	// priority. See Options.PriorityInversion.
+	Inversions uint64
+
+	Paused bool
+
+	// Encoded message body sizes in bytes. Messages without
+	// encoded body, e.g. memqueue messages, are not counted.
+	MinPayloadSize uint32
+	AvgPayloadSize uint32
+	MaxPayloadSize uint32
 }
 
 // Processor reserves messages from the queue, processes them,
 // and then either releases or deletes messages from the queue.
 type Processor struct {
+	// 64-bit counters are accessed atomically and must be
+	// the first fields to be 64-bit aligned on 32-bit platforms.
+	processed    uint64
+	fails        uint64
+	retries      uint64
+	requeued     uint64
+	panics       uint64
+	timeouts     uint64
+	deadLettered uint64
+	expired      uint64
+	coalesced    uint64
+	filtered     uint64
+	inversions   uint64
+	durations    histogram
+	statsSince   int64 // unix nanoseconds
+	inFlightSeq  uint64
+	allocSeq     uint64
+
 	q   Queuer
 	opt *msgqueue.Options
 
 	handler         msgqueue.Handler
 	fallbackHandler msgqueue.Handler
 
-	ch chan *msgqueue.Message
-	wg sync.WaitGroup
+	// Buffered messages indexed by priority. Every buffered message
+	// has a token in ready, so workers can wait for a message in any
+	// lane and then take the message with the highest priority.
+	lanes []chan *msgqueue.Message
+	ready chan struct{}
+	wg    sync.WaitGroup
 
 	delBatch *internal.Batcher
+	delays   *internal.TimerWheel
+
+	expireLimiter *timerate.Limiter
+	skew          skewEstimator
 
 	_started uint32
 	stop     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	workersMu    sync.Mutex
+	workerNumber int
+	workers      []chan struct{} // quit channels of running workers
+
+	limitsMu sync.Mutex
+	limits   map[limitKey]*keyLimit
+	parked   chan struct{} // slots of messages waiting for their key
+
+	coalesceMu sync.Mutex
+	coalescing map[string]*coalesceGroup
+
+	// Messages dequeued by workers hold a gate ticket until they are
+	// processed. gateMu makes dequeuing and taking the ticket atomic,
+	// but tickets are waited for without holding it.
+	gateMu      sync.Mutex
+	gateReaders *sync.WaitGroup // messages dequeued after the last barrier
+	gateBarrier chan struct{}   // closed when the last barrier is processed
+
+	chaos chaosStats
+
+	allocsMu sync.Mutex
+	allocs   map[string]*AllocStats
+
+	inFlightMu   sync.Mutex
+	inFlightMsgs map[*msgqueue.Message]*InFlightMessage
+
+	fetchErrMu sync.Mutex
+	fetchErr   error // set when fetching fails persistently
+
+	eventsMu sync.Mutex
+	events   chan Event
+
+	abortMu  sync.Mutex
+	abortErr error // reason passed to Abort
+
+	pauseMu     sync.Mutex
+	resumeCh    chan struct{} // non-nil when processor is paused
+	pausedNames map[string]struct{}
 
 	errCount   uint32
 	delayCount uint32
 	delaySec   uint32
 
 	inFlight    uint32
+	delayed     uint32
 	deleting    uint32
-	processed   uint32
-	fails       uint32
-	retries     uint32
+	abandoned   uint32
 	avgDuration uint32
+
+	minPayloadSize uint32
+	avgPayloadSize uint32
+	maxPayloadSize uint32
 }
 
 // New creates new Processor for the queue using provided processing options.
@@ -67,7 +223,25 @@ func New(q Queuer, opt *msgqueue.Options) *Processor {
 		q:   q,
 		opt: opt,
 
-		ch: make(chan *msgqueue.Message, opt.BufferSize),
+		lanes: make([]chan *msgqueue.Message, opt.PriorityLanes),
+		ready: make(chan struct{}, opt.PriorityLanes*opt.BufferSize),
+
+		workerNumber: opt.WorkerNumber,
+
+		limits:     make(map[limitKey]*keyLimit),
+		parked:     make(chan struct{}, opt.BufferSize),
+		coalescing: make(map[string]*coalesceGroup),
+
+		gateReaders: new(sync.WaitGroup),
+
+		inFlightMsgs: make(map[*msgqueue.Message]*InFlightMessage),
+		allocs:       make(map[string]*AllocStats),
+
+		statsSince: time.Now().UnixNano(),
+	}
+
+	for i := range p.lanes {
+		p.lanes[i] = make(chan *msgqueue.Message, opt.BufferSize)
 	}
 
 	p.setHandler(opt.Handler)
@@ -75,7 +249,16 @@ func New(q Queuer, opt *msgqueue.Options) *Processor {
 		p.setFallbackHandler(opt.FallbackHandler)
 	}
 
-	p.delBatch = internal.NewBatcher(p.opt.ScavengerNumber, p.deleteBatch)
+	p.delBatch = internal.NewBatcher(p.opt.ScavengerNumber, p.opt.DeleteLinger, p.deleteBatch)
+	p.delays = internal.NewTimerWheel(delayTick)
+
+	if opt.MaxAge > 0 && opt.ExpireRateLimit != timerate.Inf {
+		p.expireLimiter = timerate.NewLimiter(opt.ExpireRateLimit, 1)
+	}
+
+	if opt.Expvar {
+		p.publishExpvar()
+	}
 
 	return p
 }
@@ -90,28 +273,107 @@ func Start(q Queuer, opt *msgqueue.Options) *Processor {
 func (p *Processor) String() string {
 	return fmt.Sprintf(
 		"Processor<%s workers=%d scavengers=%d buffer=%d>",
-		p.q.Name(), p.opt.WorkerNumber, p.opt.ScavengerNumber, p.opt.BufferSize,
+		p.q.Name(), p.WorkerNumber(), p.opt.ScavengerNumber, p.opt.BufferSize,
 	)
 }
 
+func (p *Processor) debugf(format string, args ...interface{}) {
+	p.opt.Logf(msgqueue.LogDebug, format, args...)
+}
+
+func (p *Processor) infof(format string, args ...interface{}) {
+	p.opt.Logf(msgqueue.LogInfo, format, args...)
+}
+
+func (p *Processor) warnf(format string, args ...interface{}) {
+	p.opt.Logf(msgqueue.LogWarn, format, args...)
+}
+
+func (p *Processor) errorf(format string, args ...interface{}) {
+	p.opt.Logf(msgqueue.LogError, format, args...)
+}
+
+// retryf logs failure of the message that will be retried.
+func (p *Processor) retryf(format string, args ...interface{}) {
+	if p.opt.QuietRetries {
+		p.debugf(format, args...)
+	} else {
+		p.warnf(format, args...)
+	}
+}
+
+// ResetStats resets counters and averages reported by Stats.
+// Buffered, InFlight, Delayed, and Deleting are not reset.
+func (p *Processor) ResetStats() {
+	for _, counter := range []*uint64{
+		&p.processed, &p.fails, &p.retries, &p.requeued, &p.panics,
+		&p.timeouts, &p.deadLettered, &p.expired, &p.coalesced, &p.filtered,
+		&p.inversions,
+	} {
+		atomic.StoreUint64(counter, 0)
+	}
+	p.durations.Reset()
+	for _, avg := range []*uint32{
+		&p.avgDuration, &p.minPayloadSize, &p.avgPayloadSize, &p.maxPayloadSize,
+	} {
+		atomic.StoreUint32(avg, 0)
+	}
+	p.resetAllocStats()
+	atomic.StoreInt64(&p.statsSince, time.Now().UnixNano())
+}
+
+// DurationBuckets returns the number of messages processed within each
+// of the sorted bounds, total number of processed messages, and total
+// processing duration, e.g. to export a histogram. Counts are precise
+// to about 12% of the bound.
+func (p *Processor) DurationBuckets(bounds []time.Duration) ([]uint64, uint64, time.Duration) {
+	return p.durations.Buckets(bounds)
+}
+
 // Stats returns processor stats.
 func (p *Processor) Stats() *Stats {
+	qs := p.durations.Quantiles(0.5, 0.95, 0.99)
 	return &Stats{
+		Buffered:    uint32(len(p.ready)),
 		InFlight:    atomic.LoadUint32(&p.inFlight),
+		Delayed:     atomic.LoadUint32(&p.delayed),
 		Deleting:    atomic.LoadUint32(&p.deleting),
-		Processed:   atomic.LoadUint32(&p.processed),
-		Retries:     atomic.LoadUint32(&p.retries),
-		Fails:       atomic.LoadUint32(&p.fails),
+		Processed:   atomic.LoadUint64(&p.processed),
+		Retries:     atomic.LoadUint64(&p.retries),
+		Requeued:    atomic.LoadUint64(&p.requeued),
+		Fails:       atomic.LoadUint64(&p.fails),
+		Panics:      atomic.LoadUint64(&p.panics),
+		Timeouts:    atomic.LoadUint64(&p.timeouts),
 		AvgDuration: time.Duration(atomic.LoadUint32(&p.avgDuration)) * time.Millisecond,
+		Abandoned:   atomic.LoadUint32(&p.abandoned),
+
+		P50Duration: qs[0],
+		P95Duration: qs[1],
+		P99Duration: qs[2],
+
+		ClockSkew: p.skew.Skew(),
+
+		DeadLettered: atomic.LoadUint64(&p.deadLettered),
+		Expired:      atomic.LoadUint64(&p.expired),
+		Coalesced:    atomic.LoadUint64(&p.coalesced),
+		Filtered:     atomic.LoadUint64(&p.filtered),
+		Inversions:   atomic.LoadUint64(&p.inversions),
+
+		Paused: p.Paused(),
+
+		MinPayloadSize: atomic.LoadUint32(&p.minPayloadSize),
+		AvgPayloadSize: atomic.LoadUint32(&p.avgPayloadSize),
+		MaxPayloadSize: atomic.LoadUint32(&p.maxPayloadSize),
 	}
 }
 
 func (p *Processor) setHandler(handler interface{}) {
-	p.handler = msgqueue.NewHandler(handler)
+	h := msgqueue.NewCodecHandler(handler, p.opt.Codec)
+	p.handler = msgqueue.Chain(h, p.opt.Middleware...)
 }
 
 func (p *Processor) setFallbackHandler(handler interface{}) {
-	p.fallbackHandler = msgqueue.NewHandler(handler)
+	p.fallbackHandler = msgqueue.NewCodecHandler(handler, p.opt.Codec)
 }
 
 // Add adds message to the processor internal queue.
@@ -120,6 +382,16 @@ func (p *Processor) Add(msg *msgqueue.Message) error {
 	return nil
 }
 
+// AddReleased adds the released message back to the processor internal
+// queue. Unlike Add it does not block when the buffer is full, because
+// messages are released by workers that hold messages dequeued before
+// barriers; such messages are added by a goroutine.
+func (p *Processor) AddReleased(msg *msgqueue.Message) error {
+	atomic.AddUint32(&p.inFlight, 1)
+	p.enqueueAsync(msg)
+	return nil
+}
+
 // Add adds message to the processor internal queue with specified delay.
 func (p *Processor) AddDelay(msg *msgqueue.Message, delay time.Duration) error {
 	if delay == 0 {
@@ -127,8 +399,12 @@ func (p *Processor) AddDelay(msg *msgqueue.Message, delay time.Duration) error {
 	}
 
 	atomic.AddUint32(&p.inFlight, 1)
-	time.AfterFunc(delay, func() {
-		p.ch <- msg
+	atomic.AddUint32(&p.delayed, 1)
+	// Timer wheel calls due functions one by one, so the message
+	// is enqueued without blocking other delayed messages.
+	p.delays.AfterFunc(delay, func() {
+		atomic.AddUint32(&p.delayed, ^uint32(0))
+		p.enqueueAsync(msg)
 	})
 	return nil
 }
@@ -142,39 +418,125 @@ func (p *Processor) Start() error {
 	p.wg.Add(1)
 	go p.messageFetcher()
 
+	if p.opt.MaxWorkers > 0 {
+		p.wg.Add(1)
+		go p.autoscaler()
+	}
+
+	if redis, ok := p.opt.Redis.(msgqueue.RedisCmdable); ok && p.opt.StatsReportInterval > 0 {
+		p.wg.Add(1)
+		go p.statsReporter(redis)
+	}
+
+	if p.opt.Metrics != nil {
+		p.wg.Add(1)
+		go p.metricsReporter()
+	}
+
+	if p.opt.Chaos != nil {
+		p.wg.Add(1)
+		go p.chaosRunner()
+	}
+
+	p.infof("%s started", p)
+
+	if p.opt.OnStart != nil {
+		p.opt.OnStart()
+	}
+
 	return nil
 }
 
 func (p *Processor) startWorkers() bool {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
 	if !atomic.CompareAndSwapUint32(&p._started, 0, 1) {
 		return false
 	}
 
+	p.resetAbort()
+	p.setFetchErr(nil)
 	p.stop = make(chan struct{})
-	p.wg.Add(p.opt.WorkerNumber)
-	for i := 0; i < p.opt.WorkerNumber; i++ {
-		go p.worker()
-	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.addWorkers(p.workerNumber)
 	return true
 }
 
+func (p *Processor) addWorkers(n int) {
+	p.wg.Add(n)
+	for i := 0; i < n; i++ {
+		quit := make(chan struct{})
+		p.workers = append(p.workers, quit)
+		go p.worker(p.ctx, quit)
+	}
+}
+
+// WorkerNumber returns the number of workers processing messages.
+func (p *Processor) WorkerNumber() int {
+	p.workersMu.Lock()
+	n := p.workerNumber
+	p.workersMu.Unlock()
+	return n
+}
+
+// SetWorkerNumber changes the number of workers without stopping
+// the processor. Extra workers finish processing current messages
+// before exiting. BufferSize is not changed.
+func (p *Processor) SetWorkerNumber(n int) error {
+	if n < 1 {
+		return fmt.Errorf("queue: WorkerNumber=%d is not positive", n)
+	}
+
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	p.workerNumber = n
+	if p.stopped() {
+		return nil
+	}
+
+	if d := n - len(p.workers); d > 0 {
+		p.addWorkers(d)
+	} else {
+		for _, quit := range p.workers[n:] {
+			close(quit)
+		}
+		p.workers = p.workers[:n]
+	}
+	return nil
+}
+
 // Stop is StopTimeout with 30 seconds timeout.
 func (p *Processor) Stop() error {
 	return p.StopTimeout(stopTimeout)
 }
 
 // StopTimeout waits workers for timeout duration to finish processing current
-// messages and stops workers.
+// messages and stops workers. Context passed to handlers is cancelled
+// after buffered messages are processed or when the timeout expires,
+// so long-running handlers can observe shutdown.
 func (p *Processor) StopTimeout(timeout time.Duration) error {
-	return p.stopWorkersTimeout(timeout)
+	return p.stopWorkersTimeout(timeout, false)
 }
 
-func (p *Processor) stopWorkersTimeout(timeout time.Duration) error {
+// stopWorkersTimeout stops workers and cancels handler context after
+// workers exit or the timeout expires. When cancelNow is set, context is
+// cancelled immediately, so running handlers are interrupted.
+func (p *Processor) stopWorkersTimeout(timeout time.Duration, cancelNow bool) error {
+	p.workersMu.Lock()
 	if !atomic.CompareAndSwapUint32(&p._started, 1, 0) {
+		p.workersMu.Unlock()
 		return nil
 	}
+	p.workers = nil
+	p.workersMu.Unlock()
 
 	close(p.stop)
+	cancel := p.cancel
+	if cancelNow {
+		cancel()
+	}
 
 	stopped := make(chan struct{})
 	go func() {
@@ -182,10 +544,17 @@ func (p *Processor) stopWorkersTimeout(timeout time.Duration) error {
 		close(stopped)
 	}()
 
+	if p.opt.OnStop != nil {
+		defer p.opt.OnStop()
+	}
+
 	select {
 	case <-time.After(timeout):
+		cancel()
 		return fmt.Errorf("workers did not stop after %s", timeout)
 	case <-stopped:
+		cancel()
+		p.infof("%s stopped", p.q)
 		return p.delBatch.Wait()
 	}
 }
@@ -194,6 +563,108 @@ func (p *Processor) stopped() bool {
 	return atomic.LoadUint32(&p._started) == 0
 }
 
+// Pause stops fetching and processing messages without stopping workers.
+// Buffered messages are kept and processed after Resume. Messages that
+// are being processed are not interrupted.
+func (p *Processor) Pause() {
+	p.pauseMu.Lock()
+	paused := p.resumeCh == nil
+	if paused {
+		p.resumeCh = make(chan struct{})
+	}
+	p.pauseMu.Unlock()
+
+	if paused {
+		p.emit(EventPaused, nil, nil, 0)
+	}
+}
+
+// Resume resumes processing paused by Pause.
+func (p *Processor) Resume() {
+	p.pauseMu.Lock()
+	resumed := p.resumeCh != nil
+	if resumed {
+		close(p.resumeCh)
+		p.resumeCh = nil
+	}
+	p.pauseMu.Unlock()
+
+	if resumed {
+		p.emit(EventResumed, nil, nil, 0)
+	}
+}
+
+// Paused reports whether processor is paused by Pause.
+func (p *Processor) Paused() bool {
+	p.pauseMu.Lock()
+	paused := p.resumeCh != nil
+	p.pauseMu.Unlock()
+	return paused
+}
+
+// PauseName pauses processing of messages with the task name returned
+// by Options.PauseKey, which defaults to msgqueue.TaskHeader. Workers
+// release such messages with MinBackoff delay without processing them
+// and without counting the release as a retry.
+func (p *Processor) PauseName(name string) {
+	p.pauseMu.Lock()
+	if p.pausedNames == nil {
+		p.pausedNames = make(map[string]struct{})
+	}
+	p.pausedNames[name] = struct{}{}
+	p.pauseMu.Unlock()
+}
+
+// ResumeName resumes processing of messages paused by PauseName.
+func (p *Processor) ResumeName(name string) {
+	p.pauseMu.Lock()
+	delete(p.pausedNames, name)
+	p.pauseMu.Unlock()
+}
+
+// PausedNames returns names of messages paused by PauseName.
+func (p *Processor) PausedNames() []string {
+	p.pauseMu.Lock()
+	names := make([]string, 0, len(p.pausedNames))
+	for name := range p.pausedNames {
+		names = append(names, name)
+	}
+	p.pauseMu.Unlock()
+	return names
+}
+
+func (p *Processor) namePaused(msg *msgqueue.Message) bool {
+	var name string
+	if p.opt.PauseKey != nil {
+		name = p.opt.PauseKey(msg)
+	} else {
+		name = msg.Header[msgqueue.TaskHeader]
+	}
+	if name == "" {
+		return false
+	}
+	p.pauseMu.Lock()
+	_, ok := p.pausedNames[name]
+	p.pauseMu.Unlock()
+	return ok
+}
+
+// waitResume blocks while processor is paused. Stopping the processor
+// overrides the pause so buffered messages can be drained.
+func (p *Processor) waitResume() {
+	p.pauseMu.Lock()
+	ch := p.resumeCh
+	p.pauseMu.Unlock()
+	if ch == nil {
+		return
+	}
+
+	select {
+	case <-ch:
+	case <-p.stop:
+	}
+}
+
 func (p *Processor) paused() time.Duration {
 	const threshold = 100
 
@@ -234,15 +705,28 @@ func (p *Processor) ProcessAll() error {
 			time.Sleep(100 * time.Millisecond)
 		}
 	}
-	return p.stopWorkersTimeout(stopTimeout)
+	return p.stopWorkersTimeout(stopTimeout, false)
 }
 
 // ProcessOne processes at most one message in the queue.
+// It returns msgqueue.ErrQueueEmpty when there are no messages and
+// msgqueue.ErrRateLimited when message is not processed because of
+// the rate limit. Rate limited message is released back to the queue
+// with the rate limit delay without counting a retry.
 func (p *Processor) ProcessOne() error {
 	msg, err := p.reserveOne()
 	if err != nil {
 		return err
 	}
+
+	if limit := p.opt.RateLimitAt(time.Now()); p.opt.RateLimiter != nil && limit != timerate.Inf {
+		delay, allow := p.opt.RateLimiter.AllowRate(p.rateLimitKey(msg), limit)
+		if !allow {
+			p.releaseRateLimited(msg, delay)
+			return msgqueue.ErrRateLimited
+		}
+	}
+
 	retErr := p.Process(msg)
 	if err := p.delBatch.Wait(); err != nil && retErr == nil {
 		retErr = err
@@ -250,34 +734,50 @@ func (p *Processor) ProcessOne() error {
 	return retErr
 }
 
+func (p *Processor) releaseRateLimited(msg *msgqueue.Message, delay time.Duration) {
+	// Release increments ReservedCount of memqueue messages.
+	msg.ReservedCount--
+	if err := p.releaseMessage(msg, delay); err != nil {
+		p.errorf("%s Release failed: %s", p.q, err)
+	}
+	atomic.AddUint32(&p.inFlight, ^uint32(0))
+}
+
 func (p *Processor) reserveOne() (*msgqueue.Message, error) {
 	select {
-	case msg := <-p.ch:
-		return msg, nil
+	case <-p.ready:
+		return p.takeMessage(), nil
 	default:
 	}
 
-	msgs, err := p.q.ReserveN(1)
+	msgs, err := p.reserveN(1)
 	if err != nil && err != ErrNotSupported {
 		return nil, err
 	}
 	if len(msgs) == 0 {
-		return nil, errors.New("queue is empty")
+		return nil, msgqueue.ErrQueueEmpty
 	}
 	atomic.AddUint32(&p.inFlight, 1)
+	p.skew.Observe(&msgs[0])
 	return &msgs[0], nil
 }
 
 func (p *Processor) messageFetcher() {
 	defer p.wg.Done()
+	var errCount int
 	for {
 		if p.stopped() {
 			break
 		}
 
+		p.waitResume()
+		if p.stopped() {
+			break
+		}
+
 		if pauseTime := p.paused(); pauseTime > 0 {
 			p.resetPause()
-			log.Printf("%s is automatically paused for %s", p.q, pauseTime)
+			p.warnf("%s is automatically paused for %s", p.q, pauseTime)
 			time.Sleep(pauseTime)
 			continue
 		}
@@ -288,43 +788,269 @@ func (p *Processor) messageFetcher() {
 				break
 			}
 
-			log.Printf("%s ReserveN failed: %s (sleeping for %s)", p.q, err, consumerBackoff)
-			time.Sleep(consumerBackoff)
+			errCount++
+			if errCount >= reconnectThreshold {
+				if errCount == reconnectThreshold {
+					p.setConnected(false)
+				}
+				p.setFetchErr(err)
+				p.reconnect()
+			}
+
+			backoff := exponentialBackoff(consumerBackoff, errCount)
+			if backoff > maxConsumerBackoff {
+				backoff = maxConsumerBackoff
+			}
+			p.errorf("%s ReserveN failed: %s (sleeping for %s)", p.q, err, backoff)
+			time.Sleep(backoff)
 			continue
 		}
+
+		if errCount >= reconnectThreshold {
+			p.setConnected(true)
+			p.setFetchErr(nil)
+		}
+		errCount = 0
+	}
+}
+
+func (p *Processor) reconnect() {
+	r, ok := p.q.(Reconnecter)
+	if !ok {
+		return
+	}
+	if err := r.Reconnect(); err != nil {
+		p.errorf("%s Reconnect failed: %s", p.q, err)
+	}
+}
+
+func (p *Processor) setConnected(connected bool) {
+	if connected {
+		p.infof("%s is connected", p.q)
+	} else {
+		p.warnf("%s is disconnected", p.q)
+	}
+	if p.opt.ConnStateHandler != nil {
+		p.opt.ConnStateHandler(p.q.Name(), connected)
 	}
 }
 
 func (p *Processor) fetchMessages() (int, error) {
-	msgs, err := p.q.ReserveN(p.opt.BufferSize)
+	// Messages parked by dispatch count against the buffer.
+	n := p.opt.BufferSize - len(p.parked)
+	if n < 1 {
+		n = 1
+	}
+	msgs, err := p.reserveN(n)
 	if err != nil {
 		return 0, err
 	}
+	if len(msgs) > 0 {
+		p.debugf("%s reserved %d messages", p.q, len(msgs))
+	}
 	for i := range msgs {
+		p.skew.Observe(&msgs[i])
 		p.queueMessage(&msgs[i])
 	}
 	return len(msgs), nil
 }
 
-func (p *Processor) worker() {
+func (p *Processor) worker(ctx context.Context, quit <-chan struct{}) {
 	defer p.wg.Done()
+
+	if p.opt.WorkerInit != nil {
+		var ok bool
+		ctx, ok = p.initWorker(ctx, quit)
+		if !ok {
+			return
+		}
+	}
+	if p.opt.WorkerShutdown != nil {
+		defer p.opt.WorkerShutdown(ctx)
+	}
+
 	for {
-		msg, ok := p.dequeueMessage()
+		msg, t, ok := p.dequeueMessage(quit)
 		if !ok {
 			break
 		}
 
-		if p.opt.RateLimiter != nil {
-			for {
-				delay, allow := p.opt.RateLimiter.AllowRate(p.q.Name(), p.opt.RateLimit)
-				if allow {
-					break
-				}
-				time.Sleep(delay)
-			}
+		// Message dequeued before Pause is held until Resume.
+		p.waitResume()
+
+		if p.opt.RateLimiter != nil && !p.waitRateLimit(msg, t) {
+			// Message is returned to the buffer.
+			continue
 		}
 
+		p.dispatch(ctx, msg, t)
+	}
+}
+
+type limitKey struct {
+	group bool
+	key   string
+}
+
+type keyLimit struct {
+	running int
+	waiting []parkedMessage
+}
+
+type parkedMessage struct {
+	msg           *msgqueue.Message
+	ticket        gateTicket
+	stopHeartbeat func()
+}
+
+// dispatchLimit returns the key and the number of messages with that key
+// that can be processed at the same time. Messages with GroupKey are
+// processed sequentially and are not subject to ConcurrencyLimits.
+func (p *Processor) dispatchLimit(msg *msgqueue.Message) (limitKey, int) {
+	if msg.GroupKey != "" {
+		return limitKey{group: true, key: msg.GroupKey}, 1
+	}
+	if p.opt.ConcurrencyKey != nil {
+		key := p.opt.ConcurrencyKey(msg)
+		return limitKey{key: key}, p.opt.ConcurrencyLimits[key]
+	}
+	return limitKey{}, 0
+}
+
+// dispatch processes the message respecting GroupKey and ConcurrencyLimits.
+// When the limit for the message key is reached, the message is handed over
+// to the worker that processes message with the same key, so workers are
+// not blocked by messages that can't be processed yet. Parked messages are
+// heartbeated and take buffer slots, so at most BufferSize messages are
+// parked and the fetcher reserves fewer messages while they wait.
+func (p *Processor) dispatch(ctx context.Context, msg *msgqueue.Message, t gateTicket) {
+	if p.namePaused(msg) {
+		p.requeue(msg, errNamePaused)
+		p.ungate(t)
+		return
+	}
+
+	key, limit := p.dispatchLimit(msg)
+	if limit == 0 {
+		msg.SetContext(ctx)
+		p.Process(msg)
+		p.ungate(t)
+		return
+	}
+
+	// The slot is taken before the lock, because the worker waits
+	// for it when too many messages are parked.
+	p.parked <- struct{}{}
+
+	p.limitsMu.Lock()
+	l, ok := p.limits[key]
+	if !ok {
+		l = new(keyLimit)
+		p.limits[key] = l
+	}
+	if l.running >= limit {
+		l.waiting = append(l.waiting, parkedMessage{
+			msg:           msg,
+			ticket:        t,
+			stopHeartbeat: p.heartbeat(msg),
+		})
+		p.limitsMu.Unlock()
+		return
+	}
+	l.running++
+	p.limitsMu.Unlock()
+	<-p.parked
+
+	for msg != nil {
+		msg.SetContext(ctx)
 		p.Process(msg)
+		p.ungate(t)
+
+		var parked parkedMessage
+		p.limitsMu.Lock()
+		if len(l.waiting) > 0 {
+			parked = l.waiting[0]
+			l.waiting[0] = parkedMessage{}
+			l.waiting = l.waiting[1:]
+		} else {
+			l.running--
+			if l.running == 0 {
+				delete(p.limits, key)
+			}
+		}
+		p.limitsMu.Unlock()
+
+		msg, t = parked.msg, parked.ticket
+		if msg != nil {
+			parked.stopHeartbeat()
+			<-p.parked
+		}
+	}
+}
+
+// initWorker calls WorkerInit until it succeeds or worker is stopped.
+func (p *Processor) initWorker(ctx context.Context, quit <-chan struct{}) (context.Context, bool) {
+	backoff := consumerBackoff
+	for {
+		workerCtx, err := p.opt.WorkerInit(ctx)
+		if err == nil {
+			return workerCtx, true
+		}
+
+		p.errorf("%s WorkerInit failed: %s (retrying in %s)", p.q, err, backoff)
+		select {
+		case <-p.stop:
+			return nil, false
+		case <-quit:
+			return nil, false
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxConsumerBackoff {
+			backoff = maxConsumerBackoff
+		}
+	}
+}
+
+func (p *Processor) rateLimitKey(msg *msgqueue.Message) string {
+	if p.opt.RateLimitKey != nil {
+		if key := p.opt.RateLimitKey(msg); key != "" {
+			return p.q.Name() + ":" + key
+		}
+	}
+	return p.q.Name()
+}
+
+// waitRateLimit waits until the message is allowed by the rate limit.
+// It reports false if the message is returned to the buffer because
+// of Options.PriorityInversion.
+func (p *Processor) waitRateLimit(msg *msgqueue.Message, t gateTicket) bool {
+	key := p.rateLimitKey(msg)
+	var inverted bool
+	for {
+		// Limit is evaluated on every attempt so schedule changes
+		// apply to messages that are already waiting.
+		limit := p.opt.RateLimitAt(time.Now())
+		if limit == timerate.Inf {
+			return true
+		}
+		delay, allow := p.opt.RateLimiter.AllowRate(key, limit)
+		if allow {
+			return true
+		}
+		if p.opt.PriorityInversion != msgqueue.InversionIgnore {
+			if !inverted && p.inverted(msg) {
+				inverted = true
+				if p.reorder(msg, t) {
+					return false
+				}
+			}
+			if delay > inversionCheckInterval {
+				delay = inversionCheckInterval
+			}
+		}
+		time.Sleep(delay)
 	}
 }
 
@@ -335,32 +1061,467 @@ func (p *Processor) Process(msg *msgqueue.Message) error {
 		return nil
 	}
 
-	start := time.Now()
-	err := p.handler.HandleMessage(msg)
-	p.updateAvgDuration(time.Since(start))
+	if res, done, err := p.prepare(msg); done {
+		p.apply(msg, res, err)
+		return err
+	}
 
-	if err == nil {
-		atomic.AddUint32(&p.processed, 1)
-		p.delete(msg, nil)
-		return nil
+	if p.opt.CoalesceKey != nil {
+		if key := p.opt.CoalesceKey(msg); key != "" {
+			return p.processCoalesced(key, msg)
+		}
 	}
 
-	if msg.ReservedCount < p.opt.RetryLimit {
-		atomic.AddUint32(&p.retries, 1)
+	return p.process(msg)
+}
+
+func (p *Processor) process(msg *msgqueue.Message) (err error) {
+	endSpan := p.traceProcess(msg)
+	defer func() {
+		endSpan(err)
+	}()
+
+	var res result
+	res, err = p.run(msg)
+	p.apply(msg, res, err)
+	return err
+}
+
+// Outcomes of the message reported by prepare and run.
+type result int
+
+const (
+	resultProcessed result = iota
+	resultRequeued
+	resultAborted
+	resultRetried
+	resultFailed
+	resultExpired
+)
+
+// apply deletes or releases the message according to its outcome.
+func (p *Processor) apply(msg *msgqueue.Message, res result, err error) {
+	switch res {
+	case resultProcessed:
+		p.delete(msg, nil)
+	case resultRequeued:
+		p.requeue(msg, err)
+	case resultAborted:
+		p.releaseAborted(msg)
+	case resultRetried:
 		p.release(msg, err)
-	} else {
-		atomic.AddUint32(&p.fails, 1)
+	case resultFailed:
 		p.delete(msg, err)
+	case resultExpired:
+		p.deleteExpired(msg)
+	}
+}
+
+// prepare applies steps shared by Process and Handle before the handler
+// is called: it restores name and loads latest args of the upserted
+// message, expires old messages, and applies Filter and FeatureFlags.
+// It reports whether the outcome of the message is already known,
+// so the handler must not be called.
+func (p *Processor) prepare(msg *msgqueue.Message) (result, bool, error) {
+	p.restoreName(msg)
+
+	if err := p.aborted(); err != nil {
+		return resultAborted, true, err
 	}
 
+	if p.opt.Upsert && msg.Name != "" {
+		if err := msgqueue.LoadLatestArgs(p.opt, msg); err != nil {
+			atomic.AddUint64(&p.retries, 1)
+			p.count("retried")
+			p.emit(EventRetried, msg, err, 0)
+			return resultRetried, true, err
+		}
+	}
+
+	if p.expire(msg) {
+		return resultExpired, true, msgqueue.ErrExpired
+	}
+
+	if p.opt.Filter != nil && !p.opt.Filter(msg) {
+		atomic.AddUint64(&p.filtered, 1)
+		p.count("filtered")
+		p.record(msg, msgqueue.OutcomeDiscarded, nil, 0)
+		return resultProcessed, true, nil
+	}
+
+	if p.opt.FeatureFlags != nil {
+		if res, done, err := p.applyFlags(msg); done {
+			return res, true, err
+		}
+	}
+
+	return 0, false, nil
+}
+
+// run runs the handler and updates stats, ledger, and events according
+// to the outcome, which is applied to the message by the caller, e.g.
+// by deleting or releasing it. Handler error is returned as is.
+func (p *Processor) run(msg *msgqueue.Message) (result, error) {
+	if msg.Body != "" {
+		p.updatePayloadSize(uint32(len(msg.Body)))
+	}
+
+	if p.opt.Redis != nil {
+		msg.SetContext(msgqueue.ContextWithRedis(msg.Context(), p.opt))
+		msg.SetContext(msgqueue.ContextWithCheckpoint(msg.Context(), p.opt, msg))
+	}
+
+	if p.opt.CaptureOutput {
+		msg.SetContext(msgqueue.WithOutputCapture(msg.Context()))
+	}
+
+	defer p.trackInFlight(msg)()
+
+	stopHeartbeat := p.heartbeat(msg)
+	stopSample := p.sampleAllocs(msg)
+	start := time.Now()
+	var err error
+	if p.opt.HandlerTimeout > 0 {
+		err = p.handleMessageTimeout(msg)
+	} else {
+		err = p.handleMessage(p.handler, msg)
+	}
+	dur := time.Since(start)
+	stopSample()
+	p.updateAvgDuration(dur)
+	p.durations.Observe(dur)
+	p.timing("duration", dur)
+	stopHeartbeat()
+
+	if err == nil || errors.Is(err, msgqueue.ErrDiscarded) {
+		if err == nil {
+			p.record(msg, msgqueue.OutcomeProcessed, nil, dur)
+			if p.opt.OnMessageProcessed != nil {
+				p.opt.OnMessageProcessed(msg, dur)
+			}
+		} else {
+			p.record(msg, msgqueue.OutcomeDiscarded, nil, dur)
+		}
+		atomic.AddUint64(&p.processed, 1)
+		p.count("processed")
+		p.emit(EventProcessed, msg, err, dur)
+		return resultProcessed, err
+	}
+
+	if isRequeue(err) {
+		p.record(msg, msgqueue.OutcomeRequeued, nil, dur)
+		return resultRequeued, err
+	}
+
+	if p.aborted() != nil {
+		p.record(msg, msgqueue.OutcomeRequeued, err, dur)
+		return resultAborted, err
+	}
+
+	if output := msgqueue.CapturedOutput(msg.Context()); output != "" {
+		p.warnf("%s handler output of %s:\n%s", p.q, msg, output)
+	}
+
+	if p.opt.OnMessageFailed != nil {
+		p.opt.OnMessageFailed(msg, err)
+	}
+
+	if msg.ReservedCount < p.retryLimit(msg) && !isUnretryable(err) {
+		p.record(msg, msgqueue.OutcomeRetried, err, dur)
+		atomic.AddUint64(&p.retries, 1)
+		p.count("retried")
+		p.emit(EventRetried, msg, err, dur)
+		return resultRetried, err
+	}
+
+	p.record(msg, msgqueue.OutcomeFailed, err, dur)
+	atomic.AddUint64(&p.fails, 1)
+	p.count("failed")
+	p.emit(EventFailed, msg, err, dur)
+	return resultFailed, err
+}
+
+// restoreName restores the name of the upserted message that was
+// added using remote queue, which does not store message names.
+func (p *Processor) restoreName(msg *msgqueue.Message) {
+	if p.opt.Upsert && msg.Name == "" {
+		msg.Name = msg.Header[msgqueue.NameHeader]
+	}
+}
+
+// releaseUpserted unlocks the name of the upserted message that is being
+// deleted. It releases the message instead when its args were upserted
+// after they were loaded, so it is processed again using latest args.
+func (p *Processor) releaseUpserted(msg *msgqueue.Message) bool {
+	if !p.upsertedAgain(msg) {
+		return false
+	}
+	if err := p.releaseMessage(msg, 0); err != nil {
+		p.errorf("%s Release failed: %s", p.q, err)
+	}
+	atomic.AddUint32(&p.inFlight, ^uint32(0))
+	return true
+}
+
+// upsertedAgain unlocks the name of the upserted message unless its args
+// were upserted after they were loaded. It reports whether the message
+// must be processed again using latest args.
+func (p *Processor) upsertedAgain(msg *msgqueue.Message) bool {
+	if !p.opt.Upsert || msg.Name == "" {
+		return false
+	}
+	deleted, err := msgqueue.DeleteLoadedArgs(p.opt, msg)
+	if err != nil {
+		p.warnf("%s DeleteLoadedArgs failed: %s", p.q, err)
+		return false
+	}
+	return !deleted
+}
+
+type coalesceGroup struct {
+	dups []*msgqueue.Message
+}
+
+// processCoalesced processes the message unless message with the same key
+// is being processed. In that case the message is attached to the one being
+// processed and is deleted or released depending on its result.
+func (p *Processor) processCoalesced(key string, msg *msgqueue.Message) error {
+	p.coalesceMu.Lock()
+	if g, ok := p.coalescing[key]; ok {
+		g.dups = append(g.dups, msg)
+		p.coalesceMu.Unlock()
+		return nil
+	}
+	g := new(coalesceGroup)
+	p.coalescing[key] = g
+	p.coalesceMu.Unlock()
+
+	err := p.process(msg)
+
+	p.coalesceMu.Lock()
+	delete(p.coalescing, key)
+	p.coalesceMu.Unlock()
+
+	for _, dup := range g.dups {
+		if err == nil || errors.Is(err, msgqueue.ErrDiscarded) {
+			atomic.AddUint64(&p.coalesced, 1)
+			p.delete(dup, nil)
+		} else {
+			p.release(dup, nil)
+		}
+	}
 	return err
 }
 
+// expire dead-letters the message if it is older than MaxAge and
+// ExpireRateLimit allows it. It reports whether message is expired,
+// so the caller deletes it.
+func (p *Processor) expire(msg *msgqueue.Message) bool {
+	if p.opt.MaxAge == 0 || msg.CreatedAt.IsZero() {
+		return false
+	}
+	age := time.Since(msg.CreatedAt)
+	if age <= p.opt.MaxAge {
+		return false
+	}
+	if p.expireLimiter != nil && !p.expireLimiter.Allow() {
+		return false
+	}
+
+	atomic.AddUint64(&p.expired, 1)
+	p.record(msg, msgqueue.OutcomeExpired, msgqueue.ErrExpired, 0)
+	if p.opt.ExpiredHandler != nil {
+		p.opt.ExpiredHandler(msg, age)
+	} else {
+		p.infof("%s message expired after %s", p.q, age)
+	}
+
+	if p.opt.DeadLetterQueue != nil {
+		if err := p.deadLetter(msg, msgqueue.ErrExpired); err == nil {
+			atomic.AddUint64(&p.deadLettered, 1)
+		} else {
+			p.errorf("%s moving to %s failed: %s", p.q, p.opt.DeadLetterQueue.Name(), err)
+		}
+	}
+
+	return true
+}
+
+// deleteExpired deletes the expired message unlocking its upserted name.
+func (p *Processor) deleteExpired(msg *msgqueue.Message) {
+	if p.releaseUpserted(msg) {
+		return
+	}
+	p.deleteExpiredCheckpoint(msg)
+	p.remove(msg)
+}
+
+// deleteExpiredCheckpoint deletes checkpoint of the expired message.
+// Handler did not run, so checkpoints saved by previous deliveries
+// are deleted unconditionally.
+func (p *Processor) deleteExpiredCheckpoint(msg *msgqueue.Message) {
+	if err := msgqueue.DeleteMessageCheckpoint(p.opt, msg); err != nil {
+		p.warnf("%s DeleteCheckpoint failed: %s", p.q, err)
+	}
+}
+
+// handleMessage calls the handler and converts handler panic into an error.
+func (p *Processor) handleMessage(h msgqueue.Handler, msg *msgqueue.Message) (err error) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		atomic.AddUint64(&p.panics, 1)
+		stack := debug.Stack()
+		if p.opt.PanicHandler != nil {
+			p.opt.PanicHandler(msg, v, stack)
+		} else {
+			p.errorf("%s handler panicked: %v\n%s", p.q, v, stack)
+		}
+		err = fmt.Errorf("handler panicked: %v", v)
+	}()
+	return h.HandleMessage(msg)
+}
+
+// heartbeat periodically extends reservation of the message while
+// it is processed so long-running messages are not redelivered to
+// other consumers. Returned function stops the heartbeat.
+func (p *Processor) heartbeat(msg *msgqueue.Message) func() {
+	if msg.ReservationId == "" {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(p.opt.ReservationTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			err := p.q.Touch(msg, p.opt.ReservationTimeout)
+			if err == ErrNotSupported {
+				return
+			}
+			if err != nil {
+				p.warnf("%s Touch failed: %s", p.q, err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// handleMessageTimeout calls the handler with a deadline context and
+// returns ErrHandlerTimeout if handler does not return in time. Handler
+// that ignores the context keeps running in the background with its own
+// copy of the message, but the worker is freed to process other messages.
+// At most as many handlers as there are current workers are abandoned;
+// after that the worker waits for the handler to return before the
+// message is retried.
+func (p *Processor) handleMessageTimeout(msg *msgqueue.Message) error {
+	ctx, cancel := context.WithTimeout(msg.Context(), p.opt.HandlerTimeout)
+	defer cancel()
+
+	cp := *msg
+	if msg.Header != nil {
+		cp.Header = make(map[string]string, len(msg.Header))
+		for k, v := range msg.Header {
+			cp.Header[k] = v
+		}
+	}
+	cp.SetContext(ctx)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.handleMessage(p.handler, &cp)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		// Processor is stopped; handler observes the cancellation.
+		return <-errCh
+	}
+	atomic.AddUint64(&p.timeouts, 1)
+
+	if int(atomic.LoadUint32(&p.abandoned)) >= p.WorkerNumber() {
+		<-errCh
+		return msgqueue.ErrHandlerTimeout
+	}
+	atomic.AddUint32(&p.abandoned, 1)
+	go func() {
+		<-errCh
+		atomic.AddUint32(&p.abandoned, ^uint32(0))
+	}()
+	return msgqueue.ErrHandlerTimeout
+}
+
+func isRequeue(err error) bool {
+	var v Requeuer
+	return errors.As(err, &v) && v.Requeue()
+}
+
+// requeue releases the message without counting it as a retry.
+func (p *Processor) requeue(msg *msgqueue.Message, reason error) {
+	atomic.AddUint64(&p.requeued, 1)
+	p.count("requeued")
+
+	delay := p.opt.MinBackoff
+	var v Delayer
+	if errors.As(reason, &v) && v.Delay() > 0 {
+		delay = v.Delay()
+	}
+
+	// Release increments ReservedCount of memqueue messages.
+	msg.ReservedCount--
+	if err := p.releaseMessage(msg, delay); err != nil {
+		p.errorf("%s Release failed: %s", p.q, err)
+	}
+
+	atomic.AddUint32(&p.inFlight, ^uint32(0))
+}
+
+func isUnretryable(err error) bool {
+	var v Unretryable
+	return errors.As(err, &v) && v.Unretryable()
+}
+
+func (p *Processor) retryLimit(msg *msgqueue.Message) int {
+	if msg.RetryLimit > 0 {
+		return msg.RetryLimit
+	}
+	return p.opt.RetryLimit
+}
+
 // Purge discards messages from the internal queue.
 func (p *Processor) Purge() error {
 	for {
 		select {
-		case msg := <-p.ch:
+		case <-p.ready:
+			msg := p.takeMessage()
+			p.restoreName(msg)
+			if p.opt.Upsert && msg.Name != "" {
+				if err := msgqueue.DeleteLatestArgs(p.opt, msg); err != nil {
+					p.warnf("%s DeleteLatestArgs failed: %s", p.q, err)
+				}
+			}
 			p.delete(msg, nil)
 		default:
 			return nil
@@ -370,31 +1531,177 @@ func (p *Processor) Purge() error {
 
 func (p *Processor) queueMessage(msg *msgqueue.Message) {
 	atomic.AddUint32(&p.inFlight, 1)
-	p.ch <- msg
+	p.enqueueMessage(msg)
+}
+
+func (p *Processor) enqueueMessage(msg *msgqueue.Message) {
+	p.emit(EventReserved, msg, nil, 0)
+	p.lanes[p.lane(msg)] <- msg
+	p.ready <- struct{}{}
 }
 
-func (p *Processor) dequeueMessage() (*msgqueue.Message, bool) {
+// enqueueAsync works like enqueueMessage, but the message is added by
+// a goroutine instead of blocking the caller when the lane is full.
+func (p *Processor) enqueueAsync(msg *msgqueue.Message) {
+	p.emit(EventReserved, msg, nil, 0)
+	lane := p.lanes[p.lane(msg)]
 	select {
-	case msg := <-p.ch:
-		return msg, true
-	case <-p.stop:
+	case lane <- msg:
+		p.ready <- struct{}{}
+	default:
+		go func() {
+			lane <- msg
+			p.ready <- struct{}{}
+		}()
+	}
+}
+
+// lane returns the buffer lane of the message. Priorities
+// above the top lane share the top lane.
+func (p *Processor) lane(msg *msgqueue.Message) int {
+	switch {
+	case msg.Priority <= 0:
+		return 0
+	case msg.Priority >= len(p.lanes):
+		return len(p.lanes) - 1
+	default:
+		return msg.Priority
+	}
+}
+
+// takeMessage returns buffered message with the highest priority.
+// Caller must hold a token received from ready, which guarantees
+// that there is a message in one of the lanes.
+func (p *Processor) takeMessage() *msgqueue.Message {
+	for {
+		for i := len(p.lanes) - 1; i >= 0; i-- {
+			select {
+			case msg := <-p.lanes[i]:
+				return msg
+			default:
+			}
+		}
+		// Concurrent worker may take the message from the lane that
+		// is not scanned yet, while a new message is added to the lane
+		// that is already scanned.
+		runtime.Gosched()
+	}
+}
+
+// gateTicket is held by a dequeued message until it is processed.
+type gateTicket struct {
+	readers *sync.WaitGroup // set for ordinary messages
+	barrier chan struct{}   // set for barriers
+}
+
+// takeGated takes buffered message with a gate ticket, so barrier
+// messages wait for messages dequeued before them and messages
+// dequeued after barrier wait for the barrier.
+func (p *Processor) takeGated() (*msgqueue.Message, gateTicket) {
+	var t gateTicket
+	var readers *sync.WaitGroup
+
+	p.gateMu.Lock()
+	msg := p.takeMessage()
+	prev := p.gateBarrier
+	if isBarrier(msg) {
+		t.barrier = make(chan struct{})
+		readers = p.gateReaders
+		p.gateBarrier = t.barrier
+		p.gateReaders = new(sync.WaitGroup)
+	} else {
+		t.readers = p.gateReaders
+		t.readers.Add(1)
+	}
+	p.gateMu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+	if readers != nil {
+		readers.Wait()
+	}
+	return msg, t
+}
+
+func (p *Processor) ungate(t gateTicket) {
+	if t.barrier != nil {
+		close(t.barrier)
+	} else {
+		t.readers.Done()
+	}
+}
+
+// isBarrier reports whether message is a queue-wide barrier. Barriers
+// with GroupKey are ordered within the group by dispatch.
+func isBarrier(msg *msgqueue.Message) bool {
+	return msg.Barrier && msg.GroupKey == ""
+}
+
+func (p *Processor) dequeueMessage(quit <-chan struct{}) (*msgqueue.Message, gateTicket, bool) {
+	var timer *time.Timer
+	var idle <-chan time.Time
+	if p.opt.MaxWorkers > 0 && p.opt.WorkerIdleTimeout > 0 {
+		timer = time.NewTimer(p.opt.WorkerIdleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	for {
+		if p.aborted() != nil {
+			return nil, gateTicket{}, false
+		}
+
 		select {
-		case msg := <-p.ch:
-			return msg, true
-		default:
-			return nil, false
+		case <-p.ready:
+			msg, t := p.takeGated()
+			return msg, t, true
+		case <-quit:
+			return nil, gateTicket{}, false
+		case <-idle:
+			if p.retireWorker(quit) {
+				return nil, gateTicket{}, false
+			}
+			timer.Reset(p.opt.WorkerIdleTimeout)
+		case <-p.stop:
+			select {
+			case <-p.ready:
+				msg, t := p.takeGated()
+				return msg, t, true
+			default:
+				return nil, gateTicket{}, false
+			}
+		}
+	}
+}
+
+// retireWorker removes idle worker from the pool unless the pool
+// is already at MinWorkers. It reports whether worker is removed.
+func (p *Processor) retireWorker(quit <-chan struct{}) bool {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	if p.stopped() || len(p.workers) <= p.opt.MinWorkers {
+		return false
+	}
+	for i, ch := range p.workers {
+		if ch == quit {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			p.workerNumber = len(p.workers)
+			return true
 		}
 	}
+	return false
 }
 
 func (p *Processor) release(msg *msgqueue.Message, reason error) {
 	delay := p.releaseBackoff(msg, reason)
 
 	if reason != nil {
-		log.Printf("%s handler failed (retry in %s): %s", p.q, delay, reason)
+		p.retryf("%s handler failed (retry in %s): %s", p.q, delay, reason)
 	}
-	if err := p.q.Release(msg, delay); err != nil {
-		log.Printf("%s Release failed: %s", p.q, err)
+	if err := p.releaseMessage(msg, delay); err != nil {
+		p.errorf("%s Release failed: %s", p.q, err)
 	}
 
 	atomic.AddUint32(&p.inFlight, ^uint32(0))
@@ -402,7 +1709,8 @@ func (p *Processor) release(msg *msgqueue.Message, reason error) {
 
 func (p *Processor) releaseBackoff(msg *msgqueue.Message, reason error) time.Duration {
 	if reason != nil {
-		if delayer, ok := reason.(Delayer); ok {
+		var delayer Delayer
+		if errors.As(reason, &delayer) {
 			delay := delayer.Delay()
 			if delay > time.Minute {
 				atomic.StoreUint32(&p.delaySec, uint32(delay/time.Second))
@@ -420,26 +1728,83 @@ func (p *Processor) releaseBackoff(msg *msgqueue.Message, reason error) time.Dur
 }
 
 func (p *Processor) delete(msg *msgqueue.Message, reason error) {
+	if p.releaseUpserted(msg) {
+		return
+	}
+
 	if reason == nil {
 		p.resetPause()
 	} else {
-		log.Printf("%s handler failed: %s", p.q, reason)
+		p.errorf("%s handler failed: %s", p.q, reason)
+		p.handleFailed(msg, reason)
+	}
 
-		if p.fallbackHandler != nil {
-			if err := p.fallbackHandler.HandleMessage(msg); err != nil {
-				log.Printf("%s fallback handler failed: %s", p.q, err)
-			}
-		}
+	if reason == nil && p.injectChaos(msg) {
+		atomic.AddUint32(&p.inFlight, ^uint32(0))
+		return
 	}
 
+	p.deleteCheckpoint(msg)
+	p.remove(msg)
+}
+
+// remove deletes the message from the queue using delete batch.
+func (p *Processor) remove(msg *msgqueue.Message) {
 	atomic.AddUint32(&p.inFlight, ^uint32(0))
 	atomic.AddUint32(&p.deleting, 1)
 	p.delBatch.Add(msg)
 }
 
+func (p *Processor) deleteCheckpoint(msg *msgqueue.Message) {
+	if err := msgqueue.DeleteCheckpoint(msg.Context()); err != nil {
+		p.warnf("%s DeleteCheckpoint failed: %s", p.q, err)
+	}
+}
+
+func (p *Processor) handleFailed(msg *msgqueue.Message, reason error) {
+	if p.opt.DeadLetterQueue != nil {
+		err := p.deadLetter(msg, reason)
+		if err == nil {
+			atomic.AddUint64(&p.deadLettered, 1)
+			return
+		}
+		p.errorf("%s moving to %s failed: %s", p.q, p.opt.DeadLetterQueue.Name(), err)
+	}
+
+	if p.fallbackHandler != nil {
+		if err := p.handleMessage(p.fallbackHandler, msg); err != nil {
+			p.errorf("%s fallback handler failed: %s", p.q, err)
+		}
+	}
+}
+
+func (p *Processor) deadLetter(msg *msgqueue.Message, reason error) error {
+	body := msg.Body
+	if body == "" {
+		var err error
+		body, err = msg.EncodeArgs(p.opt.Codec)
+		if err != nil {
+			return err
+		}
+	}
+	dlq := msgqueue.NewMessage(p.q.Name(), reason.Error(), msg.ReservedCount, body)
+	dlq.Header = msg.Header
+	if output := msgqueue.CapturedOutput(msg.Context()); output != "" {
+		dlq.Header = make(map[string]string, len(msg.Header)+1)
+		for k, v := range msg.Header {
+			dlq.Header[k] = v
+		}
+		dlq.Header["output"] = output
+	}
+	return p.opt.DeadLetterQueue.Add(dlq)
+}
+
 func (p *Processor) deleteBatch(msgs []*msgqueue.Message) {
-	if err := p.q.DeleteBatch(msgs); err != nil {
-		log.Printf("%s DeleteBatch failed: %s", p.q, err)
+	_, endSpan := p.startSpan(context.Background(), msgqueue.SpanDeleteBatch, nil)
+	err := p.q.DeleteBatch(msgs)
+	endSpan(err)
+	if err != nil {
+		p.errorf("%s DeleteBatch failed: %s", p.q, err)
 	}
 	atomic.AddUint32(&p.deleting, ^uint32(len(msgs)-1))
 }
@@ -449,20 +1814,65 @@ func (p *Processor) updateAvgDuration(dur time.Duration) {
 	ms := float64(dur / time.Millisecond)
 	for {
 		avg := atomic.LoadUint32(&p.avgDuration)
-		newAvg := uint32((1-decay)*float64(avg) + decay*ms)
+		newAvg := uint32(ms)
+		if avg != 0 {
+			newAvg = uint32((1-decay)*float64(avg) + decay*ms)
+		}
 		if atomic.CompareAndSwapUint32(&p.avgDuration, avg, newAvg) {
 			break
 		}
 	}
 }
 
+func (p *Processor) updatePayloadSize(size uint32) {
+	const decay = float64(1) / 100
+	for {
+		avg := atomic.LoadUint32(&p.avgPayloadSize)
+		newAvg := size
+		if avg != 0 {
+			newAvg = uint32((1-decay)*float64(avg) + decay*float64(size))
+		}
+		if atomic.CompareAndSwapUint32(&p.avgPayloadSize, avg, newAvg) {
+			break
+		}
+	}
+	for {
+		min := atomic.LoadUint32(&p.minPayloadSize)
+		if min != 0 && min <= size {
+			break
+		}
+		if atomic.CompareAndSwapUint32(&p.minPayloadSize, min, size) {
+			break
+		}
+	}
+	for {
+		max := atomic.LoadUint32(&p.maxPayloadSize)
+		if max >= size {
+			break
+		}
+		if atomic.CompareAndSwapUint32(&p.maxPayloadSize, max, size) {
+			break
+		}
+	}
+}
+
 func (p *Processor) resetPause() {
 	atomic.StoreUint32(&p.errCount, 0)
 	atomic.StoreUint32(&p.delayCount, 0)
 }
 
+// exponentialBackoff doubles dur for every retry after the first one.
+// It is capped by maxBackoff, so large retry counts don't overflow.
 func exponentialBackoff(dur time.Duration, retry int) time.Duration {
-	dur <<= uint(retry - 1)
+	if dur <= 0 {
+		return dur
+	}
+	for i := 1; i < retry; i++ {
+		if dur > maxBackoff/2 {
+			return maxBackoff
+		}
+		dur <<= 1
+	}
 	if dur > maxBackoff {
 		dur = maxBackoff
 	}
@@ -34,8 +34,8 @@ func printStats(p *processor.Processor) {
 		old = st
 
 		log.Printf(
-			"%s: inFlight=%d deleting=%d processed=%d fails=%d retries=%d avg_dur=%s\n",
-			p, st.InFlight, st.Deleting, st.Processed, st.Fails, st.Retries, st.AvgDuration,
+			"%s: inFlight=%d deleting=%d processed=%d fails=%d retries=%d panics=%d avg_dur=%s\n",
+			p, st.InFlight, st.Deleting, st.Processed, st.Fails, st.Retries, st.Panics, st.AvgDuration,
 		)
 	}
 }
@@ -90,6 +90,46 @@ func testProcessor(t *testing.T, q processor.Queuer) {
 	}
 }
 
+func testAddBatch(t *testing.T, q processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	const n = 25
+
+	ch := make(chan int, n)
+	handler := func(i int) error {
+		ch <- i
+		return nil
+	}
+
+	msgs := make([]*msgqueue.Message, n)
+	for i := range msgs {
+		msgs[i] = msgqueue.NewMessage(i)
+	}
+	if err := q.AddBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler: handler,
+	})
+
+	seen := make(map[int]bool)
+	for len(seen) < n {
+		select {
+		case i := <-ch:
+			seen[i] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages, wanted %d", len(seen), n)
+		}
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testDelay(t *testing.T, q processor.Queuer) {
 	t.Parallel()
 
@@ -124,6 +164,40 @@ func testDelay(t *testing.T, q processor.Queuer) {
 	}
 }
 
+func testScheduledAt(t *testing.T, q processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	handlerCh := make(chan time.Time, 10)
+	handler := func() {
+		handlerCh <- time.Now()
+	}
+
+	start := time.Now()
+
+	msg := msgqueue.NewMessage()
+	msg.ScheduledAt = start.Add(5 * time.Second)
+	err := q.Add(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler: handler,
+	})
+
+	tm := <-handlerCh
+	sub := tm.Sub(start)
+	if !durEqual(sub, 5*time.Second) {
+		t.Fatalf("message was delayed by %s, wanted %s", sub, 5*time.Second)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testRetry(t *testing.T, q processor.Queuer) {
 	t.Parallel()
 
@@ -213,6 +287,65 @@ func testNamedMessage(t *testing.T, q processor.Queuer) {
 	}
 }
 
+func testUpsert(t *testing.T, q processor.Queuer, redis msgqueue.Redis) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	for _, s := range []string{"v1", "v2"} {
+		msg := msgqueue.NewMessage(s)
+		msg.Name = "the-name"
+		if err := q.Add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch := make(chan string, 10)
+	p := processor.Start(q, &msgqueue.Options{
+		Name: q.Name(),
+		Handler: func(s string) {
+			ch <- s
+		},
+		Redis:  redis,
+		Upsert: true,
+	})
+
+	select {
+	case s := <-ch:
+		if s != "v2" {
+			t.Fatalf("got %q, wanted v2", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message was not processed")
+	}
+
+	// Message with the same name is added once the first one is processed.
+	msg := msgqueue.NewMessage("v3")
+	msg.Name = "the-name"
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-ch:
+		if s != "v3" {
+			t.Fatalf("got %q, wanted v3", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upserted message was not processed")
+	}
+
+	select {
+	case s := <-ch:
+		t.Fatalf("message was processed again with %q", s)
+	case <-time.After(time.Second):
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func testCallOnce(t *testing.T, q processor.Queuer) {
 	t.Parallel()
 
@@ -348,6 +481,212 @@ func testDelayer(t *testing.T, q processor.Queuer) {
 	}
 }
 
+func testTouch(t *testing.T, q processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	var count int64
+	handler := func() {
+		atomic.AddInt64(&count, 1)
+		// Longer than ReservationTimeout.
+		time.Sleep(5 * time.Second)
+	}
+
+	err := q.Call()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler:            handler,
+		WorkerNumber:       2,
+		ReservationTimeout: 2 * time.Second,
+	})
+
+	time.Sleep(7 * time.Second)
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&count); n != 1 {
+		t.Fatalf("message is processed %d times, wanted 1", n)
+	}
+}
+
+func testTouchParked(t *testing.T, q processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	var count int64
+	handler := func() {
+		atomic.AddInt64(&count, 1)
+		// Longer than ReservationTimeout.
+		time.Sleep(3 * time.Second)
+	}
+
+	for i := 0; i < 2; i++ {
+		msg := msgqueue.NewMessage()
+		msg.GroupKey = "account"
+		if err := q.Add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler:            handler,
+		WorkerNumber:       2,
+		ReservationTimeout: 2 * time.Second,
+	})
+
+	// Second message is parked until the first one is processed.
+	time.Sleep(8 * time.Second)
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&count); n != 2 {
+		t.Fatalf("messages are processed %d times, wanted 2", n)
+	}
+}
+
+func testPauseName(t *testing.T, q processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+
+	ch := make(chan string, 10)
+	p := processor.New(q, &msgqueue.Options{
+		Handler: func(s string) {
+			ch <- s
+		},
+		MinBackoff: time.Second,
+	})
+	p.PauseName("buggy")
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, task := range []string{"buggy", "healthy"} {
+		msg := msgqueue.NewMessage(task)
+		msg.Header = map[string]string{msgqueue.TaskHeader: task}
+		if err := q.Add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case s := <-ch:
+		if s != "healthy" {
+			t.Fatalf("got %q, wanted healthy", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message was not processed")
+	}
+
+	select {
+	case s := <-ch:
+		t.Fatalf("paused message %q was processed", s)
+	case <-time.After(3 * time.Second):
+	}
+
+	p.ResumeName("buggy")
+
+	select {
+	case s := <-ch:
+		if s != "buggy" {
+			t.Fatalf("got %q, wanted buggy", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("resumed message was not processed")
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Stats().Retries; n != 0 {
+		t.Fatalf("got %d retries, wanted 0", n)
+	}
+}
+
+func testRedrive(t *testing.T, q, dlq processor.Queuer) {
+	t.Parallel()
+
+	_ = q.Purge()
+	_ = dlq.Purge()
+
+	const n = 10
+
+	var failing int32 = 1
+	ch := make(chan int, n)
+	handler := func(i int) error {
+		if atomic.LoadInt32(&failing) == 1 {
+			return msgqueue.Unretryable(errors.New("fake error"))
+		}
+		ch <- i
+		return nil
+	}
+
+	msgs := make([]*msgqueue.Message, n)
+	for i := range msgs {
+		msgs[i] = msgqueue.NewMessage(i)
+	}
+	if err := q.AddBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler:         handler,
+		DeadLetterQueue: dlq.(msgqueue.Queue),
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		size, err := dlq.(processor.Lener).Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dead letter queue has %d messages, wanted %d", size, n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+
+	moved, err := processor.Redrive(dlq, q.(msgqueue.Queue), &processor.RedriveOptions{
+		BatchSize: 3,
+		RateLimit: 100,
+		Unwrap:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != n {
+		t.Fatalf("moved %d messages, wanted %d", moved, n)
+	}
+
+	seen := make(map[int]bool)
+	for len(seen) < n {
+		select {
+		case i := <-ch:
+			seen[i] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages, wanted %d", len(seen), n)
+		}
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func durEqual(d1, d2 time.Duration) bool {
 	return d1 >= d2 && d2-d1 < 3*time.Second
 }
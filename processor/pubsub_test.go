@@ -0,0 +1,82 @@
+package processor_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/gcpubsub"
+
+	pubsub "cloud.google.com/go/pubsub/apiv1"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+)
+
+// Tests expect Pub/Sub emulator, i.e. PUBSUB_EMULATOR_HOST is set.
+const pubsubProject = "msgqueue-test"
+
+func pubsubQueue(t *testing.T, name string, opt *msgqueue.Options) *gcpubsub.Queue {
+	ctx := context.Background()
+	pub, err := pubsub.NewPublisherClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := pubsub.NewSubscriberClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	topic := fmt.Sprintf("projects/%s/topics/%s", pubsubProject, opt.Name)
+
+	// Topic and subscription already exist when tests are rerun.
+	_, _ = pub.CreateTopic(ctx, &pubsubpb.Topic{
+		Name: topic,
+	})
+	_, _ = sub.CreateSubscription(ctx, &pubsubpb.Subscription{
+		Name:               fmt.Sprintf("projects/%s/subscriptions/%s", pubsubProject, opt.Name),
+		Topic:              topic,
+		AckDeadlineSeconds: 10,
+	})
+
+	q := gcpubsub.NewQueue(pub, sub, pubsubProject, opt)
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestPubSubProcessor(t *testing.T) {
+	testProcessor(t, pubsubQueue(t, "pubsub-processor", &msgqueue.Options{}))
+}
+
+func TestPubSubAddBatch(t *testing.T) {
+	testAddBatch(t, pubsubQueue(t, "pubsub-add-batch", &msgqueue.Options{}))
+}
+
+func TestPubSubDelay(t *testing.T) {
+	testDelay(t, pubsubQueue(t, "pubsub-delay", &msgqueue.Options{}))
+}
+
+func TestPubSubNamedMessage(t *testing.T) {
+	testNamedMessage(t, pubsubQueue(t, "pubsub-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestPubSubCallOnce(t *testing.T) {
+	testCallOnce(t, pubsubQueue(t, "pubsub-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestPubSubDelayer(t *testing.T) {
+	testDelayer(t, pubsubQueue(t, "pubsub-delayer", &msgqueue.Options{}))
+}
+
+func TestPubSubTouch(t *testing.T) {
+	testTouch(t, pubsubQueue(t, "pubsub-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Handle processes the message delivered by the backend, e.g. by HTTP
+// push, using processor handler, middleware, and stats. Like Process,
+// it restores upserted names, expires old messages, and applies Filter
+// and FeatureFlags. Unlike Process, the message is neither released nor
+// deleted, because the backend redelivers the message when Handle
+// returns an error. Messages that exceed the retry limit or fail with
+// unretryable error are moved to DeadLetterQueue or passed to
+// FallbackHandler and Handle returns nil, so they are not redelivered.
+func (p *Processor) Handle(msg *msgqueue.Message) (err error) {
+	endSpan := p.traceProcess(msg)
+	defer func() {
+		endSpan(err)
+	}()
+
+	res, done, err := p.prepare(msg)
+	if !done {
+		res, err = p.run(msg)
+	}
+
+	switch res {
+	case resultProcessed:
+		return p.acknowledge(msg)
+	case resultExpired:
+		if p.upsertedAgain(msg) {
+			return msgqueue.ErrRequeue
+		}
+		p.deleteExpiredCheckpoint(msg)
+		return nil
+	case resultRetried:
+		p.errorf("%s handler failed: %s", p.q, err)
+	case resultFailed:
+		p.errorf("%s handler failed: %s", p.q, err)
+		p.handleFailed(msg, err)
+		return p.acknowledge(msg)
+	}
+	return err
+}
+
+// acknowledge finishes the pushed message that is not redelivered.
+// The message is redelivered instead when its args were upserted
+// after they were loaded.
+func (p *Processor) acknowledge(msg *msgqueue.Message) error {
+	if p.upsertedAgain(msg) {
+		return msgqueue.ErrRequeue
+	}
+	p.deleteCheckpoint(msg)
+	return nil
+}
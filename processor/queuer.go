@@ -10,10 +10,15 @@ type Queuer interface {
 	Name() string
 	Processor() *Processor
 	Add(msg *msgqueue.Message) error
+	AddBatch(msgs []*msgqueue.Message) error
 	Call(args ...interface{}) error
 	CallOnce(dur time.Duration, args ...interface{}) error
 	ReserveN(n int) ([]msgqueue.Message, error)
 	Release(*msgqueue.Message, time.Duration) error
+	// Touch extends message reservation by the duration from now.
+	Touch(*msgqueue.Message, time.Duration) error
+	// Ping checks that the queue backend is reachable.
+	Ping() error
 	Delete(msg *msgqueue.Message) error
 	DeleteBatch(msg []*msgqueue.Message) error
 	Purge() error
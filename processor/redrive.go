@@ -0,0 +1,179 @@
+package processor
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-msgqueue/msgqueue"
+
+	timerate "golang.org/x/time/rate"
+)
+
+// RedriveOptions configures moving messages from a dead letter queue.
+type RedriveOptions struct {
+	// Number of messages reserved and moved at once. The default is 10.
+	BatchSize int
+	// Max number of messages moved per second. The default is no limit.
+	RateLimit timerate.Limit
+	// Max number of messages to move. The default is to move all
+	// messages until the dead letter queue is empty.
+	MaxMessages int
+
+	// Messages were dead-lettered by Processor using
+	// Options.DeadLetterQueue, so the original message is restored
+	// from the dead-lettered message args before it is moved.
+	Unwrap bool
+}
+
+func (opt *RedriveOptions) Init() {
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = 10
+	}
+	if opt.RateLimit == 0 {
+		opt.RateLimit = timerate.Inf
+	}
+}
+
+// Limiter returns rate limiter that throttles moved messages.
+func (opt *RedriveOptions) Limiter() *timerate.Limiter {
+	return timerate.NewLimiter(opt.RateLimit, opt.BatchSize)
+}
+
+// Redrive moves messages from the dead letter queue back to the target
+// queue, e.g. after the incident that failed them is fixed. Messages
+// are moved in batches and are deleted from dlq only after they are
+// added to the target. It returns the number of moved messages.
+func Redrive(dlq Queuer, target msgqueue.Queue, opt *RedriveOptions) (int, error) {
+	if opt == nil {
+		opt = new(RedriveOptions)
+	}
+	opt.Init()
+	limiter := opt.Limiter()
+
+	var moved int
+	for opt.MaxMessages == 0 || moved < opt.MaxMessages {
+		n := opt.BatchSize
+		if opt.MaxMessages > 0 && opt.MaxMessages-moved < n {
+			n = opt.MaxMessages - moved
+		}
+
+		msgs, err := dlq.ReserveN(n)
+		if err != nil {
+			return moved, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		if err := limiter.WaitN(context.Background(), len(msgs)); err != nil {
+			releaseAll(dlq, msgs)
+			return moved, err
+		}
+
+		batch, err := redriveBatch(dlq, msgs, opt)
+		if err == nil {
+			err = addAll(target, batch)
+		}
+		if err != nil {
+			releaseAll(dlq, msgs)
+			return moved, err
+		}
+
+		reserved := make([]*msgqueue.Message, len(msgs))
+		for i := range msgs {
+			reserved[i] = &msgs[i]
+		}
+		if err := dlq.DeleteBatch(reserved); err != nil {
+			return moved, err
+		}
+		moved += len(msgs)
+	}
+	return moved, nil
+}
+
+// redriveBatch returns new messages for the target queue.
+func redriveBatch(dlq Queuer, msgs []msgqueue.Message, opt *RedriveOptions) ([]*msgqueue.Message, error) {
+	batch := make([]*msgqueue.Message, len(msgs))
+	for i := range msgs {
+		msg := &msgs[i]
+		if opt.Unwrap {
+			body, err := unwrapDeadLetter(queueCodec(dlq), msg.Body)
+			if err != nil {
+				return nil, err
+			}
+			batch[i] = &msgqueue.Message{
+				Body:   body,
+				Header: unwrapHeader(msg.Header),
+			}
+			continue
+		}
+		batch[i] = &msgqueue.Message{
+			Body:       msg.Body,
+			Header:     msg.Header,
+			Priority:   msg.Priority,
+			RetryLimit: msg.RetryLimit,
+			GroupKey:   msg.GroupKey,
+			Barrier:    msg.Barrier,
+		}
+	}
+	return batch, nil
+}
+
+func queueCodec(q Queuer) msgqueue.Codec {
+	if q, ok := q.(msgqueue.Queue); ok && q.Options().Codec != nil {
+		return q.Options().Codec
+	}
+	return msgqueue.MsgpackCodec
+}
+
+// unwrapDeadLetter returns the original message body of the message
+// created by Processor.deadLetter.
+func unwrapDeadLetter(codec msgqueue.Codec, body string) (string, error) {
+	var queue, reason, origBody string
+	var attempts int
+	err := codec.Unmarshal([]byte(body), []interface{}{&queue, &reason, &attempts, &origBody})
+	if err != nil {
+		return "", err
+	}
+	if origBody == "" {
+		return "", errors.New("queue: dead-lettered message has empty body")
+	}
+	return origBody, nil
+}
+
+// unwrapHeader returns the header without handler output
+// captured by Processor.deadLetter.
+func unwrapHeader(header map[string]string) map[string]string {
+	if _, ok := header["output"]; !ok {
+		return header
+	}
+	h := make(map[string]string, len(header))
+	for k, v := range header {
+		if k != "output" {
+			h[k] = v
+		}
+	}
+	return h
+}
+
+func addAll(q msgqueue.Queue, msgs []*msgqueue.Message) error {
+	if q, ok := q.(interface {
+		AddBatch([]*msgqueue.Message) error
+	}); ok {
+		return q.AddBatch(msgs)
+	}
+	for _, msg := range msgs {
+		if err := q.Add(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAll releases messages that were not moved,
+// so they are available in the dead letter queue again.
+func releaseAll(q Queuer, msgs []msgqueue.Message) {
+	for i := range msgs {
+		_ = q.Release(&msgs[i], 0)
+	}
+}
@@ -0,0 +1,68 @@
+package processor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Window after which old clock skew samples are discarded.
+const skewWindow = 5 * time.Minute
+
+// skewEstimator estimates the clock skew between the consumer and the
+// host that sets Message.CreatedAt (broker or producer) as the minimum
+// age of received messages. Queue latency is always positive so the
+// minimum over many messages converges to the skew plus the minimum
+// latency. Samples are kept for one to two skew windows.
+type skewEstimator struct {
+	mu sync.Mutex
+
+	windowStart time.Time
+	cur, prev   time.Duration
+	hasCur      bool
+	hasPrev     bool
+}
+
+// Observe records the age of the received message. Redelivered and
+// delayed messages are ignored, because their age includes backoff.
+func (e *skewEstimator) Observe(msg *msgqueue.Message) {
+	if msg.CreatedAt.IsZero() || msg.ReservedCount > 1 || msg.Delay > 0 {
+		return
+	}
+
+	now := time.Now()
+	age := now.Sub(msg.CreatedAt)
+
+	e.mu.Lock()
+	if now.Sub(e.windowStart) > skewWindow {
+		e.prev, e.hasPrev = e.cur, e.hasCur
+		e.hasCur = false
+		e.windowStart = now
+	}
+	if !e.hasCur || age < e.cur {
+		e.cur = age
+		e.hasCur = true
+	}
+	e.mu.Unlock()
+}
+
+// Skew returns estimated skew. Positive skew means that consumer clock
+// is ahead of the clock that sets Message.CreatedAt.
+func (e *skewEstimator) Skew() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	switch {
+	case e.hasCur && e.hasPrev:
+		if e.prev < e.cur {
+			return e.prev
+		}
+		return e.cur
+	case e.hasCur:
+		return e.cur
+	case e.hasPrev:
+		return e.prev
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+func TestSkewEstimator(t *testing.T) {
+	var e skewEstimator
+	if skew := e.Skew(); skew != 0 {
+		t.Fatalf("got %s, wanted 0", skew)
+	}
+
+	observe := func(age time.Duration, reservedCount int) {
+		e.Observe(&msgqueue.Message{
+			CreatedAt:     time.Now().Add(-age),
+			ReservedCount: reservedCount,
+		})
+	}
+
+	observe(time.Minute, 1)
+	observe(2*time.Second, 1)
+	observe(time.Hour, 1)
+	// Redelivered message is ignored.
+	observe(-time.Hour, 2)
+
+	skew := e.Skew()
+	if skew < 2*time.Second || skew > 3*time.Second {
+		t.Fatalf("got %s, wanted ~2s", skew)
+	}
+
+	// Consumer clock is behind the producer clock.
+	observe(-5*time.Second, 1)
+	skew = e.Skew()
+	if skew > -4*time.Second {
+		t.Fatalf("got %s, wanted ~-5s", skew)
+	}
+}
+
+func TestSkewEstimatorWindow(t *testing.T) {
+	var e skewEstimator
+	e.Observe(&msgqueue.Message{CreatedAt: time.Now()})
+
+	// Samples older than two windows are discarded.
+	e.windowStart = time.Now().Add(-2 * skewWindow)
+	e.Observe(&msgqueue.Message{CreatedAt: time.Now().Add(-time.Minute)})
+	e.windowStart = time.Now().Add(-2 * skewWindow)
+	e.Observe(&msgqueue.Message{CreatedAt: time.Now().Add(-time.Hour)})
+
+	skew := e.Skew()
+	if skew < time.Minute || skew > time.Minute+time.Second {
+		t.Fatalf("got %s, wanted ~1m", skew)
+	}
+}
@@ -0,0 +1,72 @@
+package processor_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/sqliteq"
+)
+
+func sqliteQueue(t *testing.T, name string, opt *msgqueue.Options) *sqliteq.Queue {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opt.Name = queueName(name)
+	q := sqliteq.NewQueue(db, opt)
+	if err := q.Purge(); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestSQLiteProcessor(t *testing.T) {
+	testProcessor(t, sqliteQueue(t, "sqlite-processor", &msgqueue.Options{}))
+}
+
+func TestSQLiteAddBatch(t *testing.T) {
+	testAddBatch(t, sqliteQueue(t, "sqlite-add-batch", &msgqueue.Options{}))
+}
+
+func TestSQLiteDelay(t *testing.T) {
+	testDelay(t, sqliteQueue(t, "sqlite-delay", &msgqueue.Options{}))
+}
+
+func TestSQLiteRetry(t *testing.T) {
+	testRetry(t, sqliteQueue(t, "sqlite-retry", &msgqueue.Options{}))
+}
+
+func TestSQLiteNamedMessage(t *testing.T) {
+	testNamedMessage(t, sqliteQueue(t, "sqlite-named-message", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestSQLiteCallOnce(t *testing.T) {
+	testCallOnce(t, sqliteQueue(t, "sqlite-call-once", &msgqueue.Options{
+		Redis: redisRing(),
+	}))
+}
+
+func TestSQLiteDelayer(t *testing.T) {
+	testDelayer(t, sqliteQueue(t, "sqlite-delayer", &msgqueue.Options{}))
+}
+
+func TestSQLiteTouch(t *testing.T) {
+	testTouch(t, sqliteQueue(t, "sqlite-touch", &msgqueue.Options{
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
+
+func TestSQLiteRedrive(t *testing.T) {
+	testRedrive(t,
+		sqliteQueue(t, "sqlite-redrive", &msgqueue.Options{}),
+		sqliteQueue(t, "sqlite-redrive-dlq", &msgqueue.Options{}))
+}
@@ -1,20 +1,26 @@
 package processor_test
 
 import (
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-msgqueue/msgqueue"
 	"github.com/go-msgqueue/msgqueue/azsqs"
+	"github.com/go-msgqueue/msgqueue/processor"
 
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
-var accountId string
+var accountId, s3Bucket string
 
 func init() {
 	accountId = os.Getenv("AWS_ACCOUNT_ID")
+	s3Bucket = os.Getenv("AWS_S3_BUCKET")
 }
 
 func awsSQS() *sqs.SQS {
@@ -27,18 +33,46 @@ func TestSQSProcessor(t *testing.T) {
 	}))
 }
 
+func TestSQSAddBatch(t *testing.T) {
+	testAddBatch(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-add-batch"),
+	}))
+}
+
+func TestSQSFactory(t *testing.T) {
+	f := azsqs.NewFactory(awsSQS(), accountId, &msgqueue.FactoryOptions{
+		APIRateLimit: 10,
+	})
+	testProcessor(t, f.NewQueue(&msgqueue.Options{
+		Name: queueName("sqs-factory"),
+	}))
+}
+
 func TestSQSDelay(t *testing.T) {
 	testDelay(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
 		Name: queueName("sqs-delay"),
 	}))
 }
 
+func TestSQSScheduledAt(t *testing.T) {
+	testScheduledAt(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-scheduled-at"),
+	}))
+}
+
 func TestSQSRetry(t *testing.T) {
 	testRetry(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
 		Name: queueName("sqs-retry"),
 	}))
 }
 
+func TestSQSTouch(t *testing.T) {
+	testTouch(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name:               queueName("sqs-touch"),
+		ReservationTimeout: 2 * time.Second,
+	}))
+}
+
 func TestSQSNamedMessage(t *testing.T) {
 	testNamedMessage(t, azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
 		Name:  queueName("sqs-named-message"),
@@ -64,3 +98,157 @@ func TestSQSDelayer(t *testing.T) {
 		Name: queueName("sqs-delayer"),
 	}))
 }
+
+func TestSQSLargePayload(t *testing.T) {
+	q := azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-large-payload"),
+	})
+	q.SetS3Options(&azsqs.S3Options{
+		S3:     s3.New(session.New()),
+		Bucket: s3Bucket,
+	})
+	_ = q.Purge()
+
+	payload := strings.Repeat("x", 512*1024)
+	ch := make(chan struct{})
+	handler := func(s string) error {
+		if s != payload {
+			t.Fatalf("got %d bytes, wanted %d", len(s), len(payload))
+		}
+		close(ch)
+		return nil
+	}
+
+	if err := q.Call(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler: handler,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("message was not processed")
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQSReleaseHeader(t *testing.T) {
+	q := azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-release-header"),
+	})
+	_ = q.Purge()
+
+	ch := make(chan *msgqueue.Message, 10)
+	handler := msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+		ch <- msg
+		if msg.Header["attempt"] == "" {
+			msg.Header = map[string]string{"tenant": msg.Header["tenant"], "attempt": "1"}
+			return errors.New("fake error")
+		}
+		return nil
+	})
+
+	msg := msgqueue.NewMessage()
+	msg.Header = map[string]string{"tenant": "acme"}
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	p := processor.Start(q, &msgqueue.Options{
+		Handler:    handler,
+		RetryLimit: 3,
+		MinBackoff: time.Second,
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg = <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message was not processed")
+		}
+	}
+	if msg.Header["tenant"] != "acme" || msg.Header["attempt"] != "1" {
+		t.Fatalf("got header %v", msg.Header)
+	}
+	if msg.ReservedCount != 2 {
+		t.Fatalf("got ReservedCount=%d, wanted 2", msg.ReservedCount)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQSRedrive(t *testing.T) {
+	testRedrive(t,
+		azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+			Name: queueName("sqs-redrive"),
+		}),
+		azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+			Name: queueName("sqs-redrive-dlq"),
+		}))
+}
+
+func TestSQSRedriveVerbatim(t *testing.T) {
+	q := azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-redrive-verbatim"),
+	})
+	dlq := azsqs.NewQueue(awsSQS(), accountId, &msgqueue.Options{
+		Name: queueName("sqs-redrive-verbatim-dlq"),
+	})
+	_ = q.Purge()
+	_ = dlq.Purge()
+
+	const n = 15
+
+	msgs := make([]*msgqueue.Message, n)
+	for i := range msgs {
+		msgs[i] = msgqueue.NewMessage(i)
+		msgs[i].Header = map[string]string{"tenant": "acme"}
+	}
+	if err := dlq.AddBatch(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := dlq.CloseTimeout(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := azsqs.Redrive(dlq, q, &processor.RedriveOptions{
+		MaxMessages: n,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != n {
+		t.Fatalf("moved %d messages, wanted %d", moved, n)
+	}
+
+	ch := make(chan *msgqueue.Message, n)
+	p := processor.Start(q, &msgqueue.Options{
+		Handler: msgqueue.HandlerFunc(func(msg *msgqueue.Message) error {
+			ch <- msg
+			return nil
+		}),
+	})
+
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-ch:
+			if msg.Header["tenant"] != "acme" {
+				t.Fatalf("got header %v", msg.Header)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d messages, wanted %d", i, n)
+		}
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	timerate "golang.org/x/time/rate"
+)
+
+// StatsJSONVersion is the version of the document produced by StatsJSON.
+// It is incremented when fields are renamed or removed; new fields
+// can be added without changing the version.
+const StatsJSONVersion = 1
+
+// statsJSONBuckets are upper bounds of the duration histogram
+// buckets reported by StatsJSON.
+var statsJSONBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+type statsDoc struct {
+	Version int       `json:"version"`
+	Queue   string    `json:"queue"`
+	Worker  string    `json:"worker"`
+	Time    time.Time `json:"time"`
+	// Time when the processor was created or stats were reset.
+	Since time.Time `json:"since"`
+
+	Gauges    statsGauges    `json:"gauges"`
+	Counters  statsCounters  `json:"counters"`
+	Rates     statsRates     `json:"rates"`
+	Durations statsDurations `json:"durations"`
+	Payload   statsPayload   `json:"payload"`
+	Config    statsConfig    `json:"config"`
+}
+
+type statsGauges struct {
+	Buffered     uint32 `json:"buffered"`
+	InFlight     uint32 `json:"in_flight"`
+	Delayed      uint32 `json:"delayed"`
+	Deleting     uint32 `json:"deleting"`
+	Abandoned    uint32 `json:"abandoned"`
+	WorkerNumber int    `json:"worker_number"`
+	Paused       bool   `json:"paused"`
+}
+
+type statsCounters struct {
+	Processed    uint64 `json:"processed"`
+	Retries      uint64 `json:"retries"`
+	Requeued     uint64 `json:"requeued"`
+	Fails        uint64 `json:"fails"`
+	Panics       uint64 `json:"panics"`
+	Timeouts     uint64 `json:"timeouts"`
+	DeadLettered uint64 `json:"dead_lettered"`
+	Expired      uint64 `json:"expired"`
+	Coalesced    uint64 `json:"coalesced"`
+	Filtered     uint64 `json:"filtered"`
+	Inversions   uint64 `json:"inversions"`
+}
+
+// statsRates are average numbers of messages per second since
+// the processor was created or stats were reset.
+type statsRates struct {
+	Processed float64 `json:"processed"`
+	Retries   float64 `json:"retries"`
+	Fails     float64 `json:"fails"`
+}
+
+type statsDurations struct {
+	AvgMs       float64        `json:"avg_ms"`
+	P50Ms       float64        `json:"p50_ms"`
+	P95Ms       float64        `json:"p95_ms"`
+	P99Ms       float64        `json:"p99_ms"`
+	ClockSkewMs float64        `json:"clock_skew_ms"`
+	Histogram   statsHistogram `json:"histogram"`
+}
+
+type statsHistogram struct {
+	Count uint64  `json:"count"`
+	SumMs float64 `json:"sum_ms"`
+	// Cumulative counts of durations that are less than
+	// or equal to the upper bound.
+	Buckets []statsBucket `json:"buckets"`
+}
+
+type statsBucket struct {
+	LeMs  float64 `json:"le_ms"`
+	Count uint64  `json:"count"`
+}
+
+type statsPayload struct {
+	MinBytes uint32 `json:"min_bytes"`
+	AvgBytes uint32 `json:"avg_bytes"`
+	MaxBytes uint32 `json:"max_bytes"`
+}
+
+type statsConfig struct {
+	WorkerNumber         int     `json:"worker_number"`
+	MinWorkers           int     `json:"min_workers"`
+	MaxWorkers           int     `json:"max_workers"`
+	ScavengerNumber      int     `json:"scavenger_number"`
+	BufferSize           int     `json:"buffer_size"`
+	PriorityLanes        int     `json:"priority_lanes"`
+	RetryLimit           int     `json:"retry_limit"`
+	MinBackoffMs         float64 `json:"min_backoff_ms"`
+	MaxAgeMs             float64 `json:"max_age_ms"`
+	HandlerTimeoutMs     float64 `json:"handler_timeout_ms"`
+	ReservationTimeoutMs float64 `json:"reservation_timeout_ms"`
+	// Current rate limit in messages per second or null if unlimited.
+	RateLimit *float64 `json:"rate_limit"`
+	Sync      bool     `json:"sync"`
+}
+
+// StatsJSON returns processor stats, including duration histogram and
+// processing options, as a versioned JSON document with stable field
+// names, e.g. for monitoring agents that should not depend on Stats
+// layout. Durations are in milliseconds. See StatsJSONVersion.
+func (p *Processor) StatsJSON() ([]byte, error) {
+	now := time.Now()
+	since := time.Unix(0, atomic.LoadInt64(&p.statsSince))
+	st := p.Stats()
+	counts, count, sum := p.DurationBuckets(statsJSONBuckets)
+
+	doc := &statsDoc{
+		Version: StatsJSONVersion,
+		Queue:   p.q.Name(),
+		Worker:  workerId,
+		Time:    now.UTC(),
+		Since:   since.UTC(),
+
+		Gauges: statsGauges{
+			Buffered:     st.Buffered,
+			InFlight:     st.InFlight,
+			Delayed:      st.Delayed,
+			Deleting:     st.Deleting,
+			Abandoned:    st.Abandoned,
+			WorkerNumber: p.WorkerNumber(),
+			Paused:       st.Paused,
+		},
+		Counters: statsCounters{
+			Processed:    st.Processed,
+			Retries:      st.Retries,
+			Requeued:     st.Requeued,
+			Fails:        st.Fails,
+			Panics:       st.Panics,
+			Timeouts:     st.Timeouts,
+			DeadLettered: st.DeadLettered,
+			Expired:      st.Expired,
+			Coalesced:    st.Coalesced,
+			Filtered:     st.Filtered,
+			Inversions:   st.Inversions,
+		},
+		Durations: statsDurations{
+			AvgMs:       durationMs(st.AvgDuration),
+			P50Ms:       durationMs(st.P50Duration),
+			P95Ms:       durationMs(st.P95Duration),
+			P99Ms:       durationMs(st.P99Duration),
+			ClockSkewMs: durationMs(st.ClockSkew),
+			Histogram: statsHistogram{
+				Count:   count,
+				SumMs:   durationMs(sum),
+				Buckets: make([]statsBucket, len(counts)),
+			},
+		},
+		Payload: statsPayload{
+			MinBytes: st.MinPayloadSize,
+			AvgBytes: st.AvgPayloadSize,
+			MaxBytes: st.MaxPayloadSize,
+		},
+		Config: statsConfig{
+			WorkerNumber:         p.opt.WorkerNumber,
+			MinWorkers:           p.opt.MinWorkers,
+			MaxWorkers:           p.opt.MaxWorkers,
+			ScavengerNumber:      p.opt.ScavengerNumber,
+			BufferSize:           p.opt.BufferSize,
+			PriorityLanes:        p.opt.PriorityLanes,
+			RetryLimit:           p.opt.RetryLimit,
+			MinBackoffMs:         durationMs(p.opt.MinBackoff),
+			MaxAgeMs:             durationMs(p.opt.MaxAge),
+			HandlerTimeoutMs:     durationMs(p.opt.HandlerTimeout),
+			ReservationTimeoutMs: durationMs(p.opt.ReservationTimeout),
+			Sync:                 p.opt.Sync,
+		},
+	}
+
+	if sec := now.Sub(since).Seconds(); sec > 0 {
+		doc.Rates = statsRates{
+			Processed: float64(st.Processed) / sec,
+			Retries:   float64(st.Retries) / sec,
+			Fails:     float64(st.Fails) / sec,
+		}
+	}
+
+	for i, n := range counts {
+		doc.Durations.Histogram.Buckets[i] = statsBucket{
+			LeMs:  durationMs(statsJSONBuckets[i]),
+			Count: n,
+		}
+	}
+
+	if limit := p.opt.RateLimitAt(now); limit != timerate.Inf {
+		f := float64(limit)
+		doc.Config.RateLimit = &f
+	}
+
+	return json.Marshal(doc)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+func endNoop(error) {}
+
+// startSpan starts span of the operation if Options.TracerProvider is set
+// and returns the function that ends it.
+func (p *Processor) startSpan(
+	ctx context.Context, name string, msg *msgqueue.Message,
+) (context.Context, func(error)) {
+	tracer := p.opt.Tracer()
+	if tracer == nil {
+		return ctx, endNoop
+	}
+	ctx, span := tracer.Start(ctx, name, msg)
+	return ctx, span.End
+}
+
+// traceProcess starts processing span that continues the trace stored
+// in the message header by the producer and returns the function that
+// ends it. Discarded and requeued messages are not traced as errors.
+func (p *Processor) traceProcess(msg *msgqueue.Message) func(error) {
+	tracer := p.opt.Tracer()
+	if tracer == nil {
+		return endNoop
+	}
+	ctx := tracer.Extract(msg.Context(), msg.Header)
+	ctx, span := tracer.Start(ctx, msgqueue.SpanProcess, msg)
+	msg.SetContext(ctx)
+	return func(err error) {
+		if errors.Is(err, msgqueue.ErrDiscarded) || isRequeue(err) {
+			err = nil
+		}
+		span.End(err)
+	}
+}
+
+func (p *Processor) reserveN(n int) ([]msgqueue.Message, error) {
+	_, end := p.startSpan(context.Background(), msgqueue.SpanReserve, nil)
+	msgs, err := p.q.ReserveN(n)
+	if err == ErrNotSupported {
+		end(nil)
+	} else {
+		end(err)
+	}
+	return msgs, err
+}
+
+func (p *Processor) releaseMessage(msg *msgqueue.Message, delay time.Duration) error {
+	_, end := p.startSpan(msg.Context(), msgqueue.SpanRelease, msg)
+	err := p.q.Release(msg, delay)
+	end(err)
+	return err
+}
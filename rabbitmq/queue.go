@@ -0,0 +1,635 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message headers that store message attributes.
+// RabbitMQ does not count deliveries of classic queues, so reserved
+// count is stored in the header when the message is released.
+const (
+	priorityHeader      = "Msgqueue-Priority"
+	retryLimitHeader    = "Msgqueue-Retry-Limit"
+	groupKeyHeader      = "Msgqueue-Group-Key"
+	barrierHeader       = "Msgqueue-Barrier"
+	reservedCountHeader = "Msgqueue-Reserved-Count"
+)
+
+// Default max_message_size of RabbitMQ server.
+const maxMessageSize = 16 * 1024 * 1024
+
+// Maximum message TTL supported by RabbitMQ.
+const maxDelay = (1<<32 - 1) * time.Millisecond
+
+// Time during which ReserveN waits for messages.
+const fetchWait = time.Second
+
+var errNacked = errors.New("queue: message is nacked by the broker")
+
+type Queue struct {
+	conn     *amqp.Connection
+	opt      *msgqueue.Options
+	producer *producer.Producer
+
+	// Channel in confirm mode used to publish messages.
+	pubMu sync.Mutex
+	pubCh *amqp.Channel
+
+	// Consumer channel generation is incremented every time new channel
+	// is opened, because delivery tags are unique only per channel.
+	consumeMu  sync.Mutex
+	consumeCh  *amqp.Channel
+	consumeGen uint64
+	deliveries <-chan amqp.Delivery
+
+	// Time when delay queues were declared, so they are declared
+	// again before they expire.
+	delaysMu sync.Mutex
+	delays   map[time.Duration]time.Time
+
+	// Reserved messages indexed by channel generation and delivery tag,
+	// so they can be acked.
+	reservedMu sync.Mutex
+	reserved   map[string]reservedDelivery
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that publishes messages to the durable
+// queue opt.Name using the default exchange and consumes them with
+// prefetch count opt.BufferSize. The queue is declared on first use.
+func NewQueue(conn *amqp.Connection, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		conn:     conn,
+		opt:      opt,
+		delays:   make(map[time.Duration]time.Time),
+		reserved: make(map[string]reservedDelivery),
+	}
+
+	q.producer = producer.New(opt, q.add, producer.MaxSize(maxMessageSize))
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(conn *amqp.Connection, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(conn, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:           q.Name(),
+		Backend:        "rabbitmq",
+		Options:        q.opt,
+		MaxPayloadSize: maxMessageSize,
+		MaxDelay:       maxDelay,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+func (q *Queue) declare(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(q.Name(), true, false, false, false, nil)
+	return err
+}
+
+// publishChannel returns the channel used to publish messages
+// opening new one if the previous channel is closed.
+func (q *Queue) publishChannel() (*amqp.Channel, error) {
+	q.pubMu.Lock()
+	defer q.pubMu.Unlock()
+
+	if q.pubCh != nil && !q.pubCh.IsClosed() {
+		return q.pubCh, nil
+	}
+
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if err := q.declare(ch); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	q.pubCh = ch
+	return ch, nil
+}
+
+// consume returns deliveries of the queue consumer and generation
+// of its channel starting new consumer if the previous channel is closed.
+func (q *Queue) consume() (<-chan amqp.Delivery, uint64, error) {
+	q.consumeMu.Lock()
+	defer q.consumeMu.Unlock()
+
+	if q.consumeCh != nil && !q.consumeCh.IsClosed() {
+		return q.deliveries, q.consumeGen, nil
+	}
+
+	ch, err := q.conn.Channel()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := q.declare(ch); err != nil {
+		ch.Close()
+		return nil, 0, err
+	}
+	if err := ch.Qos(q.opt.BufferSize, 0, false); err != nil {
+		ch.Close()
+		return nil, 0, err
+	}
+	deliveries, err := ch.Consume(q.Name(), "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, 0, err
+	}
+
+	q.consumeGen++
+	gen := q.consumeGen
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		// Deliveries of the closed channel can't be acked
+		// and are redelivered by the broker.
+		for range closed {
+		}
+		q.dropReserved(gen)
+	}()
+
+	q.consumeCh = ch
+	q.deliveries = deliveries
+	return deliveries, gen, nil
+}
+
+// delayBucket rounds the delay up to the power of two milliseconds,
+// so only a few delay queues are declared. Messages are never delivered
+// before the delay, but can be delivered up to twice as late.
+func delayBucket(delay time.Duration) time.Duration {
+	if delay >= maxDelay {
+		return maxDelay
+	}
+	ms := uint64((delay + time.Millisecond - 1) / time.Millisecond)
+	if ms <= 1 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	bucket := time.Duration(1<<bits.Len64(ms-1)) * time.Millisecond
+	if bucket > maxDelay {
+		return maxDelay
+	}
+	return bucket
+}
+
+// delayQueue returns name of the queue that holds messages for the delay
+// and dead-letters them to the queue. The delay queue is deleted by the
+// broker when it is not declared again for twice the delay plus an hour,
+// so the name is declared again after half of that time.
+func (q *Queue) delayQueue(ch *amqp.Channel, delay time.Duration) (string, error) {
+	name := fmt.Sprintf("%s.delay.%d", q.Name(), delay/time.Millisecond)
+	expires := 2*delay + time.Hour
+
+	q.delaysMu.Lock()
+	declared, ok := q.delays[delay]
+	q.delaysMu.Unlock()
+	if ok && time.Since(declared) < expires/2 {
+		return name, nil
+	}
+
+	_, err := ch.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":             int64(delay / time.Millisecond),
+		"x-expires":                 int64(expires / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": q.Name(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	q.delaysMu.Lock()
+	q.delays[delay] = time.Now()
+	q.delaysMu.Unlock()
+	return name, nil
+}
+
+// publish publishes the message to the queue after the delay and waits
+// until the broker confirms it.
+func (q *Queue) publish(pub amqp.Publishing, delay time.Duration) error {
+	ch, err := q.publishChannel()
+	if err != nil {
+		return err
+	}
+
+	key := q.Name()
+	if delay >= time.Millisecond {
+		key, err = q.delayQueue(ch, delayBucket(delay))
+		if err != nil {
+			return err
+		}
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(
+		context.Background(), "", key, false, false, pub)
+	if err != nil {
+		return err
+	}
+	if !confirm.Wait() {
+		return errNacked
+	}
+	return nil
+}
+
+// Len returns the number of messages that are ready to be delivered.
+// Delayed messages are not counted.
+func (q *Queue) Len() (int, error) {
+	ch, err := q.publishChannel()
+	if err != nil {
+		return 0, err
+	}
+	queue, err := ch.QueueDeclarePassive(q.Name(), true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	return queue.Messages, nil
+}
+
+// Ping checks that the connection is open and the queue is reachable.
+func (q *Queue) Ping() error {
+	if q.conn.IsClosed() {
+		return amqp.ErrClosed
+	}
+	_, err := q.Len()
+	return err
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.publishMessage(msg)
+}
+
+// addBatch publishes messages one by one, because
+// AMQP does not support batched publishing.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	for _, msg := range msgs {
+		if err := q.publishMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Queue) publishMessage(msg *msgqueue.Message) error {
+	id, err := newMessageId()
+	if err != nil {
+		return err
+	}
+
+	err = q.publish(amqp.Publishing{
+		Headers:      publishingHeaders(msg),
+		DeliveryMode: amqp.Persistent,
+		MessageId:    id,
+		Timestamp:    time.Now(),
+		Body:         []byte(msg.Body),
+	}, msg.ScheduledDelay())
+	if err != nil {
+		return err
+	}
+
+	msg.Id = id
+	return nil
+}
+
+// publishingHeaders returns AMQP headers that store message
+// header and options.
+func publishingHeaders(msg *msgqueue.Message) amqp.Table {
+	headers := make(amqp.Table, len(msg.Header)+1)
+	for k, v := range msg.Header {
+		headers[k] = v
+	}
+	if msg.Priority != 0 {
+		headers[priorityHeader] = strconv.Itoa(msg.Priority)
+	}
+	if msg.RetryLimit != 0 {
+		headers[retryLimitHeader] = strconv.Itoa(msg.RetryLimit)
+	}
+	if msg.GroupKey != "" {
+		headers[groupKeyHeader] = msg.GroupKey
+	}
+	if msg.Barrier {
+		headers[barrierHeader] = "1"
+	}
+	return headers
+}
+
+func newMessageId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Add adds message to the queue. It returns msgqueue.ErrTooLarge
+// if encoded message exceeds RabbitMQ max message size.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue. Named messages are added
+// using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN waits for the first delivery up to a second and returns
+// it together with other deliveries that are already prefetched.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	deliveries, gen, err := q.consume()
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(fetchWait)
+	defer timer.Stop()
+
+	var msgs []msgqueue.Message
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			return nil, amqp.ErrClosed
+		}
+		msgs = append(msgs, q.reserve(d, gen))
+	case <-timer.C:
+		return nil, nil
+	}
+
+	for len(msgs) < n {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return msgs, nil
+			}
+			msgs = append(msgs, q.reserve(d, gen))
+		default:
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
+
+type reservedDelivery struct {
+	gen uint64
+	amqp.Delivery
+}
+
+func (q *Queue) reserve(d amqp.Delivery, gen uint64) msgqueue.Message {
+	reservedCount, _ := strconv.Atoi(headerString(d.Headers, reservedCountHeader))
+	reservedCount++
+	if d.Redelivered {
+		// Previous delivery was not acked before the channel was closed.
+		reservedCount++
+	}
+
+	priority, _ := strconv.Atoi(headerString(d.Headers, priorityHeader))
+	retryLimit, _ := strconv.Atoi(headerString(d.Headers, retryLimitHeader))
+
+	reservationId := strconv.FormatUint(gen, 10) + ":" + strconv.FormatUint(d.DeliveryTag, 10)
+	q.reservedMu.Lock()
+	q.reserved[reservationId] = reservedDelivery{gen: gen, Delivery: d}
+	q.reservedMu.Unlock()
+
+	return msgqueue.Message{
+		Id:            d.MessageId,
+		Body:          string(d.Body),
+		Header:        messageHeader(d.Headers),
+		Priority:      priority,
+		RetryLimit:    retryLimit,
+		GroupKey:      headerString(d.Headers, groupKeyHeader),
+		Barrier:       headerString(d.Headers, barrierHeader) != "",
+		CreatedAt:     d.Timestamp,
+		ReservationId: reservationId,
+		ReservedCount: reservedCount,
+	}
+}
+
+func headerString(t amqp.Table, key string) string {
+	s, _ := t[key].(string)
+	return s
+}
+
+func messageHeader(t amqp.Table) map[string]string {
+	var header map[string]string
+	for k, v := range t {
+		s, ok := v.(string)
+		if !ok || k == priorityHeader || k == retryLimitHeader ||
+			k == groupKeyHeader || k == barrierHeader || k == reservedCountHeader {
+			continue
+		}
+		if header == nil {
+			header = make(map[string]string, len(t))
+		}
+		header[k] = s
+	}
+	return header
+}
+
+func (q *Queue) reservedDelivery(msg *msgqueue.Message) (amqp.Delivery, error) {
+	q.reservedMu.Lock()
+	d, ok := q.reserved[msg.ReservationId]
+	if ok {
+		delete(q.reserved, msg.ReservationId)
+	}
+	q.reservedMu.Unlock()
+
+	if !ok {
+		return d.Delivery, fmt.Errorf("queue: %s is not reserved", msg)
+	}
+	return d.Delivery, nil
+}
+
+// dropReserved forgets deliveries of the closed channel generation.
+func (q *Queue) dropReserved(gen uint64) {
+	q.reservedMu.Lock()
+	for id, d := range q.reserved {
+		if d.gen == gen {
+			delete(q.reserved, id)
+		}
+	}
+	q.reservedMu.Unlock()
+}
+
+// Release publishes copy of the message with the delay using delay
+// queue and acks the original message. AMQP can't redeliver messages
+// with delay, so the delay queue dead-letters the message to the queue
+// when its TTL expires. Message is requeued without delay if the copy
+// can't be published.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	d, err := q.reservedDelivery(msg)
+	if err != nil {
+		return err
+	}
+
+	// Header can be changed by the handler, so it is
+	// published from the message instead of the delivery.
+	headers := publishingHeaders(msg)
+	headers[reservedCountHeader] = strconv.Itoa(msg.ReservedCount)
+
+	err = q.publish(amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	}, delay)
+	if err != nil {
+		_ = d.Nack(false, true)
+		return err
+	}
+	return d.Ack(false)
+}
+
+// Touch is not supported, because AMQP has no reservation timeout.
+// Unacked messages stay reserved until the channel is closed.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	return msgqueue.ErrNotSupported
+}
+
+// Delete acks the message.
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	d, err := q.reservedDelivery(msg)
+	if err != nil {
+		return err
+	}
+	return d.Ack(false)
+}
+
+// DeleteBatch acks the messages one by one, because messages
+// can't be acked with a single multiple ack out of order.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	var firstErr error
+	for _, msg := range msgs {
+		if err := q.Delete(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Purge deletes ready messages from the queue.
+// Delayed messages are not deleted.
+func (q *Queue) Purge() error {
+	ch, err := q.publishChannel()
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueuePurge(q.Name(), false)
+	return err
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+// Channels are closed after the processor is stopped, so the broker
+// redelivers prefetched messages to other consumers.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	q.consumeMu.Lock()
+	if q.consumeCh != nil {
+		if err := q.consumeCh.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		q.consumeCh = nil
+	}
+	q.consumeMu.Unlock()
+
+	q.pubMu.Lock()
+	if q.pubCh != nil {
+		if err := q.pubCh.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		q.pubCh = nil
+	}
+	q.pubMu.Unlock()
+
+	return firstErr
+}
@@ -0,0 +1,56 @@
+package msgqueue
+
+import (
+	"sync"
+	"time"
+
+	timerate "golang.org/x/time/rate"
+)
+
+// LocalRateLimiter is an in-process token bucket RateLimiter. It is used
+// by default when RateLimit is set without Redis, so limits are enforced
+// per process rather than across all processes sharing the queue.
+type LocalRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*timerate.Limiter
+}
+
+var _ RateLimiter = (*LocalRateLimiter)(nil)
+
+func NewLocalRateLimiter() *LocalRateLimiter {
+	return &LocalRateLimiter{
+		limiters: make(map[string]*timerate.Limiter),
+	}
+}
+
+func (l *LocalRateLimiter) AllowRate(name string, limit timerate.Limit) (time.Duration, bool) {
+	if limit == timerate.Inf {
+		return 0, true
+	}
+
+	r := l.limiter(name, limit).Reserve()
+	if !r.OK() {
+		return time.Second, false
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return 0, true
+	}
+	r.Cancel()
+	return delay, false
+}
+
+func (l *LocalRateLimiter) limiter(name string, limit timerate.Limit) *timerate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.limiters[name]
+	if !ok {
+		lim = timerate.NewLimiter(limit, 1)
+		l.limiters[name] = lim
+	} else if lim.Limit() != limit {
+		lim.SetLimit(limit)
+	}
+	return lim
+}
@@ -0,0 +1,82 @@
+package msgqueue
+
+import (
+	"fmt"
+	"time"
+
+	timerate "golang.org/x/time/rate"
+)
+
+const day = 24 * time.Hour
+
+// RateLimitWindow overrides Options.RateLimit during a time of day window.
+// Start and End are offsets from midnight in local time. Window with End
+// before Start wraps around midnight, e.g. 22:00-06:00.
+type RateLimitWindow struct {
+	Start time.Duration
+	End   time.Duration
+	Limit timerate.Limit
+}
+
+func (w *RateLimitWindow) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+func (w *RateLimitWindow) validate() error {
+	if w.Start < 0 || w.Start >= day {
+		return fmt.Errorf("queue: RateLimitWindow.Start=%s is out of range", w.Start)
+	}
+	if w.End < 0 || w.End >= day {
+		return fmt.Errorf("queue: RateLimitWindow.End=%s is out of range", w.End)
+	}
+	if w.Limit < 0 {
+		return fmt.Errorf("queue: RateLimitWindow.Limit=%v is negative", w.Limit)
+	}
+	return nil
+}
+
+// RateLimitAt returns the rate limit in effect at tm. The first window
+// in RateLimitSchedule that contains tm wins; otherwise RateLimit is used.
+func (opt *Options) RateLimitAt(tm time.Time) timerate.Limit {
+	if len(opt.RateLimitSchedule) == 0 {
+		return opt.RateLimit
+	}
+
+	tm = tm.Local()
+	midnight := time.Date(tm.Year(), tm.Month(), tm.Day(), 0, 0, 0, 0, tm.Location())
+	offset := tm.Sub(midnight)
+
+	for i := range opt.RateLimitSchedule {
+		w := &opt.RateLimitSchedule[i]
+		if w.contains(offset) {
+			return w.Limit
+		}
+	}
+	return opt.RateLimit
+}
+
+func (opt *Options) hasRateLimit() bool {
+	if opt.RateLimit != 0 && opt.RateLimit != timerate.Inf {
+		return true
+	}
+	for _, w := range opt.RateLimitSchedule {
+		if w.Limit != 0 && w.Limit != timerate.Inf {
+			return true
+		}
+	}
+	return false
+}
+
+// minRateLimit returns the lowest configured rate limit.
+func (opt *Options) minRateLimit() timerate.Limit {
+	limit := opt.RateLimit
+	for _, w := range opt.RateLimitSchedule {
+		if w.Limit < limit {
+			limit = w.Limit
+		}
+	}
+	return limit
+}
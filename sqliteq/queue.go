@@ -0,0 +1,450 @@
+package sqliteq
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/internal/producer"
+	"github.com/go-msgqueue/msgqueue/processor"
+)
+
+// Table that stores messages of all queues.
+const tableName = "msgqueue_messages"
+
+// Times are stored as Unix time in milliseconds.
+const createTableQuery = `
+CREATE TABLE IF NOT EXISTS ` + tableName + ` (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	queue TEXT NOT NULL,
+	body BLOB NOT NULL,
+	header TEXT,
+	priority INTEGER NOT NULL DEFAULT 0,
+	retry_limit INTEGER NOT NULL DEFAULT 0,
+	group_key TEXT NOT NULL DEFAULT '',
+	barrier INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	locked_until INTEGER NOT NULL,
+	reserved_count INTEGER NOT NULL DEFAULT 0,
+	reservation_id TEXT
+);
+CREATE INDEX IF NOT EXISTS ` + tableName + `_queue_locked_until_idx
+	ON ` + tableName + ` (queue, locked_until);
+`
+
+const selectReadyQuery = `
+SELECT id, body, header, priority, retry_limit, group_key, barrier,
+	created_at, reserved_count
+FROM ` + tableName + `
+WHERE queue = ? AND locked_until <= ?
+ORDER BY priority DESC, id
+LIMIT ?
+`
+
+// Local file is cheap to poll, but there is no way
+// to wait for new messages.
+const pollInterval = 100 * time.Millisecond
+
+type Queue struct {
+	db  *sql.DB
+	opt *msgqueue.Options
+
+	producer *producer.Producer
+
+	// SQLite allows only one writer at a time, so writes of the queue
+	// are serialized instead of failing with SQLITE_BUSY.
+	mu      sync.Mutex
+	created bool
+
+	p *processor.Processor
+}
+
+var _ processor.Queuer = (*Queue)(nil)
+var _ processor.ManagedQueue = (*Queue)(nil)
+var _ processor.Lener = (*Queue)(nil)
+var _ msgqueue.Describer = (*Queue)(nil)
+
+// NewQueue creates new Queue that stores messages in the
+// msgqueue_messages table of the SQLite database. The table is
+// created on first use. SQLite driver, e.g. github.com/mattn/go-sqlite3
+// or modernc.org/sqlite, must be registered by the app.
+func NewQueue(db *sql.DB, opt *msgqueue.Options) *Queue {
+	opt.Init()
+
+	q := Queue{
+		db:  db,
+		opt: opt,
+	}
+
+	q.producer = producer.New(opt, q.add, nil)
+
+	registerQueue(&q)
+	return &q
+}
+
+// New creates new Queue using functional options. Unlike NewQueue
+// it returns an error if options are invalid.
+func New(db *sql.DB, opts ...msgqueue.Option) (*Queue, error) {
+	opt, err := msgqueue.NewOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewQueue(db, opt), nil
+}
+
+func (q *Queue) Name() string {
+	return q.opt.Name
+}
+
+func (q *Queue) String() string {
+	return fmt.Sprintf("Queue<%s>", q.Name())
+}
+
+func (q *Queue) Options() *msgqueue.Options {
+	return q.opt
+}
+
+func (q *Queue) Describe() *msgqueue.Description {
+	return &msgqueue.Description{
+		Name:    q.Name(),
+		Backend: "sqlite",
+		Options: q.opt,
+		Capabilities: msgqueue.Capabilities{
+			Delay: true,
+			Purge: true,
+			Renew: true,
+			Len:   true,
+		},
+	}
+}
+
+func (q *Queue) Processor() *processor.Processor {
+	if q.p == nil {
+		q.p = processor.New(q, q.opt)
+	}
+	return q.p
+}
+
+// do calls fn with q.mu held creating the messages table if needed.
+func (q *Queue) do(fn func() error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.created {
+		if _, err := q.db.Exec(createTableQuery); err != nil {
+			return err
+		}
+		q.created = true
+	}
+	return fn()
+}
+
+// Len returns the number of messages that are ready to be reserved.
+func (q *Queue) Len() (int, error) {
+	var n int
+	err := q.do(func() error {
+		return q.db.QueryRow(
+			`SELECT count(*) FROM `+tableName+` WHERE queue = ? AND locked_until <= ?`,
+			q.Name(), unixMilli(time.Now()),
+		).Scan(&n)
+	})
+	return n, err
+}
+
+// Ping checks that the database is reachable.
+func (q *Queue) Ping() error {
+	return q.db.Ping()
+}
+
+func (q *Queue) add(msg *msgqueue.Message) error {
+	if msgs, ok := msg.Args[0].([]*msgqueue.Message); ok {
+		return q.addBatch(msgs)
+	}
+
+	msg = msg.Args[0].(*msgqueue.Message)
+	return q.addBatch([]*msgqueue.Message{msg})
+}
+
+// addBatch inserts messages in a single transaction.
+func (q *Queue) addBatch(msgs []*msgqueue.Message) error {
+	return q.do(func() error {
+		tx, err := q.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Prepare(`INSERT INTO ` + tableName + ` (queue, body, header, ` +
+			`priority, retry_limit, group_key, barrier, created_at, locked_until) ` +
+			`VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		now := time.Now()
+		ids := make([]int64, len(msgs))
+		for i, msg := range msgs {
+			var header interface{}
+			if len(msg.Header) > 0 {
+				b, err := json.Marshal(msg.Header)
+				if err != nil {
+					return err
+				}
+				header = string(b)
+			}
+
+			res, err := stmt.Exec(
+				q.Name(), []byte(msg.Body), header, msg.Priority,
+				msg.RetryLimit, msg.GroupKey, msg.Barrier,
+				unixMilli(now), unixMilli(now.Add(msg.ScheduledDelay())),
+			)
+			if err != nil {
+				return err
+			}
+			ids[i], err = res.LastInsertId()
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		for i, msg := range msgs {
+			msg.Id = strconv.FormatInt(ids[i], 10)
+		}
+		return nil
+	})
+}
+
+// Add adds message to the queue.
+func (q *Queue) Add(msg *msgqueue.Message) error {
+	return q.producer.Add(msg)
+}
+
+// AddBatch adds messages to the queue using transactions.
+// Named messages are added using Add so they are deduplicated as usual.
+func (q *Queue) AddBatch(msgs []*msgqueue.Message) error {
+	return q.producer.AddBatch(msgs)
+}
+
+// Call creates a message using the args and adds it to the queue.
+func (q *Queue) Call(args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	return q.Add(msg)
+}
+
+// CallOnce works like Call, but it adds message with same args
+// only once in a period.
+func (q *Queue) CallOnce(period time.Duration, args ...interface{}) error {
+	msg := msgqueue.NewMessage(args...)
+	msg.SetDelayName(period, args...)
+	return q.Add(msg)
+}
+
+// ReserveN locks up to n ready messages with highest priority
+// for ReservationTimeout. Locked messages become ready again when
+// the lock expires, including after the process is restarted.
+func (q *Queue) ReserveN(n int) ([]msgqueue.Message, error) {
+	reservationId := newReservationId()
+
+	var msgs []msgqueue.Message
+	err := q.do(func() error {
+		tx, err := q.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		now := time.Now()
+		msgs, err = selectReady(tx, q.Name(), now, n)
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+
+		var b strings.Builder
+		b.WriteString(`UPDATE ` + tableName + ` SET locked_until = ?, ` +
+			`reserved_count = reserved_count + 1, reservation_id = ? WHERE id IN (`)
+		args := []interface{}{
+			unixMilli(now.Add(q.opt.ReservationTimeout)), reservationId,
+		}
+		for i := range msgs {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("?")
+			args = append(args, msgs[i].Id)
+
+			msgs[i].ReservationId = reservationId
+			msgs[i].ReservedCount++
+		}
+		b.WriteString(")")
+
+		if _, err := tx.Exec(b.String(), args...); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		time.Sleep(pollInterval)
+	}
+	return msgs, nil
+}
+
+func selectReady(tx *sql.Tx, queue string, now time.Time, n int) ([]msgqueue.Message, error) {
+	rows, err := tx.Query(selectReadyQuery, queue, unixMilli(now), n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []msgqueue.Message
+	for rows.Next() {
+		var (
+			id        int64
+			body      []byte
+			header    sql.NullString
+			createdAt int64
+			msg       msgqueue.Message
+		)
+		err := rows.Scan(
+			&id, &body, &header, &msg.Priority, &msg.RetryLimit,
+			&msg.GroupKey, &msg.Barrier, &createdAt, &msg.ReservedCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Id = strconv.FormatInt(id, 10)
+		msg.Body = string(body)
+		msg.CreatedAt = time.Unix(0, createdAt*int64(time.Millisecond))
+		if header.Valid {
+			if err := json.Unmarshal([]byte(header.String), &msg.Header); err != nil {
+				return nil, err
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func newReservationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixMilli(tm time.Time) int64 {
+	return tm.UnixNano() / int64(time.Millisecond)
+}
+
+func parseId(msg *msgqueue.Message) (int64, error) {
+	return strconv.ParseInt(msg.Id, 10, 64)
+}
+
+// Release unlocks the message after the delay. The message is not
+// changed if its reservation expired and it is reserved again.
+func (q *Queue) Release(msg *msgqueue.Message, delay time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	return q.do(func() error {
+		_, err := q.db.Exec(
+			`UPDATE `+tableName+` SET locked_until = ?, reservation_id = NULL `+
+				`WHERE id = ? AND reservation_id = ?`,
+			unixMilli(time.Now().Add(delay)), id, msg.ReservationId,
+		)
+		return err
+	})
+}
+
+// Touch extends message lock to the duration from now.
+func (q *Queue) Touch(msg *msgqueue.Message, dur time.Duration) error {
+	id, err := parseId(msg)
+	if err != nil {
+		return err
+	}
+	return q.do(func() error {
+		_, err := q.db.Exec(
+			`UPDATE `+tableName+` SET locked_until = ? WHERE id = ? AND reservation_id = ?`,
+			unixMilli(time.Now().Add(dur)), id, msg.ReservationId,
+		)
+		return err
+	})
+}
+
+func (q *Queue) Delete(msg *msgqueue.Message) error {
+	return q.DeleteBatch([]*msgqueue.Message{msg})
+}
+
+// DeleteBatch deletes the messages in a single transaction. Messages which
+// reservation expired and that are reserved again are not deleted.
+func (q *Queue) DeleteBatch(msgs []*msgqueue.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	return q.do(func() error {
+		tx, err := q.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		stmt, err := tx.Prepare(`DELETE FROM ` + tableName + ` WHERE id = ? AND reservation_id = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for _, msg := range msgs {
+			id, err := parseId(msg)
+			if err != nil {
+				return err
+			}
+			if _, err := stmt.Exec(id, msg.ReservationId); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// Purge deletes all messages of the queue including reserved messages.
+func (q *Queue) Purge() error {
+	return q.do(func() error {
+		_, err := q.db.Exec(`DELETE FROM `+tableName+` WHERE queue = ?`, q.Name())
+		return err
+	})
+}
+
+// Close is CloseTimeout with 30 seconds timeout.
+func (q *Queue) Close() error {
+	return q.CloseTimeout(30 * time.Second)
+}
+
+// Close closes the queue waiting for pending messages to be processed.
+func (q *Queue) CloseTimeout(timeout time.Duration) error {
+	var firstErr error
+	if err := q.producer.CloseTimeout(timeout); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if q.p != nil {
+		if err := q.p.StopTimeout(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
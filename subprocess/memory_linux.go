@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package subprocess
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+func processRSS(pid int) (int64, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	var size, rss int64
+	if _, err := fmt.Sscan(string(b), &size, &rss); err != nil {
+		return 0, err
+	}
+	return rss * int64(os.Getpagesize()), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package subprocess
+
+import "github.com/go-msgqueue/msgqueue"
+
+func processRSS(pid int) (int64, error) {
+	return 0, msgqueue.ErrNotSupported
+}
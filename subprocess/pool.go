@@ -0,0 +1,300 @@
+// Package subprocess runs message handlers in a pool of worker processes,
+// so a crashing or misbehaving handler can't take down the consumer.
+//
+// Worker process reads requests from stdin and writes responses to stdout,
+// one JSON document per line. Worker must write exactly one response for
+// each request. Worker stderr is passed through to the consumer stderr.
+package subprocess
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+// Request is written to worker stdin as one line of JSON.
+type Request struct {
+	Id     string            `json:"id,omitempty"`
+	Body   string            `json:"body"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+// Response is read from worker stdout as one line of JSON.
+// Empty Error means that message was processed successfully.
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+type Options struct {
+	// Path and args of the worker executable.
+	Path string
+	Args []string
+	// Environment of the worker process. The default is
+	// the environment of the current process.
+	Env []string
+
+	// Number of worker processes. The default is runtime.NumCPU().
+	PoolSize int
+
+	// Time after which worker processing a message is killed
+	// and respawned. The default is no limit.
+	Timeout time.Duration
+
+	// Resident memory in bytes after which worker is killed
+	// and respawned. Only supported on Linux. The default is no limit.
+	MaxMemory int64
+
+	// Codec used to encode message args when message has no body.
+	// The default is msgqueue.MsgpackCodec.
+	Codec msgqueue.Codec
+}
+
+func (opt *Options) init() {
+	if opt.PoolSize == 0 {
+		opt.PoolSize = runtime.NumCPU()
+	}
+	if opt.Codec == nil {
+		opt.Codec = msgqueue.MsgpackCodec
+	}
+}
+
+// Pool is a msgqueue.Handler that passes messages to worker processes.
+// Workers are started lazily and respawned when they crash, time out,
+// or exceed memory limit.
+type Pool struct {
+	opt    *Options
+	procs  chan *process
+	closed uint32
+}
+
+var _ msgqueue.Handler = (*Pool)(nil)
+
+func NewPool(opt *Options) *Pool {
+	opt.init()
+	p := &Pool{
+		opt:   opt,
+		procs: make(chan *process, opt.PoolSize),
+	}
+	for i := 0; i < opt.PoolSize; i++ {
+		p.procs <- nil
+	}
+	return p
+}
+
+func (p *Pool) HandleMessage(msg *msgqueue.Message) error {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return msgqueue.ErrShutdown
+	}
+
+	proc := <-p.procs
+	defer func() {
+		p.procs <- proc
+	}()
+
+	if proc != nil && proc.exited() {
+		proc.kill()
+		proc = nil
+	}
+	if proc == nil {
+		var err error
+		proc, err = p.spawn()
+		if err != nil {
+			return err
+		}
+	}
+
+	body := msg.Body
+	if body == "" {
+		var err error
+		body, err = msg.EncodeArgs(p.opt.Codec)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := proc.call(&Request{
+		Id:     msg.Id,
+		Body:   body,
+		Header: msg.Header,
+	}, p.opt.Timeout)
+	if err != nil {
+		proc.kill()
+		proc = nil
+		return err
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+// Close waits for workers to finish processing current messages
+// and kills them.
+func (p *Pool) Close() error {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return nil
+	}
+	for i := 0; i < p.opt.PoolSize; i++ {
+		if proc := <-p.procs; proc != nil {
+			proc.kill()
+		}
+	}
+	for i := 0; i < p.opt.PoolSize; i++ {
+		p.procs <- nil
+	}
+	return nil
+}
+
+func (p *Pool) spawn() (*process, error) {
+	cmd := exec.Command(p.opt.Path, p.opt.Args...)
+	cmd.Env = p.opt.Env
+	cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// os.Pipe is used instead of StdoutPipe, because Wait closes
+	// StdoutPipe and the last response could be lost.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = w
+
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		w.Close()
+		return nil, err
+	}
+	w.Close()
+
+	proc := &process{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		r:      bufio.NewReader(stdout),
+		done:   make(chan struct{}),
+	}
+	go proc.wait()
+	if p.opt.MaxMemory > 0 {
+		go proc.watchMemory(p.opt.MaxMemory)
+	}
+	return proc, nil
+}
+
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	r      *bufio.Reader
+
+	done      chan struct{}
+	oomKilled uint32
+}
+
+func (p *process) wait() {
+	_ = p.cmd.Wait()
+	close(p.done)
+}
+
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill kills the worker process group unless the worker has already
+// exited and was reaped, because its group id could be reused.
+func (p *process) kill() {
+	if !p.exited() {
+		_ = killProcess(p.cmd)
+	}
+	<-p.done
+	p.stdin.Close()
+	p.stdout.Close()
+}
+
+type result struct {
+	line []byte
+	err  error
+}
+
+func (p *process) call(req *Request, timeout time.Duration) (*Response, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+		return nil, p.exitError(err)
+	}
+
+	ch := make(chan result, 1)
+	go func() {
+		line, err := p.r.ReadBytes('\n')
+		ch <- result{line: line, err: err}
+	}()
+
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, p.exitError(res.err)
+		}
+		var resp Response
+		if err := json.Unmarshal(res.line, &resp); err != nil {
+			return nil, fmt.Errorf("subprocess: invalid response %q: %s", res.line, err)
+		}
+		return &resp, nil
+	case <-timeoutCh:
+		return nil, fmt.Errorf("subprocess: worker timed out after %s", timeout)
+	}
+}
+
+func (p *process) exitError(err error) error {
+	if atomic.LoadUint32(&p.oomKilled) == 1 {
+		return errors.New("subprocess: worker exceeded memory limit")
+	}
+	return fmt.Errorf("subprocess: worker exited: %s", err)
+}
+
+func (p *process) watchMemory(max int64) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		rss, err := processRSS(p.cmd.Process.Pid)
+		if err != nil || rss <= max {
+			continue
+		}
+		atomic.StoreUint32(&p.oomKilled, 1)
+		_ = killProcess(p.cmd)
+		return
+	}
+}
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package subprocess_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/subprocess"
+)
+
+func shellPool(script string, timeout time.Duration) *subprocess.Pool {
+	return subprocess.NewPool(&subprocess.Options{
+		Path:     "/bin/sh",
+		Args:     []string{"-c", script},
+		PoolSize: 1,
+		Timeout:  timeout,
+	})
+}
+
+func TestPoolProcessesMessages(t *testing.T) {
+	pool := shellPool(`while read line; do echo '{}'; done`, 0)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := pool.HandleMessage(msgqueue.NewMessage("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPoolReturnsWorkerError(t *testing.T) {
+	pool := shellPool(`while read line; do echo '{"error": "fake error"}'; done`, 0)
+	defer pool.Close()
+
+	err := pool.HandleMessage(msgqueue.NewMessage())
+	if err == nil || err.Error() != "fake error" {
+		t.Fatalf("got %v, wanted fake error", err)
+	}
+}
+
+func TestPoolRespawnsCrashedWorker(t *testing.T) {
+	// Worker processes one message and crashes on the next one.
+	pool := shellPool(`read line; echo '{}'; read line; exit 1`, 0)
+	defer pool.Close()
+
+	if err := pool.HandleMessage(msgqueue.NewMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := pool.HandleMessage(msgqueue.NewMessage())
+	if err == nil || !strings.Contains(err.Error(), "worker exited") {
+		t.Fatalf("got %v, wanted worker exited error", err)
+	}
+
+	if err := pool.HandleMessage(msgqueue.NewMessage()); err != nil {
+		t.Fatalf("worker was not respawned: %s", err)
+	}
+}
+
+func TestPoolKillsTimedOutWorker(t *testing.T) {
+	pool := shellPool(`read line; sleep 10`, 100*time.Millisecond)
+	defer pool.Close()
+
+	start := time.Now()
+	err := pool.HandleMessage(msgqueue.NewMessage())
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, wanted timeout error", err)
+	}
+	if dur := time.Since(start); dur > 5*time.Second {
+		t.Fatalf("worker was killed after %s", dur)
+	}
+}
+
+func TestPoolRespawnsTimedOutWorker(t *testing.T) {
+	pool := shellPool(`while read line; do
+	case "$line" in
+	*slow*) sleep 10;;
+	*) echo '{}';;
+	esac
+done`, 100*time.Millisecond)
+	defer pool.Close()
+
+	msg := msgqueue.NewMessage()
+	msg.Body = "slow"
+	err := pool.HandleMessage(msg)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, wanted timeout error", err)
+	}
+
+	msg = msgqueue.NewMessage()
+	msg.Body = "fast"
+	if err := pool.HandleMessage(msg); err != nil {
+		t.Fatalf("worker was not respawned: %s", err)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	pool := shellPool(`while read line; do echo '{}'; done`, 0)
+
+	if err := pool.HandleMessage(msgqueue.NewMessage()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := pool.HandleMessage(msgqueue.NewMessage())
+	if err != msgqueue.ErrShutdown {
+		t.Fatalf("got %v, wanted ErrShutdown", err)
+	}
+}
@@ -0,0 +1,60 @@
+package msgqueue
+
+import "context"
+
+// Names of the spans created by the processor.
+const (
+	SpanReserve     = "msgqueue.Reserve"
+	SpanProcess     = "msgqueue.Process"
+	SpanRelease     = "msgqueue.Release"
+	SpanDeleteBatch = "msgqueue.DeleteBatch"
+)
+
+// TracerProvider returns Tracer for the queue with the name.
+// See tracing/otel package for OpenTelemetry implementation.
+type TracerProvider interface {
+	Tracer(queue string) Tracer
+}
+
+// Tracer creates spans of queue operations and propagates trace
+// context from producers to consumers using message headers.
+type Tracer interface {
+	// Start starts span with the name that is a child of the span in ctx.
+	// Message is nil for operations on multiple messages.
+	Start(ctx context.Context, name string, msg *Message) (context.Context, Span)
+	// Inject stores trace context of ctx in the header.
+	Inject(ctx context.Context, header map[string]string)
+	// Extract returns a copy of ctx that carries trace context
+	// stored in the header.
+	Extract(ctx context.Context, header map[string]string) context.Context
+}
+
+// Span is a traced queue operation.
+type Span interface {
+	// End ends the span recording the error if it is not nil.
+	End(err error)
+}
+
+// Tracer returns tracer of the queue or nil if Options.TracerProvider
+// is not set.
+func (opt *Options) Tracer() Tracer {
+	return opt.tracer
+}
+
+// InjectTrace stores trace context of the message context in the message
+// header, so processing of the message is traced as a child of the span
+// that added it. It is used by queues when Options.TracerProvider is set.
+func InjectTrace(opt *Options, msg *Message) {
+	if opt.tracer == nil {
+		return
+	}
+
+	header := msg.Header
+	if header == nil {
+		header = make(map[string]string)
+	}
+	opt.tracer.Inject(msg.Context(), header)
+	if len(header) > 0 {
+		msg.Header = header
+	}
+}
@@ -0,0 +1,104 @@
+// Package otel traces queue operations using OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/go-msgqueue/msgqueue"
+)
+
+const instrumentationName = "github.com/go-msgqueue/msgqueue"
+
+var spanKinds = map[string]trace.SpanKind{
+	msgqueue.SpanReserve:     trace.SpanKindClient,
+	msgqueue.SpanProcess:     trace.SpanKindConsumer,
+	msgqueue.SpanRelease:     trace.SpanKindClient,
+	msgqueue.SpanDeleteBatch: trace.SpanKindClient,
+}
+
+// TracerProvider is msgqueue.TracerProvider that creates OpenTelemetry
+// spans.
+type TracerProvider struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+}
+
+var _ msgqueue.TracerProvider = (*TracerProvider)(nil)
+
+// NewTracerProvider returns TracerProvider that creates spans using the
+// provider and propagates trace context using the propagator. The default
+// propagator is W3C Trace Context.
+func NewTracerProvider(
+	provider trace.TracerProvider, propagator propagation.TextMapPropagator,
+) *TracerProvider {
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	return &TracerProvider{
+		provider:   provider,
+		propagator: propagator,
+	}
+}
+
+func (tp *TracerProvider) Tracer(queue string) msgqueue.Tracer {
+	return &tracer{
+		tracer:     tp.provider.Tracer(instrumentationName),
+		propagator: tp.propagator,
+		queue:      queue,
+	}
+}
+
+type tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	queue      string
+}
+
+func (t *tracer) Start(
+	ctx context.Context, name string, msg *msgqueue.Message,
+) (context.Context, msgqueue.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("messaging.system", "msgqueue"),
+		attribute.String("messaging.destination.name", t.queue),
+	}
+	if msg != nil {
+		if msg.Id != "" {
+			attrs = append(attrs, attribute.String("messaging.message.id", msg.Id))
+		}
+		if msg.Name != "" {
+			attrs = append(attrs, attribute.String("msgqueue.message.name", msg.Name))
+		}
+		attrs = append(attrs, attribute.Int("msgqueue.message.reserved_count", msg.ReservedCount))
+	}
+
+	ctx, span := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(spanKinds[name]),
+		trace.WithAttributes(attrs...),
+	)
+	return ctx, otelSpan{span}
+}
+
+func (t *tracer) Inject(ctx context.Context, header map[string]string) {
+	t.propagator.Inject(ctx, propagation.MapCarrier(header))
+}
+
+func (t *tracer) Extract(ctx context.Context, header map[string]string) context.Context {
+	return t.propagator.Extract(ctx, propagation.MapCarrier(header))
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
@@ -0,0 +1,81 @@
+package otel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/go-msgqueue/msgqueue"
+	"github.com/go-msgqueue/msgqueue/memqueue"
+	"github.com/go-msgqueue/msgqueue/tracing/otel"
+)
+
+func TestTracerProvider(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	q := memqueue.NewQueue(&msgqueue.Options{
+		Name: "otel-test",
+		Handler: func(fail bool) error {
+			if fail {
+				return errors.New("fake error")
+			}
+			return nil
+		},
+		RetryLimit:     2,
+		MinBackoff:     time.Millisecond,
+		DeleteLinger:   time.Millisecond,
+		TracerProvider: otel.NewTracerProvider(provider, nil),
+	})
+
+	ctx, producer := provider.Tracer("test").Start(context.Background(), "producer")
+	msg := msgqueue.NewMessage(false)
+	msg.SetContext(ctx)
+	if err := q.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	producer.End()
+
+	if err := q.Call(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.CloseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var processed, failed, released, deleted int
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case msgqueue.SpanProcess:
+			if span.Status().Description == "" {
+				processed++
+				if span.Parent().SpanID() != producer.SpanContext().SpanID() {
+					t.Fatalf("got parent %s, wanted producer span", span.Parent().SpanID())
+				}
+			} else {
+				failed++
+			}
+		case msgqueue.SpanRelease:
+			released++
+		case msgqueue.SpanDeleteBatch:
+			deleted++
+		}
+	}
+
+	if processed != 1 {
+		t.Fatalf("got %d processed spans, wanted 1", processed)
+	}
+	if failed != 2 {
+		t.Fatalf("got %d failed spans, wanted 2", failed)
+	}
+	if released != 1 {
+		t.Fatalf("got %d release spans, wanted 1", released)
+	}
+	if deleted == 0 {
+		t.Fatal("got no delete batch spans")
+	}
+}
@@ -0,0 +1,78 @@
+//go:build go1.18
+// +build go1.18
+
+package msgqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TypedQueue wraps the queue so messages carry a single value of type T.
+type TypedQueue[T any] struct {
+	q Queue
+}
+
+// NewTypedQueue returns a TypedQueue that adds messages to q.
+func NewTypedQueue[T any](q Queue) *TypedQueue[T] {
+	return &TypedQueue[T]{q: q}
+}
+
+func (q *TypedQueue[T]) Name() string {
+	return q.q.Name()
+}
+
+// Add adds message with the value to the queue.
+func (q *TypedQueue[T]) Add(v T) error {
+	return q.q.Add(NewMessage(v))
+}
+
+// AddDelay adds message with the value to the queue with specified delay.
+func (q *TypedQueue[T]) AddDelay(v T, delay time.Duration) error {
+	msg := NewMessage(v)
+	msg.Delay = delay
+	return q.q.Add(msg)
+}
+
+type typedHandler[T any] struct {
+	fn    func(context.Context, T) error
+	codec Codec
+}
+
+var _ codecHandler = (*typedHandler[struct{}])(nil)
+
+// TypedHandler returns a Handler that decodes message into
+// value of type T and calls fn with it.
+func TypedHandler[T any](fn func(ctx context.Context, v T) error) Handler {
+	return &typedHandler[T]{
+		fn:    fn,
+		codec: MsgpackCodec,
+	}
+}
+
+func (h *typedHandler[T]) withCodec(codec Codec) Handler {
+	return &typedHandler[T]{
+		fn:    h.fn,
+		codec: codec,
+	}
+}
+
+func (h *typedHandler[T]) HandleMessage(msg *Message) error {
+	var v T
+	switch {
+	case msg.Body != "":
+		if err := h.codec.Unmarshal([]byte(msg.Body), []interface{}{&v}); err != nil {
+			return err
+		}
+	case len(msg.Args) == 1:
+		var ok bool
+		v, ok = msg.Args[0].(T)
+		if !ok {
+			return fmt.Errorf("got %T, handler expects %T", msg.Args[0], v)
+		}
+	default:
+		return fmt.Errorf("got %d args, handler expects 1 args", len(msg.Args))
+	}
+	return h.fn(msg.Context(), v)
+}
@@ -0,0 +1,108 @@
+package msgqueue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Latest args live as long as names of pending messages are locked.
+const upsertArgsTTL = 24 * time.Hour
+
+// NameHeader carries the name of upserted messages through queues
+// that don't store Message.Name, so consumers can load latest args.
+const NameHeader = "Msgqueue-Name"
+
+var errUpsertRedis = errors.New("queue: Upsert requires Redis that implements RedisCmdable")
+
+// upsertArgsScript stores latest args and reports whether message
+// with the same name is already pending.
+const upsertArgsScript = `
+local pending = redis.call("exists", KEYS[1])
+redis.call("set", KEYS[1], ARGV[1], "px", ARGV[2])
+return pending
+`
+
+// deleteArgsScript deletes latest args unless they were replaced
+// after the message loaded them.
+const deleteArgsScript = `
+local args = redis.call("get", KEYS[1])
+if args == false or args == ARGV[1] then
+	redis.call("del", KEYS[1])
+	return 1
+end
+return 0
+`
+
+func upsertKey(queue, name string) string {
+	return fmt.Sprintf("upsert:%s:%s", queue, name)
+}
+
+// UpsertLatestArgs stores encoded args of the named message, so they
+// replace args of the pending message with the same name when it is
+// processed. It reports whether such message is pending, in which case
+// the message must not be added. Stored args mark the name as pending
+// until the message is deleted by the processor.
+// It is used by queues when Options.Upsert is set.
+func UpsertLatestArgs(opt *Options, msg *Message) (pending bool, err error) {
+	client, ok := opt.Redis.(RedisCmdable)
+	if !ok {
+		return false, errUpsertRedis
+	}
+	body := msg.Body
+	if body == "" {
+		body, err = msg.EncodeArgs(opt.Codec)
+		if err != nil {
+			return false, err
+		}
+	}
+	ttl := int64(upsertArgsTTL / time.Millisecond)
+	n, err := client.Eval(upsertArgsScript, []string{upsertKey(opt.Name, msg.Name)}, body, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == int64(1), nil
+}
+
+// LoadLatestArgs replaces args of the named message with the latest
+// args stored using UpsertLatestArgs.
+func LoadLatestArgs(opt *Options, msg *Message) error {
+	client, ok := opt.Redis.(RedisCmdable)
+	if !ok {
+		return errUpsertRedis
+	}
+	body, err := client.Get(upsertKey(opt.Name, msg.Name)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	msg.Args = nil
+	msg.Body = body
+	return nil
+}
+
+// DeleteLatestArgs deletes latest args of the named message, which
+// allows adding message with the same name again.
+func DeleteLatestArgs(opt *Options, msg *Message) error {
+	return opt.Redis.Del(upsertKey(opt.Name, msg.Name)).Err()
+}
+
+// DeleteLoadedArgs works like DeleteLatestArgs, but it reports false
+// and keeps args that were upserted after the message loaded them,
+// so the message can be processed again using them.
+func DeleteLoadedArgs(opt *Options, msg *Message) (bool, error) {
+	client, ok := opt.Redis.(RedisCmdable)
+	if !ok {
+		return false, errUpsertRedis
+	}
+	n, err := client.Eval(deleteArgsScript, []string{upsertKey(opt.Name, msg.Name)}, msg.Body).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == int64(1), nil
+}